@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/samjwillis97/sams-blackhole/internal/audit"
+	"github.com/samjwillis97/sams-blackhole/internal/config"
+	"github.com/samjwillis97/sams-blackhole/internal/debrid"
+	"github.com/samjwillis97/sams-blackhole/internal/housekeeping"
+	"github.com/samjwillis97/sams-blackhole/internal/jobs"
+	"github.com/samjwillis97/sams-blackhole/internal/repair"
+)
+
+// TODO: Move to cobra once there are a few more of these
+
+func runCommand(log *slog.Logger, name string, args []string) {
+	switch name {
+	case "scan":
+		scanCommand(log, args)
+	case "audit":
+		auditCommand(log, args)
+	case "jobs":
+		jobsCommand(log, args)
+	case "housekeep":
+		housekeepCommand(log, args)
+	case "auth":
+		authCommand(log, args)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n", name)
+		fmt.Fprintln(os.Stderr, "usage: blackhole [scan|audit|jobs|housekeep|auth]")
+		os.Exit(2)
+	}
+}
+
+func scanCommand(log *slog.Logger, args []string) {
+	flags := flag.NewFlagSet("scan", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", config.GetAppConfig().Repair.DryRun, "report broken links without repairing them")
+	flags.Parse(args)
+
+	results, err := repair.Run(log, *dryRun)
+	if err != nil {
+		log.Error("scan failed", "err", err)
+		os.Exit(1)
+	}
+
+	failed := 0
+	for _, r := range results {
+		status := "ok"
+		if r.Err != nil {
+			status = r.Err.Error()
+			failed++
+		}
+		name := r.Torrent
+		if r.Account != "" {
+			name = r.Account + "/" + r.Torrent
+		}
+		fmt.Printf("%s\t%d links\t%s\t%s\n", name, r.Links, r.Action, status)
+	}
+
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// auditCommand lists recorded jobs, or prints the timeline of the one job the
+// query matches
+func auditCommand(log *slog.Logger, args []string) {
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	flags.Parse(args)
+	query := flags.Arg(0)
+
+	summaries, err := audit.List(query)
+	if err != nil {
+		log.Error("failed to list audit timelines", "err", err)
+		os.Exit(1)
+	}
+
+	if len(summaries) != 1 {
+		for _, s := range summaries {
+			status := s.State
+			if s.Failed {
+				status = "failed"
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\n", s.JobID, s.Updated.Format(time.RFC3339), s.Instance, status, s.Path)
+		}
+		return
+	}
+
+	entries, err := audit.Timeline(summaries[0].JobID)
+	if err != nil {
+		log.Error("failed to read audit timeline", "err", err)
+		os.Exit(1)
+	}
+
+	for _, e := range entries {
+		detail := e.Message
+		if e.From != "" || e.To != "" {
+			detail = fmt.Sprintf("%s %s -> %s", e.Message, e.From, e.To)
+		}
+		for _, extra := range []string{e.Status, e.Path} {
+			if extra != "" {
+				detail += " " + extra
+			}
+		}
+		if e.Count > 0 {
+			detail += fmt.Sprintf(" (%d)", e.Count)
+		}
+		if e.Error != "" {
+			detail += " error: " + e.Error
+		}
+		fmt.Printf("%s\t%s\t%s\n", e.Time.Format(time.RFC3339), e.Kind, detail)
+	}
+}
+
+// jobsCommand lists the jobs of the running blackhole, or acts on one of them
+// through its HTTP server
+func jobsCommand(log *slog.Logger, args []string) {
+	flags := flag.NewFlagSet("jobs", flag.ExitOnError)
+	serverURL := flags.String("server", defaultServerURL(), "url of the running blackhole's http server")
+	from := flags.String("from", "addingToDebrid", "state to retry from, addingToDebrid or debridProcessing")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: blackhole jobs [flags] [list|retry <id>|cancel <id>|complete <id>]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	action := flags.Arg(0)
+	if action == "" || action == "list" {
+		list, err := listJobs(*serverURL)
+		if err != nil {
+			log.Error("failed to list jobs", "err", err)
+			os.Exit(1)
+		}
+
+		for _, job := range list {
+			p := job.ProcessingPath
+			if job.FailedPath != "" {
+				p = job.FailedPath
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\n", job.ID, job.Updated.Format(time.RFC3339), job.Instance, job.State, p)
+		}
+		return
+	}
+
+	jobID := flags.Arg(1)
+	if jobID == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	query := url.Values{}
+	switch action {
+	case "retry":
+		query.Set("from", *from)
+	case "cancel", "complete":
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if err := jobAction(*serverURL, jobID, action, query); err != nil {
+		log.Error(fmt.Sprintf("failed to %s job", action), "jobID", jobID, "err", err)
+		os.Exit(1)
+	}
+}
+
+// defaultServerURL is the configured server address as seen from this machine
+func defaultServerURL() string {
+	address := config.GetAppConfig().Server.Address
+	if strings.HasPrefix(address, ":") {
+		address = "localhost" + address
+	}
+	return "http://" + address
+}
+
+func listJobs(serverURL string) ([]jobs.Job, error) {
+	resp, err := http.Get(serverURL + "/jobs")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+
+	list := []jobs.Job{}
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	return list, err
+}
+
+func jobAction(serverURL string, jobID string, action string, query url.Values) error {
+	endpoint := fmt.Sprintf("%s/jobs/%s/%s?%s", serverURL, url.PathEscape(jobID), action, query.Encode())
+	req, err := http.NewRequest(http.MethodPost, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth("blackhole", config.GetAppConfig().Server.APIKey())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return responseError(resp)
+	}
+	return nil
+}
+
+func responseError(resp *http.Response) error {
+	body, _ := io.ReadAll(resp.Body)
+	return errors.New(fmt.Sprintf("Unexpected response code: %d, message: %s", resp.StatusCode, strings.TrimSpace(string(body))))
+}
+
+// housekeepCommand removes torrents from debrid that nothing refers to,
+// printing each torrent acted on
+func housekeepCommand(log *slog.Logger, args []string) {
+	flags := flag.NewFlagSet("housekeep", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", config.GetAppConfig().Housekeeping.DryRun, "report torrents without removing them")
+	flags.Parse(args)
+
+	report, err := housekeeping.Run(log, *dryRun)
+	if err != nil {
+		log.Error("housekeeping failed", "err", err)
+		os.Exit(1)
+	}
+
+	action := "removed"
+	if report.DryRun {
+		action = "would remove"
+	}
+	printCandidates := func(action string, candidates []housekeeping.Candidate) {
+		for _, c := range candidates {
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\t%s\n", action, c.ID, c.Reason, c.Status, c.Filename, c.Error)
+		}
+	}
+	printCandidates(action, report.Removed)
+	printCandidates("allowed", report.Allowed)
+	printCandidates("failed", report.Failed)
+
+	if len(report.Failed) > 0 {
+		os.Exit(1)
+	}
+}
+
+// authCommand authorizes blackhole on the debrid account through the device
+// code flow, the token it leaves behind is used in place of `DEBRID_API_KEY`
+func authCommand(log *slog.Logger, args []string) {
+	flags := flag.NewFlagSet("auth", flag.ExitOnError)
+	flags.Parse(args)
+
+	code, err := debrid.RequestDeviceCode()
+	if err != nil {
+		log.Error("failed to request device code", "err", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Go to %s and enter the code %s\n", code.VerificationURL, code.UserCode)
+
+	token, err := debrid.Authorize(code)
+	if err != nil {
+		log.Error("failed to authorize", "err", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Authorized, token saved to %s and valid until %s\n", debrid.TokenPath(), token.ExpiresAt.Format(time.RFC3339))
+}
@@ -1,5 +1,11 @@
 package arr
 
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
 type ArrService int
 
 const (
@@ -46,6 +52,8 @@ const (
 type HistoryItemData struct {
 	TorrentInfoHash string             `json:"torrentInfoHash"`
 	ReleaseType     HistoryReleaseType `json:"releaseType"`
+	DroppedPath     string             `json:"droppedPath"`  // Only present on imports, where *arr found the file
+	ImportedPath    string             `json:"importedPath"` // Only present on imports, where *arr put the file
 }
 
 // Should only ever be present on sonarr items
@@ -61,8 +69,12 @@ type HistoryItem struct {
 	ID          int                  `json:"id"`
 	SourceTitle string               `json:"sourceTitle"`
 	EventType   HistoryItemEventType `json:"eventType"`
+	Date        time.Time            `json:"date"`
+	DownloadID  string               `json:"downloadId"` // The info hash for torrents
 	Data        HistoryItemData      `json:"data"`
 	Episode     HistoryItemEpisode   `json:"episode"`
+	EpisodeID   int                  `json:"episodeId"` // Only present on sonarr items
+	MovieID     int                  `json:"movieId"`   // Only present on radarr items
 }
 
 type HistoryResponse struct {
@@ -72,13 +84,50 @@ type HistoryResponse struct {
 	Records      []HistoryItem `json:"records"`
 }
 
+// QueueItem is a download *arr is still tracking, it leaves the queue once
+// everything in it has been imported
+type QueueItem struct {
+	ID                   int    `json:"id"`
+	Title                string `json:"title"`
+	DownloadID           string `json:"downloadId"` // The info hash for torrents
+	Status               string `json:"status"`
+	TrackedDownloadState string `json:"trackedDownloadState"`
+	OutputPath           string `json:"outputPath"` // Where *arr sees the download
+}
+
+type QueueResponse struct {
+	Page         int         `json:"page"`
+	PageSize     int         `json:"pageSize"`
+	TotalRecords int         `json:"totalRecords"`
+	Records      []QueueItem `json:"records"`
+}
+
 type CommandResponse struct {
 	ID   int    `json:"id"`
 	Name string `json:"name"`
 }
 
+type RootFolder struct {
+	ID         int    `json:"id"`
+	Path       string `json:"path"`
+	Accessible bool   `json:"accessible"`
+}
+
 type ArrClient interface {
 	FailHistoryItem(id int) error
 	GetHistory(pagesize int) (HistoryResponse, error)
+	GetQueue(pagesize int) (QueueResponse, error)
+	GetRootFolders() ([]RootFolder, error)
 	RefreshMonitoredDownloads() (CommandResponse, error)
 }
+
+func CreateNewClient(service ArrService, baseUrl string, apiKey string) (ArrClient, error) {
+	switch service {
+	case Sonarr:
+		return CreateNewSonarrClient(baseUrl, apiKey)
+	case Radarr:
+		return CreateNewRadarrClient(baseUrl, apiKey)
+	}
+
+	return nil, errors.New(fmt.Sprintf("Unknown arr service: %s", service))
+}
@@ -0,0 +1,240 @@
+// Package arrtest provides an in-process fake of the Sonarr/Radarr v3 API
+// for use in tests.
+package arrtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/samjwillis97/sams-blackhole/internal/arr"
+)
+
+// Call is a single request received by the fake server
+type Call struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Body   []byte
+	APIKey string
+}
+
+// Command is the decoded body of a `/api/v3/command` post
+type Command struct {
+	Name         string `json:"name"`
+	SeriesID     int    `json:"seriesId"`
+	SeasonNumber int    `json:"seasonNumber"`
+	EpisodeIDs   []int  `json:"episodeIds"`
+	MovieIDs     []int  `json:"movieIds"`
+}
+
+type Server struct {
+	*httptest.Server
+
+	// When set, requests without a matching `X-Api-Key` are rejected
+	APIKey string
+
+	mu            sync.Mutex
+	records       []arr.HistoryItem
+	queue         []arr.QueueItem
+	rootFolders   []arr.RootFolder
+	calls         []Call
+	failed        []int
+	commands      []Command
+	nextCommandID int
+}
+
+// NewServer starts a fake *arr server, it should be closed by the caller
+func NewServer() *Server {
+	s := &Server{nextCommandID: 1}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v3/history", s.handleHistory)
+	mux.HandleFunc("GET /api/v3/queue", s.handleQueue)
+	mux.HandleFunc("POST /api/v3/history/failed/{id}", s.handleFailHistory)
+	mux.HandleFunc("POST /api/v3/command", s.handleCommand)
+	mux.HandleFunc("GET /api/v3/rootfolder", s.handleRootFolders)
+
+	s.Server = httptest.NewServer(s.record(mux))
+
+	return s
+}
+
+// SetHistory replaces the records served by the history endpoint
+func (s *Server) SetHistory(records ...arr.HistoryItem) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = records
+}
+
+// SetQueue replaces the downloads served by the queue endpoint
+func (s *Server) SetQueue(items ...arr.QueueItem) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queue = items
+}
+
+// SetRootFolders replaces the folders served by the root folder endpoint
+func (s *Server) SetRootFolders(folders ...arr.RootFolder) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rootFolders = folders
+}
+
+// Calls returns every request received so far, in order
+func (s *Server) Calls() []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Call{}, s.calls...)
+}
+
+// FailedHistoryIDs returns the history IDs that have been marked as failed
+func (s *Server) FailedHistoryIDs() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int{}, s.failed...)
+}
+
+// Commands returns every command that has been posted
+func (s *Server) Commands() []Command {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Command{}, s.commands...)
+}
+
+// CommandNames returns the names of every command that has been posted
+func (s *Server) CommandNames() []string {
+	names := []string{}
+	for _, c := range s.Commands() {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+func (s *Server) record(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(strings.NewReader(string(body)))
+
+		s.mu.Lock()
+		s.calls = append(s.calls, Call{
+			Method: r.Method,
+			Path:   r.URL.Path,
+			Query:  r.URL.Query(),
+			Body:   body,
+			APIKey: r.Header.Get("X-Api-Key"),
+		})
+		s.mu.Unlock()
+
+		if s.APIKey != "" && r.Header.Get("X-Api-Key") != s.APIKey {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	pageSize, err := strconv.Atoi(r.URL.Query().Get("pageSize"))
+	if err != nil || pageSize <= 0 {
+		pageSize = 10
+	}
+
+	s.mu.Lock()
+	records := s.records
+	s.mu.Unlock()
+
+	response := arr.HistoryResponse{
+		Page:         1,
+		PageSize:     pageSize,
+		TotalRecords: len(records),
+		Records:      records[:min(pageSize, len(records))],
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) handleQueue(w http.ResponseWriter, r *http.Request) {
+	pageSize, err := strconv.Atoi(r.URL.Query().Get("pageSize"))
+	if err != nil || pageSize <= 0 {
+		pageSize = 10
+	}
+
+	s.mu.Lock()
+	queue := s.queue
+	s.mu.Unlock()
+
+	response := arr.QueueResponse{
+		Page:         1,
+		PageSize:     pageSize,
+		TotalRecords: len(queue),
+		Records:      queue[:min(pageSize, len(queue))],
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) handleRootFolders(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	folders := append([]arr.RootFolder{}, s.rootFolders...)
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, folders)
+}
+
+func (s *Server) handleFailHistory(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, record := range s.records {
+		if record.ID == id {
+			s.failed = append(s.failed, id)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNotFound)
+}
+
+func (s *Server) handleCommand(w http.ResponseWriter, r *http.Request) {
+	var command Command
+	if err := json.NewDecoder(r.Body).Decode(&command); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	id := s.nextCommandID
+	s.nextCommandID++
+	s.commands = append(s.commands, command)
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusCreated, arr.CommandResponse{ID: id, Name: command.Name})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("failed to marshal response: %s", err)))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
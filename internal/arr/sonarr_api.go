@@ -110,6 +110,44 @@ func (s *SonarrClient) GetHistory(pagesize int) (HistoryResponse, error) {
 	return apiResponse, nil
 }
 
+func (s *SonarrClient) GetQueue(pagesize int) (QueueResponse, error) {
+	url := s.URL.JoinPath("/api/v3/queue")
+
+	query := url.Query()
+	query.Add("pageSize", fmt.Sprintf("%d", pagesize))
+	query.Add("includeUnknownSeriesItems", "true")
+	url.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, url.String(), nil)
+	if err != nil {
+		return QueueResponse{}, err
+	}
+
+	req = s.blessSonarrRequest(req)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return QueueResponse{}, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return QueueResponse{}, errors.New(fmt.Sprintf("Unable to make request response code: %d", resp.StatusCode))
+	}
+
+	bodyBytes, _ := io.ReadAll(resp.Body)
+
+	var apiResponse QueueResponse
+	err = json.Unmarshal(bodyBytes, &apiResponse)
+	if err != nil {
+		return QueueResponse{}, err
+	}
+
+	return apiResponse, nil
+}
+
 // Have to get the ID from the history endpoint, will investigate what the mapping is
 func (s *SonarrClient) FailHistoryItem(id int) error {
 	url := s.URL.JoinPath("/api/v3/history/failed", fmt.Sprintf("%d", id))
@@ -172,3 +210,76 @@ func (s *SonarrClient) SearchSeason(seriesId int, seasonNumber int) (CommandResp
 
 	return apiResponse, nil
 }
+
+func (s *SonarrClient) GetRootFolders() ([]RootFolder, error) {
+	url := s.URL.JoinPath("/api/v3/rootfolder")
+
+	req, err := http.NewRequest(http.MethodGet, url.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req = s.blessSonarrRequest(req)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		// TODO: Trace log
+		return nil, errors.New(fmt.Sprintf("Unable to make request response code: %d", resp.StatusCode))
+	}
+
+	bodyBytes, _ := io.ReadAll(resp.Body)
+
+	var apiResponse []RootFolder
+	err = json.Unmarshal(bodyBytes, &apiResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	return apiResponse, nil
+}
+
+func (s *SonarrClient) SearchEpisodes(episodeIds []int) (CommandResponse, error) {
+	url := s.URL.JoinPath("/api/v3/command")
+
+	payload, err := json.Marshal(map[string]any{"name": "EpisodeSearch", "episodeIds": episodeIds})
+	if err != nil {
+		return CommandResponse{}, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url.String(), bytes.NewBuffer(payload))
+	if err != nil {
+		return CommandResponse{}, err
+	}
+
+	req = s.blessSonarrRequest(req)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return CommandResponse{}, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		// TODO: Trace log
+		return CommandResponse{}, errors.New(fmt.Sprintf("Unable to make request response code: %d", resp.StatusCode))
+	}
+
+	bodyBytes, _ := io.ReadAll(resp.Body)
+
+	var apiResponse CommandResponse
+	err = json.Unmarshal(bodyBytes, &apiResponse)
+	if err != nil {
+		return CommandResponse{}, err
+	}
+
+	return apiResponse, nil
+}
@@ -0,0 +1,106 @@
+package arr
+
+type WebhookEventType string
+
+const (
+	WebhookTest                      WebhookEventType = "Test"
+	WebhookGrab                                       = "Grab"
+	WebhookDownload                                   = "Download" // Sent once the download has been imported
+	WebhookManualInteractionRequired                  = "ManualInteractionRequired"
+	WebhookDownloadFailed                             = "DownloadFailed"
+)
+
+// Only present on sonarr payloads
+type WebhookSeries struct {
+	ID     int    `json:"id"`
+	Title  string `json:"title"`
+	Path   string `json:"path"`
+	TvdbID int    `json:"tvdbId"`
+}
+
+// Only present on sonarr payloads
+type WebhookEpisode struct {
+	ID            int    `json:"id"`
+	EpisodeNumber int    `json:"episodeNumber"`
+	SeasonNumber  int    `json:"seasonNumber"`
+	Title         string `json:"title"`
+}
+
+// Only present on radarr payloads
+type WebhookMovie struct {
+	ID         int    `json:"id"`
+	Title      string `json:"title"`
+	Year       int    `json:"year"`
+	FolderPath string `json:"folderPath"`
+	TmdbID     int    `json:"tmdbId"`
+}
+
+type WebhookRelease struct {
+	ReleaseTitle string             `json:"releaseTitle"`
+	Indexer      string             `json:"indexer"`
+	Size         int64              `json:"size"`
+	ReleaseType  HistoryReleaseType `json:"releaseType"` // Only present on sonarr payloads
+}
+
+// The episode or movie file on imports, the source path is where *arr found it
+type WebhookFile struct {
+	ID           int    `json:"id"`
+	RelativePath string `json:"relativePath"`
+	Path         string `json:"path"`
+	SourcePath   string `json:"sourcePath"`
+}
+
+type WebhookStatusMessage struct {
+	Title    string   `json:"title"`
+	Messages []string `json:"messages"`
+}
+
+// WebhookPayload is the body of a "Connect → Webhook" request from either
+// sonarr or radarr, fields not sent for an event are left empty
+type WebhookPayload struct {
+	EventType      WebhookEventType `json:"eventType"`
+	InstanceName   string           `json:"instanceName"`
+	ApplicationUrl string           `json:"applicationUrl"`
+
+	Series   WebhookSeries    `json:"series"`
+	Episodes []WebhookEpisode `json:"episodes"`
+	Movie    WebhookMovie     `json:"movie"`
+
+	Release            WebhookRelease `json:"release"`
+	DownloadClient     string         `json:"downloadClient"`
+	DownloadClientType string         `json:"downloadClientType"`
+	DownloadID         string         `json:"downloadId"` // The info hash for torrents
+
+	EpisodeFile WebhookFile `json:"episodeFile"`
+	MovieFile   WebhookFile `json:"movieFile"`
+	IsUpgrade   bool        `json:"isUpgrade"`
+
+	Message                string                 `json:"message"`                // Only present on failures
+	DownloadStatus         string                 `json:"downloadStatus"`         // Only present when manual interaction is required
+	DownloadStatusMessages []WebhookStatusMessage `json:"downloadStatusMessages"` // Only present when manual interaction is required
+}
+
+// ImportedFrom returns where *arr found the imported file
+func (p WebhookPayload) ImportedFrom() string {
+	if p.EpisodeFile.SourcePath != "" {
+		return p.EpisodeFile.SourcePath
+	}
+	return p.MovieFile.SourcePath
+}
+
+// ImportedTo returns where *arr put the imported file
+func (p WebhookPayload) ImportedTo() string {
+	if p.EpisodeFile.Path != "" {
+		return p.EpisodeFile.Path
+	}
+	return p.MovieFile.Path
+}
+
+// SeasonNumber returns the season the episodes are in, which is only
+// meaningful for season packs
+func (p WebhookPayload) SeasonNumber() int {
+	if len(p.Episodes) == 0 {
+		return 0
+	}
+	return p.Episodes[0].SeasonNumber
+}
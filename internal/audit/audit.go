@@ -0,0 +1,298 @@
+// Package audit keeps an append-only timeline for each job, from the file
+// being picked up to it being linked or failing, so what happened to an item
+// can be read back in one place rather than pieced together from the logs.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samjwillis97/sams-blackhole/internal/clock"
+	"github.com/samjwillis97/sams-blackhole/internal/config"
+	"github.com/samjwillis97/sams-blackhole/internal/logger/attr"
+)
+
+const (
+	directoryName = "audit"
+	extension     = ".jsonl"
+	pruneInterval = time.Hour
+)
+
+type Kind string
+
+const (
+	Registered  Kind = "registered"  // The job was created, the path is where it was picked up from
+	Transition  Kind = "transition"  // The state machine moved between states
+	DebridCall  Kind = "debrid"      // A call to the debrid API, the status is the torrent's when known
+	MountMatch  Kind = "mount_match" // The torrent appeared in the debrid mount
+	Linked      Kind = "linked"      // The torrent was linked into the completed path
+	ArrCallback Kind = "arr"         // A call back to *arr
+	Error       Kind = "error"       // Anything else that went wrong
+	Manual      Kind = "manual"      // The job was retried, cancelled or completed by hand
+)
+
+type Entry struct {
+	Time    time.Time `json:"time"`
+	Kind    Kind      `json:"kind"`
+	Message string    `json:"message,omitempty"`
+	From    string    `json:"from,omitempty"`
+	To      string    `json:"to,omitempty"`
+	Status  string    `json:"status,omitempty"`
+	Path    string    `json:"path,omitempty"`
+	Count   int       `json:"count,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// Summary describes a job's timeline without reading the whole of it
+type Summary struct {
+	JobID    string    `json:"jobId"`
+	Instance string    `json:"instance"`
+	Path     string    `json:"path"`
+	Started  time.Time `json:"started"`
+	Updated  time.Time `json:"updated"`
+	State    string    `json:"state,omitempty"` // The last state transitioned to
+	Failed   bool      `json:"failed"`
+}
+
+var mu sync.Mutex
+
+// Record appends an entry to the job's timeline, the time is set if it is
+// missing. Failures are only logged, the timeline is never worth failing the
+// job over.
+func Record(jobID string, e Entry) {
+	if jobID == "" {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = clock.Now()
+	}
+
+	if err := record(jobID, e); err != nil {
+		slog.Default().Warn("failed to record audit entry", "jobID", jobID, "err", err)
+	}
+}
+
+// Err is the error's message for an entry, empty when there is no error
+func Err(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func record(jobID string, e Entry) error {
+	dir, err := directory()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(timelinePath(dir, jobID), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// Timeline returns every entry recorded for the job, oldest first
+func Timeline(jobID string) ([]Entry, error) {
+	dir, err := directory()
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.ContainsAny(jobID, `/\`) || jobID == "" {
+		return nil, errors.New(fmt.Sprintf("Invalid job ID: %s", jobID))
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	f, err := os.Open(timelinePath(dir, jobID))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []Entry{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// A line cut short by a crash shouldn't hide the rest
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, scanner.Err()
+}
+
+// List summarises every recorded job, most recently updated first. When a
+// query is given only jobs whose ID, instance or path contain it are listed.
+func List(query string) ([]Summary, error) {
+	dir, err := directory()
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []Summary{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := []Summary{}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), extension) {
+			continue
+		}
+
+		jobID := strings.TrimSuffix(f.Name(), extension)
+		entries, err := Timeline(jobID)
+		if err != nil || len(entries) == 0 {
+			continue
+		}
+
+		s := summarise(jobID, entries)
+		if query != "" && !matches(s, query) {
+			continue
+		}
+		summaries = append(summaries, s)
+	}
+
+	slices.SortFunc(summaries, func(a, b Summary) int {
+		return b.Updated.Compare(a.Updated)
+	})
+
+	return summaries, nil
+}
+
+func summarise(jobID string, entries []Entry) Summary {
+	s := Summary{
+		JobID:   jobID,
+		Started: entries[0].Time,
+		Updated: entries[len(entries)-1].Time,
+	}
+
+	for _, e := range entries {
+		switch e.Kind {
+		case Registered:
+			s.Instance = e.Message
+			s.Path = e.Path
+		case Transition:
+			s.State = e.To
+			s.Failed = s.Failed || e.To == "failure"
+		}
+	}
+
+	return s
+}
+
+func matches(s Summary, query string) bool {
+	query = strings.ToLower(query)
+	for _, field := range []string{s.JobID, s.Instance, s.Path} {
+		if strings.Contains(strings.ToLower(field), query) {
+			return true
+		}
+	}
+	return false
+}
+
+// Prune removes timelines that haven't been written to within the retention
+// period, returning the job IDs removed
+func Prune(retention time.Duration) ([]string, error) {
+	dir, err := directory()
+	if err != nil {
+		return nil, err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	files, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	removed := []string{}
+	cutoff := clock.Now().Add(-retention)
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), extension) {
+			continue
+		}
+
+		info, err := f.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+
+		if err := os.Remove(path.Join(dir, f.Name())); err != nil {
+			return removed, err
+		}
+		removed = append(removed, strings.TrimSuffix(f.Name(), extension))
+	}
+
+	return removed, nil
+}
+
+// Schedule prunes timelines older than the configured retention, it returns
+// straight away if timelines are kept forever
+func Schedule(logger *slog.Logger) {
+	retention := config.GetAppConfig().Audit.Retention
+	if retention <= 0 {
+		return
+	}
+
+	logger = logger.With(attr.MonitorName("audit"))
+	for {
+		removed, err := Prune(retention)
+		if err != nil {
+			logger.Error("failed to prune audit timelines", "err", err)
+		} else if len(removed) > 0 {
+			logger.Info("pruned audit timelines", "count", len(removed))
+		}
+
+		clock.Sleep(pruneInterval)
+	}
+}
+
+func directory() (string, error) {
+	statePath := config.GetAppConfig().StatePath
+	if statePath == "" {
+		return "", errors.New("No state path configured")
+	}
+	return path.Join(statePath, directoryName), nil
+}
+
+func timelinePath(dir string, jobID string) string {
+	return path.Join(dir, jobID+extension)
+}
@@ -0,0 +1,149 @@
+package audit_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/samjwillis97/sams-blackhole/internal/audit"
+	"github.com/samjwillis97/sams-blackhole/internal/config"
+	"github.com/spf13/viper"
+)
+
+func setup(t *testing.T) string {
+	statePath := t.TempDir()
+
+	mockViper := viper.New()
+	mockViper.Set("state_path", statePath)
+	config.InitializeAppConfig(mockViper)
+
+	return statePath
+}
+
+func recordJob(jobID string, instance string, ingestedPath string, failed bool) {
+	audit.Record(jobID, audit.Entry{Kind: audit.Registered, Message: instance, Path: ingestedPath})
+	audit.Record(jobID, audit.Entry{Kind: audit.Transition, Message: "torrentFound", From: "new", To: "processing"})
+	audit.Record(jobID, audit.Entry{Kind: audit.DebridCall, Message: "addMagnet"})
+	if failed {
+		audit.Record(jobID, audit.Entry{Kind: audit.Transition, Message: "failed", From: "processing", To: "failure", Error: "dead torrent"})
+	}
+}
+
+func TestTimeline(t *testing.T) {
+	setup(t)
+	recordJob("job-1", "sonarr", "/watch/Show.S01E01.magnet", true)
+
+	entries, err := audit.Timeline("job-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 4 {
+		t.Fatalf("Expected 4 entries, got %d", len(entries))
+	}
+	if entries[3].Kind != audit.Transition || entries[3].To != "failure" || entries[3].Error != "dead torrent" {
+		t.Errorf("Expected the failure to be last, got %+v", entries[3])
+	}
+	for _, e := range entries {
+		if e.Time.IsZero() {
+			t.Errorf("Expected every entry to be timestamped, got %+v", e)
+		}
+	}
+
+	if _, err := audit.Timeline("../job-1"); err == nil {
+		t.Errorf("Expected job IDs with separators to be rejected")
+	}
+}
+
+func TestListFiltersByQuery(t *testing.T) {
+	setup(t)
+	recordJob("job-1", "sonarr", "/watch/Show.S01E01.magnet", true)
+	recordJob("job-2", "radarr", "/watch/Movie.2024.magnet", false)
+
+	all, err := audit.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 {
+		t.Fatalf("Expected both jobs, got %v", all)
+	}
+
+	matched, err := audit.List("show.s01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matched) != 1 || matched[0].JobID != "job-1" || !matched[0].Failed || matched[0].Instance != "sonarr" {
+		t.Errorf("Expected only the failed episode, got %+v", matched)
+	}
+}
+
+func TestPruneRemovesOldTimelines(t *testing.T) {
+	statePath := setup(t)
+	recordJob("old", "sonarr", "/watch/old.magnet", false)
+	recordJob("new", "sonarr", "/watch/new.magnet", false)
+
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(path.Join(statePath, "audit", "old.jsonl"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := audit.Prune(24 * time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0] != "old" {
+		t.Errorf("Expected only the old timeline to be pruned, got %v", removed)
+	}
+
+	if _, err := audit.Timeline("new"); err != nil {
+		t.Errorf("Expected the new timeline to be kept, got %s", err)
+	}
+}
+
+func TestHandlers(t *testing.T) {
+	setup(t)
+	mockSecretViper := viper.New()
+	mockSecretViper.Set("SERVER_API_KEY", "server-api-key")
+	config.InitializeSecrets(mockSecretViper)
+	recordJob("job-1", "sonarr", "/watch/Show.S01E01.magnet", true)
+
+	mux := http.NewServeMux()
+	mux.Handle(audit.ListPattern, audit.ListHandler())
+	mux.Handle(audit.TimelinePattern, audit.TimelineHandler())
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/audit/job-1", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a request without the key to be refused, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/audit?q=sonarr&apikey=server-api-key", nil))
+	var summaries []audit.Summary
+	if err := json.Unmarshal(w.Body.Bytes(), &summaries); err != nil {
+		t.Fatal(err)
+	}
+	if len(summaries) != 1 {
+		t.Errorf("Expected one job to be listed, got %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/audit/job-1?apikey=server-api-key", nil))
+	var entries []audit.Entry
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 {
+		t.Errorf("Expected the whole timeline, got %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/audit/missing?apikey=server-api-key", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown job, got %d", w.Code)
+	}
+}
@@ -0,0 +1,56 @@
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+
+	"github.com/samjwillis97/sams-blackhole/internal/server"
+)
+
+// Patterns the handlers are served on, both need the server's API key and the
+// list takes an optional `q` query parameter to search by
+const (
+	ListPattern     = "GET /audit"
+	TimelinePattern = "GET /audit/{job}"
+)
+
+// ListHandler serves summaries of every recorded job
+func ListHandler() http.Handler {
+	return server.RequireAPIKey(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		summaries, err := List(r.URL.Query().Get("q"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, summaries)
+	}))
+}
+
+// TimelineHandler serves every entry recorded for a job
+func TimelineHandler() http.Handler {
+	return server.RequireAPIKey(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entries, err := Timeline(r.PathValue("job"))
+		if errors.Is(err, os.ErrNotExist) {
+			http.Error(w, "unknown job", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, entries)
+	}))
+}
+
+func writeJSON(w http.ResponseWriter, body any) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,458 @@
+// Package cleanup follows items once they have been linked into the completed
+// path, and after *arr has imported them and the instance's retention period
+// has passed removes the completed folder and optionally the debrid torrent.
+package cleanup
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samjwillis97/sams-blackhole/internal/arr"
+	"github.com/samjwillis97/sams-blackhole/internal/clock"
+	"github.com/samjwillis97/sams-blackhole/internal/config"
+	"github.com/samjwillis97/sams-blackhole/internal/debrid"
+	"github.com/samjwillis97/sams-blackhole/internal/logger/attr"
+	"github.com/samjwillis97/sams-blackhole/internal/mediaserver"
+	"github.com/samjwillis97/sams-blackhole/internal/rclone"
+	"github.com/samjwillis97/sams-blackhole/internal/repair"
+)
+
+const stateFilename = "imports.json"
+
+// Item is a completed folder waiting on *arr to import it
+type Item struct {
+	CompletedPath string         `json:"completedPath"`
+	MountName     string         `json:"mountName,omitempty"` // Name of the torrent in the debrid mount
+	InfoHash      string         `json:"infoHash,omitempty"`
+	DebridID      string         `json:"debridId,omitempty"`
+	Account       string         `json:"account,omitempty"` // The debrid account, `real_debrid` when empty
+	Service       arr.ArrService `json:"service"`
+	Instance      string         `json:"instance"`
+	LinkedAt      time.Time      `json:"linkedAt"`
+	ImportedAt    time.Time      `json:"importedAt,omitempty"` // Zero until *arr has imported it
+}
+
+// Imported reports whether *arr has imported the item
+func (i Item) Imported() bool {
+	return !i.ImportedAt.IsZero()
+}
+
+var (
+	stateMu sync.Mutex
+	running sync.Mutex
+)
+
+// Track starts following a completed folder, an item already being followed
+// is left as it is
+func Track(item Item) error {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	if config.GetAppConfig().StatePath == "" {
+		return errors.New("No state path configured")
+	}
+
+	items, err := readState()
+	if err != nil {
+		return err
+	}
+
+	if _, ok := items[item.CompletedPath]; ok {
+		return nil
+	}
+	items[item.CompletedPath] = item
+
+	return writeState(items)
+}
+
+// IsTracked reports whether a completed folder is being followed
+func IsTracked(completedPath string) bool {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	items, err := readState()
+	if err != nil {
+		return false
+	}
+
+	_, ok := items[completedPath]
+	return ok
+}
+
+// List returns every item being followed, oldest first
+func List() ([]Item, error) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	items, err := readState()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]Item, 0, len(items))
+	for _, item := range items {
+		list = append(list, item)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].LinkedAt.Before(list[j].LinkedAt)
+	})
+
+	return list, nil
+}
+
+// MarkImported records an import *arr has told us about directly, by the
+// download's hash or the path it imported from. *arr tells us about each file
+// as it is imported, so the item is only marked once its download has left
+// the queue, otherwise the scheduled cleanup marks it later. It returns
+// whether an item being followed matched, then whether it was marked.
+func MarkImported(conf config.ArrConfig, infoHash string, importedFrom string) (bool, bool, error) {
+	record := arr.HistoryItem{
+		EventType:  arr.DownloadFolderImported,
+		DownloadID: infoHash,
+		Data:       arr.HistoryItemData{DroppedPath: importedFrom},
+	}
+
+	items, err := List()
+	if err != nil {
+		return false, false, err
+	}
+
+	var item Item
+	matched := false
+	for _, i := range items {
+		if i.Instance != conf.Name || i.Imported() {
+			continue
+		}
+
+		if _, ok := findImport(i, []arr.HistoryItem{record}); ok {
+			item, matched = i, true
+			break
+		}
+	}
+	if !matched {
+		return false, false, nil
+	}
+
+	client, err := arr.CreateNewClient(item.Service, conf.Url, conf.APIKey())
+	if err != nil {
+		return true, false, err
+	}
+
+	queue, err := client.GetQueue(conf.GetHistoryPageSize())
+	if err != nil {
+		return true, false, err
+	}
+
+	if queued(item, queue.Records) {
+		return true, false, nil
+	}
+
+	item.ImportedAt = clock.Now()
+	return true, true, update(item)
+}
+
+// Run checks *arr history for imports of every item being followed, then
+// cleans up each imported item whose retention period has passed. It returns
+// the items that were cleaned up.
+func Run(logger *slog.Logger) ([]Item, error) {
+	if !running.TryLock() {
+		return nil, errors.New("Cleanup is already running")
+	}
+	defer running.Unlock()
+
+	items, err := List()
+	if err != nil {
+		return nil, err
+	}
+
+	byInstance := map[string][]Item{}
+	for _, item := range items {
+		byInstance[item.Instance] = append(byInstance[item.Instance], item)
+	}
+
+	cleaned := []Item{}
+	for instance, instanceItems := range byInstance {
+		instanceLogger := logger.With("instance", instance)
+
+		conf, ok := findInstance(instanceItems[0].Service, instance)
+		if !ok {
+			instanceLogger.Warn("instance is no longer configured, leaving its items")
+			continue
+		}
+
+		instanceItems = markImported(conf, instanceItems, instanceLogger)
+
+		for _, item := range instanceItems {
+			if !item.Imported() || clock.Since(item.ImportedAt) < conf.Cleanup.GetRetention() {
+				continue
+			}
+
+			itemLogger := instanceLogger.With("completedPath", item.CompletedPath, "importedAt", item.ImportedAt)
+			if err := cleanItem(conf, item, itemLogger); err != nil {
+				itemLogger.Warn("failed to clean up imported item", "err", err)
+				continue
+			}
+			cleaned = append(cleaned, item)
+		}
+	}
+
+	logger.Info("finished cleaning up imported items", "tracked", len(items), "cleaned", len(cleaned))
+
+	return cleaned, nil
+}
+
+// Schedule runs the cleanup on the configured interval, it returns straight
+// away if no interval is set
+func Schedule(logger *slog.Logger) {
+	interval := config.GetAppConfig().Timings.ImportCheckInterval
+	if interval <= 0 {
+		return
+	}
+
+	logger = logger.With(attr.MonitorName("cleanup"))
+	for {
+		clock.Sleep(interval)
+
+		_, err := Run(logger)
+		if err != nil {
+			logger.Error("cleanup failed", "err", err)
+		}
+	}
+}
+
+// markImported looks for each item that hasn't been imported yet in the
+// instance's history, recording when it was imported and having the media
+// servers scan where it went. *arr imports a download a file at a time, so an
+// item still in its queue is left until the rest of it has been imported.
+func markImported(conf config.ArrConfig, items []Item, logger *slog.Logger) []Item {
+	pending := false
+	for _, item := range items {
+		pending = pending || !item.Imported()
+	}
+	if !pending {
+		return items
+	}
+
+	client, err := arr.CreateNewClient(items[0].Service, conf.Url, conf.APIKey())
+	if err != nil {
+		logger.Warn("unable to create client", "err", err)
+		return items
+	}
+
+	history, err := client.GetHistory(conf.GetHistoryPageSize())
+	if err != nil {
+		logger.Warn("unable to get history", "err", err)
+		return items
+	}
+
+	queue, err := client.GetQueue(conf.GetHistoryPageSize())
+	if err != nil {
+		logger.Warn("unable to get queue", "err", err)
+		return items
+	}
+
+	imported := []string{}
+	for i, item := range items {
+		if item.Imported() {
+			continue
+		}
+
+		record, ok := findImport(item, history.Records)
+		if !ok {
+			continue
+		}
+
+		if queued(item, queue.Records) {
+			logger.Debug("item is still being imported", "completedPath", item.CompletedPath)
+			continue
+		}
+
+		imported = append(imported, record.Data.ImportedPath)
+
+		item.ImportedAt = record.Date
+		if item.ImportedAt.IsZero() {
+			item.ImportedAt = clock.Now()
+		}
+		items[i] = item
+
+		logger.Info("item has been imported", "completedPath", item.CompletedPath, "importedAt", item.ImportedAt)
+		if err := update(item); err != nil {
+			logger.Warn("failed to record import", "completedPath", item.CompletedPath, "err", err)
+		}
+	}
+
+	if len(imported) > 0 {
+		go mediaserver.Refresh(logger, conf.Name, imported)
+	}
+
+	return items
+}
+
+// findImport finds the history record of *arr importing the item, by the
+// download's hash or otherwise by the folder it was dropped from. *arr may see
+// the completed path under a different mount point so only the folder's name
+// is compared.
+func findImport(item Item, records []arr.HistoryItem) (arr.HistoryItem, bool) {
+	name := path.Base(item.CompletedPath)
+
+	for _, r := range records {
+		if r.EventType != arr.DownloadFolderImported && r.EventType != arr.MovieFolderImported {
+			continue
+		}
+
+		if item.InfoHash != "" && strings.EqualFold(r.DownloadID, item.InfoHash) {
+			return r, true
+		}
+
+		for _, segment := range strings.Split(filepath.ToSlash(r.Data.DroppedPath), "/") {
+			if segment == name {
+				return r, true
+			}
+		}
+	}
+
+	return arr.HistoryItem{}, false
+}
+
+// queued reports whether the item's download is still in *arr's queue, matched
+// the same way as findImport
+func queued(item Item, records []arr.QueueItem) bool {
+	name := path.Base(item.CompletedPath)
+
+	for _, r := range records {
+		if item.InfoHash != "" && strings.EqualFold(r.DownloadID, item.InfoHash) {
+			return true
+		}
+
+		for _, segment := range strings.Split(filepath.ToSlash(r.OutputPath), "/") {
+			if segment == name {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func cleanItem(conf config.ArrConfig, item Item, logger *slog.Logger) error {
+	// *arr has its own link or copy of everything it imported
+	if err := os.RemoveAll(item.CompletedPath); err != nil {
+		return err
+	}
+	logger.Info("removed imported completed folder")
+
+	if conf.Cleanup.DeleteFromDebrid {
+		if item.DebridID == "" {
+			logger.Warn("no debrid ID recorded, leaving torrent in debrid")
+		} else {
+			if err := debrid.For(item.Account).Remove(item.DebridID); err != nil {
+				return err
+			}
+			logger.Info("removed torrent from debrid", attr.DebridID(item.DebridID))
+
+			// It is gone on purpose, so shouldn't be repaired or listed
+			if item.MountName != "" {
+				if err := repair.ForgetLinked(item.Account, item.MountName); err != nil {
+					logger.Warn("failed to forget link for repair", "err", err)
+				}
+
+				if rclone.Enabled() {
+					if err := rclone.Forget(item.MountName); err != nil {
+						logger.Warn("failed to forget torrent in rclone", "err", err)
+					}
+				}
+			}
+		}
+	}
+
+	return forget(item.CompletedPath)
+}
+
+func findInstance(service arr.ArrService, name string) (config.ArrConfig, bool) {
+	instances := config.GetAppConfig().Sonarr
+	if service == arr.Radarr {
+		instances = config.GetAppConfig().Radarr
+	}
+
+	for _, conf := range instances {
+		if conf.Name == name {
+			return conf, true
+		}
+	}
+	return config.ArrConfig{}, false
+}
+
+func update(item Item) error {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	items, err := readState()
+	if err != nil {
+		return err
+	}
+
+	items[item.CompletedPath] = item
+
+	return writeState(items)
+}
+
+func forget(completedPath string) error {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	items, err := readState()
+	if err != nil {
+		return err
+	}
+
+	delete(items, completedPath)
+
+	return writeState(items)
+}
+
+func statePath() string {
+	return path.Join(config.GetAppConfig().StatePath, stateFilename)
+}
+
+func readState() (map[string]Item, error) {
+	items := map[string]Item{}
+
+	data, err := os.ReadFile(statePath())
+	if errors.Is(err, os.ErrNotExist) {
+		return items, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &items)
+	if err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+func writeState(items map[string]Item) error {
+	data, err := json.MarshalIndent(items, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Written to the side then renamed so a crash can't leave partial state
+	tmpPath := statePath() + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0o644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, statePath())
+}
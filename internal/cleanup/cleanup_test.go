@@ -0,0 +1,248 @@
+package cleanup_test
+
+import (
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/samjwillis97/sams-blackhole/internal/arr"
+	"github.com/samjwillis97/sams-blackhole/internal/arr/arrtest"
+	"github.com/samjwillis97/sams-blackhole/internal/cleanup"
+	"github.com/samjwillis97/sams-blackhole/internal/config"
+	"github.com/samjwillis97/sams-blackhole/internal/debrid/debridtest"
+	"github.com/samjwillis97/sams-blackhole/internal/logger"
+	"github.com/spf13/viper"
+)
+
+const testHash = "150947B245DA89629349290C2812ECDB6D0308C7"
+
+type setupOutput struct {
+	CompletedDir string
+	Arr          *arrtest.Server
+	Debrid       *debridtest.Server
+}
+
+func setup(t *testing.T, cleanupConfig map[string]any) setupOutput {
+	root := t.TempDir()
+	out := setupOutput{
+		CompletedDir: path.Join(root, "completed"),
+		Arr:          arrtest.NewServer(),
+		Debrid:       debridtest.NewServer(),
+	}
+	t.Cleanup(out.Arr.Close)
+	t.Cleanup(out.Debrid.Close)
+
+	mountDir := path.Join(root, "mount")
+	for _, dir := range []string{out.CompletedDir, mountDir} {
+		if err := os.Mkdir(dir, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mockViper := viper.New()
+	mockViper.Set("real_debrid.url", out.Debrid.URL)
+	mockViper.Set("real_debrid.watch_path", mountDir)
+	mockViper.Set("state_path", root)
+	mockViper.Set("sonarr", []map[string]any{{
+		"name":           "cleanuptest",
+		"url":            out.Arr.URL,
+		"completed_path": out.CompletedDir,
+		"cleanup":        cleanupConfig,
+	}})
+	config.InitializeAppConfig(mockViper)
+
+	mockSecretViper := viper.New()
+	mockSecretViper.Set("DEBRID_API_KEY", "debrid")
+	mockSecretViper.Set("CLEANUPTEST_API_KEY", "arr")
+	config.InitializeSecrets(mockSecretViper)
+
+	return out
+}
+
+func completedFolder(t *testing.T, out setupOutput, name string) string {
+	dir := path.Join(out.CompletedDir, name)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(dir, name+".mkv"), []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func exists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
+
+func TestRemovesCompletedFolderOnceImported(t *testing.T) {
+	out := setup(t, map[string]any{})
+	log := slog.New(logger.NewHandler(&slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	imported := completedFolder(t, out, "Show.S01E01.1080p")
+	waiting := completedFolder(t, out, "Show.S01E02.1080p")
+	for _, dir := range []string{imported, waiting} {
+		err := cleanup.Track(cleanup.Item{CompletedPath: dir, Service: arr.Sonarr, Instance: "cleanuptest"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// *arr sees the completed path under its own mount point
+	out.Arr.SetHistory(arr.HistoryItem{
+		ID:        1,
+		EventType: arr.DownloadFolderImported,
+		Date:      time.Now().Add(-2 * time.Hour),
+		Data:      arr.HistoryItemData{DroppedPath: "/downloads/completed/Show.S01E01.1080p/Show.S01E01.1080p.mkv"},
+	})
+
+	cleaned, err := cleanup.Run(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cleaned) != 1 || cleaned[0].CompletedPath != imported {
+		t.Errorf("Expected only %s to be cleaned, got %v", imported, cleaned)
+	}
+	if exists(imported) || cleanup.IsTracked(imported) {
+		t.Errorf("Expected %s to be removed and forgotten", imported)
+	}
+	if !exists(waiting) || !cleanup.IsTracked(waiting) {
+		t.Errorf("Expected %s to be kept until imported", waiting)
+	}
+	if len(out.Debrid.Removed()) != 0 {
+		t.Errorf("Expected nothing to be removed from debrid, got %v", out.Debrid.Removed())
+	}
+}
+
+func TestKeepsImportedItemsForRetention(t *testing.T) {
+	out := setup(t, map[string]any{"retention": "2h"})
+	log := slog.New(logger.NewHandler(&slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	recent := completedFolder(t, out, "Movie.2023.1080p")
+	old := completedFolder(t, out, "Movie.2021.1080p")
+	for _, dir := range []string{recent, old} {
+		err := cleanup.Track(cleanup.Item{CompletedPath: dir, Service: arr.Sonarr, Instance: "cleanuptest"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out.Arr.SetHistory(
+		arr.HistoryItem{
+			ID:        1,
+			EventType: arr.DownloadFolderImported,
+			Date:      time.Now().Add(-time.Hour),
+			Data:      arr.HistoryItemData{DroppedPath: "/downloads/Movie.2023.1080p"},
+		},
+		arr.HistoryItem{
+			ID:        2,
+			EventType: arr.DownloadFolderImported,
+			Date:      time.Now().Add(-3 * time.Hour),
+			Data:      arr.HistoryItemData{DroppedPath: "/downloads/Movie.2021.1080p"},
+		},
+	)
+
+	if _, err := cleanup.Run(log); err != nil {
+		t.Fatal(err)
+	}
+
+	if exists(old) {
+		t.Errorf("Expected %s to be removed after its retention", old)
+	}
+	if !exists(recent) {
+		t.Errorf("Expected %s to be kept for its retention", recent)
+	}
+
+	items, err := cleanup.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || !items[0].Imported() {
+		t.Errorf("Expected the retained item to be recorded as imported, got %v", items)
+	}
+}
+
+func TestWaitsForDownloadToLeaveQueue(t *testing.T) {
+	out := setup(t, map[string]any{})
+	log := slog.New(logger.NewHandler(&slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	dir := completedFolder(t, out, "Show.S01.1080p")
+	err := cleanup.Track(cleanup.Item{CompletedPath: dir, InfoHash: testHash, Service: arr.Sonarr, Instance: "cleanuptest"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first episode of the season pack has been imported, the rest haven't
+	out.Arr.SetHistory(arr.HistoryItem{
+		ID:         1,
+		EventType:  arr.DownloadFolderImported,
+		DownloadID: testHash,
+		Date:       time.Now().Add(-2 * time.Hour),
+		Data:       arr.HistoryItemData{DroppedPath: "/downloads/Show.S01.1080p/Show.S01E01.1080p.mkv"},
+	})
+	out.Arr.SetQueue(arr.QueueItem{ID: 1, DownloadID: testHash, TrackedDownloadState: "importing"})
+
+	if _, err := cleanup.Run(log); err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := cleanup.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists(dir) || len(items) != 1 || items[0].Imported() {
+		t.Fatalf("Expected %s to be kept and not imported while in the queue, got %v", dir, items)
+	}
+
+	out.Arr.SetQueue()
+
+	if _, err := cleanup.Run(log); err != nil {
+		t.Fatal(err)
+	}
+
+	if exists(dir) {
+		t.Errorf("Expected %s to be removed once it left the queue", dir)
+	}
+}
+
+func TestDeletesFromDebridByHash(t *testing.T) {
+	out := setup(t, map[string]any{"delete_from_debrid": true})
+	log := slog.New(logger.NewHandler(&slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	out.Debrid.Seed(debridtest.Torrent{ID: "DEBRIDID", Filename: "Show.S01E01.1080p", Hash: testHash})
+	dir := completedFolder(t, out, "Renamed.By.Blackhole")
+	err := cleanup.Track(cleanup.Item{
+		CompletedPath: dir,
+		MountName:     "Show.S01E01.1080p",
+		InfoHash:      testHash,
+		DebridID:      "DEBRIDID",
+		Service:       arr.Sonarr,
+		Instance:      "cleanuptest",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out.Arr.SetHistory(arr.HistoryItem{
+		ID:         1,
+		EventType:  arr.DownloadFolderImported,
+		DownloadID: testHash,
+		Date:       time.Now().Add(-2 * time.Hour),
+		Data:       arr.HistoryItemData{DroppedPath: "/downloads/elsewhere/Show.S01E01.1080p.mkv"},
+	})
+
+	if _, err := cleanup.Run(log); err != nil {
+		t.Fatal(err)
+	}
+
+	if exists(dir) {
+		t.Errorf("Expected %s to be removed", dir)
+	}
+	if !slices.Equal(out.Debrid.Removed(), []string{"DEBRIDID"}) {
+		t.Errorf("Expected the torrent to be removed from debrid, got %v", out.Debrid.Removed())
+	}
+}
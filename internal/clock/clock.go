@@ -0,0 +1,80 @@
+// Package clock routes all timing through a replaceable Clock so tests can
+// control time instead of sleeping.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+type Timer interface {
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                            { return time.Now() }
+func (realClock) Sleep(d time.Duration)                     { time.Sleep(d) }
+func (realClock) After(d time.Duration) <-chan time.Time    { return time.After(d) }
+func (realClock) AfterFunc(d time.Duration, f func()) Timer { return time.AfterFunc(d, f) }
+
+var (
+	mu      sync.RWMutex
+	current Clock = realClock{}
+)
+
+// Real returns a clock backed by the time package
+func Real() Clock {
+	return realClock{}
+}
+
+// Get returns the clock currently in use
+func Get() Clock {
+	mu.RLock()
+	defer mu.RUnlock()
+	return current
+}
+
+// Set replaces the clock in use, returning a function that restores the
+// previous one
+func Set(c Clock) func() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	previous := current
+	current = c
+
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		current = previous
+	}
+}
+
+func Now() time.Time {
+	return Get().Now()
+}
+
+func Since(t time.Time) time.Duration {
+	return Get().Now().Sub(t)
+}
+
+func Sleep(d time.Duration) {
+	Get().Sleep(d)
+}
+
+func After(d time.Duration) <-chan time.Time {
+	return Get().After(d)
+}
+
+func AfterFunc(d time.Duration, f func()) Timer {
+	return Get().AfterFunc(d, f)
+}
@@ -0,0 +1,144 @@
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Fake is a Clock that only moves when advanced, timers due during an
+// Advance are fired in order before it returns
+type Fake struct {
+	mu      sync.Mutex
+	now     time.Time
+	timers  []*fakeTimer
+	changed chan struct{}
+}
+
+type fakeTimer struct {
+	clock  *Fake
+	at     time.Time
+	fn     func()
+	ch     chan time.Time
+	active bool
+}
+
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now, changed: make(chan struct{})}
+}
+
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *Fake) Sleep(d time.Duration) {
+	<-f.After(d)
+}
+
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	f.schedule(&fakeTimer{clock: f, ch: ch}, d)
+	return ch
+}
+
+func (f *Fake) AfterFunc(d time.Duration, fn func()) Timer {
+	t := &fakeTimer{clock: f, fn: fn}
+	f.schedule(t, d)
+	return t
+}
+
+// Advance moves the clock forward, firing any timers that fall due
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	target := f.now.Add(d)
+	f.mu.Unlock()
+
+	for {
+		f.mu.Lock()
+		sort.SliceStable(f.timers, func(i, j int) bool { return f.timers[i].at.Before(f.timers[j].at) })
+
+		if len(f.timers) == 0 || f.timers[0].at.After(target) {
+			f.now = target
+			f.mu.Unlock()
+			return
+		}
+
+		t := f.timers[0]
+		f.timers = f.timers[1:]
+		t.active = false
+		if t.at.After(f.now) {
+			f.now = t.at
+		}
+		now := f.now
+		f.mu.Unlock()
+
+		if t.fn != nil {
+			t.fn()
+		} else {
+			t.ch <- now
+		}
+	}
+}
+
+// Pending returns the number of timers and sleepers waiting on the clock
+func (f *Fake) Pending() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.timers)
+}
+
+// BlockUntil waits until at least n timers or sleepers are waiting on the
+// clock, used to avoid advancing before a goroutine has started waiting
+func (f *Fake) BlockUntil(n int) {
+	for {
+		f.mu.Lock()
+		pending := len(f.timers)
+		changed := f.changed
+		f.mu.Unlock()
+
+		if pending >= n {
+			return
+		}
+		<-changed
+	}
+}
+
+func (f *Fake) schedule(t *fakeTimer, d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	t.at = f.now.Add(d)
+	t.active = true
+	f.timers = append(f.timers, t)
+
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (t *fakeTimer) Stop() bool {
+	f := t.clock
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !t.active {
+		return false
+	}
+
+	t.active = false
+	for i, pending := range f.timers {
+		if pending == t {
+			f.timers = append(f.timers[:i], f.timers[i+1:]...)
+			break
+		}
+	}
+
+	return true
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	wasActive := t.Stop()
+	t.clock.schedule(t, d)
+	return wasActive
+}
@@ -0,0 +1,74 @@
+package clock_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/samjwillis97/sams-blackhole/internal/clock"
+)
+
+func TestFakeFiresTimersInOrder(t *testing.T) {
+	c := clock.NewFake(time.Unix(0, 0))
+
+	fired := []string{}
+	c.AfterFunc(2*time.Second, func() { fired = append(fired, "second") })
+	c.AfterFunc(1*time.Second, func() { fired = append(fired, "first") })
+	stopped := c.AfterFunc(1500*time.Millisecond, func() { fired = append(fired, "stopped") })
+
+	if !stopped.Stop() {
+		t.Errorf("Expected pending timer to stop")
+	}
+
+	c.Advance(1 * time.Second)
+	if len(fired) != 1 || fired[0] != "first" {
+		t.Errorf("Expected only first timer to fire, got %v", fired)
+	}
+
+	c.Advance(5 * time.Second)
+	if len(fired) != 2 || fired[1] != "second" {
+		t.Errorf("Expected second timer to fire, got %v", fired)
+	}
+
+	if expected := time.Unix(6, 0); !c.Now().Equal(expected) {
+		t.Errorf("Expected clock to be at %v, got %v", expected, c.Now())
+	}
+}
+
+func TestFakeResetPushesTimerBack(t *testing.T) {
+	c := clock.NewFake(time.Unix(0, 0))
+
+	fired := false
+	timer := c.AfterFunc(time.Second, func() { fired = true })
+
+	c.Advance(900 * time.Millisecond)
+	timer.Reset(time.Second)
+	c.Advance(900 * time.Millisecond)
+
+	if fired {
+		t.Errorf("Expected reset timer not to have fired yet")
+	}
+
+	c.Advance(100 * time.Millisecond)
+	if !fired {
+		t.Errorf("Expected reset timer to have fired")
+	}
+}
+
+func TestFakeSleepWakesOnAdvance(t *testing.T) {
+	c := clock.NewFake(time.Unix(0, 0))
+	done := make(chan struct{})
+
+	go func() {
+		c.Sleep(time.Minute)
+		close(done)
+	}()
+
+	c.BlockUntil(1)
+	c.Advance(time.Minute)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("Expected sleeper to wake after advancing")
+	}
+}
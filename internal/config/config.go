@@ -3,8 +3,14 @@ package config
 import (
 	"errors"
 	"fmt"
+	"log/slog"
 	"net/url"
 	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -15,24 +21,677 @@ var appSecrets *viper.Viper = nil
 var confSet bool = false
 var appConf AppConfig
 
+// Guards both the config and secrets, goroutines left running by one test may
+// still be reading them while the next initializes its own
+var confMu sync.RWMutex
+
 type DebridConfig struct {
+	Account      string `mapstructure:"-"` // Name of the account, empty for `real_debrid`
+	Provider     string `mapstructure:"-"` // Whose API the account is on, only other accounts can be on another provider
 	Url          string
 	WatchPatch   string `mapstructure:"watch_path"`
 	MountTimeout int64  `mapstructure:"mount_timeout"` // This is time we will wait for it to appear in the mount
+
+	AllowEmptyMount bool   `mapstructure:"allow_empty_mount"` // An empty mount is otherwise treated as the mount having died
+	Watcher         string `mapstructure:"watcher"`           // How the mount is watched, `poll` when not set as FUSE mounts don't notify
+
+	Keys  KeySource   `mapstructure:",squash"` // Falls back to `DEBRID_API_KEY`, not needed once authorized with `blackhole auth`
+	Retry RetryConfig `mapstructure:"retry"`
+	Slots SlotsConfig `mapstructure:"slots"`
+
+	// Used by `blackhole auth` for the device code flow, the open source app's
+	// client is used when not set
+	OAuthUrl string `mapstructure:"oauth_url"`
+	ClientID string `mapstructure:"client_id"`
+}
+
+// The debrid services an account can be on
+const (
+	ProviderRealDebrid = "real_debrid"
+	ProviderTorBox     = "torbox" // Only for NZBs, with the Usenet API
+)
+
+// GetProvider returns the account's provider with the default applied
+func (c DebridConfig) GetProvider() string {
+	if c.Provider == "" {
+		return ProviderRealDebrid
+	}
+	return c.Provider
+}
+
+// SupportsUsenet reports whether NZBs can be added to the account
+func (c DebridConfig) SupportsUsenet() bool {
+	return c.GetProvider() == ProviderTorBox
+}
+
+const (
+	DefaultDebridOAuthUrl = "https://api.real-debrid.com/oauth/v2/"
+	DefaultDebridClientID = "X245A4XAIBGVM"
+)
+
+// GetOAuthUrl returns the OAuth API's URL with the default applied
+func (c DebridConfig) GetOAuthUrl() string {
+	if c.OAuthUrl == "" {
+		return DefaultDebridOAuthUrl
+	}
+	return c.OAuthUrl
+}
+
+// GetClientID returns the OAuth client with the default applied
+func (c DebridConfig) GetClientID() string {
+	if c.ClientID == "" {
+		return DefaultDebridClientID
+	}
+	return c.ClientID
+}
+
+// How the account's active torrent slots are watched, items wait in a local
+// queue while they are all in use
+type SlotsConfig struct {
+	CheckInterval time.Duration `mapstructure:"check_interval"` // How often the active count is checked and stale torrents collected
+	StaleAfter    time.Duration `mapstructure:"stale_after"`    // How long a torrent blackhole added can go without downloading before it is removed
+}
+
+const (
+	DefaultSlotsCheckInterval = 30 * time.Second
+	DefaultSlotsStaleAfter    = 2 * time.Hour
+)
+
+// GetSlots returns the slot settings with defaults applied
+func (c DebridConfig) GetSlots() SlotsConfig {
+	s := c.Slots
+	if s.CheckInterval <= 0 {
+		s.CheckInterval = DefaultSlotsCheckInterval
+	}
+	if s.StaleAfter <= 0 {
+		s.StaleAfter = DefaultSlotsStaleAfter
+	}
+	return s
+}
+
+// How a failing debrid call is retried, policies are by the kind of failure
+// and permanent failures are never retried
+type RetryConfig struct {
+	Deadline    time.Duration `mapstructure:"deadline"`     // Total time an item has once it starts retrying, after which it is left in processing for later
+	Network     RetryPolicy   `mapstructure:"network"`      // Requests that didn't get a response
+	RateLimited RetryPolicy   `mapstructure:"rate_limited"` // 429 responses
+	Server      RetryPolicy   `mapstructure:"server"`       // 5xx responses
+}
+
+type RetryPolicy struct {
+	MaxAttempts int           `mapstructure:"max_attempts"` // Including the first, so 1 never retries
+	Backoff     time.Duration `mapstructure:"backoff"`      // Wait before the first retry, doubled for each after
+	MaxBackoff  time.Duration `mapstructure:"max_backoff"`
+}
+
+// Built in retry policies, used for anything that has not been configured
+var (
+	DefaultRetryDeadline  = 5 * time.Minute
+	DefaultNetworkRetry   = RetryPolicy{MaxAttempts: 5, Backoff: 2 * time.Second, MaxBackoff: 30 * time.Second}
+	DefaultRateLimitRetry = RetryPolicy{MaxAttempts: 5, Backoff: 10 * time.Second, MaxBackoff: time.Minute}
+	DefaultServerRetry    = RetryPolicy{MaxAttempts: 4, Backoff: 5 * time.Second, MaxBackoff: time.Minute}
+)
+
+// GetRetry returns the retry policies with defaults applied
+func (c DebridConfig) GetRetry() RetryConfig {
+	r := c.Retry
+	if r.Deadline <= 0 {
+		r.Deadline = DefaultRetryDeadline
+	}
+	r.Network = withDefaultRetry(r.Network, DefaultNetworkRetry)
+	r.RateLimited = withDefaultRetry(r.RateLimited, DefaultRateLimitRetry)
+	r.Server = withDefaultRetry(r.Server, DefaultServerRetry)
+	return r
+}
+
+func withDefaultRetry(p RetryPolicy, d RetryPolicy) RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = d.MaxAttempts
+	}
+	if p.Backoff <= 0 {
+		p.Backoff = d.Backoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = max(d.MaxBackoff, p.Backoff)
+	}
+	return p
+}
+
+// Delay is how long to wait before the retry following the given attempt,
+// counting from 1
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	delay := p.Backoff
+	for i := 1; i < attempt && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, p.MaxBackoff)
+}
+
+// GetMountTimeout returns how long to wait for a torrent to appear in the mount
+func (c DebridConfig) GetMountTimeout() time.Duration {
+	return time.Duration(c.MountTimeout) * time.Second
+}
+
+// Remote control API of the rclone instance serving the debrid mount, leaving
+// the URL empty disables it. The password is the `RCLONE_PASSWORD` secret.
+type RcloneConfig struct {
+	Url            string
+	User           string
+	Fs             string        `mapstructure:"fs"`              // Only needed when rclone is serving more than one mount
+	Dir            string        `mapstructure:"dir"`             // Directory of torrents relative to the root of the mount
+	HealthInterval time.Duration `mapstructure:"health_interval"` // How often to check `core/stats`, disabled when zero
+}
+
+// Built in values for any timing that has not been configured
+const (
+	DefaultDebounce            = 5 * time.Second
+	DefaultPollInterval        = 1 * time.Second
+	DefaultProcessingDeadline  = 30 * time.Second
+	DefaultDebridRetryInterval = 1 * time.Second
+	DefaultMountHealthInterval = 10 * time.Second
+	DefaultReconcileInterval   = 1 * time.Minute
+)
+
+// Timings that can be set per *arr instance, zero values fall back to the
+// global timings
+type ArrTimings struct {
+	Debounce            time.Duration `mapstructure:"debounce"`              // Quiet period after the last write before a file is handled
+	ProcessingDeadline  time.Duration `mapstructure:"processing_deadline"`   // Total time an item has to get through debrid before failing, until it starts retrying
+	DebridRetryInterval time.Duration `mapstructure:"debrid_retry_interval"` // Wait between checks of a torrent's debrid status
+}
+
+type Timings struct {
+	ArrTimings          `mapstructure:",squash"`
+	PollInterval        time.Duration `mapstructure:"poll_interval"`         // How often the debrid mount is polled for changes
+	MountHealthInterval time.Duration `mapstructure:"mount_health_interval"` // How often the debrid mount is checked for being alive
+	ReconcileInterval   time.Duration `mapstructure:"reconcile_interval"`    // How often the hybrid watcher lists directories for missed events
+	ImportCheckInterval time.Duration `mapstructure:"import_check_interval"` // How often *arr history is checked for imports to clean up, disabled when zero
+}
+
+// HTTP server for status and metrics, leaving the address empty disables it
+type ServerConfig struct {
+	Address string `mapstructure:"address"`
+}
+
+// What happens to an item once *arr has imported it
+type CleanupConfig struct {
+	Retention        time.Duration `mapstructure:"retention"`          // How long after the import before the completed folder is removed, defaults to an hour
+	DeleteFromDebrid bool          `mapstructure:"delete_from_debrid"` // Also delete the torrent, which breaks anything *arr imported as a symlink
+}
+
+// Leaves *arr time to finish with the folder, it can still be reading files
+// after the import is recorded
+const DefaultCleanupRetention = time.Hour
+
+// GetRetention returns how long the completed folder is kept after the import
+func (c CleanupConfig) GetRetention() time.Duration {
+	if c.Retention <= 0 {
+		return DefaultCleanupRetention
+	}
+	return c.Retention
 }
 
 type ArrConfig struct {
 	Name           string `mapstructure:"name"`
 	Url            string
-	WatchPath      string `mapstructure:"watch_path"`
-	ProcessingPath string `mapstructure:"processing_path"`
-	CompletedPath  string `mapstructure:"completed_path"`
+	WatchPath      string        `mapstructure:"watch_path"`
+	ProcessingPath string        `mapstructure:"processing_path"`
+	CompletedPath  string        `mapstructure:"completed_path"`
+	Recursive      bool          `mapstructure:"recursive"`     // Also pick up files dropped into subdirectories of the watch path
+	MaxDepth       int           `mapstructure:"max_depth"`     // How many subdirectories deep to go when recursive, unlimited when zero
+	Watcher        string        `mapstructure:"watcher"`       // Either `fsnotify`, `poll` or `hybrid`, use one of the latter for network shares
+	LibraryPaths   []string      `mapstructure:"library_paths"` // Overrides the root folders reported by the *arr API
+	LinkStrategy   string        `mapstructure:"link_strategy"` // How files are put into the completed path, see the link package
+	Priority       int           `mapstructure:"priority"`      // Items from instances with a higher priority take free debrid slots first
+	Keys           KeySource     `mapstructure:",squash"`       // Falls back to `<NAME>_API_KEY`
+	Cleanup        CleanupConfig `mapstructure:"cleanup"`
+	Timings        ArrTimings    `mapstructure:"timings"`
+
+	MountTimeout    int64  `mapstructure:"mount_timeout"`     // Seconds to wait for a torrent to appear in the mount, as under `real_debrid`, the debrid mount timeout when zero
+	Uncached        string `mapstructure:"uncached"`          // Either `fail` to only take what debrid has cached, or `wait` for debrid to download it within the processing deadline, NZBs are always waited for
+	SeasonPacks     string `mapstructure:"season_packs"`      // Either `research` to search for a failed season pack's season again, or `fail` to only fail the release
+	HistoryPageSize int    `mapstructure:"history_page_size"` // How many *arr history records are searched for a release
+
+	DebridAccount string        `mapstructure:"debrid_account"` // One of `debrid_accounts`, `real_debrid` when empty
+	Routes        []RouteConfig `mapstructure:"routes"`
+}
+
+// Sends matching files somewhere other than the instance's account and
+// completed path, the first route a file matches is used
+type RouteConfig struct {
+	Subfolder     string `mapstructure:"subfolder"` // Directory under the watch path the file was dropped into
+	Pattern       string `mapstructure:"pattern"`   // Matched against the file name, ignoring case
+	Account       string `mapstructure:"account"`
+	CompletedPath string `mapstructure:"completed_path"`
+	LinkStrategy  string `mapstructure:"link_strategy"`
+}
+
+// Route is where a file ends up once its routes have been applied
+type Route struct {
+	Account       string `json:"account,omitempty"`
+	CompletedPath string `json:"completedPath"`
+	LinkStrategy  string `json:"linkStrategy,omitempty"`
+}
+
+// Built in values for any instance policy that has not been configured
+const (
+	DefaultUncached        = "fail"
+	DefaultSeasonPacks     = "research"
+	DefaultHistoryPageSize = 100
+)
+
+// GetMountTimeout returns how long to wait for this instance's torrents to
+// appear in the mount
+func (c ArrConfig) GetMountTimeout() time.Duration {
+	if c.MountTimeout <= 0 {
+		return GetAppConfig().RealDebrid.GetMountTimeout()
+	}
+	return time.Duration(c.MountTimeout) * time.Second
+}
+
+// GetUncached returns what happens to torrents debrid has to download first
+func (c ArrConfig) GetUncached() string {
+	if c.Uncached == "" {
+		return DefaultUncached
+	}
+	return c.Uncached
+}
+
+// GetSeasonPacks returns what happens when a season pack fails
+func (c ArrConfig) GetSeasonPacks() string {
+	if c.SeasonPacks == "" {
+		return DefaultSeasonPacks
+	}
+	return c.SeasonPacks
+}
+
+// GetHistoryPageSize returns how much of the history is searched
+func (c ArrConfig) GetHistoryPageSize() int {
+	if c.HistoryPageSize <= 0 {
+		return DefaultHistoryPageSize
+	}
+	return c.HistoryPageSize
+}
+
+type RepairConfig struct {
+	Interval      time.Duration `mapstructure:"interval"`       // How often to scan for broken links, disabled when zero
+	Action        string        `mapstructure:"action"`         // Either `readd` or `research`
+	CheckReadable bool          `mapstructure:"check_readable"` // Read from each link target, catches files the mount lists but can't serve
+	DryRun        bool          `mapstructure:"dry_run"`
+}
+
+type ReconcileConfig struct {
+	Interval   time.Duration `mapstructure:"interval"` // How often to compare the directories against known jobs, disabled when zero
+	DryRun     bool          `mapstructure:"dry_run"`
+	KeepFailed time.Duration `mapstructure:"keep_failed"` // How long failed jobs are kept to be retried by hand, forever when zero
+}
+
+// Each job's timeline is kept under the state path, see the audit package
+type AuditConfig struct {
+	Retention time.Duration `mapstructure:"retention"` // How long a timeline is kept after it was last written to, forever when zero
+}
+
+// Removes torrents nothing refers to from the debrid account, see the
+// housekeeping package
+type HousekeepingConfig struct {
+	Interval    time.Duration `mapstructure:"interval"`     // How often to run, disabled when zero
+	DryRun      bool          `mapstructure:"dry_run"`      // Only report what would be removed
+	GracePeriod time.Duration `mapstructure:"grace_period"` // How long after being added a torrent is left alone, unless it errored
+	Allowlist   []string      `mapstructure:"allowlist"`    // Torrent IDs, info hashes or filename patterns that are never removed
+}
+
+const DefaultHousekeepingGracePeriod = 24 * time.Hour
+
+// GetGracePeriod returns the grace period with the default applied
+func (c HousekeepingConfig) GetGracePeriod() time.Duration {
+	if c.GracePeriod <= 0 {
+		return DefaultHousekeepingGracePeriod
+	}
+	return c.GracePeriod
+}
+
+// Where logs go and what they look like, see the logger package
+type LogConfig struct {
+	Level  string        `mapstructure:"level"`  // One of `debug`, `info`, `warn` or `error`
+	Format string        `mapstructure:"format"` // One of `pretty`, `logfmt` or `json`, use one of the latter for log aggregators
+	Color  string        `mapstructure:"color"`  // One of `auto`, `always` or `never`, `auto` only colors a terminal
+	File   LogFileConfig `mapstructure:"file"`
+}
+
+// Logs are also written to the file when a path is set, rotating once it
+// reaches the maximum size
+type LogFileConfig struct {
+	Path       string `mapstructure:"path"`
+	MaxSize    int    `mapstructure:"max_size"`    // Megabytes, 100 when not set
+	MaxBackups int    `mapstructure:"max_backups"` // How many rotated files are kept, 5 when not set
+}
+
+// Where notifications are sent, see the notify package. Tokens are read from
+// the `<NAME>_TOKEN` secret.
+type NotifierConfig struct {
+	Name    string   `mapstructure:"name"`
+	Type    string   `mapstructure:"type"` // One of `discord`, `slack`, `ntfy`, `gotify`, `apprise` or `webhook`
+	Url     string   `mapstructure:"url"`
+	Events  []string `mapstructure:"events"`  // Which events are sent, every event when empty
+	Title   string   `mapstructure:"title"`   // Template for the title, the event's default when empty
+	Message string   `mapstructure:"message"` // Template for the message, the event's default when empty
+}
+
+// A media server told to scan what *arr imports from the completed path,
+// see the mediaserver package. The token falls back to `<NAME>_TOKEN`.
+type MediaServerConfig struct {
+	Name         string        `mapstructure:"name"`
+	Type         string        `mapstructure:"type"` // One of `plex`, `jellyfin` or `emby`
+	Url          string        `mapstructure:"url"`
+	Keys         KeySource     `mapstructure:",squash"`
+	Instances    []string      `mapstructure:"instances"`     // Whose imports are scanned, every instance when empty
+	PathMappings []PathMapping `mapstructure:"path_mappings"` // For when the server sees the library under another path than *arr
+	Retry        RetryPolicy   `mapstructure:"retry"`
+}
+
+// Replaces the From prefix of a path with To
+type PathMapping struct {
+	From string `mapstructure:"from"`
+	To   string `mapstructure:"to"`
+}
+
+var DefaultMediaServerRetry = RetryPolicy{MaxAttempts: 3, Backoff: 10 * time.Second, MaxBackoff: time.Minute}
+
+// Token returns the secret for this media server, from `<NAME>_TOKEN` unless
+// another source is set
+func (c MediaServerConfig) Token() string {
+	key, _ := c.Keys.resolve(c.fallbackKey())
+	return key
+}
+
+func (c MediaServerConfig) fallbackKey() string {
+	return fmt.Sprintf("%s_TOKEN", strings.ToUpper(c.Name))
+}
+
+// GetRetry returns the retry policy with defaults applied
+func (c MediaServerConfig) GetRetry() RetryPolicy {
+	return withDefaultRetry(c.Retry, DefaultMediaServerRetry)
+}
+
+// Another debrid account files can be routed to, anything not set here is
+// inherited from `real_debrid`. The key falls back to `<NAME>_DEBRID_API_KEY`.
+type DebridAccountConfig struct {
+	Name      string    `mapstructure:"name"`
+	Provider  string    `mapstructure:"provider"` // Either `real_debrid` or `torbox`, the latter needs its own url
+	Url       string    `mapstructure:"url"`
+	WatchPath string    `mapstructure:"watch_path"` // Where this account is mounted
+	Watcher   string    `mapstructure:"watcher"`    // How the mount is watched, the same as `real_debrid` when not set
+	Keys      KeySource `mapstructure:",squash"`
 }
 
 type AppConfig struct {
-	RealDebrid DebridConfig `mapstructure:"real_debrid"`
-	Sonarr     []ArrConfig
-	Radarr     []ArrConfig
+	RealDebrid     DebridConfig          `mapstructure:"real_debrid"`
+	DebridAccounts []DebridAccountConfig `mapstructure:"debrid_accounts"`
+	Rclone         RcloneConfig
+	Server         ServerConfig
+	StatePath      string `mapstructure:"state_path"` // Directory blackhole keeps its own state in
+	Timings        Timings
+	Log            LogConfig
+	Repair         RepairConfig
+	Reconcile      ReconcileConfig
+	Audit          AuditConfig
+	Housekeeping   HousekeepingConfig
+	Notifications  []NotifierConfig
+	MediaServers   []MediaServerConfig `mapstructure:"media_servers"`
+	Sonarr         []ArrConfig
+	Radarr         []ArrConfig
+}
+
+// Secret is a value that must not end up in logs
+type Secret string
+
+const redacted = "[redacted]"
+
+func (s Secret) String() string {
+	return redacted
+}
+
+func (s Secret) LogValue() slog.Value {
+	return slog.StringValue(redacted)
+}
+
+// MarshalText covers configs logged in the JSON format
+func (s Secret) MarshalText() ([]byte, error) {
+	return []byte(redacted), nil
+}
+
+// Where an API key is read from, the first one set is used
+type KeySource struct {
+	Key     Secret `mapstructure:"api_key"`
+	KeyFile string `mapstructure:"api_key_file"` // Such as a Docker or Kubernetes secret under `/run/secrets`
+	KeyEnv  string `mapstructure:"api_key_env"`  // An environment variable or `.env` entry
+}
+
+// resolve reads the key, from the fallback secret when no source is set. The
+// file is read every time so rotated secrets are picked up.
+func (k KeySource) resolve(fallback string) (string, error) {
+	switch {
+	case k.Key != "":
+		return string(k.Key), nil
+	case k.KeyFile != "":
+		data, err := os.ReadFile(k.KeyFile)
+		if err != nil {
+			return "", err
+		}
+		key := strings.TrimSpace(string(data))
+		if key == "" {
+			return "", errors.New(fmt.Sprintf("%s is empty", k.KeyFile))
+		}
+		return key, nil
+	case k.KeyEnv != "":
+		key := GetSecrets().GetString(k.KeyEnv)
+		if key == "" {
+			return "", errors.New(fmt.Sprintf("%s is not set", k.KeyEnv))
+		}
+		return key, nil
+	}
+	return GetSecrets().GetString(fallback), nil
+}
+
+// APIKey returns the secret for this instance, from `<NAME>_API_KEY` unless
+// another source is set
+func (c ArrConfig) APIKey() string {
+	key, _ := c.Keys.resolve(c.fallbackKey())
+	return key
+}
+
+func (c ArrConfig) fallbackKey() string {
+	return fmt.Sprintf("%s_API_KEY", strings.ToUpper(c.Name))
+}
+
+// APIKey returns the key for the debrid API, from `DEBRID_API_KEY` or
+// `<NAME>_DEBRID_API_KEY` for other accounts unless another source is set
+func (c DebridConfig) APIKey() string {
+	key, _ := c.Keys.resolve(c.fallbackKey())
+	return key
+}
+
+func (c DebridConfig) fallbackKey() string {
+	if c.Account == "" {
+		return "DEBRID_API_KEY"
+	}
+	return fmt.Sprintf("%s_DEBRID_API_KEY", strings.ToUpper(c.Account))
+}
+
+// DebridAccount returns the config for the named debrid account, the empty
+// name being `real_debrid`
+func (c AppConfig) DebridAccount(name string) (DebridConfig, bool) {
+	if name == "" {
+		return c.RealDebrid, true
+	}
+
+	for _, account := range c.DebridAccounts {
+		if account.Name != name {
+			continue
+		}
+
+		conf := c.RealDebrid
+		conf.Account = account.Name
+		conf.Provider = account.Provider
+		conf.Keys = account.Keys
+		if account.Url != "" {
+			conf.Url = account.Url
+		}
+		if account.WatchPath != "" {
+			conf.WatchPatch = account.WatchPath
+		}
+		if account.Watcher != "" {
+			conf.Watcher = account.Watcher
+		}
+		return conf, true
+	}
+
+	return DebridConfig{}, false
+}
+
+// DebridAccountNames returns every debrid account, starting with the empty
+// name of `real_debrid`
+func (c AppConfig) DebridAccountNames() []string {
+	names := []string{""}
+	for _, account := range c.DebridAccounts {
+		names = append(names, account.Name)
+	}
+	return names
+}
+
+// DebridMounts returns the account of every distinct debrid mount, accounts
+// sharing a mount are only returned once
+func (c AppConfig) DebridMounts() []DebridConfig {
+	mounts := []DebridConfig{}
+	seen := map[string]bool{}
+	for _, name := range c.DebridAccountNames() {
+		account, _ := c.DebridAccount(name)
+		if seen[account.WatchPatch] {
+			continue
+		}
+		seen[account.WatchPatch] = true
+		mounts = append(mounts, account)
+	}
+	return mounts
+}
+
+// Route returns where the file goes, from the first route it matches and the
+// instance otherwise. The path is relative to the watch path.
+func (c ArrConfig) Route(relPath string) Route {
+	route := Route{
+		Account:       c.DebridAccount,
+		CompletedPath: c.CompletedPath,
+		LinkStrategy:  c.LinkStrategy,
+	}
+
+	for _, r := range c.Routes {
+		if !r.matches(relPath) {
+			continue
+		}
+
+		if r.Account != "" {
+			route.Account = r.Account
+		}
+		if r.CompletedPath != "" {
+			route.CompletedPath = r.CompletedPath
+		}
+		if r.LinkStrategy != "" {
+			route.LinkStrategy = r.LinkStrategy
+		}
+		break
+	}
+
+	return route
+}
+
+// CompletedPaths returns every path the instance links into, its own and any
+// its routes send files to
+func (c ArrConfig) CompletedPaths() []string {
+	paths := []string{c.CompletedPath}
+	for _, r := range c.Routes {
+		if r.CompletedPath != "" && !slices.Contains(paths, r.CompletedPath) {
+			paths = append(paths, r.CompletedPath)
+		}
+	}
+	return paths
+}
+
+func (r RouteConfig) matches(relPath string) bool {
+	relPath = path.Clean(relPath)
+
+	if r.Subfolder != "" {
+		subfolder := path.Clean(r.Subfolder)
+		if !strings.HasPrefix(path.Dir(relPath)+"/", subfolder+"/") {
+			return false
+		}
+	}
+
+	if r.Pattern != "" {
+		matched, err := path.Match(strings.ToLower(r.Pattern), strings.ToLower(path.Base(relPath)))
+		if err != nil || !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+// APIKey returns the key the job and audit routes must be requested with,
+// from `SERVER_API_KEY`
+func (c ServerConfig) APIKey() string {
+	return GetSecrets().GetString("SERVER_API_KEY")
+}
+
+// Token returns the secret for this notifier, from `<NAME>_TOKEN`
+func (c NotifierConfig) Token() string {
+	return GetSecrets().GetString(fmt.Sprintf("%s_TOKEN", strings.ToUpper(c.Name)))
+}
+
+// GetTimings returns the global timings with defaults applied
+func (c AppConfig) GetTimings() Timings {
+	t := c.Timings
+	t.ArrTimings = withDefaultTimings(t.ArrTimings)
+	if t.PollInterval <= 0 {
+		t.PollInterval = DefaultPollInterval
+	}
+	if t.MountHealthInterval <= 0 {
+		t.MountHealthInterval = DefaultMountHealthInterval
+	}
+	if t.ReconcileInterval <= 0 {
+		t.ReconcileInterval = DefaultReconcileInterval
+	}
+	return t
+}
+
+// GetTimings returns the timings for this instance, anything not set on the
+// instance is inherited from the global timings
+func (c ArrConfig) GetTimings() ArrTimings {
+	global := GetAppConfig().GetTimings().ArrTimings
+
+	t := c.Timings
+	if t.Debounce <= 0 {
+		t.Debounce = global.Debounce
+	}
+	if t.ProcessingDeadline <= 0 {
+		t.ProcessingDeadline = global.ProcessingDeadline
+	}
+	if t.DebridRetryInterval <= 0 {
+		t.DebridRetryInterval = global.DebridRetryInterval
+	}
+	return t
+}
+
+func withDefaultTimings(t ArrTimings) ArrTimings {
+	if t.Debounce <= 0 {
+		t.Debounce = DefaultDebounce
+	}
+	if t.ProcessingDeadline <= 0 {
+		t.ProcessingDeadline = DefaultProcessingDeadline
+	}
+	if t.DebridRetryInterval <= 0 {
+		t.DebridRetryInterval = DefaultDebridRetryInterval
+	}
+	return t
 }
 
 // This seems kinda fucked idk
@@ -40,12 +699,12 @@ func InitializeAppConfig(v *viper.Viper) {
 	var conf AppConfig
 
 	if v != nil {
+		applyDefaults(v)
 		err := v.Unmarshal(&conf)
 		if err != nil {
 			panic(errors.New("Failed to unmarshal app config"))
 		}
-		confSet = true
-		appConf = conf
+		setAppConfig(conf)
 
 		return
 	}
@@ -53,6 +712,12 @@ func InitializeAppConfig(v *viper.Viper) {
 	v = viper.New()
 
 	v.SetDefault("real_debrid.mount_timeout", 600)
+	v.SetDefault("state_path", "/var/lib/blackhole")
+	v.SetDefault("repair.action", "readd")
+	v.SetDefault("repair.check_readable", true)
+	v.SetDefault("log.level", "info")
+	v.SetDefault("log.format", "pretty")
+	v.SetDefault("log.color", "auto")
 
 	v.SetConfigName("blackhole")
 	v.SetConfigType("yaml")
@@ -64,20 +729,79 @@ func InitializeAppConfig(v *viper.Viper) {
 	v.AutomaticEnv()
 	v.BindEnv("real_debrid.url", "DEBRID_URL")
 
+	applyDefaults(v)
 	err := v.Unmarshal(&conf)
 	if err != nil {
 		panic(errors.New("Failed to unmarshal app config"))
 	}
 
+	setAppConfig(conf)
+
+	validateAppConfig(conf)
+}
+
+func setAppConfig(conf AppConfig) {
+	confMu.Lock()
+	defer confMu.Unlock()
+
 	confSet = true
 	appConf = conf
+}
+
+// applyDefaults puts the `defaults` block under every *arr instance. Anything
+// set on the instance wins, blocks such as `timings` are merged key by key.
+func applyDefaults(v *viper.Viper) {
+	defaults, ok := v.Get("defaults").(map[string]any)
+	if !ok {
+		return
+	}
+
+	for _, service := range []string{"sonarr", "radarr"} {
+		var instances []map[string]any
+		switch raw := v.Get(service).(type) {
+		case []map[string]any:
+			instances = raw
+		case []any:
+			for _, instance := range raw {
+				if m, ok := instance.(map[string]any); ok {
+					instances = append(instances, m)
+				}
+			}
+		}
+		if len(instances) == 0 {
+			continue
+		}
+
+		merged := []map[string]any{}
+		for _, instance := range instances {
+			merged = append(merged, mergeDefaults(instance, defaults))
+		}
+		v.Set(service, merged)
+	}
+}
+
+func mergeDefaults(instance map[string]any, defaults map[string]any) map[string]any {
+	merged := map[string]any{}
+	for k, v := range defaults {
+		merged[k] = v
+	}
+
+	for k, v := range instance {
+		instanceBlock, instanceOk := v.(map[string]any)
+		defaultBlock, defaultOk := merged[k].(map[string]any)
+		if instanceOk && defaultOk {
+			merged[k] = mergeDefaults(instanceBlock, defaultBlock)
+			continue
+		}
+		merged[k] = v
+	}
 
-	validateAppConfig()
+	return merged
 }
 
 func InitializeSecrets(v *viper.Viper) {
 	if v != nil {
-		secretsSet = true
+		setSecrets(v)
 		return
 	}
 
@@ -89,27 +813,44 @@ func InitializeSecrets(v *viper.Viper) {
 
 	v.AutomaticEnv()
 
+	setSecrets(v)
+}
+
+func setSecrets(v *viper.Viper) {
+	confMu.Lock()
+	defer confMu.Unlock()
+
 	secretsSet = true
 	appSecrets = v
 }
 
 func GetSecrets() *viper.Viper {
-	if !secretsSet {
+	confMu.RLock()
+	set, secrets := secretsSet, appSecrets
+	confMu.RUnlock()
+
+	if !set {
 		InitializeSecrets(nil)
+		return GetSecrets()
 	}
 
-	return appSecrets
+	return secrets
 }
 
 func GetAppConfig() AppConfig {
-	if !confSet {
+	confMu.RLock()
+	set, conf := confSet, appConf
+	confMu.RUnlock()
+
+	if !set {
 		InitializeAppConfig(nil)
+		return GetAppConfig()
 	}
 
-	return appConf
+	return conf
 }
 
-func validateAppConfig() {
+func validateAppConfig(appConf AppConfig) {
 	_, err := url.ParseRequestURI(appConf.RealDebrid.Url)
 	if err != nil {
 		panic(errors.New("Invalid URL for Real Debrid"))
@@ -119,12 +860,145 @@ func validateAppConfig() {
 		panic(errors.New(fmt.Sprintf("Invalid path for Real Debrid watch: %s", appConf.RealDebrid.WatchPatch)))
 	}
 
+	if !validWatcher(appConf.RealDebrid.Watcher) {
+		panic(errors.New(fmt.Sprintf("Invalid watcher for Real Debrid: %s", appConf.RealDebrid.Watcher)))
+	}
+
+	// A missing key is fine, the token from `blackhole auth` may be used instead
+	if _, err := appConf.RealDebrid.Keys.resolve("DEBRID_API_KEY"); err != nil {
+		panic(errors.New(fmt.Sprintf("Unable to read API key for Real Debrid: %s", err)))
+	}
+
+	seenAccounts := map[string]bool{}
+	for _, v := range appConf.DebridAccounts {
+		if v.Name == "" || seenAccounts[v.Name] {
+			panic(errors.New(fmt.Sprintf("Debrid accounts need a unique name: %s", v.Name)))
+		}
+		seenAccounts[v.Name] = true
+
+		if !validProvider(v.Provider) {
+			panic(errors.New(fmt.Sprintf("Invalid provider for debrid account %s: %s", v.Name, v.Provider)))
+		}
+
+		if !validWatcher(v.Watcher) {
+			panic(errors.New(fmt.Sprintf("Invalid watcher for debrid account %s: %s", v.Name, v.Watcher)))
+		}
+
+		// Real-Debrid's URL would be inherited otherwise
+		if v.Provider == ProviderTorBox && v.Url == "" {
+			panic(errors.New(fmt.Sprintf("No URL for TorBox debrid account: %s", v.Name)))
+		}
+
+		conf, _ := appConf.DebridAccount(v.Name)
+		if _, err := url.ParseRequestURI(conf.Url); err != nil {
+			panic(errors.New(fmt.Sprintf("Invalid URL for debrid account: %s", v.Name)))
+		}
+
+		if _, err := os.Stat(conf.WatchPatch); err != nil {
+			panic(errors.New(fmt.Sprintf("Invalid path for debrid account watch: %s", v.Name)))
+		}
+
+		if key, err := conf.Keys.resolve(conf.fallbackKey()); err != nil {
+			panic(errors.New(fmt.Sprintf("Unable to read API key for debrid account %s: %s", v.Name, err)))
+		} else if key == "" {
+			panic(errors.New(fmt.Sprintf("No API key for debrid account: %s", v.Name)))
+		}
+	}
+
+	if appConf.Rclone.Url != "" {
+		if _, err := url.ParseRequestURI(appConf.Rclone.Url); err != nil {
+			panic(errors.New("Invalid URL for rclone"))
+		}
+	}
+
+	if err := os.MkdirAll(appConf.StatePath, os.ModePerm); err != nil {
+		panic(errors.New(fmt.Sprintf("Unable to create state directory: %s", appConf.StatePath)))
+	}
+
+	if !validLogLevel(appConf.Log.Level) {
+		panic(errors.New(fmt.Sprintf("Invalid log level: %s", appConf.Log.Level)))
+	}
+
+	if !validLogFormat(appConf.Log.Format) {
+		panic(errors.New(fmt.Sprintf("Invalid log format: %s", appConf.Log.Format)))
+	}
+
+	if !validLogColor(appConf.Log.Color) {
+		panic(errors.New(fmt.Sprintf("Invalid log color: %s", appConf.Log.Color)))
+	}
+
+	for _, v := range appConf.Notifications {
+		if !validNotifierType(v.Type) {
+			panic(errors.New(fmt.Sprintf("Invalid type for notifier: %s", v.Name)))
+		}
+
+		if _, err := url.ParseRequestURI(v.Url); err != nil {
+			panic(errors.New(fmt.Sprintf("Invalid URL for notifier: %s", v.Name)))
+		}
+
+		for _, event := range v.Events {
+			if !validNotifyEvent(event) {
+				panic(errors.New(fmt.Sprintf("Invalid event for notifier %s: %s", v.Name, event)))
+			}
+		}
+	}
+
+	for _, v := range appConf.MediaServers {
+		if !validMediaServerType(v.Type) {
+			panic(errors.New(fmt.Sprintf("Invalid type for media server: %s", v.Name)))
+		}
+
+		if _, err := url.ParseRequestURI(v.Url); err != nil {
+			panic(errors.New(fmt.Sprintf("Invalid URL for media server: %s", v.Name)))
+		}
+
+		if key, err := v.Keys.resolve(v.fallbackKey()); err != nil {
+			panic(errors.New(fmt.Sprintf("Unable to read token for media server %s: %s", v.Name, err)))
+		} else if key == "" {
+			panic(errors.New(fmt.Sprintf("No token for media server: %s", v.Name)))
+		}
+	}
+
+	if appConf.Repair.Action != "readd" && appConf.Repair.Action != "research" {
+		panic(errors.New(fmt.Sprintf("Invalid repair action: %s", appConf.Repair.Action)))
+	}
+
+	for _, pattern := range appConf.Housekeeping.Allowlist {
+		if _, err := path.Match(pattern, ""); err != nil {
+			panic(errors.New(fmt.Sprintf("Invalid housekeeping allowlist pattern: %s", pattern)))
+		}
+	}
+
 	for _, v := range appConf.Sonarr {
 		_, err = url.ParseRequestURI(v.Url)
 		if err != nil {
 			panic(errors.New(fmt.Sprintf("Invalid URL for Sonarr: %s", v.Name)))
 		}
 
+		if !validLinkStrategy(v.LinkStrategy) {
+			panic(errors.New(fmt.Sprintf("Invalid link strategy for Sonarr: %s", v.Name)))
+		}
+
+		if !validWatcher(v.Watcher) {
+			panic(errors.New(fmt.Sprintf("Invalid watcher for Sonarr: %s", v.Name)))
+		}
+
+		if !validUncached(v.Uncached) {
+			panic(errors.New(fmt.Sprintf("Invalid uncached policy for Sonarr: %s", v.Name)))
+		}
+
+		validateRoutes(appConf, "Sonarr", v)
+
+		if !validSeasonPacks(v.SeasonPacks) {
+			panic(errors.New(fmt.Sprintf("Invalid season pack policy for Sonarr: %s", v.Name)))
+		}
+
+		if key, err := v.Keys.resolve(v.fallbackKey()); err != nil {
+			panic(errors.New(fmt.Sprintf("Unable to read API key for Sonarr %s: %s", v.Name, err)))
+		} else if key == "" {
+			panic(errors.New(fmt.Sprintf("No API key for Sonarr: %s", v.Name)))
+		}
+
 		if _, err := os.Stat(v.CompletedPath); err != nil {
 			panic(errors.New(fmt.Sprintf("Invalid path for Sonarr completed: %s", v.Name)))
 		}
@@ -140,6 +1014,30 @@ func validateAppConfig() {
 			panic(errors.New(fmt.Sprintf("Invalid URL for Radarr: %s", v.Name)))
 		}
 
+		if !validLinkStrategy(v.LinkStrategy) {
+			panic(errors.New(fmt.Sprintf("Invalid link strategy for Radarr: %s", v.Name)))
+		}
+
+		if !validWatcher(v.Watcher) {
+			panic(errors.New(fmt.Sprintf("Invalid watcher for Radarr: %s", v.Name)))
+		}
+
+		if !validUncached(v.Uncached) {
+			panic(errors.New(fmt.Sprintf("Invalid uncached policy for Radarr: %s", v.Name)))
+		}
+
+		validateRoutes(appConf, "Radarr", v)
+
+		if !validSeasonPacks(v.SeasonPacks) {
+			panic(errors.New(fmt.Sprintf("Invalid season pack policy for Radarr: %s", v.Name)))
+		}
+
+		if key, err := v.Keys.resolve(v.fallbackKey()); err != nil {
+			panic(errors.New(fmt.Sprintf("Unable to read API key for Radarr %s: %s", v.Name, err)))
+		} else if key == "" {
+			panic(errors.New(fmt.Sprintf("No API key for Radarr: %s", v.Name)))
+		}
+
 		if _, err := os.Stat(v.CompletedPath); err != nil {
 			panic(errors.New(fmt.Sprintf("Invalid path for Radarr completed: %s", v.Name)))
 		}
@@ -149,3 +1047,89 @@ func validateAppConfig() {
 		}
 	}
 }
+
+func validLinkStrategy(strategy string) bool {
+	return strategy == "" || validName(LinkStrategies, strategy)
+}
+
+func validateRoutes(appConf AppConfig, service string, v ArrConfig) {
+	if _, ok := appConf.DebridAccount(v.DebridAccount); !ok {
+		panic(errors.New(fmt.Sprintf("Unknown debrid account for %s %s: %s", service, v.Name, v.DebridAccount)))
+	}
+
+	for i, r := range v.Routes {
+		if r.Subfolder == "" && r.Pattern == "" {
+			panic(errors.New(fmt.Sprintf("Route %d for %s %s needs a subfolder or pattern", i, service, v.Name)))
+		}
+
+		if _, err := path.Match(r.Pattern, ""); err != nil {
+			panic(errors.New(fmt.Sprintf("Invalid pattern for %s %s route: %s", service, v.Name, r.Pattern)))
+		}
+
+		if _, ok := appConf.DebridAccount(r.Account); !ok {
+			panic(errors.New(fmt.Sprintf("Unknown debrid account for %s %s route: %s", service, v.Name, r.Account)))
+		}
+
+		if !validLinkStrategy(r.LinkStrategy) {
+			panic(errors.New(fmt.Sprintf("Invalid link strategy for %s %s route: %s", service, v.Name, r.LinkStrategy)))
+		}
+
+		if r.CompletedPath != "" {
+			if _, err := os.Stat(r.CompletedPath); err != nil {
+				panic(errors.New(fmt.Sprintf("Invalid completed path for %s %s route: %s", service, v.Name, r.CompletedPath)))
+			}
+		}
+	}
+}
+
+func validUncached(policy string) bool {
+	switch policy {
+	case "", "fail", "wait":
+		return true
+	}
+	return false
+}
+
+func validSeasonPacks(policy string) bool {
+	switch policy {
+	case "", "research", "fail":
+		return true
+	}
+	return false
+}
+
+func validWatcher(backend string) bool {
+	return backend == "" || validName(Watchers, backend)
+}
+
+func validProvider(provider string) bool {
+	switch provider {
+	case "", ProviderRealDebrid, ProviderTorBox:
+		return true
+	}
+	return false
+}
+
+func validNotifierType(notifierType string) bool {
+	return validName(NotifierTypes, notifierType)
+}
+
+func validMediaServerType(serverType string) bool {
+	return validName(MediaServerTypes, serverType)
+}
+
+func validNotifyEvent(event string) bool {
+	return validName(NotifyEvents, event)
+}
+
+func validLogLevel(level string) bool {
+	return level == "" || validName(LogLevels, strings.ToLower(level))
+}
+
+func validLogFormat(format string) bool {
+	return format == "" || validName(LogFormats, format)
+}
+
+func validLogColor(color string) bool {
+	return color == "" || validName(LogColors, color)
+}
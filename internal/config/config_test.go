@@ -0,0 +1,161 @@
+package config_test
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/samjwillis97/sams-blackhole/internal/config"
+	"github.com/spf13/viper"
+)
+
+func TestAPIKeySources(t *testing.T) {
+	keyFile := path.Join(t.TempDir(), "sonarr_api_key")
+	if err := os.WriteFile(keyFile, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	mockViper := viper.New()
+	mockViper.Set("sonarr", []map[string]any{
+		{"name": "inline", "api_key": "from-config"},
+		{"name": "file", "api_key_file": keyFile},
+		{"name": "env", "api_key_env": "SONARR_KEY"},
+		{"name": "fallback"},
+	})
+	mockViper.Set("real_debrid.api_key_file", keyFile)
+	config.InitializeAppConfig(mockViper)
+
+	mockSecretViper := viper.New()
+	mockSecretViper.Set("SONARR_KEY", "from-env")
+	mockSecretViper.Set("FALLBACK_API_KEY", "from-fallback")
+	mockSecretViper.Set("DEBRID_API_KEY", "unused")
+	config.InitializeSecrets(mockSecretViper)
+
+	expected := []string{"from-config", "from-file", "from-env", "from-fallback"}
+	for i, conf := range config.GetAppConfig().Sonarr {
+		if conf.APIKey() != expected[i] {
+			t.Errorf("Expected %s to have key %s, got %s", conf.Name, expected[i], conf.APIKey())
+		}
+	}
+
+	if key := config.GetAppConfig().RealDebrid.APIKey(); key != "from-file" {
+		t.Errorf("Expected the debrid key to be read from the file, got %s", key)
+	}
+}
+
+func TestAPIKeysAreRedactedInLogs(t *testing.T) {
+	mockViper := viper.New()
+	mockViper.Set("sonarr", []map[string]any{{"name": "inline", "api_key": "super-secret"}})
+	config.InitializeAppConfig(mockViper)
+	conf := config.GetAppConfig().Sonarr[0]
+
+	var out bytes.Buffer
+	for _, handler := range []slog.Handler{slog.NewTextHandler(&out, nil), slog.NewJSONHandler(&out, nil)} {
+		log := slog.New(handler)
+		log.Info("instance", "config", conf, "key", conf.Keys.Key)
+	}
+
+	if strings.Contains(out.String(), "super-secret") {
+		t.Errorf("Expected the key to be redacted, got %s", out.String())
+	}
+}
+
+func TestInstancesInheritDefaults(t *testing.T) {
+	mockViper := viper.New()
+	mockViper.Set("real_debrid.mount_timeout", 60)
+	mockViper.Set("defaults", map[string]any{
+		"uncached":     "fail",
+		"season_packs": "research",
+		"priority":     10,
+		"timings":      map[string]any{"debounce": "2s", "processing_deadline": "1m"},
+	})
+	mockViper.Set("sonarr", []map[string]any{
+		{"name": "regular"},
+		{
+			"name":          "4k",
+			"mount_timeout": 1800,
+			"uncached":      "wait",
+			"season_packs":  "fail",
+			"priority":      0,
+			"timings":       map[string]any{"processing_deadline": "2h"},
+		},
+	})
+	config.InitializeAppConfig(mockViper)
+
+	regular := config.GetAppConfig().Sonarr[0]
+	if regular.GetUncached() != "fail" || regular.GetSeasonPacks() != "research" || regular.Priority != 10 {
+		t.Errorf("Expected the defaults to be inherited, got %+v", regular)
+	}
+	if regular.GetMountTimeout() != time.Minute {
+		t.Errorf("Expected the debrid mount timeout, got %s", regular.GetMountTimeout())
+	}
+
+	uhd := config.GetAppConfig().Sonarr[1]
+	if uhd.GetUncached() != "wait" || uhd.GetSeasonPacks() != "fail" || uhd.Priority != 0 {
+		t.Errorf("Expected the instance to override the defaults, got %+v", uhd)
+	}
+	if uhd.GetMountTimeout() != 30*time.Minute {
+		t.Errorf("Expected the instance mount timeout, got %s", uhd.GetMountTimeout())
+	}
+	// Blocks are merged rather than replaced
+	timings := uhd.GetTimings()
+	if timings.Debounce != 2*time.Second || timings.ProcessingDeadline != 2*time.Hour {
+		t.Errorf("Expected the timings to be merged, got %+v", timings)
+	}
+}
+
+func TestRoutesPickAccountAndCompletedPath(t *testing.T) {
+	mockViper := viper.New()
+	mockViper.Set("real_debrid.url", "https://api.real-debrid.com/rest/1.0/")
+	mockViper.Set("real_debrid.watch_path", "/mnt/realdebrid")
+	mockViper.Set("real_debrid.retry.deadline", "5m")
+	mockViper.Set("real_debrid.watcher", "poll")
+	mockViper.Set("debrid_accounts", []map[string]any{{"name": "second", "watch_path": "/mnt/second", "watcher": "fsnotify"}})
+	mockViper.Set("sonarr", []map[string]any{{
+		"name":           "sonarr",
+		"completed_path": "/completed",
+		"link_strategy":  "symlink",
+		"debrid_account": "second",
+		"routes": []map[string]any{
+			{"subfolder": "anime", "completed_path": "/anime"},
+			{"pattern": "*.4K.*", "link_strategy": "strm"},
+		},
+	}})
+	config.InitializeAppConfig(mockViper)
+
+	mockSecretViper := viper.New()
+	mockSecretViper.Set("SECOND_DEBRID_API_KEY", "second-key")
+	config.InitializeSecrets(mockSecretViper)
+
+	conf := config.GetAppConfig().Sonarr[0]
+	cases := map[string]config.Route{
+		"Show.S01E01.magnet":            {Account: "second", CompletedPath: "/completed", LinkStrategy: "symlink"},
+		"anime/Show.S01E01.magnet":      {Account: "second", CompletedPath: "/anime", LinkStrategy: "symlink"},
+		"anime/deep/Show.S01E01.magnet": {Account: "second", CompletedPath: "/anime", LinkStrategy: "symlink"},
+		"animated/Show.S01E01.magnet":   {Account: "second", CompletedPath: "/completed", LinkStrategy: "symlink"},
+		"Show.S01E01.4k.WEB.magnet":     {Account: "second", CompletedPath: "/completed", LinkStrategy: "strm"},
+	}
+	for relPath, expected := range cases {
+		if route := conf.Route(relPath); route != expected {
+			t.Errorf("Expected %s to be routed to %+v, got %+v", relPath, expected, route)
+		}
+	}
+
+	account, ok := config.GetAppConfig().DebridAccount("second")
+	if !ok {
+		t.Fatal("Expected the second account to be found")
+	}
+	if account.Url != "https://api.real-debrid.com/rest/1.0/" || account.WatchPatch != "/mnt/second" || account.Retry.Deadline != 5*time.Minute {
+		t.Errorf("Expected the account to inherit from real_debrid, got %+v", account)
+	}
+	if account.Watcher != "fsnotify" {
+		t.Errorf("Expected the account's own watcher, got %s", account.Watcher)
+	}
+	if account.APIKey() != "second-key" {
+		t.Errorf("Expected the account's key, got %s", account.APIKey())
+	}
+}
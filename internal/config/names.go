@@ -0,0 +1,40 @@
+package config
+
+import (
+	"slices"
+	"sync"
+)
+
+// Settings that name something implemented in another package. That package
+// registers the names when it's loaded, so they're validated here without
+// config importing it.
+const (
+	LinkStrategies   = "link strategy"
+	Watchers         = "watcher"
+	NotifierTypes    = "notifier type"
+	NotifyEvents     = "notify event"
+	LogLevels        = "log level"
+	LogFormats       = "log format"
+	LogColors        = "log color"
+	MediaServerTypes = "media server type"
+)
+
+var (
+	namesMu sync.RWMutex
+	names   = map[string][]string{}
+)
+
+// RegisterNames adds to the values a setting can take
+func RegisterNames(setting string, values ...string) {
+	namesMu.Lock()
+	defer namesMu.Unlock()
+
+	names[setting] = append(names[setting], values...)
+}
+
+func validName(setting string, value string) bool {
+	namesMu.RLock()
+	defer namesMu.RUnlock()
+
+	return slices.Contains(names[setting], value)
+}
@@ -3,15 +3,20 @@ package debrid
 import (
 	"bytes"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"mime/multipart"
 	"net/http"
 	"net/url"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/samjwillis97/sams-blackhole/internal/clock"
 	"github.com/samjwillis97/sams-blackhole/internal/config"
+	"github.com/samjwillis97/sams-blackhole/internal/notify"
 )
 
 type AddTorrentResponse struct {
@@ -35,25 +40,148 @@ const (
 	Dead                              = "dead"
 )
 
+type TorrentFile struct {
+	ID       int    `json:"id"`
+	Path     string `json:"path"`
+	Bytes    int64  `json:"bytes"`
+	Selected int    `json:"selected"`
+}
+
 type GetInfoResponse struct {
-	Filename         string       `json:"filename"`
-	OriginalFilename string       `json:"original_filename"`
-	Status           DebridStatus `json:"status"`
+	ID               string        `json:"id"`
+	Filename         string        `json:"filename"`
+	OriginalFilename string        `json:"original_filename"`
+	Hash             string        `json:"hash"`
+	Status           DebridStatus  `json:"status"`
+	Files            []TorrentFile `json:"files"`
+	Links            []string      `json:"links"` // One per selected file, in the same order as `Files`
+	Added            time.Time     `json:"added"`
+}
+
+type ActiveCountResponse struct {
+	Active int `json:"nb"`
+	Limit  int `json:"limit"`
+}
+
+type UnrestrictResponse struct {
+	ID       string `json:"id"`
+	Filename string `json:"filename"`
+	Filesize int64  `json:"filesize"`
+	Download string `json:"download"`
+}
+
+// Client makes requests to one debrid account through its provider's API,
+// the package level functions use `real_debrid`
+type Client interface {
+	AddMagnet(magnetLink string) (AddTorrentResponse, error)
+	AddTorrent(filepath string) (AddTorrentResponse, error)
+	AddNZB(filepath string) (AddTorrentResponse, error)
+	SelectFiles(torrentId string, fileIds []string) error
+	GetInfo(torrentId string) (GetInfoResponse, error)
+	Remove(id string) error
+	UnrestrictLink(link string) (UnrestrictResponse, error)
+	ListTorrents(limit int) ([]GetInfoResponse, error)
+	ActiveCount() (ActiveCountResponse, error)
 }
 
-func blessRequest(r *http.Request) *http.Request {
-	r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", config.GetSecrets().GetString("DEBRID_API_KEY")))
+// For returns the client for the named account, `real_debrid` when empty
+func For(account string) Client {
+	rd := realDebrid{account: account}
+	if rd.config().GetProvider() == config.ProviderTorBox {
+		return torBox{rd}
+	}
+	return rd
+}
+
+type realDebrid struct {
+	account string
+}
+
+func (c realDebrid) config() config.DebridConfig {
+	conf, _ := config.GetAppConfig().DebridAccount(c.account)
+	return conf
+}
+
+// Only `real_debrid` can be authorized with `blackhole auth`, other accounts
+// always use their API key
+func (c realDebrid) blessRequest(r *http.Request) *http.Request {
+	token := c.config().APIKey()
+	if c.account == "" {
+		token = accessToken()
+	}
+	r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
 
 	return r
 }
 
+var (
+	client = &http.Client{}
+
+	rateLimitMu       sync.Mutex
+	lastRateLimitSent time.Time
+)
+
+const rateLimitNotifyInterval = time.Minute
+
+// do sends the request, letting anyone listening know when debrid starts
+// rate limiting. Notifications are held back to one a minute.
+func (c realDebrid) do(req *http.Request) (*http.Response, error) {
+	resp, err := client.Do(req)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized && c.account == "" {
+		resp, err = c.retryUnauthorized(req, resp)
+	}
+	if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+		return resp, err
+	}
+
+	rateLimitMu.Lock()
+	defer rateLimitMu.Unlock()
+
+	now := clock.Now()
+	if now.Sub(lastRateLimitSent) < rateLimitNotifyInterval {
+		return resp, err
+	}
+	lastRateLimitSent = now
+
+	notify.Async(slog.Default(), notify.Event{
+		Type:  notify.RateLimited,
+		Error: fmt.Sprintf("%s %s returned %d", req.Method, req.URL.Path, resp.StatusCode),
+		Time:  now,
+	})
+
+	return resp, err
+}
+
+// retryUnauthorized sends the request again once the access token has been
+// refreshed, API keys can't be refreshed so their response is kept
+func (c realDebrid) retryUnauthorized(req *http.Request, resp *http.Response) (*http.Response, error) {
+	refused := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !refreshAfterUnauthorized(refused) {
+		return resp, nil
+	}
+
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return resp, nil
+		}
+		retry.Body = body
+	} else if req.Body != nil && req.Body != http.NoBody {
+		return resp, nil
+	}
+
+	resp.Body.Close()
+	return client.Do(c.blessRequest(retry))
+}
+
 // TODO: implement retries
 // TODO: Maybe put a lock around this to ensure not too many requests at once
 // And they can all share the same retry mechanism to not overload
 
 // Contents of a magnet file contain the magnet link
-func AddMagnet(magnetLink string) (AddTorrentResponse, error) {
-	reqUrl, err := url.Parse(config.GetAppConfig().RealDebrid.Url)
+func (c realDebrid) AddMagnet(magnetLink string) (AddTorrentResponse, error) {
+	reqUrl, err := url.Parse(c.config().Url)
 	reqUrl = reqUrl.JoinPath("torrents/addMagnet")
 
 	var body bytes.Buffer
@@ -68,11 +196,10 @@ func AddMagnet(magnetLink string) (AddTorrentResponse, error) {
 		return AddTorrentResponse{}, err
 	}
 
-	req = blessRequest(req)
+	req = c.blessRequest(req)
 	req.Header.Set("Content-Type", writer.FormDataContentType())
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return AddTorrentResponse{}, err
 	}
@@ -82,7 +209,7 @@ func AddMagnet(magnetLink string) (AddTorrentResponse, error) {
 
 	if resp.StatusCode >= 300 {
 		// TODO: Trace log
-		return AddTorrentResponse{}, errors.New(fmt.Sprintf("Unable to make request response code: %d, message: %s", resp.StatusCode, string(bodyBytes)))
+		return AddTorrentResponse{}, newAPIError(resp.StatusCode, bodyBytes)
 	}
 
 	var apiResponse AddTorrentResponse
@@ -94,8 +221,8 @@ func AddMagnet(magnetLink string) (AddTorrentResponse, error) {
 	return apiResponse, nil
 }
 
-func SelectFiles(torrentId string, fileIds []string) error {
-	reqUrl, err := url.Parse(config.GetAppConfig().RealDebrid.Url)
+func (c realDebrid) SelectFiles(torrentId string, fileIds []string) error {
+	reqUrl, err := url.Parse(c.config().Url)
 	if err != nil {
 		return err
 	}
@@ -125,28 +252,27 @@ func SelectFiles(torrentId string, fileIds []string) error {
 		return err
 	}
 
-	req = blessRequest(req)
+	req = c.blessRequest(req)
 	req.Header.Set("Content-Type", writer.FormDataContentType())
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return err
 	}
 
 	defer resp.Body.Close()
-	// bodyBytes, _ := io.ReadAll(resp.Body)
+	bodyBytes, _ := io.ReadAll(resp.Body)
 
 	if resp.StatusCode >= 300 {
 		// TODO: Trace log
-		return errors.New(fmt.Sprintf("Unable to make request response code: %d", resp.StatusCode))
+		return newAPIError(resp.StatusCode, bodyBytes)
 	}
 
 	return nil
 }
 
-func GetInfo(torrentId string) (GetInfoResponse, error) {
-	url, err := url.Parse(config.GetAppConfig().RealDebrid.Url)
+func (c realDebrid) GetInfo(torrentId string) (GetInfoResponse, error) {
+	url, err := url.Parse(c.config().Url)
 	if err != nil {
 		return GetInfoResponse{}, err
 	}
@@ -157,10 +283,9 @@ func GetInfo(torrentId string) (GetInfoResponse, error) {
 		return GetInfoResponse{}, err
 	}
 
-	req = blessRequest(req)
+	req = c.blessRequest(req)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return GetInfoResponse{}, err
 	}
@@ -170,7 +295,7 @@ func GetInfo(torrentId string) (GetInfoResponse, error) {
 
 	if resp.StatusCode >= 300 {
 		// TODO: Trace log
-		return GetInfoResponse{}, errors.New(fmt.Sprintf("Unable to make request response code: %d", resp.StatusCode))
+		return GetInfoResponse{}, newAPIError(resp.StatusCode, bodyBytes)
 	}
 
 	var apiResponse GetInfoResponse
@@ -182,8 +307,8 @@ func GetInfo(torrentId string) (GetInfoResponse, error) {
 	return apiResponse, nil
 }
 
-func AddTorrent(filepath string) (AddTorrentResponse, error) {
-	url, err := url.Parse(config.GetAppConfig().RealDebrid.Url)
+func (c realDebrid) AddTorrent(filepath string) (AddTorrentResponse, error) {
+	url, err := url.Parse(c.config().Url)
 	if err != nil {
 		return AddTorrentResponse{}, err
 	}
@@ -200,24 +325,21 @@ func AddTorrent(filepath string) (AddTorrentResponse, error) {
 		return AddTorrentResponse{}, err
 	}
 
-	req = blessRequest(req)
+	req = c.blessRequest(req)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return AddTorrentResponse{}, err
 	}
 
 	defer resp.Body.Close()
+	bodyBytes, _ := io.ReadAll(resp.Body)
 
 	if resp.StatusCode >= 300 {
 		// TODO: Trace log
-		return AddTorrentResponse{}, errors.New(fmt.Sprintf("Unable to make request response code: %d", resp.StatusCode))
+		return AddTorrentResponse{}, newAPIError(resp.StatusCode, bodyBytes)
 	}
 
-	defer resp.Body.Close()
-	bodyBytes, _ := io.ReadAll(resp.Body)
-
 	var apiResponse AddTorrentResponse
 	err = json.Unmarshal(bodyBytes, &apiResponse)
 	if err != nil {
@@ -227,8 +349,13 @@ func AddTorrent(filepath string) (AddTorrentResponse, error) {
 	return apiResponse, nil
 }
 
-func Remove(id string) error {
-	url, err := url.Parse(config.GetAppConfig().RealDebrid.Url)
+// Real-Debrid only downloads from hosters and torrents
+func (c realDebrid) AddNZB(filepath string) (AddTorrentResponse, error) {
+	return AddTorrentResponse{}, ErrNoUsenet
+}
+
+func (c realDebrid) Remove(id string) error {
+	url, err := url.Parse(c.config().Url)
 	if err != nil {
 		return err
 	}
@@ -239,18 +366,173 @@ func Remove(id string) error {
 		return err
 	}
 
-	req = blessRequest(req)
+	req = c.blessRequest(req)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return err
 	}
 
+	defer resp.Body.Close()
+
 	if resp.StatusCode != 204 {
 		// TODO: Trace log
-		return errors.New(fmt.Sprintf("Failed to delete with status code: %d", resp.StatusCode))
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return newAPIError(resp.StatusCode, bodyBytes)
 	}
 
 	return nil
 }
+
+// UnrestrictLink turns a hoster link from a torrent's info into a direct
+// download link
+func (c realDebrid) UnrestrictLink(link string) (UnrestrictResponse, error) {
+	reqUrl, err := url.Parse(c.config().Url)
+	if err != nil {
+		return UnrestrictResponse{}, err
+	}
+	reqUrl = reqUrl.JoinPath("unrestrict/link")
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	err = writer.WriteField("link", link)
+	if err != nil {
+		return UnrestrictResponse{}, err
+	}
+	writer.Close()
+
+	req, err := http.NewRequest(http.MethodPost, reqUrl.String(), &body)
+	if err != nil {
+		return UnrestrictResponse{}, err
+	}
+
+	req = c.blessRequest(req)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	resp, err := c.do(req)
+	if err != nil {
+		return UnrestrictResponse{}, err
+	}
+
+	defer resp.Body.Close()
+	bodyBytes, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode >= 300 {
+		// TODO: Trace log
+		return UnrestrictResponse{}, newAPIError(resp.StatusCode, bodyBytes)
+	}
+
+	var apiResponse UnrestrictResponse
+	err = json.Unmarshal(bodyBytes, &apiResponse)
+	if err != nil {
+		return UnrestrictResponse{}, err
+	}
+
+	return apiResponse, nil
+}
+
+// ListTorrents returns the most recently added torrents on the account, the
+// entries only include summary fields such as the ID, filename and hash
+func (c realDebrid) ListTorrents(limit int) ([]GetInfoResponse, error) {
+	reqUrl, err := url.Parse(c.config().Url)
+	if err != nil {
+		return nil, err
+	}
+	reqUrl = reqUrl.JoinPath("torrents")
+	reqUrl.RawQuery = url.Values{"limit": {fmt.Sprint(limit)}}.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, reqUrl.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req = c.blessRequest(req)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+	bodyBytes, _ := io.ReadAll(resp.Body)
+
+	// No torrents on the account
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+
+	if resp.StatusCode >= 300 {
+		// TODO: Trace log
+		return nil, newAPIError(resp.StatusCode, bodyBytes)
+	}
+
+	var apiResponse []GetInfoResponse
+	err = json.Unmarshal(bodyBytes, &apiResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	return apiResponse, nil
+}
+
+// ActiveCount returns how many torrents are active on the account, out of
+// the most it may have at once
+func (c realDebrid) ActiveCount() (ActiveCountResponse, error) {
+	reqUrl, err := url.Parse(c.config().Url)
+	if err != nil {
+		return ActiveCountResponse{}, err
+	}
+	reqUrl = reqUrl.JoinPath("torrents/activeCount")
+
+	req, err := http.NewRequest(http.MethodGet, reqUrl.String(), nil)
+	if err != nil {
+		return ActiveCountResponse{}, err
+	}
+
+	req = c.blessRequest(req)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return ActiveCountResponse{}, err
+	}
+
+	defer resp.Body.Close()
+	bodyBytes, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode >= 300 {
+		return ActiveCountResponse{}, newAPIError(resp.StatusCode, bodyBytes)
+	}
+
+	var apiResponse ActiveCountResponse
+	err = json.Unmarshal(bodyBytes, &apiResponse)
+	if err != nil {
+		return ActiveCountResponse{}, err
+	}
+
+	return apiResponse, nil
+}
+
+// AddMagnet adds the magnet link to `real_debrid`
+func AddMagnet(magnetLink string) (AddTorrentResponse, error) {
+	return For("").AddMagnet(magnetLink)
+}
+
+// Remove deletes a torrent from `real_debrid`
+func Remove(id string) error {
+	return For("").Remove(id)
+}
+
+// UnrestrictLink unrestricts a hoster link with `real_debrid`
+func UnrestrictLink(link string) (UnrestrictResponse, error) {
+	return For("").UnrestrictLink(link)
+}
+
+// ListTorrents lists the torrents on `real_debrid`
+func ListTorrents(limit int) ([]GetInfoResponse, error) {
+	return For("").ListTorrents(limit)
+}
+
+// ActiveCount gets how many of `real_debrid`'s slots are in use
+func ActiveCount() (ActiveCountResponse, error) {
+	return For("").ActiveCount()
+}
@@ -0,0 +1,634 @@
+// Package debridtest provides an in-process fake of the Real-Debrid API for
+// use in tests. It also answers TorBox's Usenet API, where torrent IDs must
+// be numbers.
+package debridtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samjwillis97/sams-blackhole/internal/debrid"
+)
+
+// Torrent describes how the fake responds for a single added torrent
+type Torrent struct {
+	ID               string
+	Filename         string
+	OriginalFilename string
+	Hash             string
+
+	// Statuses are returned in order by successive info requests, the last
+	// status is repeated once exhausted
+	Statuses []debrid.DebridStatus
+
+	Files []debrid.TorrentFile
+	Links []string
+
+	// When the torrent was added, now when not set
+	Added time.Time
+}
+
+// Call is a single request received by the fake server
+type Call struct {
+	Method        string
+	Path          string
+	Body          []byte
+	Authorization string
+}
+
+// failure makes matching requests fail with the status, for as many times as
+// are left
+type failure struct {
+	method string
+	prefix string
+	status int
+	times  int
+}
+
+type torrentState struct {
+	Torrent
+	infoRequests int
+}
+
+type Server struct {
+	*httptest.Server
+
+	// When set, requests without a matching bearer token are rejected
+	APIKey string
+
+	// When set, adds are refused once this many torrents have yet to finish
+	// downloading
+	SlotLimit int
+
+	mu       sync.Mutex
+	expected []Torrent
+	torrents map[string]*torrentState
+	calls    []Call
+	added    []string
+	order    []string // Both added and seeded torrents, oldest first
+	selected []string
+	removed  []string
+	failures []*failure
+
+	// OAuth, once enabled only the current access token is accepted
+	oauth        bool
+	approved     bool
+	issued       int
+	accessToken  string
+	refreshToken string
+	refreshes    int
+}
+
+// The device flow's fixed values
+const (
+	DeviceCode   = "device-code"
+	UserCode     = "ABCDEF"
+	ClientID     = "device-client"
+	ClientSecret = "device-secret"
+)
+
+// NewServer starts a fake Real-Debrid server, it should be closed by the
+// caller
+func NewServer() *Server {
+	s := &Server{torrents: map[string]*torrentState{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /torrents/addMagnet", s.handleAdd)
+	mux.HandleFunc("PUT /torrents/addTorrent", s.handleAdd)
+	mux.HandleFunc("GET /torrents", s.handleList)
+	mux.HandleFunc("GET /torrents/activeCount", s.handleActiveCount)
+	mux.HandleFunc("GET /torrents/info/{id}", s.handleInfo)
+	mux.HandleFunc("POST /torrents/selectFiles/{id}", s.handleSelectFiles)
+	mux.HandleFunc("DELETE /torrents/delete/{id}", s.handleDelete)
+	mux.HandleFunc("POST /unrestrict/link", s.handleUnrestrict)
+	mux.HandleFunc("POST /usenet/createusenetdownload", s.handleCreateUsenet)
+	mux.HandleFunc("GET /usenet/mylist", s.handleUsenetList)
+	mux.HandleFunc("POST /usenet/controlusenetdownload", s.handleControlUsenet)
+	mux.HandleFunc("GET /oauth/v2/device/code", s.handleDeviceCode)
+	mux.HandleFunc("GET /oauth/v2/device/credentials", s.handleDeviceCredentials)
+	mux.HandleFunc("POST /oauth/v2/token", s.handleToken)
+
+	s.Server = httptest.NewServer(s.record(mux))
+
+	return s
+}
+
+// Expect queues a torrent to be returned by the next add request, torrents
+// are handed out in the order they are expected
+func (s *Server) Expect(t Torrent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expected = append(s.expected, t)
+}
+
+// Seed adds a torrent as though it had been added before the test started
+func (s *Server) Seed(t Torrent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t.Added.IsZero() {
+		t.Added = time.Now()
+	}
+	s.torrents[t.ID] = &torrentState{Torrent: t}
+	s.order = append(s.order, t.ID)
+}
+
+// Fail makes the next requests with the method whose path starts with the
+// prefix fail with the status, a negative number of times fails them forever
+func (s *Server) Fail(method string, prefix string, status int, times int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, &failure{method: method, prefix: prefix, status: status, times: times})
+}
+
+// Calls returns every request received so far, in order
+func (s *Server) Calls() []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Call{}, s.calls...)
+}
+
+// Added returns the IDs of torrents that have been added
+func (s *Server) Added() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.added...)
+}
+
+// Selected returns the IDs of torrents that have had files selected
+func (s *Server) Selected() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.selected...)
+}
+
+// Removed returns the IDs of torrents that have been deleted
+func (s *Server) Removed() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.removed...)
+}
+
+func (s *Server) record(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(strings.NewReader(string(body)))
+
+		s.mu.Lock()
+		s.calls = append(s.calls, Call{
+			Method:        r.Method,
+			Path:          r.URL.Path,
+			Body:          body,
+			Authorization: r.Header.Get("Authorization"),
+		})
+		status := s.takeFailure(r)
+		s.mu.Unlock()
+
+		if status != 0 {
+			writeError(w, status, "injected failure", -1)
+			return
+		}
+
+		if !strings.HasPrefix(r.URL.Path, "/oauth/") && !s.authorized(r) {
+			writeError(w, http.StatusUnauthorized, "bad_token", 8)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// takeFailure returns the status to fail the request with, zero when it
+// should succeed. The lock must be held.
+func (s *Server) takeFailure(r *http.Request) int {
+	for _, f := range s.failures {
+		if f.times == 0 || f.method != r.Method || !strings.HasPrefix(r.URL.Path, f.prefix) {
+			continue
+		}
+		if f.times > 0 {
+			f.times--
+		}
+		return f.status
+	}
+	return 0
+}
+
+func (s *Server) handleAdd(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.SlotLimit > 0 && s.active() >= s.SlotLimit {
+		writeError(w, 509, "too_many_active_downloads", 21)
+		return
+	}
+
+	t, ok := s.takeExpected()
+	if !ok {
+		writeError(w, http.StatusServiceUnavailable, "no torrent expected", -1)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, debrid.AddTorrentResponse{
+		ID:  t.ID,
+		URI: fmt.Sprintf("%s/torrents/info/%s", s.URL, t.ID),
+	})
+}
+
+// takeExpected adds the next expected torrent. The lock must be held.
+func (s *Server) takeExpected() (Torrent, bool) {
+	if len(s.expected) == 0 {
+		return Torrent{}, false
+	}
+
+	t := s.expected[0]
+	s.expected = s.expected[1:]
+	if t.Added.IsZero() {
+		t.Added = time.Now()
+	}
+
+	s.torrents[t.ID] = &torrentState{Torrent: t}
+	s.added = append(s.added, t.ID)
+	s.order = append(s.order, t.ID)
+
+	return t, true
+}
+
+// Torrents are listed newest first like the real API
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := []debrid.GetInfoResponse{}
+	for i := len(s.order) - 1; i >= 0; i-- {
+		t, ok := s.torrents[s.order[i]]
+		if !ok {
+			continue
+		}
+		list = append(list, debrid.GetInfoResponse{
+			ID:       t.ID,
+			Filename: t.Filename,
+			Hash:     t.Hash,
+			Status:   t.status(),
+			Links:    t.Links,
+			Added:    t.Added,
+		})
+	}
+
+	if len(list) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) handleInfo(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.torrents[r.PathValue("id")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown_ressource", 7)
+		return
+	}
+
+	status := t.status()
+	t.infoRequests++
+
+	writeJSON(w, http.StatusOK, debrid.GetInfoResponse{
+		ID:               t.ID,
+		Filename:         t.Filename,
+		OriginalFilename: t.OriginalFilename,
+		Hash:             t.Hash,
+		Status:           status,
+		Files:            t.Files,
+		Links:            t.Links,
+	})
+}
+
+// status is what the next info request returns
+func (t *torrentState) status() debrid.DebridStatus {
+	if len(t.Statuses) == 0 {
+		return debrid.Downloaded
+	}
+	return t.Statuses[min(t.infoRequests, len(t.Statuses)-1)]
+}
+
+// active counts the torrents that have yet to finish downloading. The lock
+// must be held.
+func (s *Server) active() int {
+	count := 0
+	for _, t := range s.torrents {
+		if t.status() != debrid.Downloaded {
+			count++
+		}
+	}
+	return count
+}
+
+// SetStatuses replaces the statuses of a torrent, such as to have it finish
+func (s *Server) SetStatuses(id string, statuses ...debrid.DebridStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.torrents[id]; ok {
+		t.Statuses = statuses
+		t.infoRequests = 0
+	}
+}
+
+func (s *Server) handleActiveCount(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, debrid.ActiveCountResponse{Active: s.active(), Limit: s.SlotLimit})
+}
+
+func (s *Server) handleSelectFiles(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := r.PathValue("id")
+	if _, ok := s.torrents[id]; !ok {
+		writeError(w, http.StatusNotFound, "unknown_ressource", 7)
+		return
+	}
+
+	s.selected = append(s.selected, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := r.PathValue("id")
+	if _, ok := s.torrents[id]; !ok {
+		writeError(w, http.StatusNotFound, "unknown_ressource", 7)
+		return
+	}
+
+	delete(s.torrents, id)
+	s.removed = append(s.removed, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Unrestricted links point back at the fake under `/download/`
+func (s *Server) handleUnrestrict(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		writeError(w, http.StatusBadRequest, "parameter_missing", 1)
+		return
+	}
+
+	link := r.FormValue("link")
+	if link == "" {
+		writeError(w, http.StatusBadRequest, "parameter_missing", 1)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, debrid.UnrestrictResponse{
+		ID:       link,
+		Filename: path.Base(link),
+		Download: fmt.Sprintf("%s/download/%s", s.URL, url.PathEscape(path.Base(link))),
+	})
+}
+
+func (s *Server) handleCreateUsenet(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		writeError(w, http.StatusBadRequest, "BAD_REQUEST", -1)
+		return
+	}
+	if _, _, err := r.FormFile("file"); err != nil {
+		writeError(w, http.StatusBadRequest, "NO_FILE", -1)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.takeExpected()
+	if !ok {
+		writeError(w, http.StatusServiceUnavailable, "no download expected", -1)
+		return
+	}
+
+	id, _ := strconv.Atoi(t.ID)
+	writeTorBox(w, map[string]any{"usenetdownload_id": id, "hash": t.Hash})
+}
+
+func (s *Server) handleUsenetList(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id := r.URL.Query().Get("id"); id != "" {
+		t, ok := s.torrents[id]
+		if !ok {
+			writeError(w, http.StatusNotFound, "DOWNLOAD_NOT_FOUND", -1)
+			return
+		}
+
+		status := t.status()
+		t.infoRequests++
+		writeTorBox(w, usenetDownload(t, status))
+		return
+	}
+
+	list := []map[string]any{}
+	for i := len(s.order) - 1; i >= 0; i-- {
+		if t, ok := s.torrents[s.order[i]]; ok {
+			list = append(list, usenetDownload(t, t.status()))
+		}
+	}
+	writeTorBox(w, list)
+}
+
+func (s *Server) handleControlUsenet(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		ID        int    `json:"usenet_id"`
+		Operation string `json:"operation"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Operation != "delete" {
+		writeError(w, http.StatusBadRequest, "BAD_REQUEST", -1)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := strconv.Itoa(body.ID)
+	if _, ok := s.torrents[id]; !ok {
+		writeError(w, http.StatusNotFound, "DOWNLOAD_NOT_FOUND", -1)
+		return
+	}
+
+	delete(s.torrents, id)
+	s.removed = append(s.removed, id)
+	writeTorBox(w, nil)
+}
+
+// usenetDownload is how TorBox describes a download with the status
+func usenetDownload(t *torrentState, status debrid.DebridStatus) map[string]any {
+	id, _ := strconv.Atoi(t.ID)
+	state := map[debrid.DebridStatus]string{
+		debrid.Downloaded: "completed",
+		debrid.Queued:     "queued",
+		debrid.Error:      "failed",
+	}[status]
+	if state == "" {
+		state = "downloading"
+	}
+
+	files := []map[string]any{}
+	for _, f := range t.Files {
+		files = append(files, map[string]any{"id": f.ID, "short_name": strings.TrimPrefix(f.Path, "/"), "size": f.Bytes})
+	}
+
+	return map[string]any{
+		"id":                id,
+		"hash":              t.Hash,
+		"name":              t.Filename,
+		"download_state":    state,
+		"download_finished": status == debrid.Downloaded,
+		"download_present":  status == debrid.Downloaded,
+		"created_at":        t.Added,
+		"files":             files,
+	}
+}
+
+func writeTorBox(w http.ResponseWriter, data any) {
+	writeJSON(w, http.StatusOK, map[string]any{"success": true, "detail": "", "data": data})
+}
+
+func writeError(w http.ResponseWriter, status int, message string, code int) {
+	writeJSON(w, status, map[string]any{
+		"error":      message,
+		"error_code": code,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	provided := r.Header.Get("Authorization")
+	if s.oauth {
+		return s.accessToken != "" && provided == fmt.Sprintf("Bearer %s", s.accessToken)
+	}
+	return s.APIKey == "" || provided == fmt.Sprintf("Bearer %s", s.APIKey)
+}
+
+// EnableOAuth only accepts access tokens issued through the device flow
+func (s *Server) EnableOAuth() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.oauth = true
+}
+
+// ApproveDevice acts as the user entering the code, until then the device
+// credentials are withheld
+func (s *Server) ApproveDevice() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.approved = true
+}
+
+// ExpireAccessToken stops accepting the current access token, the refresh
+// token can still be used for a new one
+func (s *Server) ExpireAccessToken() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accessToken = ""
+}
+
+// Refreshes returns how many times an access token has been refreshed
+func (s *Server) Refreshes() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.refreshes
+}
+
+func (s *Server) handleDeviceCode(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("client_id") == "" {
+		writeError(w, http.StatusBadRequest, "parameter_missing", 1)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"device_code":      DeviceCode,
+		"user_code":        UserCode,
+		"interval":         1,
+		"expires_in":       600,
+		"verification_url": fmt.Sprintf("%s/device", s.URL),
+	})
+}
+
+func (s *Server) handleDeviceCredentials(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.URL.Query().Get("code") != DeviceCode {
+		writeError(w, http.StatusBadRequest, "bad_device_code", 1)
+		return
+	}
+	if !s.approved {
+		writeError(w, http.StatusForbidden, "authorization_pending", 9)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"client_id": ClientID, "client_secret": ClientSecret})
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "parameter_missing", 1)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.PostForm.Get("client_id") != ClientID || r.PostForm.Get("client_secret") != ClientSecret {
+		writeError(w, http.StatusForbidden, "bad_client", 9)
+		return
+	}
+
+	code := r.PostForm.Get("code")
+	switch {
+	case code == DeviceCode && s.approved && s.refreshToken == "":
+	case code != "" && code == s.refreshToken:
+		s.refreshes++
+	default:
+		writeError(w, http.StatusForbidden, "bad_code", 9)
+		return
+	}
+
+	s.issued++
+	s.accessToken = fmt.Sprintf("access-%d", s.issued)
+	s.refreshToken = fmt.Sprintf("refresh-%d", s.issued)
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token":  s.accessToken,
+		"expires_in":    3600,
+		"token_type":    "Bearer",
+		"refresh_token": s.refreshToken,
+	})
+}
@@ -0,0 +1,85 @@
+package debrid
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// ErrorClass groups failures by whether and how they are worth retrying
+type ErrorClass string
+
+const (
+	Permanent   ErrorClass = "permanent"    // Retrying won't help, such as a bad magnet or an unknown torrent
+	Network     ErrorClass = "network"      // The request didn't get a response
+	RateLimited ErrorClass = "rate_limited" // Debrid wants fewer requests
+	ServerError ErrorClass = "server"       // Debrid failed on its end
+	SlotsFull   ErrorClass = "slots_full"   // Every active torrent slot on the account is in use
+)
+
+// ErrNoUsenet is returned for NZBs sent to an account that can't download
+// them, the release is fine and only needs routing elsewhere
+var ErrNoUsenet = errors.New("Real-Debrid doesn't support Usenet, route NZBs to another provider")
+
+// Real-Debrid's `error_code` for an account with too many active torrents
+const tooManyActiveDownloads = 21
+
+// APIError is a response from debrid that wasn't a success
+type APIError struct {
+	StatusCode int
+	Code       int    // Real-Debrid's `error_code`, when it sent one
+	Message    string // Real-Debrid's `error`, or the body when it isn't JSON
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("Unable to make request response code: %d, message: %s", e.StatusCode, e.Message)
+}
+
+func newAPIError(statusCode int, body []byte) *APIError {
+	e := &APIError{StatusCode: statusCode, Message: string(body)}
+
+	var parsed struct {
+		Error     string `json:"error"`
+		ErrorCode int    `json:"error_code"`
+	}
+	if err := json.Unmarshal(body, &parsed); err == nil && parsed.Error != "" {
+		e.Message = parsed.Error
+		e.Code = parsed.ErrorCode
+	}
+
+	return e
+}
+
+// Classify decides what kind of failure an error from this package is,
+// anything not recognised is permanent
+func Classify(err error) ErrorClass {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		switch {
+		case apiErr.Code == tooManyActiveDownloads || apiErr.StatusCode == 509:
+			return SlotsFull
+		case apiErr.StatusCode == http.StatusTooManyRequests:
+			return RateLimited
+		case apiErr.StatusCode >= 500:
+			return ServerError
+		}
+		return Permanent
+	}
+
+	var urlErr *url.Error
+	var netErr net.Error
+	if errors.As(err, &urlErr) || errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return Network
+	}
+
+	return Permanent
+}
+
+// IsTransient reports whether the failure may go away by itself
+func IsTransient(err error) bool {
+	return err != nil && Classify(err) != Permanent
+}
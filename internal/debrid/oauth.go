@@ -0,0 +1,354 @@
+package debrid
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samjwillis97/sams-blackhole/internal/clock"
+	"github.com/samjwillis97/sams-blackhole/internal/config"
+)
+
+const (
+	tokenFilename   = "debrid_token.json"
+	deviceGrantType = "http://oauth.net/grant_type/device/1.0"
+
+	// Access tokens are refreshed this long before they expire
+	refreshMargin = time.Minute
+)
+
+// Token is what the device code flow leaves behind, it is kept under the
+// state path and used in place of the API key once it exists
+type Token struct {
+	ClientID     string    `json:"clientId"`
+	ClientSecret string    `json:"clientSecret"`
+	AccessToken  string    `json:"accessToken"`
+	RefreshToken string    `json:"refreshToken"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+}
+
+// DeviceCode is what the user needs to approve blackhole on their account
+type DeviceCode struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	Interval        int    `json:"interval"`   // Seconds to wait between checks for approval
+	ExpiresIn       int    `json:"expires_in"` // Seconds until the code can no longer be approved
+	VerificationURL string `json:"verification_url"`
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+var (
+	tokenMu sync.Mutex
+	// The token is read once per state path, tests change it between runs
+	tokenLoadedFrom string
+	token           *Token
+	// Set while the access token is being refreshed, anything else needing it
+	// refreshed waits on this one
+	refreshing *tokenRefresh
+)
+
+type tokenRefresh struct {
+	done chan struct{}
+	err  error
+}
+
+// RequestDeviceCode starts the device code flow
+func RequestDeviceCode() (DeviceCode, error) {
+	reqUrl, err := oauthUrl("device/code")
+	if err != nil {
+		return DeviceCode{}, err
+	}
+	reqUrl.RawQuery = url.Values{
+		"client_id":       {config.GetAppConfig().RealDebrid.GetClientID()},
+		"new_credentials": {"yes"},
+	}.Encode()
+
+	var code DeviceCode
+	err = oauthRequest(http.MethodGet, reqUrl, nil, &code)
+	return code, err
+}
+
+// Authorize waits for the user to approve the device code, then exchanges it
+// for a token which is saved for every request after
+func Authorize(code DeviceCode) (Token, error) {
+	clientID, clientSecret, err := waitForCredentials(code)
+	if err != nil {
+		return Token{}, err
+	}
+
+	t, err := requestToken(clientID, clientSecret, code.DeviceCode)
+	if err != nil {
+		return Token{}, err
+	}
+
+	tokenMu.Lock()
+	defer tokenMu.Unlock()
+	if err := saveToken(t); err != nil {
+		return Token{}, err
+	}
+	return t, nil
+}
+
+// waitForCredentials checks for approval until the code expires, the
+// credentials are withheld until then
+func waitForCredentials(code DeviceCode) (string, string, error) {
+	reqUrl, err := oauthUrl("device/credentials")
+	if err != nil {
+		return "", "", err
+	}
+	reqUrl.RawQuery = url.Values{
+		"client_id": {config.GetAppConfig().RealDebrid.GetClientID()},
+		"code":      {code.DeviceCode},
+	}.Encode()
+
+	interval := time.Duration(max(code.Interval, 1)) * time.Second
+	deadline := clock.Now().Add(time.Duration(code.ExpiresIn) * time.Second)
+	for {
+		var credentials struct {
+			ClientID     string `json:"client_id"`
+			ClientSecret string `json:"client_secret"`
+		}
+		err := oauthRequest(http.MethodGet, reqUrl, nil, &credentials)
+		if err == nil && credentials.ClientSecret != "" {
+			return credentials.ClientID, credentials.ClientSecret, nil
+		}
+		if err != nil && !IsTransient(err) && !isPending(err) {
+			return "", "", err
+		}
+
+		if clock.Now().Add(interval).After(deadline) {
+			return "", "", errors.New("Device code expired before it was approved")
+		}
+		clock.Sleep(interval)
+	}
+}
+
+// isPending reports whether debrid is still waiting on the user
+func isPending(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusForbidden
+}
+
+// requestToken exchanges either the device code or a refresh token for a new
+// access token
+func requestToken(clientID string, clientSecret string, code string) (Token, error) {
+	reqUrl, err := oauthUrl("token")
+	if err != nil {
+		return Token{}, err
+	}
+
+	form := url.Values{
+		"client_id":     {clientID},
+		"client_secret": {clientSecret},
+		"code":          {code},
+		"grant_type":    {deviceGrantType},
+	}
+
+	var resp tokenResponse
+	if err := oauthRequest(http.MethodPost, reqUrl, form, &resp); err != nil {
+		return Token{}, err
+	}
+
+	return Token{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		AccessToken:  resp.AccessToken,
+		RefreshToken: resp.RefreshToken,
+		ExpiresAt:    clock.Now().Add(time.Duration(resp.ExpiresIn) * time.Second),
+	}, nil
+}
+
+func oauthUrl(endpoint string) (*url.URL, error) {
+	reqUrl, err := url.Parse(config.GetAppConfig().RealDebrid.GetOAuthUrl())
+	if err != nil {
+		return nil, err
+	}
+	return reqUrl.JoinPath(endpoint), nil
+}
+
+// oauthRequest sends the form, if any, and decodes the response into out. The
+// OAuth endpoints don't take the bearer token.
+func oauthRequest(method string, reqUrl *url.URL, form url.Values, out any) error {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+
+	req, err := http.NewRequest(method, reqUrl.String(), body)
+	if err != nil {
+		return err
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	bodyBytes, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode >= 300 {
+		return newAPIError(resp.StatusCode, bodyBytes)
+	}
+
+	return json.Unmarshal(bodyBytes, out)
+}
+
+// accessToken returns the token requests are made with, the OAuth access
+// token when blackhole has been authorized and the API key otherwise
+func accessToken() string {
+	tokenMu.Lock()
+	defer tokenMu.Unlock()
+
+	t := loadToken()
+	if t == nil {
+		return config.GetAppConfig().RealDebrid.APIKey()
+	}
+
+	if clock.Now().Add(refreshMargin).After(t.ExpiresAt) {
+		if err := refreshToken(); err != nil {
+			slog.Default().Warn("failed to refresh debrid access token", "err", err)
+		}
+	}
+	return token.AccessToken
+}
+
+// refreshAfterUnauthorized refreshes the access token once it has been
+// refused, unless another request already has. It reports whether there is a
+// new token to try.
+func refreshAfterUnauthorized(refused string) bool {
+	tokenMu.Lock()
+	defer tokenMu.Unlock()
+
+	if loadToken() == nil {
+		return false
+	}
+	if token.AccessToken != refused {
+		return true
+	}
+
+	if err := refreshToken(); err != nil {
+		slog.Default().Warn("failed to refresh debrid access token", "err", err)
+		return false
+	}
+	return true
+}
+
+// refreshToken swaps the refresh token for a new access token. The lock must
+// be held and the token loaded, it is let go of while debrid is asked so
+// requests that don't need the refresh aren't held up.
+func refreshToken() error {
+	if r := refreshing; r != nil {
+		tokenMu.Unlock()
+		<-r.done
+		tokenMu.Lock()
+		return r.err
+	}
+
+	r := &tokenRefresh{done: make(chan struct{})}
+	refreshing = r
+	current := *token
+	tokenMu.Unlock()
+
+	t, err := requestToken(current.ClientID, current.ClientSecret, current.RefreshToken)
+
+	tokenMu.Lock()
+	if err == nil {
+		// Debrid may keep the same refresh token
+		if t.RefreshToken == "" {
+			t.RefreshToken = current.RefreshToken
+		}
+		err = saveToken(t)
+	}
+
+	r.err = err
+	refreshing = nil
+	close(r.done)
+	return err
+}
+
+// loadToken reads the saved token if it hasn't been already, nil when
+// blackhole has not been authorized. The lock must be held.
+func loadToken() *Token {
+	p := tokenPath()
+	if p == tokenLoadedFrom {
+		return token
+	}
+
+	tokenLoadedFrom = p
+	token = nil
+
+	data, err := os.ReadFile(p)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Default().Warn("failed to read debrid token", "err", err)
+		}
+		return nil
+	}
+
+	var t Token
+	if err := json.Unmarshal(data, &t); err != nil {
+		slog.Default().Warn("failed to read debrid token", "err", err)
+		return nil
+	}
+
+	token = &t
+	return token
+}
+
+// saveToken writes the token for later runs and uses it from now on. The lock
+// must be held.
+func saveToken(t Token) error {
+	data, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	p := tokenPath()
+	if err := os.MkdirAll(path.Dir(p), os.ModePerm); err != nil {
+		return err
+	}
+
+	// Written to the side then renamed so a crash can't lose the refresh token
+	tmpPath := p + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, p); err != nil {
+		return err
+	}
+
+	tokenLoadedFrom = p
+	token = &t
+	return nil
+}
+
+// TokenPath is where the token from the device code flow is kept
+func TokenPath() string {
+	return tokenPath()
+}
+
+func tokenPath() string {
+	return path.Join(config.GetAppConfig().StatePath, tokenFilename)
+}
+
+func (t Token) String() string {
+	return fmt.Sprintf("Token{ClientID: %s, ExpiresAt: %s}", t.ClientID, t.ExpiresAt.Format(time.RFC3339))
+}
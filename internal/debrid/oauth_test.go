@@ -0,0 +1,145 @@
+package debrid_test
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/samjwillis97/sams-blackhole/internal/config"
+	"github.com/samjwillis97/sams-blackhole/internal/debrid"
+	"github.com/samjwillis97/sams-blackhole/internal/debrid/debridtest"
+	"github.com/spf13/viper"
+)
+
+func setup(t *testing.T) *debridtest.Server {
+	server := debridtest.NewServer()
+	t.Cleanup(server.Close)
+	server.EnableOAuth()
+
+	mockViper := viper.New()
+	mockViper.Set("real_debrid.url", server.URL)
+	mockViper.Set("real_debrid.oauth_url", server.URL+"/oauth/v2/")
+	mockViper.Set("real_debrid.client_id", debridtest.ClientID)
+	mockViper.Set("state_path", t.TempDir())
+	config.InitializeAppConfig(mockViper)
+
+	mockSecretViper := viper.New()
+	mockSecretViper.Set("DEBRID_API_KEY", "not-accepted")
+	config.InitializeSecrets(mockSecretViper)
+
+	return server
+}
+
+func readToken(t *testing.T) debrid.Token {
+	data, err := os.ReadFile(debrid.TokenPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var token debrid.Token
+	if err := json.Unmarshal(data, &token); err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func authorize(t *testing.T, server *debridtest.Server) debrid.Token {
+	code, err := debrid.RequestDeviceCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code.UserCode != debridtest.UserCode {
+		t.Errorf("Expected user code %s, got %s", debridtest.UserCode, code.UserCode)
+	}
+
+	// The user takes a moment to enter the code
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		server.ApproveDevice()
+	}()
+
+	token, err := debrid.Authorize(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestDeviceCodeFlowSavesToken(t *testing.T) {
+	server := setup(t)
+
+	if _, err := debrid.ListTorrents(10); err == nil {
+		t.Fatal("Expected requests to be refused before authorizing")
+	}
+
+	token := authorize(t, server)
+	if token.ClientSecret != debridtest.ClientSecret {
+		t.Errorf("Expected client secret %s, got %s", debridtest.ClientSecret, token.ClientSecret)
+	}
+
+	saved := readToken(t)
+	if saved.AccessToken != token.AccessToken || saved.RefreshToken != token.RefreshToken {
+		t.Errorf("Expected %v to be saved, got %v", token, saved)
+	}
+
+	if _, err := debrid.ListTorrents(10); err != nil {
+		t.Errorf("Expected requests to use the access token, got %s", err)
+	}
+}
+
+func TestRefreshesExpiredAccessToken(t *testing.T) {
+	server := setup(t)
+	token := authorize(t, server)
+
+	server.ExpireAccessToken()
+
+	if _, err := debrid.ListTorrents(10); err != nil {
+		t.Fatalf("Expected the request to succeed after refreshing, got %s", err)
+	}
+	if server.Refreshes() != 1 {
+		t.Errorf("Expected 1 refresh, got %d", server.Refreshes())
+	}
+
+	saved := readToken(t)
+	if saved.AccessToken == token.AccessToken || saved.RefreshToken == token.RefreshToken {
+		t.Errorf("Expected the refreshed token to be saved, got %v", saved)
+	}
+
+	// The refreshed token is used from then on
+	if _, err := debrid.ListTorrents(10); err != nil {
+		t.Errorf("Expected the refreshed token to be accepted, got %s", err)
+	}
+	if server.Refreshes() != 1 {
+		t.Errorf("Expected no further refreshes, got %d", server.Refreshes())
+	}
+}
+
+func TestConcurrentRequestsShareRefresh(t *testing.T) {
+	server := setup(t)
+	authorize(t, server)
+
+	server.ExpireAccessToken()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := debrid.ListTorrents(10)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Expected every request to succeed after refreshing, got %s", err)
+		}
+	}
+	if server.Refreshes() != 1 {
+		t.Errorf("Expected the requests to share 1 refresh, got %d", server.Refreshes())
+	}
+}
@@ -0,0 +1,224 @@
+package debrid
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// torBox is an account on TorBox, only its Usenet API is used so it only
+// takes NZBs. Requests go through the same sending and API key handling as
+// Real-Debrid.
+type torBox struct {
+	rd realDebrid
+}
+
+// Every TorBox response is wrapped the same way
+type torBoxResponse struct {
+	Success bool   `json:"success"`
+	Detail  string `json:"detail"`
+	Data    any    `json:"data"` // Set to a pointer to decode into
+}
+
+type torBoxCreated struct {
+	ID   int    `json:"usenetdownload_id"`
+	Hash string `json:"hash"`
+}
+
+type torBoxFile struct {
+	ID        int    `json:"id"`
+	Name      string `json:"name"`
+	ShortName string `json:"short_name"`
+	Size      int64  `json:"size"`
+}
+
+type torBoxDownload struct {
+	ID               int          `json:"id"`
+	Hash             string       `json:"hash"`
+	Name             string       `json:"name"`
+	DownloadState    string       `json:"download_state"`
+	DownloadFinished bool         `json:"download_finished"`
+	DownloadPresent  bool         `json:"download_present"`
+	CreatedAt        time.Time    `json:"created_at"`
+	Files            []torBoxFile `json:"files"`
+}
+
+var errOnlyNZBs = errors.New("TorBox accounts only take NZBs")
+
+func (c torBox) AddMagnet(magnetLink string) (AddTorrentResponse, error) {
+	return AddTorrentResponse{}, errOnlyNZBs
+}
+
+func (c torBox) AddTorrent(filepath string) (AddTorrentResponse, error) {
+	return AddTorrentResponse{}, errOnlyNZBs
+}
+
+func (c torBox) AddNZB(filepath string) (AddTorrentResponse, error) {
+	data, err := os.ReadFile(filepath)
+	if err != nil {
+		return AddTorrentResponse{}, err
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("file", path.Base(filepath))
+	if err != nil {
+		return AddTorrentResponse{}, err
+	}
+	if _, err := part.Write(data); err != nil {
+		return AddTorrentResponse{}, err
+	}
+	if err := writer.Close(); err != nil {
+		return AddTorrentResponse{}, err
+	}
+
+	var created torBoxCreated
+	err = c.request(http.MethodPost, "usenet/createusenetdownload", nil, &body, writer.FormDataContentType(), &created)
+	if err != nil {
+		return AddTorrentResponse{}, err
+	}
+
+	id := strconv.Itoa(created.ID)
+	return AddTorrentResponse{ID: id}, nil
+}
+
+// Usenet downloads always include every file
+func (c torBox) SelectFiles(torrentId string, fileIds []string) error {
+	return nil
+}
+
+func (c torBox) GetInfo(torrentId string) (GetInfoResponse, error) {
+	query := url.Values{"id": {torrentId}, "bypass_cache": {"true"}}
+
+	var download torBoxDownload
+	err := c.request(http.MethodGet, "usenet/mylist", query, nil, "", &download)
+	if err != nil {
+		return GetInfoResponse{}, err
+	}
+
+	return download.info(), nil
+}
+
+func (c torBox) Remove(id string) error {
+	usenetID, err := strconv.Atoi(id)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Invalid TorBox ID: %s", id))
+	}
+
+	body, err := json.Marshal(map[string]any{"usenet_id": usenetID, "operation": "delete"})
+	if err != nil {
+		return err
+	}
+
+	var ignored any
+	return c.request(http.MethodPost, "usenet/controlusenetdownload", nil, bytes.NewReader(body), "application/json", &ignored)
+}
+
+func (c torBox) UnrestrictLink(link string) (UnrestrictResponse, error) {
+	return UnrestrictResponse{}, errors.New("TorBox links can't be unrestricted, use a link strategy other than strm")
+}
+
+func (c torBox) ListTorrents(limit int) ([]GetInfoResponse, error) {
+	query := url.Values{"limit": {fmt.Sprint(limit)}, "bypass_cache": {"true"}}
+
+	var downloads []torBoxDownload
+	err := c.request(http.MethodGet, "usenet/mylist", query, nil, "", &downloads)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]GetInfoResponse, 0, len(downloads))
+	for _, d := range downloads {
+		list = append(list, d.info())
+	}
+	return list, nil
+}
+
+func (c torBox) ActiveCount() (ActiveCountResponse, error) {
+	return ActiveCountResponse{}, errors.New("Slots are only tracked for Real-Debrid")
+}
+
+// request sends a request to the TorBox API, unwrapping the data of the
+// response into out
+func (c torBox) request(method string, endpoint string, query url.Values, body io.Reader, contentType string, out any) error {
+	reqUrl, err := url.Parse(c.rd.config().Url)
+	if err != nil {
+		return err
+	}
+	reqUrl = reqUrl.JoinPath(endpoint)
+	reqUrl.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(method, reqUrl.String(), body)
+	if err != nil {
+		return err
+	}
+
+	req = c.rd.blessRequest(req)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := c.rd.do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	bodyBytes, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode >= 300 {
+		return newAPIError(resp.StatusCode, bodyBytes)
+	}
+
+	apiResponse := torBoxResponse{Data: out}
+	err = json.Unmarshal(bodyBytes, &apiResponse)
+	if err != nil {
+		return err
+	}
+
+	if !apiResponse.Success {
+		return &APIError{StatusCode: resp.StatusCode, Message: apiResponse.Detail}
+	}
+
+	return nil
+}
+
+// info maps the download onto Real-Debrid's statuses, it is only downloaded
+// once TorBox has finished and is holding every file
+func (d torBoxDownload) info() GetInfoResponse {
+	info := GetInfoResponse{
+		ID:               strconv.Itoa(d.ID),
+		Filename:         d.Name,
+		OriginalFilename: d.Name,
+		Hash:             d.Hash,
+		Added:            d.CreatedAt,
+	}
+
+	state := strings.ToLower(d.DownloadState)
+	switch {
+	case d.DownloadFinished && d.DownloadPresent:
+		info.Status = Downloaded
+	case strings.Contains(state, "fail") || strings.Contains(state, "error"):
+		info.Status = Error
+	case state == "queued":
+		info.Status = Queued
+	default:
+		info.Status = Downloading
+	}
+
+	for _, f := range d.Files {
+		info.Files = append(info.Files, TorrentFile{ID: f.ID, Path: "/" + f.ShortName, Bytes: f.Size, Selected: 1})
+	}
+
+	return info
+}
@@ -0,0 +1,837 @@
+package e2e_test
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/samjwillis97/sams-blackhole/internal/arr"
+	"github.com/samjwillis97/sams-blackhole/internal/audit"
+	"github.com/samjwillis97/sams-blackhole/internal/config"
+	"github.com/samjwillis97/sams-blackhole/internal/debrid"
+	"github.com/samjwillis97/sams-blackhole/internal/debrid/debridtest"
+	"github.com/samjwillis97/sams-blackhole/internal/jobs"
+	"github.com/samjwillis97/sams-blackhole/internal/monitor/sonarr"
+	"github.com/samjwillis97/sams-blackhole/internal/mount"
+	"github.com/samjwillis97/sams-blackhole/internal/slots"
+)
+
+// Hash of both `test.magnet` and `test.torrent` in the torrents testfiles
+const testInfoHash = "150947b245da89629349290c2812ecdb6d0308c7"
+
+const releaseName = "Mythic.Quest.Ravens.Banquet.S01.1080p.ATVP.WEB-DL.DDP5.1.H.264-CasStudio"
+
+var releaseFiles = []string{
+	"Mythic.Quest.Ravens.Banquet.S01E01.mkv",
+	"Subs/Mythic.Quest.Ravens.Banquet.S01E01.srt",
+}
+
+func TestMagnetLinkedWhenMountAppears(t *testing.T) {
+	h := newHarness(t, arr.Sonarr)
+
+	h.Debrid.Expect(debridtest.Torrent{
+		ID:       "MAGNET1",
+		Filename: releaseName,
+		Statuses: []debrid.DebridStatus{debrid.WaitingFileSelection, debrid.Queued, debrid.Downloaded},
+	})
+
+	h.DropTestFile("test.magnet", releaseName+".magnet")
+
+	h.WaitFor("torrent to be added to debrid", func() bool {
+		return slices.Contains(h.Debrid.Added(), "MAGNET1")
+	})
+	h.WaitFor("files to be selected", func() bool {
+		return slices.Contains(h.Debrid.Selected(), "MAGNET1")
+	})
+
+	h.AddMountEntry(releaseName, releaseFiles...)
+
+	h.WaitFor("processing file to be removed", func() bool {
+		return !h.ProcessingFileExists(releaseName + ".magnet")
+	})
+
+	h.AssertLinked(releaseName, releaseFiles...)
+
+	if !slices.Contains(h.Arr.CommandNames(), "RefreshMonitoredDownloads") {
+		t.Errorf("expected *arr to be refreshed, commands were %v", h.Arr.CommandNames())
+	}
+	if len(h.Arr.FailedHistoryIDs()) != 0 {
+		t.Errorf("expected no history to be failed, got %v", h.Arr.FailedHistoryIDs())
+	}
+	if len(h.Debrid.Removed()) != 0 {
+		t.Errorf("expected nothing removed from debrid, got %v", h.Debrid.Removed())
+	}
+
+	summaries, err := audit.List(releaseName)
+	if err != nil || len(summaries) != 1 {
+		t.Fatalf("expected one audit timeline, got %v, %v", summaries, err)
+	}
+	entries, err := audit.Timeline(summaries[0].JobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := []audit.Kind{}
+	for _, e := range entries {
+		kinds = append(kinds, e.Kind)
+	}
+	for _, kind := range []audit.Kind{audit.Registered, audit.Transition, audit.DebridCall, audit.MountMatch, audit.Linked, audit.ArrCallback} {
+		if !slices.Contains(kinds, kind) {
+			t.Errorf("expected a %s entry in the timeline, got %v", kind, kinds)
+		}
+	}
+}
+
+func TestRcloneRefreshExposesDownloadedTorrent(t *testing.T) {
+	h := newHarness(t, arr.Sonarr)
+
+	// The mount only lists the torrent once rclone has been told to refresh
+	h.Rclone.OnRefresh = func(_ []string) {
+		h.AddMountEntry(releaseName, releaseFiles...)
+	}
+
+	h.Debrid.Expect(debridtest.Torrent{
+		ID:       "REFRESH1",
+		Filename: releaseName,
+		Statuses: []debrid.DebridStatus{debrid.Downloaded},
+	})
+
+	h.DropTestFile("test.magnet", releaseName+".magnet")
+
+	h.WaitFor("processing file to be removed", func() bool {
+		return slices.Contains(h.Debrid.Added(), "REFRESH1") && !h.ProcessingFileExists(releaseName+".magnet")
+	})
+
+	h.AssertLinked(releaseName, releaseFiles...)
+
+	if !slices.Contains(h.Rclone.Commands(), "vfs/refresh") {
+		t.Errorf("expected the rclone mount to be refreshed, commands were %v", h.Rclone.Commands())
+	}
+}
+
+func TestItemsHeldWhileMountUnhealthy(t *testing.T) {
+	h := newHarness(t, arr.Sonarr)
+
+	mount.Update(errors.New("transport endpoint is not connected"))
+	t.Cleanup(func() { mount.Update(nil) })
+
+	h.Debrid.Expect(debridtest.Torrent{
+		ID:       "HELD1",
+		Filename: releaseName,
+		Statuses: []debrid.DebridStatus{debrid.Downloaded},
+	})
+
+	h.DropTestFile("test.magnet", releaseName+".magnet")
+
+	h.WaitFor("item to be moved to processing", func() bool {
+		return h.ProcessingFileExists(releaseName + ".magnet")
+	})
+
+	// Long enough for the item to have been added had the mount been healthy
+	time.Sleep(10 * testDebounce)
+	if len(h.Debrid.Added()) != 0 {
+		t.Fatalf("expected nothing to be added to debrid while the mount is unhealthy, got %v", h.Debrid.Added())
+	}
+
+	h.AddMountEntry(releaseName, releaseFiles...)
+	mount.Update(nil)
+
+	h.WaitFor("processing file to be removed", func() bool {
+		return slices.Contains(h.Debrid.Added(), "HELD1") && !h.ProcessingFileExists(releaseName+".magnet")
+	})
+
+	h.AssertLinked(releaseName, releaseFiles...)
+}
+
+func TestTorrentFileLinkedWhenAlreadyMounted(t *testing.T) {
+	h := newHarness(t, arr.Radarr)
+
+	h.Debrid.Expect(debridtest.Torrent{
+		ID:       "TORRENT1",
+		Filename: releaseName,
+		Statuses: []debrid.DebridStatus{debrid.Downloaded},
+	})
+	h.AddMountEntry(releaseName, releaseFiles...)
+
+	h.DropTestFile("test.torrent", releaseName+".torrent")
+
+	h.WaitFor("processing file to be removed", func() bool {
+		return slices.Contains(h.Debrid.Added(), "TORRENT1") && !h.ProcessingFileExists(releaseName+".torrent")
+	})
+
+	h.AssertLinked(releaseName, releaseFiles...)
+
+	if !slices.Contains(h.Arr.CommandNames(), "RefreshMonitoredDownloads") {
+		t.Errorf("expected *arr to be refreshed, commands were %v", h.Arr.CommandNames())
+	}
+}
+
+func TestNotInstantlyAvailableFailsHistory(t *testing.T) {
+	h := newHarness(t, arr.Sonarr)
+
+	h.Arr.SetHistory(
+		arr.HistoryItem{
+			ID:        10,
+			EventType: arr.Grabbed,
+			Data:      arr.HistoryItemData{TorrentInfoHash: "SOMEOTHERHASH", ReleaseType: arr.SingleEpisode},
+		},
+		arr.HistoryItem{
+			ID:        11,
+			EventType: arr.Grabbed,
+			Data:      arr.HistoryItemData{TorrentInfoHash: testInfoHash, ReleaseType: arr.SingleEpisode},
+			Episode:   arr.HistoryItemEpisode{ID: 1, SeriesID: 7, SeasonNumber: 1, EpisodeNumber: 1},
+		},
+		arr.HistoryItem{
+			ID:        12,
+			EventType: arr.DownloadFolderImported,
+			Data:      arr.HistoryItemData{TorrentInfoHash: testInfoHash, ReleaseType: arr.SingleEpisode},
+		},
+	)
+
+	h.Debrid.Expect(debridtest.Torrent{
+		ID:       "SLOW1",
+		Filename: releaseName,
+		Statuses: []debrid.DebridStatus{debrid.Downloading},
+	})
+
+	h.DropTestFile("test.magnet", releaseName+".magnet")
+
+	h.WaitFor("torrent to be removed from debrid", func() bool {
+		return slices.Contains(h.Debrid.Removed(), "SLOW1")
+	})
+	h.WaitFor("processing file to be removed", func() bool {
+		return !h.ProcessingFileExists(releaseName + ".magnet")
+	})
+
+	if failed := h.Arr.FailedHistoryIDs(); !slices.Equal(failed, []int{11}) {
+		t.Errorf("expected only history item 11 to be failed, got %v", failed)
+	}
+	if slices.Contains(h.Arr.CommandNames(), "SeasonSearch") {
+		t.Errorf("did not expect a season search for a single episode")
+	}
+}
+
+func TestUncachedWaitedForWhenConfigured(t *testing.T) {
+	h := newHarnessWithConfig(t, arr.Sonarr, func(c *config.ArrConfig) {
+		c.Uncached = "wait"
+	})
+
+	h.Debrid.Expect(debridtest.Torrent{
+		ID:       "SLOW1",
+		Filename: releaseName,
+		Statuses: []debrid.DebridStatus{debrid.Downloading, debrid.Downloading, debrid.Downloaded},
+	})
+
+	h.DropTestFile("test.magnet", releaseName+".magnet")
+
+	h.WaitFor("torrent to be added to debrid", func() bool {
+		return slices.Contains(h.Debrid.Added(), "SLOW1")
+	})
+
+	h.AddMountEntry(releaseName, releaseFiles...)
+
+	h.WaitFor("processing file to be removed", func() bool {
+		return !h.ProcessingFileExists(releaseName + ".magnet")
+	})
+
+	h.AssertLinked(releaseName, releaseFiles...)
+
+	if len(h.Debrid.Removed()) != 0 {
+		t.Errorf("expected nothing removed from debrid, got %v", h.Debrid.Removed())
+	}
+}
+
+func TestRoutedToAnotherDebridAccount(t *testing.T) {
+	animeCompleted := t.TempDir()
+	h := newHarnessWithConfig(t, arr.Sonarr, func(c *config.ArrConfig) {
+		c.Routes = []config.RouteConfig{{Pattern: "mythic.quest.*", Account: "anime", CompletedPath: animeCompleted}}
+	})
+	anime := h.Accounts["anime"]
+
+	anime.Debrid.Expect(debridtest.Torrent{
+		ID:       "ANIME1",
+		Filename: releaseName,
+		Statuses: []debrid.DebridStatus{debrid.Downloaded},
+	})
+
+	h.DropTestFile("test.magnet", releaseName+".magnet")
+
+	h.WaitFor("torrent to be added to the routed account", func() bool {
+		return slices.Contains(anime.Debrid.Added(), "ANIME1")
+	})
+
+	h.AddMountEntryIn(anime.MountDir, releaseName, releaseFiles...)
+
+	h.WaitFor("processing file to be removed", func() bool {
+		return !h.ProcessingFileExists(releaseName + ".magnet")
+	})
+
+	for _, f := range releaseFiles {
+		target, err := os.Readlink(path.Join(animeCompleted, releaseName, f))
+		if err != nil {
+			t.Errorf("expected %s to be linked into the routed completed path: %s", f, err)
+			continue
+		}
+		if expected := path.Join(anime.MountDir, releaseName, f); target != expected {
+			t.Errorf("expected %s to link to %s, got %s", f, expected, target)
+		}
+	}
+
+	if len(h.Debrid.Added()) != 0 {
+		t.Errorf("expected nothing added to the default account, got %v", h.Debrid.Added())
+	}
+}
+
+func TestResumedFileKeepsItsRoute(t *testing.T) {
+	animeCompleted := t.TempDir()
+	h := newHarnessWithConfig(t, arr.Sonarr, func(c *config.ArrConfig) {
+		c.Routes = []config.RouteConfig{{Subfolder: "anime", Account: "anime", CompletedPath: animeCompleted}}
+	})
+	anime := h.Accounts["anime"]
+
+	anime.Debrid.Expect(debridtest.Torrent{
+		ID:       "ANIME1",
+		Filename: releaseName,
+		Statuses: []debrid.DebridStatus{debrid.Downloaded},
+	})
+
+	// Left in processing from before a restart, which subfolder it was dropped
+	// into is only known from the route written beside it
+	content, err := os.ReadFile(path.Join("..", "torrents", "testfiles", "test.magnet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	processingPath := path.Join(h.ProcessingDir, releaseName+".magnet")
+	if err := os.WriteFile(processingPath, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := jobs.WriteRoute(processingPath, h.Config.Route("anime/"+releaseName+".magnet")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sonarr.ResumeProcessingFile(h.Service, h.Config, processingPath, slog.Default()); err != nil {
+		t.Fatal(err)
+	}
+
+	h.WaitFor("torrent to be added to the routed account", func() bool {
+		return slices.Contains(anime.Debrid.Added(), "ANIME1")
+	})
+
+	h.AddMountEntryIn(anime.MountDir, releaseName, releaseFiles...)
+
+	h.WaitFor("processing file to be removed", func() bool {
+		return !h.ProcessingFileExists(releaseName + ".magnet")
+	})
+
+	if _, err := os.Lstat(path.Join(animeCompleted, releaseName, releaseFiles[0])); err != nil {
+		t.Errorf("expected the release to be linked into the routed completed path: %s", err)
+	}
+	if _, err := os.Stat(jobs.RoutePath(processingPath)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the written route to be removed with the processing file, got %v", err)
+	}
+}
+
+func TestNZBRoutedToUsenetAccount(t *testing.T) {
+	h := newHarnessWithConfig(t, arr.Sonarr, func(c *config.ArrConfig) {
+		c.Routes = []config.RouteConfig{{Pattern: "*.nzb", Account: config.ProviderTorBox}}
+	})
+	usenet := h.Accounts[config.ProviderTorBox]
+
+	// Usenet has nothing cached, NZBs are waited for without `uncached: wait`
+	usenet.Debrid.Expect(debridtest.Torrent{
+		ID:       "101",
+		Filename: releaseName,
+		Statuses: []debrid.DebridStatus{debrid.Queued, debrid.Downloading, debrid.Downloaded},
+	})
+
+	h.DropTestFile("test.nzb", releaseName+".nzb")
+
+	h.WaitFor("nzb to be added to the usenet account", func() bool {
+		return slices.Contains(usenet.Debrid.Added(), "101")
+	})
+
+	h.AddMountEntryIn(usenet.MountDir, releaseName, releaseFiles...)
+
+	h.WaitFor("processing file to be removed", func() bool {
+		return !h.ProcessingFileExists(releaseName + ".nzb")
+	})
+
+	for _, f := range releaseFiles {
+		target, err := os.Readlink(path.Join(h.CompletedDir, releaseName, f))
+		if err != nil {
+			t.Errorf("expected %s to be linked: %s", f, err)
+			continue
+		}
+		if expected := path.Join(usenet.MountDir, releaseName, f); target != expected {
+			t.Errorf("expected %s to link to %s, got %s", f, expected, target)
+		}
+	}
+
+	if len(h.Debrid.Added()) != 0 {
+		t.Errorf("expected nothing added to the default account, got %v", h.Debrid.Added())
+	}
+}
+
+func TestNZBRefusedByUsenetAccountFailsHistoryByTitle(t *testing.T) {
+	h := newHarnessWithConfig(t, arr.Sonarr, func(c *config.ArrConfig) {
+		c.Routes = []config.RouteConfig{{Pattern: "*.nzb", Account: config.ProviderTorBox}}
+	})
+	h.Accounts[config.ProviderTorBox].Debrid.Fail(http.MethodPost, "/usenet/createusenetdownload", http.StatusBadRequest, -1)
+
+	h.Arr.SetHistory(
+		arr.HistoryItem{
+			ID:          70,
+			SourceTitle: "Some.Other.Release",
+			EventType:   arr.Grabbed,
+			Data:        arr.HistoryItemData{ReleaseType: arr.SingleEpisode},
+		},
+		arr.HistoryItem{
+			ID:          71,
+			SourceTitle: releaseName,
+			EventType:   arr.Grabbed,
+			Data:        arr.HistoryItemData{ReleaseType: arr.SingleEpisode},
+		},
+	)
+
+	h.DropTestFile("test.nzb", releaseName+".nzb")
+
+	h.WaitFor("history to be failed", func() bool {
+		return slices.Equal(h.Arr.FailedHistoryIDs(), []int{71})
+	})
+}
+
+func TestNZBWithoutUsenetAccountIsKeptWithoutFailingHistory(t *testing.T) {
+	h := newHarness(t, arr.Sonarr)
+
+	h.Arr.SetHistory(arr.HistoryItem{
+		ID:          72,
+		SourceTitle: releaseName,
+		EventType:   arr.Grabbed,
+		Data:        arr.HistoryItemData{ReleaseType: arr.SingleEpisode},
+	})
+
+	h.DropTestFile("test.nzb", releaseName+".nzb")
+
+	job := h.FindJob(releaseName+".nzb", "failure")
+	h.WaitFor("failed file to be kept", func() bool {
+		job, _ = jobs.Get(job.ID)
+		return job.FailedPath != ""
+	})
+
+	if _, err := os.Stat(job.FailedPath); err != nil {
+		t.Errorf("expected the nzb to be kept: %s", err)
+	}
+	if len(h.Arr.FailedHistoryIDs()) != 0 {
+		t.Errorf("expected the release not to be failed in *arr, got %v", h.Arr.FailedHistoryIDs())
+	}
+	if len(h.Debrid.Added()) != 0 {
+		t.Errorf("expected nothing added to Real-Debrid, got %v", h.Debrid.Added())
+	}
+}
+
+func TestSeasonPackFailureResearchesSeason(t *testing.T) {
+	h := newHarness(t, arr.Sonarr)
+
+	seasonPackItem := func(id int, episode int) arr.HistoryItem {
+		return arr.HistoryItem{
+			ID:        id,
+			EventType: arr.Grabbed,
+			Data:      arr.HistoryItemData{TorrentInfoHash: testInfoHash, ReleaseType: arr.SeasonPack},
+			Episode:   arr.HistoryItemEpisode{ID: id, SeriesID: 42, SeasonNumber: 3, EpisodeNumber: episode},
+		}
+	}
+	h.Arr.SetHistory(seasonPackItem(20, 1), seasonPackItem(21, 2), seasonPackItem(22, 3))
+
+	h.Debrid.Expect(debridtest.Torrent{
+		ID:       "PACK1",
+		Filename: releaseName,
+		Statuses: []debrid.DebridStatus{debrid.MagnetError},
+	})
+
+	h.DropTestFile("test.magnet", releaseName+".magnet")
+
+	h.WaitFor("season to be searched", func() bool {
+		return slices.Contains(h.Arr.CommandNames(), "SeasonSearch")
+	})
+
+	if failed := h.Arr.FailedHistoryIDs(); !slices.Equal(failed, []int{20}) {
+		t.Errorf("expected only the first season pack item to be failed, got %v", failed)
+	}
+
+	for _, c := range h.Arr.Commands() {
+		if c.Name == "SeasonSearch" && (c.SeriesID != 42 || c.SeasonNumber != 3) {
+			t.Errorf("expected season search for series 42 season 3, got series %d season %d", c.SeriesID, c.SeasonNumber)
+		}
+	}
+
+	if !slices.Contains(h.Debrid.Removed(), "PACK1") {
+		t.Errorf("expected torrent to be removed from debrid")
+	}
+	if h.ProcessingFileExists(releaseName + ".magnet") {
+		t.Errorf("expected processing file to be removed")
+	}
+}
+
+func TestSeasonPackFailureWithoutResearch(t *testing.T) {
+	h := newHarnessWithConfig(t, arr.Sonarr, func(c *config.ArrConfig) {
+		c.SeasonPacks = "fail"
+	})
+
+	h.Arr.SetHistory(
+		arr.HistoryItem{
+			ID:        30,
+			EventType: arr.Grabbed,
+			Data:      arr.HistoryItemData{TorrentInfoHash: testInfoHash, ReleaseType: arr.SeasonPack},
+			Episode:   arr.HistoryItemEpisode{ID: 30, SeriesID: 42, SeasonNumber: 3, EpisodeNumber: 1},
+		},
+		arr.HistoryItem{
+			ID:        31,
+			EventType: arr.Grabbed,
+			Data:      arr.HistoryItemData{TorrentInfoHash: testInfoHash, ReleaseType: arr.SeasonPack},
+			Episode:   arr.HistoryItemEpisode{ID: 31, SeriesID: 42, SeasonNumber: 3, EpisodeNumber: 2},
+		},
+	)
+
+	h.Debrid.Expect(debridtest.Torrent{
+		ID:       "PACK2",
+		Filename: releaseName,
+		Statuses: []debrid.DebridStatus{debrid.MagnetError},
+	})
+
+	h.DropTestFile("test.magnet", releaseName+".magnet")
+
+	h.WaitFor("processing file to be removed", func() bool {
+		return !h.ProcessingFileExists(releaseName + ".magnet")
+	})
+	h.WaitFor("release to be failed", func() bool {
+		return len(h.Arr.FailedHistoryIDs()) > 0
+	})
+
+	if failed := h.Arr.FailedHistoryIDs(); !slices.Equal(failed, []int{30}) {
+		t.Errorf("expected only the first season pack item to be failed, got %v", failed)
+	}
+	if slices.Contains(h.Arr.CommandNames(), "SeasonSearch") {
+		t.Errorf("did not expect a season search")
+	}
+}
+
+func TestProcessingDeadlineFailsStuckTorrent(t *testing.T) {
+	h := newHarnessWithTimings(t, arr.Radarr, config.ArrTimings{
+		ProcessingDeadline: 200 * time.Millisecond,
+	})
+
+	h.Arr.SetHistory(arr.HistoryItem{
+		ID:        30,
+		EventType: arr.Grabbed,
+		Data:      arr.HistoryItemData{TorrentInfoHash: testInfoHash},
+	})
+
+	h.Debrid.Expect(debridtest.Torrent{
+		ID:       "STUCK1",
+		Filename: releaseName,
+		Statuses: []debrid.DebridStatus{debrid.Queued},
+	})
+
+	h.DropTestFile("test.magnet", releaseName+".magnet")
+
+	h.WaitFor("history to be failed", func() bool {
+		return slices.Equal(h.Arr.FailedHistoryIDs(), []int{30})
+	})
+
+	if !slices.Contains(h.Debrid.Removed(), "STUCK1") {
+		t.Errorf("expected torrent to be removed from debrid")
+	}
+}
+
+func TestTransientDebridFailureIsRetried(t *testing.T) {
+	h := newHarness(t, arr.Sonarr)
+
+	h.Debrid.Fail(http.MethodPost, "/torrents/addMagnet", http.StatusServiceUnavailable, 1)
+	h.Debrid.Fail(http.MethodGet, "/torrents/info/", http.StatusTooManyRequests, 1)
+	h.Debrid.Expect(debridtest.Torrent{
+		ID:       "FLAKY1",
+		Filename: releaseName,
+	})
+
+	h.DropTestFile("test.magnet", releaseName+".magnet")
+
+	h.WaitFor("torrent to be added to debrid", func() bool {
+		return slices.Contains(h.Debrid.Added(), "FLAKY1")
+	})
+
+	h.AddMountEntry(releaseName, releaseFiles...)
+
+	h.WaitFor("processing file to be removed", func() bool {
+		return !h.ProcessingFileExists(releaseName + ".magnet")
+	})
+
+	h.AssertLinked(releaseName, releaseFiles...)
+
+	if len(h.Arr.FailedHistoryIDs()) != 0 {
+		t.Errorf("expected no history to be failed, got %v", h.Arr.FailedHistoryIDs())
+	}
+}
+
+func TestExhaustedRetriesDeferWithoutFailingHistory(t *testing.T) {
+	h := newHarness(t, arr.Sonarr)
+
+	h.Arr.SetHistory(arr.HistoryItem{
+		ID:        40,
+		EventType: arr.Grabbed,
+		Data:      arr.HistoryItemData{TorrentInfoHash: testInfoHash, ReleaseType: arr.SingleEpisode},
+	})
+	h.Debrid.Fail(http.MethodPost, "/torrents/addMagnet", http.StatusBadGateway, -1)
+
+	h.DropTestFile("test.magnet", releaseName+".magnet")
+
+	h.WaitFor("job to be deferred", func() bool {
+		for _, job := range jobs.List() {
+			if job.State == "deferred" && path.Base(job.ProcessingPath) == releaseName+".magnet" {
+				return true
+			}
+		}
+		return false
+	})
+
+	attempts := 0
+	for _, c := range h.Debrid.Calls() {
+		if c.Path == "/torrents/addMagnet" {
+			attempts++
+		}
+	}
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts to add the magnet, got %d", attempts)
+	}
+
+	if !h.ProcessingFileExists(releaseName + ".magnet") {
+		t.Errorf("expected the file to be left in processing")
+	}
+	if len(h.Arr.FailedHistoryIDs()) != 0 {
+		t.Errorf("expected no history to be failed, got %v", h.Arr.FailedHistoryIDs())
+	}
+}
+
+func TestPermanentDebridFailureFailsHistory(t *testing.T) {
+	h := newHarness(t, arr.Sonarr)
+
+	h.Arr.SetHistory(arr.HistoryItem{
+		ID:        50,
+		EventType: arr.Grabbed,
+		Data:      arr.HistoryItemData{TorrentInfoHash: testInfoHash, ReleaseType: arr.SingleEpisode},
+	})
+	h.Debrid.Fail(http.MethodPost, "/torrents/addMagnet", http.StatusBadRequest, -1)
+
+	h.DropTestFile("test.magnet", releaseName+".magnet")
+
+	h.WaitFor("history to be failed", func() bool {
+		return slices.Equal(h.Arr.FailedHistoryIDs(), []int{50})
+	})
+
+	attempts := 0
+	for _, c := range h.Debrid.Calls() {
+		if c.Path == "/torrents/addMagnet" {
+			attempts++
+		}
+	}
+	if attempts != 1 {
+		t.Errorf("expected a permanent failure not to be retried, got %d attempts", attempts)
+	}
+}
+
+func TestFailedJobRetriedByHand(t *testing.T) {
+	h := newHarness(t, arr.Sonarr)
+
+	h.Arr.SetHistory(arr.HistoryItem{
+		ID:        60,
+		EventType: arr.Grabbed,
+		Data:      arr.HistoryItemData{TorrentInfoHash: testInfoHash, ReleaseType: arr.SingleEpisode},
+	})
+	h.Debrid.Fail(http.MethodPost, "/torrents/addMagnet", http.StatusBadRequest, 1)
+	h.Debrid.Expect(debridtest.Torrent{
+		ID:       "RETRIED1",
+		Filename: releaseName,
+		Statuses: []debrid.DebridStatus{debrid.Downloaded},
+	})
+
+	h.DropTestFile("test.magnet", releaseName+".magnet")
+
+	h.WaitFor("history to be failed", func() bool {
+		return slices.Equal(h.Arr.FailedHistoryIDs(), []int{60})
+	})
+	job := h.FindJob(releaseName+".magnet", "failure")
+	h.WaitFor("failed file to be kept", func() bool {
+		job, _ = jobs.Get(job.ID)
+		return job.FailedPath != ""
+	})
+
+	if h.ProcessingFileExists(releaseName + ".magnet") {
+		t.Errorf("expected the failed file to be moved out of processing")
+	}
+
+	if err := jobs.Retry(job.ID, "debridProcessing"); err == nil {
+		t.Errorf("expected retrying from debrid without a torrent there to fail")
+	}
+	if err := jobs.Retry(job.ID, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	h.WaitFor("torrent to be added to debrid", func() bool {
+		return slices.Contains(h.Debrid.Added(), "RETRIED1")
+	})
+	h.AddMountEntry(releaseName, releaseFiles...)
+	h.WaitFor("processing file to be removed", func() bool {
+		_, ok := jobs.Get(job.ID)
+		return !ok && !h.ProcessingFileExists(releaseName+".magnet")
+	})
+
+	h.AssertLinked(releaseName, releaseFiles...)
+}
+
+func TestCancelDeferredJob(t *testing.T) {
+	h := newHarness(t, arr.Sonarr)
+
+	h.Arr.SetHistory(arr.HistoryItem{
+		ID:        70,
+		EventType: arr.Grabbed,
+		Data:      arr.HistoryItemData{TorrentInfoHash: testInfoHash, ReleaseType: arr.SingleEpisode},
+	})
+	h.Debrid.Fail(http.MethodPost, "/torrents/addMagnet", http.StatusBadGateway, -1)
+
+	h.DropTestFile("test.magnet", releaseName+".magnet")
+	job := h.FindJob(releaseName+".magnet", "deferred")
+
+	if err := jobs.Cancel(job.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if h.ProcessingFileExists(releaseName + ".magnet") {
+		t.Errorf("expected the processing file to be removed")
+	}
+	if _, ok := jobs.Get(job.ID); ok {
+		t.Errorf("expected the job to be dropped")
+	}
+	if len(h.Arr.FailedHistoryIDs()) != 0 {
+		t.Errorf("expected no history to be failed, got %v", h.Arr.FailedHistoryIDs())
+	}
+	if err := jobs.Cancel(job.ID); !errors.Is(err, jobs.ErrNotFound) {
+		t.Errorf("expected cancelling again to find no job, got %v", err)
+	}
+}
+
+func TestForceCompleteDeferredJob(t *testing.T) {
+	h := newHarness(t, arr.Sonarr)
+
+	h.Debrid.Fail(http.MethodPost, "/torrents/addMagnet", http.StatusBadGateway, -1)
+
+	h.DropTestFile("test.magnet", releaseName+".magnet")
+	job := h.FindJob(releaseName+".magnet", "deferred")
+
+	if err := jobs.ForceComplete(job.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if h.ProcessingFileExists(releaseName + ".magnet") {
+		t.Errorf("expected the processing file to be removed")
+	}
+	if !slices.Contains(h.Arr.CommandNames(), "RefreshMonitoredDownloads") {
+		t.Errorf("expected *arr to be refreshed, commands were %v", h.Arr.CommandNames())
+	}
+	if len(h.Arr.FailedHistoryIDs()) != 0 {
+		t.Errorf("expected no history to be failed, got %v", h.Arr.FailedHistoryIDs())
+	}
+}
+
+func TestItemQueuedWhileDebridSlotsFull(t *testing.T) {
+	h := newHarness(t, arr.Sonarr)
+
+	h.Debrid.SlotLimit = 1
+	h.Debrid.Seed(debridtest.Torrent{
+		ID:       "BUSY1",
+		Filename: "Something.Else",
+		Statuses: []debrid.DebridStatus{debrid.Downloading},
+	})
+	h.Debrid.Expect(debridtest.Torrent{
+		ID:       "MAGNET1",
+		Filename: releaseName,
+		Statuses: []debrid.DebridStatus{debrid.Downloaded},
+	})
+	if err := slots.Check(); err != nil {
+		t.Fatal(err)
+	}
+
+	h.DropTestFile("test.magnet", releaseName+".magnet")
+	h.FindJob(releaseName+".magnet", "awaitingSlot")
+
+	if slices.Contains(h.Debrid.Added(), "MAGNET1") {
+		t.Errorf("expected nothing to be added while every slot is in use")
+	}
+
+	h.Debrid.SetStatuses("BUSY1", debrid.Downloaded)
+	h.WaitFor("torrent to be added once a slot frees up", func() bool {
+		slots.Check()
+		return slices.Contains(h.Debrid.Added(), "MAGNET1")
+	})
+
+	h.AddMountEntry(releaseName, releaseFiles...)
+	h.WaitFor("processing file to be removed", func() bool {
+		return !h.ProcessingFileExists(releaseName + ".magnet")
+	})
+	h.AssertLinked(releaseName, releaseFiles...)
+
+	if len(h.Arr.FailedHistoryIDs()) != 0 {
+		t.Errorf("expected no history to be failed, got %v", h.Arr.FailedHistoryIDs())
+	}
+}
+
+func TestCancelWhileAwaitingSlotLeavesQueue(t *testing.T) {
+	h := newHarness(t, arr.Sonarr)
+
+	h.Debrid.SlotLimit = 1
+	h.Debrid.Seed(debridtest.Torrent{
+		ID:       "BUSY1",
+		Filename: "Something.Else",
+		Statuses: []debrid.DebridStatus{debrid.Downloading},
+	})
+	if err := slots.Check(); err != nil {
+		t.Fatal(err)
+	}
+
+	h.DropTestFile("test.magnet", releaseName+".magnet")
+	job := h.FindJob(releaseName+".magnet", "awaitingSlot")
+
+	if err := jobs.Cancel(job.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if queued := slots.GetStatus("").Queued; queued != 0 {
+		t.Errorf("expected the cancelled item to leave the queue, got %d queued", queued)
+	}
+}
+
+func TestRefusedAddIsQueued(t *testing.T) {
+	h := newHarness(t, arr.Sonarr)
+
+	// Debrid refuses the add before a check has seen the account is full
+	h.Debrid.Fail(http.MethodPost, "/torrents/addMagnet", 509, 1)
+	h.Debrid.Expect(debridtest.Torrent{
+		ID:       "MAGNET1",
+		Filename: releaseName,
+		Statuses: []debrid.DebridStatus{debrid.Downloaded},
+	})
+
+	h.DropTestFile("test.magnet", releaseName+".magnet")
+	h.FindJob(releaseName+".magnet", "awaitingSlot")
+
+	h.WaitFor("torrent to be added after the next check", func() bool {
+		slots.Check()
+		return slices.Contains(h.Debrid.Added(), "MAGNET1")
+	})
+
+	if len(h.Arr.FailedHistoryIDs()) != 0 {
+		t.Errorf("expected no history to be failed, got %v", h.Arr.FailedHistoryIDs())
+	}
+}
@@ -0,0 +1,334 @@
+package e2e_test
+
+import (
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/samjwillis97/sams-blackhole/internal/arr"
+	"github.com/samjwillis97/sams-blackhole/internal/arr/arrtest"
+	"github.com/samjwillis97/sams-blackhole/internal/config"
+	"github.com/samjwillis97/sams-blackhole/internal/debrid/debridtest"
+	"github.com/samjwillis97/sams-blackhole/internal/jobs"
+	"github.com/samjwillis97/sams-blackhole/internal/logger"
+	"github.com/samjwillis97/sams-blackhole/internal/monitor"
+	"github.com/samjwillis97/sams-blackhole/internal/monitor/debrid"
+	"github.com/samjwillis97/sams-blackhole/internal/monitor/sonarr"
+	"github.com/samjwillis97/sams-blackhole/internal/notify"
+	"github.com/samjwillis97/sams-blackhole/internal/rclone/rclonetest"
+	"github.com/samjwillis97/sams-blackhole/internal/slots"
+	"github.com/spf13/viper"
+)
+
+const (
+	testAPIKey       = "arr-api-key"
+	testDebridAPIKey = "debrid-api-key"
+
+	scenarioTimeout = 10 * time.Second
+
+	testDebounce      = 50 * time.Millisecond
+	testPollInterval  = 20 * time.Millisecond
+	testRetryInterval = 10 * time.Millisecond
+	testRetryDeadline = 2 * time.Second
+)
+
+// harness runs blackhole against temporary directories and fake *arr,
+// Real-Debrid and rclone servers, files are dropped into the watch directory and the
+// outcome is asserted on once the monitors have handled them.
+type harness struct {
+	t *testing.T
+
+	Service       arr.ArrService
+	Config        config.ArrConfig
+	WatchDir      string
+	ProcessingDir string
+	CompletedDir  string
+	MountDir      string
+
+	Arr    *arrtest.Server
+	Debrid *debridtest.Server
+	Rclone *rclonetest.Server
+
+	// Other debrid accounts the instance is routed to, by name
+	Accounts map[string]*debridAccount
+
+	monitor monitor.Monitor
+}
+
+type debridAccount struct {
+	Debrid   *debridtest.Server
+	MountDir string
+}
+
+func newHarness(t *testing.T, service arr.ArrService) *harness {
+	return newHarnessWithTimings(t, service, config.ArrTimings{})
+}
+
+// newHarnessWithTimings overrides the instance timings, anything left unset
+// uses the fast test defaults
+func newHarnessWithTimings(t *testing.T, service arr.ArrService, timings config.ArrTimings) *harness {
+	t.Helper()
+	return newHarnessWithConfig(t, service, func(c *config.ArrConfig) {
+		c.Timings = timings
+	})
+}
+
+// newHarnessWithConfig lets the test change the instance's config before
+// anything is started
+func newHarnessWithConfig(t *testing.T, service arr.ArrService, configure func(*config.ArrConfig)) *harness {
+	t.Helper()
+
+	log := slog.New(logger.NewHandler(&slog.HandlerOptions{Level: slog.LevelDebug}))
+	root := t.TempDir()
+
+	h := &harness{
+		t:             t,
+		Service:       service,
+		WatchDir:      path.Join(root, "watch"),
+		ProcessingDir: path.Join(root, "processing"),
+		CompletedDir:  path.Join(root, "completed"),
+		MountDir:      path.Join(root, "mount"),
+		Arr:           arrtest.NewServer(),
+		Debrid:        debridtest.NewServer(),
+		Rclone:        rclonetest.NewServer(),
+	}
+	t.Cleanup(h.Arr.Close)
+	t.Cleanup(h.Debrid.Close)
+	t.Cleanup(h.Rclone.Close)
+
+	h.Arr.APIKey = testAPIKey
+	h.Debrid.APIKey = testDebridAPIKey
+
+	for _, dir := range []string{h.WatchDir, h.ProcessingDir, h.CompletedDir, h.MountDir} {
+		if err := os.Mkdir(dir, os.ModePerm); err != nil {
+			t.Fatalf("failed to create %s: %s", dir, err)
+		}
+	}
+
+	h.Config = config.ArrConfig{
+		Name:           "e2e",
+		Url:            h.Arr.URL,
+		WatchPath:      h.WatchDir,
+		ProcessingPath: h.ProcessingDir,
+		CompletedPath:  h.CompletedDir,
+	}
+	configure(&h.Config)
+
+	// Each account the instance is routed to gets its own fake and mount
+	h.Accounts = map[string]*debridAccount{}
+	accounts := []map[string]any{}
+	for _, name := range routedAccounts(h.Config) {
+		account := &debridAccount{Debrid: debridtest.NewServer(), MountDir: path.Join(root, "mount-"+name)}
+		t.Cleanup(account.Debrid.Close)
+		account.Debrid.APIKey = name + "-api-key"
+		if err := os.Mkdir(account.MountDir, os.ModePerm); err != nil {
+			t.Fatalf("failed to create %s: %s", account.MountDir, err)
+		}
+		h.Accounts[name] = account
+
+		entry := map[string]any{"name": name, "url": account.Debrid.URL, "watch_path": account.MountDir}
+		// An account named after a provider other than Real-Debrid is on it
+		if name == config.ProviderTorBox {
+			entry["provider"] = name
+		}
+		accounts = append(accounts, entry)
+	}
+
+	mockViper := viper.New()
+	mockViper.Set("real_debrid.url", h.Debrid.URL)
+	mockViper.Set("real_debrid.watch_path", h.MountDir)
+	mockViper.Set("real_debrid.mount_timeout", 60)
+	mockViper.Set("debrid_accounts", accounts)
+	mockViper.Set("rclone.url", h.Rclone.URL)
+	mockViper.Set("state_path", t.TempDir())
+	mockViper.Set("timings.debounce", testDebounce)
+	mockViper.Set("timings.poll_interval", testPollInterval)
+	mockViper.Set("timings.debrid_retry_interval", testRetryInterval)
+	mockViper.Set("real_debrid.retry.deadline", testRetryDeadline)
+	for _, class := range []string{"network", "rate_limited", "server"} {
+		mockViper.Set("real_debrid.retry."+class+".max_attempts", 3)
+		mockViper.Set("real_debrid.retry."+class+".backoff", testRetryInterval)
+	}
+	config.InitializeAppConfig(mockViper)
+
+	mockSecretViper := viper.New()
+	mockSecretViper.Set("DEBRID_API_KEY", testDebridAPIKey)
+	mockSecretViper.Set("E2E_API_KEY", testAPIKey)
+	for name := range h.Accounts {
+		mockSecretViper.Set(strings.ToUpper(name)+"_DEBRID_API_KEY", name+"-api-key")
+	}
+	config.InitializeSecrets(mockSecretViper)
+
+	// Slots are tracked across the whole process, start from this server's
+	if err := slots.Check(); err != nil {
+		t.Fatalf("failed to check debrid slots: %s", err)
+	}
+
+	settings := []monitor.MonitorSetting{
+		{
+			Name:      h.Config.Name,
+			Directory: h.WatchDir,
+			Handler:   sonarr.MonitorHandlerBuilder(service, h.Config),
+			Backend:   monitor.Fsnotify,
+		},
+		{
+			Name:      "Debrid Monitor",
+			Directory: h.MountDir,
+			Handler:   debrid.MonitorHandler,
+			Backend:   monitor.Poll,
+		},
+	}
+	for name, account := range h.Accounts {
+		settings = append(settings, monitor.MonitorSetting{
+			Name:      "Debrid Monitor " + name,
+			Directory: account.MountDir,
+			Handler:   debrid.MonitorHandler,
+			Backend:   monitor.Poll,
+		})
+	}
+
+	h.monitor = monitor.Monitor{
+		Logger:       log,
+		PollInterval: config.GetAppConfig().GetTimings().PollInterval,
+		Settings:     settings,
+	}
+
+	if err := h.monitor.StartMonitoring(); err != nil {
+		t.Fatalf("failed to start monitoring: %s", err)
+	}
+	// Handlers and notifications still running would read the config the next
+	// test replaces
+	t.Cleanup(func() {
+		h.monitor.Close()
+		notify.Wait()
+	})
+	// Failed jobs are kept to be retried, they shouldn't carry over
+	t.Cleanup(func() {
+		for _, job := range jobs.List() {
+			jobs.Remove(job.ID)
+		}
+	})
+
+	return h
+}
+
+// Drop writes a file into the watch directory as *arr would
+func (h *harness) Drop(name string, content []byte) {
+	h.t.Helper()
+
+	if err := os.WriteFile(path.Join(h.WatchDir, name), content, 0o644); err != nil {
+		h.t.Fatalf("failed to drop %s: %s", name, err)
+	}
+}
+
+// DropTestFile copies one of the torrent package test files into the watch
+// directory under the given name
+func (h *harness) DropTestFile(testFile string, name string) {
+	h.t.Helper()
+
+	content, err := os.ReadFile(path.Join("..", "torrents", "testfiles", testFile))
+	if err != nil {
+		h.t.Fatalf("failed to read %s: %s", testFile, err)
+	}
+
+	h.Drop(name, content)
+}
+
+// AddMountEntry creates a torrent directory in the debrid mount containing
+// the given files
+func (h *harness) AddMountEntry(name string, files ...string) {
+	h.t.Helper()
+	h.AddMountEntryIn(h.MountDir, name, files...)
+}
+
+// AddMountEntryIn is AddMountEntry for the mount of another account
+func (h *harness) AddMountEntryIn(mountDir string, name string, files ...string) {
+	h.t.Helper()
+
+	for _, f := range files {
+		fullPath := path.Join(mountDir, name, f)
+		if err := os.MkdirAll(path.Dir(fullPath), os.ModePerm); err != nil {
+			h.t.Fatalf("failed to create mount dir for %s: %s", f, err)
+		}
+		if err := os.WriteFile(fullPath, []byte(f), 0o644); err != nil {
+			h.t.Fatalf("failed to create mount file %s: %s", f, err)
+		}
+	}
+}
+
+// WaitFor polls the condition until it holds, failing the test if it does not
+// within the scenario timeout
+func (h *harness) WaitFor(description string, condition func() bool) {
+	h.t.Helper()
+
+	deadline := time.Now().Add(scenarioTimeout)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	h.t.Fatalf("timed out waiting for %s", description)
+}
+
+// FindJob waits for the job for a release to reach the state
+func (h *harness) FindJob(name string, state string) jobs.Job {
+	h.t.Helper()
+
+	var found jobs.Job
+	h.WaitFor("job to be "+state, func() bool {
+		for _, job := range jobs.List() {
+			if job.State == state && path.Base(job.ProcessingPath) == name {
+				found = job
+				return true
+			}
+		}
+		return false
+	})
+	return found
+}
+
+func (h *harness) ProcessingFileExists(name string) bool {
+	_, err := os.Stat(path.Join(h.ProcessingDir, name))
+	return err == nil
+}
+
+// AssertLinked checks the completed directory contains a symlink for every
+// file back into the mount
+func (h *harness) AssertLinked(name string, files ...string) {
+	h.t.Helper()
+
+	for _, f := range files {
+		linkPath := path.Join(h.CompletedDir, name, f)
+		target, err := os.Readlink(linkPath)
+		if err != nil {
+			h.t.Errorf("expected a symlink at %s: %s", linkPath, err)
+			continue
+		}
+
+		expected := path.Join(h.MountDir, name, f)
+		if target != expected {
+			h.t.Errorf("expected %s to link to %s, got %s", linkPath, expected, target)
+		}
+	}
+}
+
+// routedAccounts returns the debrid accounts other than `real_debrid` the
+// instance sends anything to
+func routedAccounts(conf config.ArrConfig) []string {
+	accounts := []string{}
+	if conf.DebridAccount != "" {
+		accounts = append(accounts, conf.DebridAccount)
+	}
+	for _, r := range conf.Routes {
+		if r.Account != "" && !slices.Contains(accounts, r.Account) {
+			accounts = append(accounts, r.Account)
+		}
+	}
+	return accounts
+}
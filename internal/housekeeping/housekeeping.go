@@ -0,0 +1,310 @@
+// Package housekeeping removes torrents blackhole added to the debrid accounts
+// that are no longer any use, those in a terminal error state and those
+// nothing refers to. A torrent is referred to by a job working on it, the
+// debrid monitor watching for it, a completed folder, a symlink into it or
+// the links recorded for repair, which is all strm, copy and hardlink leave.
+package housekeeping
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samjwillis97/sams-blackhole/internal/clock"
+	"github.com/samjwillis97/sams-blackhole/internal/config"
+	"github.com/samjwillis97/sams-blackhole/internal/debrid"
+	"github.com/samjwillis97/sams-blackhole/internal/jobs"
+	"github.com/samjwillis97/sams-blackhole/internal/logger/attr"
+	debridMonitor "github.com/samjwillis97/sams-blackhole/internal/monitor/debrid"
+	"github.com/samjwillis97/sams-blackhole/internal/notify"
+	"github.com/samjwillis97/sams-blackhole/internal/repair"
+	"github.com/samjwillis97/sams-blackhole/internal/slots"
+)
+
+// Real-Debrid lists at most this many torrents at once
+const listLimit = 5000
+
+type Reason string
+
+const (
+	Errored  Reason = "errored"  // The torrent is in a state debrid won't recover from
+	Orphaned Reason = "orphaned" // Nothing refers to the torrent
+)
+
+// Candidate is a torrent housekeeping found no use for
+type Candidate struct {
+	ID       string              `json:"id"`
+	Filename string              `json:"filename"`
+	Hash     string              `json:"hash"`
+	Account  string              `json:"account,omitempty"` // The debrid account, `real_debrid` when empty
+	Status   debrid.DebridStatus `json:"status"`
+	Added    time.Time           `json:"added"`
+	Reason   Reason              `json:"reason"`
+	Error    string              `json:"error,omitempty"`
+}
+
+// Report is everything a run found, in dry runs nothing was removed
+type Report struct {
+	Time    time.Time   `json:"time"`
+	DryRun  bool        `json:"dryRun"`
+	Checked int         `json:"checked"`
+	Removed []Candidate `json:"removed"` // What would have been removed in a dry run
+	Allowed []Candidate `json:"allowed"` // Kept for being on the allowlist
+	Failed  []Candidate `json:"failed"`  // Failed to be removed
+}
+
+var (
+	running sync.Mutex
+
+	lastMu sync.Mutex
+	last   *Report
+)
+
+// LastReport returns the report of the most recent run, nil until there has
+// been one
+func LastReport() *Report {
+	lastMu.Lock()
+	defer lastMu.Unlock()
+	return last
+}
+
+// Run checks every torrent blackhole added to each debrid account, removing
+// those found to be of no use unless they are on the allowlist
+func Run(logger *slog.Logger, dryRun bool) (Report, error) {
+	if !running.TryLock() {
+		return Report{}, errors.New("Housekeeping is already running")
+	}
+	defer running.Unlock()
+
+	conf := config.GetAppConfig().Housekeeping
+	report := Report{
+		Time:    clock.Now(),
+		DryRun:  dryRun,
+		Removed: []Candidate{},
+		Allowed: []Candidate{},
+		Failed:  []Candidate{},
+	}
+
+	// Without knowing what is linked, anything could look orphaned
+	linked, err := findLinked()
+	if err != nil {
+		return report, err
+	}
+
+	// One account being unreachable doesn't stop the others being checked
+	var listErr error
+	listed := false
+	for _, account := range config.GetAppConfig().DebridAccountNames() {
+		accountLogger := logger
+		if account != "" {
+			accountLogger = logger.With("debridAccount", account)
+		}
+
+		// Torrents added by anything else are never touched
+		owned, err := slots.Owned(account)
+		if err != nil {
+			accountLogger.Warn("failed to read torrents blackhole added, skipping account", "err", err)
+			listErr = err
+			continue
+		}
+
+		client := debrid.For(account)
+		torrents, err := client.ListTorrents(listLimit)
+		if err != nil {
+			accountLogger.Warn("failed to list torrents, skipping account", "err", err)
+			listErr = err
+			continue
+		}
+		listed = true
+		report.Checked += len(torrents)
+
+		for _, t := range torrents {
+			if _, ok := owned[t.ID]; !ok {
+				continue
+			}
+			check(client, account, t, linked, conf, dryRun, &report, accountLogger)
+		}
+	}
+	if !listed {
+		return report, listErr
+	}
+
+	logger.Info("finished housekeeping",
+		"checked", report.Checked,
+		"removed", len(report.Removed),
+		"allowed", len(report.Allowed),
+		"failed", len(report.Failed),
+		"dryRun", dryRun,
+	)
+
+	lastMu.Lock()
+	last = &report
+	lastMu.Unlock()
+
+	if !dryRun && len(report.Removed) > 0 {
+		notify.Async(logger, summarise(report))
+	}
+
+	return report, nil
+}
+
+// check removes the torrent if it is of no use, recording what was done in the
+// report
+func check(client debrid.Client, account string, t debrid.GetInfoResponse, linked map[string]bool, conf config.HousekeepingConfig, dryRun bool, report *Report, logger *slog.Logger) {
+	reason, ok := classify(account, t, linked, conf.GetGracePeriod())
+	if !ok {
+		return
+	}
+
+	c := Candidate{ID: t.ID, Filename: t.Filename, Hash: t.Hash, Account: account, Status: t.Status, Added: t.Added, Reason: reason}
+	torrentLogger := logger.With(attr.DebridID(t.ID), "filename", t.Filename, "status", t.Status, "reason", reason)
+
+	if isAllowed(conf.Allowlist, t) {
+		torrentLogger.Debug("keeping allowlisted torrent")
+		report.Allowed = append(report.Allowed, c)
+		return
+	}
+
+	if dryRun {
+		torrentLogger.Info("would remove torrent")
+		report.Removed = append(report.Removed, c)
+		return
+	}
+
+	if err := client.Remove(t.ID); err != nil {
+		torrentLogger.Warn("failed to remove torrent", "err", err)
+		c.Error = err.Error()
+		report.Failed = append(report.Failed, c)
+		return
+	}
+
+	torrentLogger.Info("removed torrent")
+	report.Removed = append(report.Removed, c)
+}
+
+// classify decides why a torrent is of no use, if it is of no use
+func classify(account string, t debrid.GetInfoResponse, linked map[string]bool, grace time.Duration) (Reason, bool) {
+	if inUse(t) {
+		return "", false
+	}
+
+	if isErrored(t.Status) {
+		return Errored, true
+	}
+
+	if clock.Since(t.Added) < grace || linked[t.Filename] {
+		return "", false
+	}
+
+	if _, ok := repair.LookupLinked(account, t.Filename); ok {
+		return "", false
+	}
+
+	return Orphaned, true
+}
+
+// inUse reports whether blackhole is still working on the torrent
+func inUse(t debrid.GetInfoResponse) bool {
+	for _, job := range jobs.List() {
+		if job.DebridID == t.ID {
+			return true
+		}
+	}
+	return debridMonitor.IsWatchingFor(t.ID, t.Filename)
+}
+
+func isErrored(status debrid.DebridStatus) bool {
+	switch status {
+	case debrid.MagnetError, debrid.Error, debrid.Virus, debrid.Dead:
+		return true
+	}
+	return false
+}
+
+// findLinked returns the names of every torrent with a completed folder or a
+// symlink into any account's mount, failing if any instance's library couldn't
+// be scanned
+func findLinked() (map[string]bool, error) {
+	appConfig := config.GetAppConfig()
+
+	roots, err := repair.ScanRoots(appConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	linked := map[string]bool{}
+	for _, account := range appConfig.DebridMounts() {
+		found, err := repair.LinkedTorrents(roots, account.WatchPatch)
+		if err != nil {
+			return nil, err
+		}
+		for name := range found {
+			linked[name] = true
+		}
+	}
+
+	for _, conf := range slices.Concat(appConfig.Sonarr, appConfig.Radarr) {
+		for _, completedPath := range conf.CompletedPaths() {
+			entries, err := os.ReadDir(completedPath)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+			for _, e := range entries {
+				linked[e.Name()] = true
+			}
+		}
+	}
+
+	return linked, nil
+}
+
+// isAllowed reports whether the torrent's ID, hash or filename is on the
+// allowlist, filenames may be matched by pattern
+func isAllowed(allowlist []string, t debrid.GetInfoResponse) bool {
+	for _, entry := range allowlist {
+		if entry == t.ID || strings.EqualFold(entry, t.Hash) {
+			return true
+		}
+		if matched, _ := path.Match(entry, t.Filename); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func summarise(report Report) notify.Event {
+	names := []string{}
+	for _, c := range report.Removed {
+		names = append(names, c.Filename)
+	}
+
+	e := notify.Event{Type: notify.Housekeeping, Release: strings.Join(names, "\n"), Time: report.Time}
+	if len(report.Failed) > 0 {
+		e.Error = "failed to remove some torrents"
+	}
+	return e
+}
+
+// Schedule runs housekeeping on the configured interval, it returns straight
+// away if no interval is set
+func Schedule(logger *slog.Logger) {
+	interval := config.GetAppConfig().Housekeeping.Interval
+	if interval <= 0 {
+		return
+	}
+
+	logger = logger.With(attr.MonitorName("housekeeping"))
+	for {
+		clock.Sleep(interval)
+
+		_, err := Run(logger, config.GetAppConfig().Housekeeping.DryRun)
+		if err != nil {
+			logger.Error("housekeeping failed", "err", err)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package housekeeping_test
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/samjwillis97/sams-blackhole/internal/config"
+	"github.com/samjwillis97/sams-blackhole/internal/debrid"
+	"github.com/samjwillis97/sams-blackhole/internal/debrid/debridtest"
+	"github.com/samjwillis97/sams-blackhole/internal/housekeeping"
+	"github.com/samjwillis97/sams-blackhole/internal/jobs"
+	"github.com/samjwillis97/sams-blackhole/internal/logger"
+	"github.com/samjwillis97/sams-blackhole/internal/repair"
+	"github.com/samjwillis97/sams-blackhole/internal/slots"
+	"github.com/spf13/viper"
+)
+
+// setup seeds the default account, configure may change the config before it
+// is initialized
+func setup(t *testing.T, configure ...func(v *viper.Viper)) *debridtest.Server {
+	root := t.TempDir()
+	mountDir := path.Join(root, "mount")
+	completedDir := path.Join(root, "completed")
+	libraryDir := path.Join(root, "library")
+	for _, dir := range []string{mountDir, path.Join(completedDir, "Completed.Name"), libraryDir} {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(path.Join(mountDir, "Linked.Name", "episode.mkv"), path.Join(libraryDir, "episode.mkv")); err != nil {
+		t.Fatal(err)
+	}
+
+	server := debridtest.NewServer()
+	t.Cleanup(server.Close)
+
+	mockViper := viper.New()
+	mockViper.Set("real_debrid.url", server.URL)
+	mockViper.Set("real_debrid.watch_path", mountDir)
+	mockViper.Set("state_path", root)
+	mockViper.Set("housekeeping.allowlist", []string{"*.iso"})
+	mockViper.Set("sonarr", []map[string]any{{
+		"name":           "housekeepingtest",
+		"url":            "http://localhost",
+		"watch_path":     path.Join(root, "watch"),
+		"completed_path": completedDir,
+		"library_paths":  []string{libraryDir},
+	}})
+	for _, fn := range configure {
+		fn(mockViper)
+	}
+	config.InitializeAppConfig(mockViper)
+
+	old := time.Now().Add(-48 * time.Hour)
+	for _, torrent := range []debridtest.Torrent{
+		{ID: "DEAD", Filename: "Dead.Name", Statuses: []debrid.DebridStatus{debrid.Dead}},
+		{ID: "ORPHAN", Filename: "Orphan.Name", Added: old},
+		{ID: "RECENT", Filename: "Recent.Name"},
+		{ID: "COMPLETED", Filename: "Completed.Name", Added: old},
+		{ID: "LINKED", Filename: "Linked.Name", Added: old},
+		{ID: "ALLOWED", Filename: "Keep.Me.iso", Added: old},
+		{ID: "IN_JOB", Filename: "In.Job", Added: old},
+		{ID: "INDEXED", Filename: "Indexed.Name", Added: old},
+	} {
+		server.Seed(torrent)
+		if err := slots.Added("", torrent.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server.Seed(debridtest.Torrent{ID: "NOT_OURS", Filename: "Not.Ours", Added: old})
+
+	// Linked with a strategy that leaves no symlink into the mount
+	if err := repair.RecordLinked(repair.LinkedTorrent{Name: "Indexed.Name", DebridID: "INDEXED"}); err != nil {
+		t.Fatal(err)
+	}
+
+	job := jobs.Register(jobs.Job{Instance: "housekeepingtest"})
+	jobs.SetDebridID(job.ID, "IN_JOB")
+	t.Cleanup(func() { jobs.Remove(job.ID) })
+
+	return server
+}
+
+func ids(candidates []housekeeping.Candidate) []string {
+	list := []string{}
+	for _, c := range candidates {
+		list = append(list, c.ID)
+	}
+	slices.Sort(list)
+	return list
+}
+
+func TestDryRunReportsWithoutRemoving(t *testing.T) {
+	server := setup(t)
+	log := slog.New(logger.NewHandler(&slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	report, err := housekeeping.Run(log, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(ids(report.Removed), []string{"DEAD", "ORPHAN"}) {
+		t.Errorf("Expected the dead and orphaned torrents to be reported, got %v", ids(report.Removed))
+	}
+	if !slices.Equal(ids(report.Allowed), []string{"ALLOWED"}) {
+		t.Errorf("Expected the allowlisted torrent to be reported, got %v", ids(report.Allowed))
+	}
+	if len(server.Removed()) != 0 {
+		t.Errorf("Expected nothing removed in a dry run, got %v", server.Removed())
+	}
+	if housekeeping.LastReport() == nil || !housekeeping.LastReport().DryRun {
+		t.Errorf("Expected the report to be kept")
+	}
+}
+
+func TestRemovesErroredAndOrphanedTorrents(t *testing.T) {
+	server := setup(t)
+	log := slog.New(logger.NewHandler(&slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	report, err := housekeeping.Run(log, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removed := server.Removed()
+	slices.Sort(removed)
+	if !slices.Equal(removed, []string{"DEAD", "ORPHAN"}) {
+		t.Errorf("Expected only the dead and orphaned torrents blackhole added to be removed, got %v", removed)
+	}
+
+	for _, c := range report.Removed {
+		if (c.ID == "DEAD" && c.Reason != housekeeping.Errored) || (c.ID == "ORPHAN" && c.Reason != housekeeping.Orphaned) {
+			t.Errorf("Unexpected reason for %s: %s", c.ID, c.Reason)
+		}
+	}
+}
+
+func TestUnscannableLibraryRemovesNothing(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(failing.Close)
+
+	// The library holding links into the mount can't be found
+	server := setup(t, func(v *viper.Viper) {
+		v.Set("radarr", []map[string]any{{"name": "unscannable", "url": failing.URL}})
+	})
+	log := slog.New(logger.NewHandler(&slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	if _, err := housekeeping.Run(log, false); err == nil {
+		t.Errorf("Expected the run to fail")
+	}
+	if len(server.Removed()) != 0 {
+		t.Errorf("Expected nothing to be removed, got %v", server.Removed())
+	}
+}
+
+func TestChecksEveryAccount(t *testing.T) {
+	root := t.TempDir()
+	animeMount := path.Join(root, "mount")
+	animeLibrary := path.Join(root, "library")
+	for _, dir := range []string{animeMount, animeLibrary} {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(path.Join(animeMount, "Anime.Linked", "episode.mkv"), path.Join(animeLibrary, "episode.mkv")); err != nil {
+		t.Fatal(err)
+	}
+
+	anime := debridtest.NewServer()
+	t.Cleanup(anime.Close)
+
+	old := time.Now().Add(-48 * time.Hour)
+	anime.Seed(debridtest.Torrent{ID: "ANIME_ORPHAN", Filename: "Anime.Orphan", Added: old})
+	anime.Seed(debridtest.Torrent{ID: "ANIME_LINKED", Filename: "Anime.Linked", Added: old})
+
+	server := setup(t, func(v *viper.Viper) {
+		v.Set("debrid_accounts", []map[string]any{{"name": "anime", "url": anime.URL, "watch_path": animeMount}})
+		v.Set("radarr", []map[string]any{{"name": "anime", "url": "http://localhost", "library_paths": []string{animeLibrary}}})
+	})
+	for _, id := range []string{"ANIME_ORPHAN", "ANIME_LINKED"} {
+		if err := slots.Added("anime", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	log := slog.New(logger.NewHandler(&slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	report, err := housekeeping.Run(log, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(anime.Removed(), []string{"ANIME_ORPHAN"}) {
+		t.Errorf("Expected only the orphaned torrent removed from the other account, got %v", anime.Removed())
+	}
+	if slices.Contains(server.Removed(), "ANIME_ORPHAN") {
+		t.Errorf("Expected the other account's torrent to be removed from that account")
+	}
+	for _, c := range report.Removed {
+		if c.ID == "ANIME_ORPHAN" && c.Account != "anime" {
+			t.Errorf("Expected the candidate to name its account, got %q", c.Account)
+		}
+	}
+}
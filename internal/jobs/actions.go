@@ -0,0 +1,89 @@
+package jobs
+
+import (
+	"errors"
+	"fmt"
+	"path"
+
+	"github.com/samjwillis97/sams-blackhole/internal/config"
+)
+
+var ErrNotFound = errors.New("Job not found")
+
+// Handle acts on the item working on a job, for when someone steps in from
+// outside of it
+type Handle interface {
+	// Retry starts a failed or deferred item again from the given state
+	Retry(from string) error
+	// Cancel stops the item and cleans up after it without failing it in *arr
+	Cancel() error
+	// ForceComplete stops the item and treats it as having succeeded
+	ForceComplete() error
+}
+
+var handles = map[string]Handle{}
+
+// SetHandle sets what a job is acted on through, it is dropped along with the
+// job
+func SetHandle(id string, h Handle) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := jobs[id]; ok {
+		handles[id] = h
+	}
+}
+
+func handle(id string) (Handle, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	h, ok := handles[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return h, nil
+}
+
+// Retry starts the job again from the given state
+func Retry(id string, from string) error {
+	h, err := handle(id)
+	if err != nil {
+		return err
+	}
+	return h.Retry(from)
+}
+
+// Cancel stops the job without failing it in *arr
+func Cancel(id string) error {
+	h, err := handle(id)
+	if err != nil {
+		return err
+	}
+	return h.Cancel()
+}
+
+// ForceComplete stops the job and treats it as having succeeded
+func ForceComplete(id string) error {
+	h, err := handle(id)
+	if err != nil {
+		return err
+	}
+	return h.ForceComplete()
+}
+
+// FailedDir is where the files of failed jobs are kept, so they can be retried
+func FailedDir() (string, error) {
+	statePath := config.GetAppConfig().StatePath
+	if statePath == "" {
+		return "", errors.New("No state path configured")
+	}
+	return path.Join(statePath, "failed"), nil
+}
+
+// FailedPath is where a failed job's file is kept
+func FailedPath(id string, processingPath string) (string, error) {
+	dir, err := FailedDir()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(dir, fmt.Sprintf("%s-%s", id, path.Base(processingPath))), nil
+}
@@ -0,0 +1,61 @@
+package jobs
+
+import (
+	"strings"
+	"time"
+
+	"github.com/samjwillis97/sams-blackhole/internal/arr"
+	"github.com/samjwillis97/sams-blackhole/internal/clock"
+)
+
+// Grabs that never turn up in the watch path are forgotten after this long
+const grabExpiry = 24 * time.Hour
+
+// Grab is what *arr told us about a release when it grabbed it, before the
+// file lands in the watch path
+type Grab struct {
+	InfoHash     string                 `json:"infoHash"`
+	Service      arr.ArrService         `json:"-"`
+	Instance     string                 `json:"instance"`
+	ReleaseTitle string                 `json:"releaseTitle"`
+	ReleaseType  arr.HistoryReleaseType `json:"releaseType,omitempty"`
+	SeriesID     int                    `json:"seriesId,omitempty"`
+	SeasonNumber int                    `json:"seasonNumber,omitempty"`
+	EpisodeIDs   []int                  `json:"episodeIds,omitempty"`
+	MovieID      int                    `json:"movieId,omitempty"`
+	GrabbedAt    time.Time              `json:"grabbedAt"`
+}
+
+var grabs = map[string]Grab{}
+
+// ExpectGrab remembers a grab until the torrent for it is picked up
+func ExpectGrab(g Grab) {
+	now := clock.Now()
+	g.GrabbedAt = now
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	for hash, existing := range grabs {
+		if now.Sub(existing.GrabbedAt) > grabExpiry {
+			delete(grabs, hash)
+		}
+	}
+
+	grabs[strings.ToUpper(g.InfoHash)] = g
+}
+
+// LookupGrab finds the grab for an info hash
+func LookupGrab(infoHash string) (Grab, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	g, ok := grabs[strings.ToUpper(infoHash)]
+	return g, ok
+}
+
+// ForgetGrab removes the grab for an info hash once it is no longer needed
+func ForgetGrab(infoHash string) {
+	mu.Lock()
+	defer mu.Unlock()
+	delete(grabs, strings.ToUpper(infoHash))
+}
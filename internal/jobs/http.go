@@ -0,0 +1,67 @@
+package jobs
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/samjwillis97/sams-blackhole/internal/server"
+)
+
+// Patterns the handlers are served on. Every handler needs the server's API
+// key, either as the basic auth password or the `apikey` query parameter, and
+// retries take the state to retry from as the `from` query parameter.
+const (
+	ListPattern     = "GET /jobs"
+	RetryPattern    = "POST /jobs/{job}/retry"
+	CancelPattern   = "POST /jobs/{job}/cancel"
+	CompletePattern = "POST /jobs/{job}/complete"
+)
+
+// ListHandler serves every tracked job
+func ListHandler() http.Handler {
+	return server.RequireAPIKey(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := json.Marshal(List())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	}))
+}
+
+func RetryHandler() http.Handler {
+	return actionHandler(func(r *http.Request) error {
+		return Retry(r.PathValue("job"), r.URL.Query().Get("from"))
+	})
+}
+
+func CancelHandler() http.Handler {
+	return actionHandler(func(r *http.Request) error {
+		return Cancel(r.PathValue("job"))
+	})
+}
+
+func CompleteHandler() http.Handler {
+	return actionHandler(func(r *http.Request) error {
+		return ForceComplete(r.PathValue("job"))
+	})
+}
+
+func actionHandler(action func(r *http.Request) error) http.Handler {
+	return server.RequireAPIKey(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := action(r)
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
@@ -0,0 +1,160 @@
+// Package jobs keeps track of every item blackhole is working on, from the
+// file being picked up in the watch path until it is handed to the debrid
+// monitor or fails.
+package jobs
+
+import (
+	"errors"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/samjwillis97/sams-blackhole/internal/arr"
+	"github.com/samjwillis97/sams-blackhole/internal/clock"
+)
+
+type Job struct {
+	ID             string         `json:"id"`
+	Service        arr.ArrService `json:"-"`
+	Instance       string         `json:"instance"`
+	IngestedPath   string         `json:"ingestedPath,omitempty"`
+	ProcessingPath string         `json:"processingPath"`
+	FailedPath     string         `json:"failedPath,omitempty"` // Where the file is kept once the job has failed
+	DebridID       string         `json:"debridId,omitempty"`
+	Account        string         `json:"account,omitempty"` // The debrid account it goes to, `real_debrid` when empty
+	CompletedPath  string         `json:"completedPath,omitempty"`
+	LinkStrategy   string         `json:"linkStrategy,omitempty"`
+	State          string         `json:"state"`
+	Started        time.Time      `json:"started"`
+	Updated        time.Time      `json:"updated"`
+}
+
+var (
+	mu   sync.Mutex
+	jobs = map[string]Job{}
+)
+
+// Register starts tracking a job, returning it with its ID set
+func Register(job Job) Job {
+	now := clock.Now()
+	job.ID = uuid.NewString()
+	job.Started = now
+	job.Updated = now
+
+	mu.Lock()
+	defer mu.Unlock()
+	jobs[job.ID] = job
+
+	return job
+}
+
+// SetState records the job moving to a new state, jobs that are no longer
+// tracked are ignored
+func SetState(id string, state string) {
+	update(id, func(j *Job) { j.State = state })
+}
+
+// SetDebridID records the torrent added to debrid for the job
+func SetDebridID(id string, debridID string) {
+	update(id, func(j *Job) { j.DebridID = debridID })
+}
+
+// SetFailedPath records where a failed job's file has been kept, writing the
+// job beside it. Clearing it removes what was written for the previous path.
+func SetFailedPath(id string, failedPath string) error {
+	previous, ok := Get(id)
+	if !ok {
+		return ErrNotFound
+	}
+
+	update(id, func(j *Job) { j.FailedPath = failedPath })
+
+	if previous.FailedPath != "" && previous.FailedPath != failedPath {
+		if err := os.Remove(KeptJobPath(previous.FailedPath)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	if failedPath == "" {
+		return nil
+	}
+
+	job, _ := Get(id)
+	return writeKept(job)
+}
+
+// SetProcessingPath records where the job's file is being processed from
+func SetProcessingPath(id string, processingPath string) {
+	update(id, func(j *Job) { j.ProcessingPath = processingPath })
+}
+
+func update(id string, fn func(j *Job)) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	job, ok := jobs[id]
+	if !ok {
+		return
+	}
+
+	fn(&job)
+	job.Updated = clock.Now()
+	jobs[id] = job
+}
+
+// Remove stops tracking a job
+func Remove(id string) {
+	mu.Lock()
+	defer mu.Unlock()
+	delete(jobs, id)
+	delete(handles, id)
+}
+
+// Get returns the job with the ID
+func Get(id string) (Job, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	job, ok := jobs[id]
+	return job, ok
+}
+
+// FindByPath returns the job for a file, by where it was picked up from, is
+// being processed or was kept after failing. Failed jobs are only found by
+// where they were kept, *arr may grab the same release again.
+func FindByPath(p string) (Job, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, job := range jobs {
+		if job.State == "failure" {
+			if job.FailedPath == p {
+				return job, true
+			}
+			continue
+		}
+
+		if job.IngestedPath == p || job.ProcessingPath == p {
+			return job, true
+		}
+	}
+	return Job{}, false
+}
+
+// List returns every tracked job, oldest first
+func List() []Job {
+	mu.Lock()
+	defer mu.Unlock()
+
+	list := make([]Job, 0, len(jobs))
+	for _, job := range jobs {
+		list = append(list, job)
+	}
+
+	slices.SortFunc(list, func(a, b Job) int {
+		return a.Started.Compare(b.Started)
+	})
+
+	return list
+}
@@ -0,0 +1,104 @@
+package jobs_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/samjwillis97/sams-blackhole/internal/config"
+	"github.com/samjwillis97/sams-blackhole/internal/jobs"
+	"github.com/spf13/viper"
+)
+
+const testAPIKey = "server-api-key"
+
+type fakeHandle struct {
+	retriedFrom string
+	cancelled   bool
+}
+
+func (h *fakeHandle) Retry(from string) error {
+	if from == "nowhere" {
+		return errors.New("Can't retry from nowhere")
+	}
+	h.retriedFrom = from
+	return nil
+}
+
+func (h *fakeHandle) Cancel() error {
+	h.cancelled = true
+	return nil
+}
+
+func (h *fakeHandle) ForceComplete() error {
+	return nil
+}
+
+func TestActionHandlers(t *testing.T) {
+	config.InitializeAppConfig(viper.New())
+	mockSecretViper := viper.New()
+	mockSecretViper.Set("SERVER_API_KEY", testAPIKey)
+	config.InitializeSecrets(mockSecretViper)
+
+	job := jobs.Register(jobs.Job{Instance: "sonarr", State: "failure"})
+	t.Cleanup(func() { jobs.Remove(job.ID) })
+	handle := &fakeHandle{}
+	jobs.SetHandle(job.ID, handle)
+
+	mux := http.NewServeMux()
+	mux.Handle(jobs.RetryPattern, jobs.RetryHandler())
+	mux.Handle(jobs.CancelPattern, jobs.CancelHandler())
+	mux.Handle(jobs.ListPattern, jobs.ListHandler())
+
+	send := func(target string, apiKey string) int {
+		method := http.MethodPost
+		if target == "/jobs" {
+			method = http.MethodGet
+		}
+		req := httptest.NewRequest(method, target, nil)
+		req.SetBasicAuth("blackhole", apiKey)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := send("/jobs/"+job.ID+"/cancel", "wrong"); code != http.StatusUnauthorized || handle.cancelled {
+		t.Errorf("Expected a wrong key to be refused, got %d", code)
+	}
+	if code := send("/jobs", "wrong"); code != http.StatusUnauthorized {
+		t.Errorf("Expected listing with a wrong key to be refused, got %d", code)
+	}
+	if code := send("/jobs", testAPIKey); code != http.StatusOK {
+		t.Errorf("Expected the jobs to be listed, got %d", code)
+	}
+	if code := send("/jobs/missing/cancel", testAPIKey); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown job, got %d", code)
+	}
+	if code := send("/jobs/"+job.ID+"/retry?from=nowhere", testAPIKey); code != http.StatusConflict {
+		t.Errorf("Expected 409 when the job can't be retried, got %d", code)
+	}
+	if code := send("/jobs/"+job.ID+"/retry?from=debridProcessing", testAPIKey); code != http.StatusNoContent || handle.retriedFrom != "debridProcessing" {
+		t.Errorf("Expected the job to be retried from debridProcessing, got %d", code)
+	}
+	if code := send("/jobs/"+job.ID+"/cancel", testAPIKey); code != http.StatusNoContent || !handle.cancelled {
+		t.Errorf("Expected the job to be cancelled, got %d", code)
+	}
+}
+
+func TestFindByPathOnlyFindsFailedJobsByWhereTheyWereKept(t *testing.T) {
+	job := jobs.Register(jobs.Job{IngestedPath: "/watch/a.magnet", ProcessingPath: "/processing/a.magnet"})
+	t.Cleanup(func() { jobs.Remove(job.ID) })
+
+	jobs.SetState(job.ID, "failure")
+	jobs.SetFailedPath(job.ID, "/state/failed/a.magnet")
+
+	for _, p := range []string{"/watch/a.magnet", "/processing/a.magnet"} {
+		if _, ok := jobs.FindByPath(p); ok {
+			t.Errorf("Expected the failed job not to own %s", p)
+		}
+	}
+	if found, ok := jobs.FindByPath("/state/failed/a.magnet"); !ok || found.ID != job.ID {
+		t.Errorf("Expected the failed job to be found by its kept file")
+	}
+}
@@ -0,0 +1,68 @@
+package jobs
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+
+	"github.com/samjwillis97/sams-blackhole/internal/arr"
+)
+
+// Jobs only live in memory, so a failed job is written beside its kept file
+// to be rebuilt after a restart rather than losing the chance to retry it
+const keptJobSuffix = ".job.json"
+
+type keptJob struct {
+	Job
+	Service arr.ArrService `json:"service"`
+}
+
+// KeptJobPath is where the job is written beside a failed job's file
+func KeptJobPath(failedPath string) string {
+	return failedPath + keptJobSuffix
+}
+
+// IsKeptJob reports whether a file in the failed directory is a written job
+// rather than a kept file
+func IsKeptJob(p string) bool {
+	return strings.HasSuffix(p, keptJobSuffix)
+}
+
+// ReadKept reads back the job written beside a failed job's file
+func ReadKept(failedPath string) (Job, error) {
+	data, err := os.ReadFile(KeptJobPath(failedPath))
+	if err != nil {
+		return Job{}, err
+	}
+
+	var kept keptJob
+	if err := json.Unmarshal(data, &kept); err != nil {
+		return Job{}, err
+	}
+
+	job := kept.Job
+	job.Service = kept.Service
+	return job, nil
+}
+
+// Restore tracks a job read back after a restart, keeping its ID and times
+func Restore(job Job) {
+	mu.Lock()
+	defer mu.Unlock()
+	jobs[job.ID] = job
+}
+
+func writeKept(job Job) error {
+	data, err := json.MarshalIndent(keptJob{Job: job, Service: job.Service}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Written to the side then renamed so a crash can't leave a partial job
+	tmpPath := KeptJobPath(job.FailedPath) + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, KeptJobPath(job.FailedPath))
+}
@@ -0,0 +1,71 @@
+package jobs
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/samjwillis97/sams-blackhole/internal/config"
+)
+
+// Which subfolder a file was dropped into is lost once it is in processing,
+// so where it was routed is written beside it to be resumed the same way
+const (
+	routeSuffix = ".route.json"
+	tmpSuffix   = ".tmp" // A route still being written, or left by a crash while it was
+)
+
+// RoutePath is where the route is written beside a processing file
+func RoutePath(processingPath string) string {
+	return processingPath + routeSuffix
+}
+
+// IsRoute reports whether a file in processing is a written route, or one
+// being written, rather than a file being processed
+func IsRoute(p string) bool {
+	return strings.HasSuffix(p, routeSuffix) || strings.HasSuffix(p, routeSuffix+tmpSuffix)
+}
+
+// RouteProcessingPath returns the processing file a written route is beside
+func RouteProcessingPath(routePath string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(routePath, tmpSuffix), routeSuffix)
+}
+
+// ReadRoute reads back the route written beside a processing file
+func ReadRoute(processingPath string) (config.Route, error) {
+	data, err := os.ReadFile(RoutePath(processingPath))
+	if err != nil {
+		return config.Route{}, err
+	}
+
+	var route config.Route
+	if err := json.Unmarshal(data, &route); err != nil {
+		return config.Route{}, err
+	}
+	return route, nil
+}
+
+// WriteRoute writes the route beside a processing file
+func WriteRoute(processingPath string, route config.Route) error {
+	data, err := json.MarshalIndent(route, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Written to the side then renamed so a crash can't leave a partial route
+	tmpPath := RoutePath(processingPath) + tmpSuffix
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, RoutePath(processingPath))
+}
+
+// RemoveRoute removes the route written beside a processing file
+func RemoveRoute(processingPath string) error {
+	if err := os.Remove(RoutePath(processingPath)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
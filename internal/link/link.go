@@ -0,0 +1,140 @@
+// Package link creates the files in a completed directory that *arr imports,
+// pointing back at a torrent in the debrid mount.
+package link
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/samjwillis97/sams-blackhole/internal/config"
+	"github.com/samjwillis97/sams-blackhole/internal/debrid"
+)
+
+const (
+	Symlink         = "symlink"
+	SymlinkRelative = "symlink_relative"
+	Hardlink        = "hardlink"
+	Copy            = "copy"
+	Strm            = "strm"
+)
+
+func init() {
+	config.RegisterNames(config.LinkStrategies, Symlink, SymlinkRelative, Hardlink, Copy, Strm)
+}
+
+// File is a single file within a torrent in the mount
+type File struct {
+	Source   string // Absolute path in the mount
+	Relative string // Path relative to the torrent root
+}
+
+type Strategy interface {
+	// Link creates dst from the file, returning the path actually written as
+	// some strategies change the file name
+	Link(f File, dst string) (string, error)
+	// Verify checks that what Link wrote is usable
+	Verify(f File, written string) error
+}
+
+// Torrent is what a strategy may need to know about the torrent being linked
+type Torrent struct {
+	DebridID string
+	Account  string // The debrid account it was added to, `real_debrid` when empty
+}
+
+// New creates the named strategy for a single torrent, an empty name is a
+// symlink
+func New(name string, torrent Torrent, logger *slog.Logger) (Strategy, error) {
+	switch name {
+	case "", Symlink:
+		return symlinkStrategy{}, nil
+	case SymlinkRelative:
+		return symlinkStrategy{relative: true}, nil
+	case Hardlink:
+		return hardlinkStrategy{}, nil
+	case Copy:
+		return copyStrategy{logger: logger}, nil
+	case Strm:
+		if torrent.DebridID == "" {
+			return nil, errors.New("Debrid ID is required to create strm files")
+		}
+		return &strmStrategy{debridID: torrent.DebridID, debrid: debrid.For(torrent.Account)}, nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("Unknown link strategy: %s", name))
+}
+
+// Tree links every file beneath src into dst, dst is created and is removed
+// again if any file fails to link or verify. The number of files linked is
+// returned.
+func Tree(src string, dst string, strategy Strategy) (int, error) {
+	err := os.Mkdir(dst, os.ModePerm)
+	if err != nil {
+		return 0, err
+	}
+
+	linked := 0
+	err = filepath.WalkDir(src, func(currentFile string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		relativePath, err := filepath.Rel(src, currentFile)
+		if err != nil {
+			return err
+		}
+
+		// Single file torrents are linked into the directory by name
+		if relativePath == "." {
+			relativePath = path.Base(currentFile)
+		}
+
+		if strings.HasPrefix(relativePath, "../") {
+			return errors.New("File appears to be from outside root dir")
+		}
+
+		fileToCreate := path.Join(dst, relativePath)
+		err = os.MkdirAll(path.Dir(fileToCreate), os.ModePerm)
+		if err != nil {
+			return err
+		}
+
+		f := File{Source: currentFile, Relative: relativePath}
+		written, err := strategy.Link(f, fileToCreate)
+		if err != nil {
+			return err
+		}
+
+		// Strategies can decide a file isn't worth linking
+		if written == "" {
+			return nil
+		}
+
+		err = strategy.Verify(f, written)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Failed to verify %s: %s", written, err))
+		}
+
+		linked++
+		return nil
+	})
+
+	if err != nil {
+		if removeErr := os.RemoveAll(dst); removeErr != nil {
+			return 0, errors.Join(err, removeErr)
+		}
+		return 0, err
+	}
+
+	return linked, nil
+}
@@ -0,0 +1,178 @@
+package link_test
+
+import (
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/samjwillis97/sams-blackhole/internal/config"
+	"github.com/samjwillis97/sams-blackhole/internal/debrid"
+	"github.com/samjwillis97/sams-blackhole/internal/debrid/debridtest"
+	"github.com/samjwillis97/sams-blackhole/internal/link"
+	"github.com/samjwillis97/sams-blackhole/internal/logger"
+	"github.com/spf13/viper"
+)
+
+var torrentFiles = []string{"Show.S01E01.mkv", "Subs/Show.S01E01.srt"}
+
+func setup(t *testing.T) (string, string) {
+	root := t.TempDir()
+	torrent := path.Join(root, "mount", "Show.S01")
+
+	for _, f := range torrentFiles {
+		fullPath := path.Join(torrent, f)
+		if err := os.MkdirAll(path.Dir(fullPath), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fullPath, []byte("content of "+f), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return torrent, path.Join(root, "completed", "Show.S01")
+}
+
+func newStrategy(t *testing.T, name string, torrent link.Torrent) link.Strategy {
+	log := slog.New(logger.NewHandler(&slog.HandlerOptions{Level: slog.LevelDebug}))
+	strategy, err := link.New(name, torrent, log)
+	if err != nil {
+		t.Fatalf("Expected to create %s strategy, got %s", name, err)
+	}
+	return strategy
+}
+
+func TestSymlinkStrategies(t *testing.T) {
+	for _, name := range []string{link.Symlink, link.SymlinkRelative} {
+		t.Run(name, func(t *testing.T) {
+			src, dst := setup(t)
+			os.MkdirAll(path.Dir(dst), os.ModePerm)
+
+			linked, err := link.Tree(src, dst, newStrategy(t, name, link.Torrent{}))
+			if err != nil {
+				t.Fatalf("Expected no error, got %s", err)
+			}
+			if linked != len(torrentFiles) {
+				t.Errorf("Expected %d files linked, got %d", len(torrentFiles), linked)
+			}
+
+			for _, f := range torrentFiles {
+				target, err := os.Readlink(path.Join(dst, f))
+				if err != nil {
+					t.Errorf("Expected a symlink for %s: %s", f, err)
+					continue
+				}
+				if path.IsAbs(target) != (name == link.Symlink) {
+					t.Errorf("Unexpected target %s for %s strategy", target, name)
+				}
+				if _, err := os.Stat(path.Join(dst, f)); err != nil {
+					t.Errorf("Expected %s to resolve: %s", f, err)
+				}
+			}
+		})
+	}
+}
+
+func TestHardlinkStrategy(t *testing.T) {
+	src, dst := setup(t)
+	os.MkdirAll(path.Dir(dst), os.ModePerm)
+
+	_, err := link.Tree(src, dst, newStrategy(t, link.Hardlink, link.Torrent{}))
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	for _, f := range torrentFiles {
+		info, err := os.Lstat(path.Join(dst, f))
+		if err != nil || !info.Mode().IsRegular() {
+			t.Errorf("Expected a regular file for %s: %v", f, err)
+		}
+	}
+}
+
+func TestCopyStrategy(t *testing.T) {
+	src, dst := setup(t)
+	os.MkdirAll(path.Dir(dst), os.ModePerm)
+
+	_, err := link.Tree(src, dst, newStrategy(t, link.Copy, link.Torrent{}))
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	for _, f := range torrentFiles {
+		content, err := os.ReadFile(path.Join(dst, f))
+		if err != nil || string(content) != "content of "+f {
+			t.Errorf("Expected %s to be copied, got %q: %v", f, content, err)
+		}
+		if _, err := os.Stat(path.Join(dst, f) + ".partial"); !os.IsNotExist(err) {
+			t.Errorf("Expected no partial file left for %s", f)
+		}
+	}
+}
+
+func setupDebrid(t *testing.T) *debridtest.Server {
+	server := debridtest.NewServer()
+	t.Cleanup(server.Close)
+
+	mockViper := viper.New()
+	mockViper.Set("real_debrid.url", server.URL)
+	config.InitializeAppConfig(mockViper)
+
+	return server
+}
+
+func TestStrmStrategy(t *testing.T) {
+	server := setupDebrid(t)
+	server.Expect(debridtest.Torrent{
+		ID: "STRM1",
+		Files: []debrid.TorrentFile{
+			{ID: 1, Path: "/Show.S01/Sample.mkv", Selected: 0},
+			{ID: 2, Path: "/Show.S01/Show.S01E01.mkv", Selected: 1},
+			{ID: 3, Path: "/Show.S01/Subs/Show.S01E01.srt", Selected: 1},
+		},
+		Links: []string{"https://real-debrid.com/d/EPISODE", "https://real-debrid.com/d/SUBS"},
+	})
+	if _, err := debrid.AddMagnet("magnet:?xt=urn:btih:abc"); err != nil {
+		t.Fatal(err)
+	}
+
+	src, dst := setup(t)
+	os.MkdirAll(path.Dir(dst), os.ModePerm)
+
+	linked, err := link.Tree(src, dst, newStrategy(t, link.Strm, link.Torrent{DebridID: "STRM1"}))
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if linked != 1 {
+		t.Errorf("Expected only the video to be linked, got %d", linked)
+	}
+
+	content, err := os.ReadFile(path.Join(dst, "Show.S01E01.strm"))
+	if err != nil {
+		t.Fatalf("Expected a strm file: %s", err)
+	}
+	if expected := server.URL + "/download/EPISODE"; strings.TrimSpace(string(content)) != expected {
+		t.Errorf("Expected strm to contain %s, got %s", expected, content)
+	}
+}
+
+func TestFailedLinkCleansUp(t *testing.T) {
+	server := setupDebrid(t)
+	server.Expect(debridtest.Torrent{ID: "EMPTY1"})
+	if _, err := debrid.AddMagnet("magnet:?xt=urn:btih:abc"); err != nil {
+		t.Fatal(err)
+	}
+
+	src, dst := setup(t)
+	os.MkdirAll(path.Dir(dst), os.ModePerm)
+
+	_, err := link.Tree(src, dst, newStrategy(t, link.Strm, link.Torrent{DebridID: "EMPTY1"}))
+	if err == nil {
+		t.Fatalf("Expected linking to fail without any debrid links")
+	}
+
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Errorf("Expected %s to be removed after failing", dst)
+	}
+}
@@ -0,0 +1,218 @@
+package link
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/samjwillis97/sams-blackhole/internal/debrid"
+)
+
+type symlinkStrategy struct {
+	relative bool
+}
+
+func (s symlinkStrategy) Link(f File, dst string) (string, error) {
+	target := f.Source
+	if s.relative {
+		var err error
+		target, err = filepath.Rel(path.Dir(dst), f.Source)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return dst, os.Symlink(target, dst)
+}
+
+func (s symlinkStrategy) Verify(f File, written string) error {
+	_, err := os.Stat(written)
+	return err
+}
+
+type hardlinkStrategy struct{}
+
+func (hardlinkStrategy) Link(f File, dst string) (string, error) {
+	return dst, os.Link(f.Source, dst)
+}
+
+func (hardlinkStrategy) Verify(f File, written string) error {
+	sourceInfo, err := os.Stat(f.Source)
+	if err != nil {
+		return err
+	}
+
+	writtenInfo, err := os.Stat(written)
+	if err != nil {
+		return err
+	}
+
+	if !os.SameFile(sourceInfo, writtenInfo) {
+		return errors.New("Hardlink does not point at the source file")
+	}
+
+	return nil
+}
+
+type copyStrategy struct {
+	logger *slog.Logger
+}
+
+// Copies to a partial file first so *arr never imports half a file
+func (s copyStrategy) Link(f File, dst string) (string, error) {
+	source, err := os.Open(f.Source)
+	if err != nil {
+		return "", err
+	}
+	defer source.Close()
+
+	info, err := source.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	partialPath := dst + ".partial"
+	destination, err := os.Create(partialPath)
+	if err != nil {
+		return "", err
+	}
+
+	progress := &progressWriter{
+		logger: s.logger.With("file", f.Relative),
+		total:  info.Size(),
+	}
+
+	_, err = io.Copy(destination, io.TeeReader(source, progress))
+	closeErr := destination.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(partialPath)
+		return "", err
+	}
+
+	return dst, os.Rename(partialPath, dst)
+}
+
+func (copyStrategy) Verify(f File, written string) error {
+	sourceInfo, err := os.Stat(f.Source)
+	if err != nil {
+		return err
+	}
+
+	writtenInfo, err := os.Stat(written)
+	if err != nil {
+		return err
+	}
+
+	if sourceInfo.Size() != writtenInfo.Size() {
+		return errors.New(fmt.Sprintf("Copied %d bytes, expected %d", writtenInfo.Size(), sourceInfo.Size()))
+	}
+
+	return nil
+}
+
+// progressWriter logs every 10% of a copy
+type progressWriter struct {
+	logger   *slog.Logger
+	total    int64
+	written  int64
+	reported int64
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.written += int64(len(b))
+
+	if p.total > 0 {
+		percent := p.written * 100 / p.total
+		if percent/10 > p.reported/10 {
+			p.reported = percent
+			p.logger.Info("copying", "percent", percent, "bytes", p.written, "totalBytes", p.total)
+		}
+	}
+
+	return len(b), nil
+}
+
+var strmExtensions = []string{".mkv", ".mp4", ".m4v", ".avi", ".mov", ".wmv", ".ts", ".webm"}
+
+// strmStrategy writes a `.strm` file per video containing a direct download
+// link from debrid, anything that isn't a video is skipped
+type strmStrategy struct {
+	debridID string
+	debrid   debrid.Client
+	info     *debrid.GetInfoResponse
+}
+
+func (s *strmStrategy) Link(f File, dst string) (string, error) {
+	ext := strings.ToLower(path.Ext(f.Relative))
+	isVideo := false
+	for _, e := range strmExtensions {
+		isVideo = isVideo || ext == e
+	}
+	if !isVideo {
+		return "", nil
+	}
+
+	hosterLink, err := s.hosterLink(f)
+	if err != nil {
+		return "", err
+	}
+
+	unrestricted, err := s.debrid.UnrestrictLink(hosterLink)
+	if err != nil {
+		return "", err
+	}
+
+	strmPath := strings.TrimSuffix(dst, path.Ext(dst)) + ".strm"
+	return strmPath, os.WriteFile(strmPath, []byte(unrestricted.Download+"\n"), 0o644)
+}
+
+func (s *strmStrategy) Verify(f File, written string) error {
+	content, err := os.ReadFile(written)
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasPrefix(string(content), "http") {
+		return errors.New("strm file does not contain a link")
+	}
+
+	return nil
+}
+
+// hosterLink finds the debrid link for a file, links are given in the same
+// order as the selected files
+func (s *strmStrategy) hosterLink(f File) (string, error) {
+	if s.info == nil {
+		info, err := s.debrid.GetInfo(s.debridID)
+		if err != nil {
+			return "", err
+		}
+		s.info = &info
+	}
+
+	selected := 0
+	for _, file := range s.info.Files {
+		if file.Selected == 0 {
+			continue
+		}
+
+		if strings.HasSuffix(file.Path, "/"+f.Relative) || path.Base(file.Path) == path.Base(f.Relative) {
+			if selected >= len(s.info.Links) {
+				break
+			}
+			return s.info.Links[selected], nil
+		}
+
+		selected++
+	}
+
+	return "", errors.New(fmt.Sprintf("No debrid link found for %s", f.Relative))
+}
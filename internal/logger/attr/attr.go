@@ -0,0 +1,33 @@
+// Package attr names the log attributes shared between modules, so an item
+// can be followed through every part of blackhole with the same query.
+package attr
+
+import "log/slog"
+
+const (
+	MonitorNameKey  = "monitorName"  // Which monitor or background task logged
+	EventIDKey      = "eventID"      // A single filesystem event and everything it caused
+	DebridIDKey     = "debridID"     // The torrent's ID on debrid
+	InfoHashKey     = "infoHash"     // The torrent's info hash, which *arr calls the download ID
+	HandlerStateKey = "handlerState" // The state an item's state machine is in
+)
+
+func MonitorName(name string) slog.Attr {
+	return slog.String(MonitorNameKey, name)
+}
+
+func EventID(id string) slog.Attr {
+	return slog.String(EventIDKey, id)
+}
+
+func DebridID(id string) slog.Attr {
+	return slog.String(DebridIDKey, id)
+}
+
+func InfoHash(hash string) slog.Attr {
+	return slog.String(InfoHashKey, hash)
+}
+
+func HandlerState(state string) slog.Attr {
+	return slog.String(HandlerStateKey, state)
+}
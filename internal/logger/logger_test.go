@@ -0,0 +1,114 @@
+package logger_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/samjwillis97/sams-blackhole/internal/config"
+	"github.com/samjwillis97/sams-blackhole/internal/logger"
+	"github.com/samjwillis97/sams-blackhole/internal/logger/attr"
+)
+
+func TestFormats(t *testing.T) {
+	tests := []struct {
+		format   string
+		expected string
+	}{
+		{"json", `"monitorName":"test"`},
+		{"logfmt", `monitorName=test`},
+		{"pretty", `"monitorName": "test"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			var out bytes.Buffer
+			log, closer, err := logger.FromConfig(config.LogConfig{Level: "info", Format: test.format, Color: "auto"}, &out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closer.Close()
+
+			log.Debug("hidden")
+			log.With(attr.MonitorName("test")).Info("shown")
+
+			if strings.Contains(out.String(), "hidden") {
+				t.Errorf("Expected debug logs to be filtered out, got %s", out.String())
+			}
+			if !strings.Contains(out.String(), test.expected) {
+				t.Errorf("Expected %s in %s", test.expected, out.String())
+			}
+			if strings.Contains(out.String(), "\033[") {
+				t.Errorf("Expected no color when not writing to a terminal")
+			}
+		})
+	}
+
+	if _, _, err := logger.FromConfig(config.LogConfig{Format: "xml"}, &bytes.Buffer{}); err == nil {
+		t.Errorf("Expected an unknown format to fail")
+	}
+}
+
+func TestFileOutput(t *testing.T) {
+	logPath := path.Join(t.TempDir(), "blackhole.log")
+
+	var out bytes.Buffer
+	log, closer, err := logger.FromConfig(config.LogConfig{Format: "json", Color: "always", File: config.LogFileConfig{Path: logPath}}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log.Info("written twice")
+	closer.Close()
+
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var record map[string]any
+	if err := json.Unmarshal(data, &record); err != nil {
+		t.Fatalf("Expected a JSON record in the file, got %s", data)
+	}
+	if record["msg"] != "written twice" || !strings.Contains(out.String(), "written twice") {
+		t.Errorf("Expected the record in both outputs")
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	logPath := path.Join(t.TempDir(), "blackhole.log")
+
+	file, err := logger.OpenRotatingFile(logPath, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := file.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string]string{
+		logPath:        "fourth\n",
+		logPath + ".1": "third\n",
+		logPath + ".2": "second\n",
+	}
+	for p, contents := range expected {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != contents {
+			t.Errorf("Expected %q in %s, got %q", contents, p, data)
+		}
+	}
+
+	if _, err := os.Stat(logPath + ".3"); err == nil {
+		t.Errorf("Expected only two backups to be kept")
+	}
+}
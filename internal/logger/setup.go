@@ -0,0 +1,145 @@
+package logger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/mattn/go-isatty"
+	"github.com/samjwillis97/sams-blackhole/internal/config"
+)
+
+const (
+	defaultMaxSize    = 100 // Megabytes
+	defaultMaxBackups = 5
+)
+
+func init() {
+	config.RegisterNames(config.LogLevels, "debug", "info", "warn", "error")
+	config.RegisterNames(config.LogFormats, "pretty", "logfmt", "json")
+	config.RegisterNames(config.LogColors, "auto", "always", "never")
+}
+
+// FromConfig creates the logger described by the config, writing to out and
+// the log file when there is one. The returned closer closes the log file.
+func FromConfig(conf config.LogConfig, out io.Writer) (*slog.Logger, io.Closer, error) {
+	var level slog.Level
+	if conf.Level != "" {
+		if err := level.UnmarshalText([]byte(conf.Level)); err != nil {
+			return nil, nil, err
+		}
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	handler, err := newFormatHandler(conf.Format, out, useColor(conf.Color, out), opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if conf.File.Path == "" {
+		return slog.New(handler), io.NopCloser(nil), nil
+	}
+
+	maxSize := conf.File.MaxSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxSize
+	}
+	maxBackups := conf.File.MaxBackups
+	if maxBackups <= 0 {
+		maxBackups = defaultMaxBackups
+	}
+
+	file, err := OpenRotatingFile(conf.File.Path, int64(maxSize)*1024*1024, maxBackups)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Escape codes are never wanted in a file
+	fileHandler, err := newFormatHandler(conf.Format, file, false, opts)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	return slog.New(fanout{handler, fileHandler}), file, nil
+}
+
+func newFormatHandler(format string, out io.Writer, color bool, opts *slog.HandlerOptions) (slog.Handler, error) {
+	switch format {
+	case "", "pretty":
+		options := []Option{WithDestinationWriter(out), WithOutputEmptyAttrs()}
+		if color {
+			options = append(options, WithColor())
+		}
+		return New(opts, options...), nil
+	case "logfmt":
+		return slog.NewTextHandler(out, opts), nil
+	case "json":
+		return slog.NewJSONHandler(out, opts), nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("Unknown log format: %s", format))
+}
+
+// useColor decides whether escape codes are written, `auto` only colors a
+// terminal and respects NO_COLOR
+func useColor(mode string, out io.Writer) bool {
+	switch strings.ToLower(mode) {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+
+	f, ok := out.(*os.File)
+	if !ok {
+		return false
+	}
+	return isatty.IsTerminal(f.Fd()) || isatty.IsCygwinTerminal(f.Fd())
+}
+
+// fanout sends each record to every handler
+type fanout []slog.Handler
+
+func (f fanout) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range f {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f fanout) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range f {
+		if h.Enabled(ctx, r.Level) {
+			errs = append(errs, h.Handle(ctx, r.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (f fanout) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(fanout, len(f))
+	for i, h := range f {
+		handlers[i] = h.WithAttrs(attrs)
+	}
+	return handlers
+}
+
+func (f fanout) WithGroup(name string) slog.Handler {
+	handlers := make(fanout, len(f))
+	for i, h := range f {
+		handlers[i] = h.WithGroup(name)
+	}
+	return handlers
+}
@@ -0,0 +1,110 @@
+// Package mediaserver tells Plex, Jellyfin and Emby to scan the folders *arr
+// imported into, rather than leaving them to notice the files on their own
+// schedule.
+package mediaserver
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/samjwillis97/sams-blackhole/internal/clock"
+	"github.com/samjwillis97/sams-blackhole/internal/config"
+	"github.com/samjwillis97/sams-blackhole/internal/metrics"
+)
+
+func init() {
+	config.RegisterNames(config.MediaServerTypes, "plex", "jellyfin", "emby")
+}
+
+var refreshFailures = metrics.NewCounter("blackhole_media_server_refresh_failures_total", "Number of media server scans that failed after every retry")
+
+// Server scans part of a media server's library
+type Server interface {
+	Refresh(folder string) error
+}
+
+// New creates the client for a media server
+func New(conf config.MediaServerConfig) (Server, error) {
+	switch conf.Type {
+	case "plex":
+		return plexServer{url: conf.Url, token: conf.Token()}, nil
+	case "jellyfin":
+		return jellyfinServer{url: conf.Url, token: conf.Token(), emby: false}, nil
+	case "emby":
+		return jellyfinServer{url: conf.Url, token: conf.Token(), emby: true}, nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("Unknown media server type: %s", conf.Type))
+}
+
+// Refresh has every media server the instance's imports go to scan the
+// folder of each imported file, retrying by the server's policy. Failures are
+// logged. It waits on the retries so is best called in its own goroutine.
+func Refresh(logger *slog.Logger, instance string, importedFiles []string) {
+	folders := []string{}
+	for _, f := range importedFiles {
+		if f == "" {
+			continue
+		}
+		if folder := path.Dir(f); !slices.Contains(folders, folder) {
+			folders = append(folders, folder)
+		}
+	}
+	if len(folders) == 0 {
+		return
+	}
+
+	for _, conf := range config.GetAppConfig().MediaServers {
+		if len(conf.Instances) > 0 && !slices.Contains(conf.Instances, instance) {
+			continue
+		}
+
+		serverLogger := logger.With("mediaServer", conf.Name)
+
+		server, err := New(conf)
+		if err != nil {
+			serverLogger.Error("failed to create media server", "err", err)
+			continue
+		}
+
+		for _, folder := range folders {
+			folder = mapPath(conf.PathMappings, folder)
+			if err := refreshWithRetry(server, folder, conf.GetRetry(), serverLogger); err != nil {
+				refreshFailures.Inc()
+				serverLogger.Warn("failed to refresh media server", "folder", folder, "err", err)
+				continue
+			}
+			serverLogger.Info("refreshed media server", "folder", folder)
+		}
+	}
+}
+
+func refreshWithRetry(server Server, folder string, retry config.RetryPolicy, logger *slog.Logger) error {
+	var err error
+	for attempt := 1; attempt <= retry.MaxAttempts; attempt++ {
+		err = server.Refresh(folder)
+		if err == nil || attempt == retry.MaxAttempts {
+			break
+		}
+
+		delay := retry.Delay(attempt)
+		logger.Debug("media server refresh failed, retrying", "folder", folder, "attempt", attempt, "delay", delay, "err", err)
+		clock.Sleep(delay)
+	}
+	return err
+}
+
+// mapPath swaps the prefix of the first mapping the path is under
+func mapPath(mappings []config.PathMapping, p string) string {
+	for _, m := range mappings {
+		from := strings.TrimSuffix(m.From, "/")
+		if p == from || strings.HasPrefix(p, from+"/") {
+			return path.Join(m.To, strings.TrimPrefix(p, from))
+		}
+	}
+	return p
+}
@@ -0,0 +1,123 @@
+package mediaserver_test
+
+import (
+	"log/slog"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/samjwillis97/sams-blackhole/internal/config"
+	"github.com/samjwillis97/sams-blackhole/internal/logger"
+	"github.com/samjwillis97/sams-blackhole/internal/mediaserver"
+	"github.com/samjwillis97/sams-blackhole/internal/mediaserver/mediaservertest"
+	"github.com/spf13/viper"
+)
+
+func setup(t *testing.T, servers []map[string]any, secrets map[string]string) *slog.Logger {
+	for _, s := range servers {
+		s["retry"] = map[string]any{"max_attempts": 3, "backoff": time.Millisecond}
+	}
+
+	mockViper := viper.New()
+	mockViper.Set("state_path", t.TempDir())
+	mockViper.Set("media_servers", servers)
+	config.InitializeAppConfig(mockViper)
+
+	mockSecretViper := viper.New()
+	for k, v := range secrets {
+		mockSecretViper.Set(k, v)
+	}
+	config.InitializeSecrets(mockSecretViper)
+
+	return slog.New(logger.NewHandler(&slog.HandlerOptions{Level: slog.LevelDebug}))
+}
+
+func newServer(t *testing.T) *mediaservertest.Server {
+	server := mediaservertest.NewServer()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestEachServerTypeIsRefreshed(t *testing.T) {
+	plex := newServer(t)
+	plex.Sections["1"] = "/media/movies"
+	plex.Sections["2"] = "/media/tv"
+	plex.Sections["3"] = "/media/tv/anime"
+	jellyfin := newServer(t)
+	emby := newServer(t)
+
+	log := setup(t, []map[string]any{
+		{"name": "plex", "type": "plex", "url": plex.URL},
+		{"name": "jellyfin", "type": "jellyfin", "url": jellyfin.URL},
+		{"name": "emby", "type": "emby", "url": emby.URL + "/emby"},
+	}, map[string]string{"PLEX_TOKEN": "plex-token", "JELLYFIN_TOKEN": "jellyfin-token", "EMBY_TOKEN": "emby-token"})
+
+	mediaserver.Refresh(log, "sonarr", []string{
+		"/media/tv/Show/Season 01/Show.S01E01.mkv",
+		"/media/tv/Show/Season 01/Show.S01E02.mkv",
+		"/media/tv/anime/Other/Season 01/Other.S01E01.mkv",
+	})
+
+	expectedPlex := []mediaservertest.Refresh{
+		{Section: "2", Path: "/media/tv/Show/Season 01", Token: "plex-token"},
+		{Section: "3", Path: "/media/tv/anime/Other/Season 01", Token: "plex-token"},
+	}
+	if refreshes := plex.Refreshes(); !slices.Equal(refreshes, expectedPlex) {
+		t.Errorf("Expected Plex refreshes %v, got %v", expectedPlex, refreshes)
+	}
+
+	expectedJellyfin := []mediaservertest.Refresh{
+		{Path: "/media/tv/Show/Season 01", Token: `MediaBrowser Token="jellyfin-token"`},
+		{Path: "/media/tv/anime/Other/Season 01", Token: `MediaBrowser Token="jellyfin-token"`},
+	}
+	if refreshes := jellyfin.Refreshes(); !slices.Equal(refreshes, expectedJellyfin) {
+		t.Errorf("Expected Jellyfin refreshes %v, got %v", expectedJellyfin, refreshes)
+	}
+
+	expectedEmby := []mediaservertest.Refresh{
+		{Path: "/media/tv/Show/Season 01", Token: "emby-token"},
+		{Path: "/media/tv/anime/Other/Season 01", Token: "emby-token"},
+	}
+	if refreshes := emby.Refreshes(); !slices.Equal(refreshes, expectedEmby) {
+		t.Errorf("Expected Emby refreshes %v, got %v", expectedEmby, refreshes)
+	}
+}
+
+func TestFailedRefreshIsRetried(t *testing.T) {
+	jellyfin := newServer(t)
+	jellyfin.Fail(2)
+
+	log := setup(t, []map[string]any{
+		{"name": "jellyfin", "type": "jellyfin", "url": jellyfin.URL},
+	}, map[string]string{"JELLYFIN_TOKEN": "token"})
+
+	mediaserver.Refresh(log, "radarr", []string{"/media/movies/Movie (2024)/Movie.mkv"})
+
+	if refreshes := jellyfin.Refreshes(); len(refreshes) != 1 || refreshes[0].Path != "/media/movies/Movie (2024)" {
+		t.Errorf("Expected the refresh to succeed on the last attempt, got %v", refreshes)
+	}
+}
+
+func TestPathsAreMappedForMatchingInstances(t *testing.T) {
+	plex := newServer(t)
+	plex.Sections["1"] = "/data/movies"
+
+	log := setup(t, []map[string]any{
+		{
+			"name":          "plex",
+			"type":          "plex",
+			"url":           plex.URL,
+			"api_key":       "inline-token",
+			"instances":     []string{"radarr"},
+			"path_mappings": []map[string]any{{"from": "/media/", "to": "/data"}},
+		},
+	}, nil)
+
+	mediaserver.Refresh(log, "sonarr", []string{"/media/movies/Ignored (2024)/Ignored.mkv"})
+	mediaserver.Refresh(log, "radarr", []string{"/media/movies/Movie (2024)/Movie.mkv"})
+
+	expected := []mediaservertest.Refresh{{Section: "1", Path: "/data/movies/Movie (2024)", Token: "inline-token"}}
+	if refreshes := plex.Refreshes(); !slices.Equal(refreshes, expected) {
+		t.Errorf("Expected refreshes %v, got %v", expected, refreshes)
+	}
+}
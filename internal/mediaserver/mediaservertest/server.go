@@ -0,0 +1,149 @@
+// Package mediaservertest provides an in-process fake of the Plex, Jellyfin
+// and Emby library scan APIs for use in tests.
+package mediaservertest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+)
+
+// Refresh is a single scan received by the fake server
+type Refresh struct {
+	Section string // The Plex library section, empty for Jellyfin and Emby
+	Path    string
+	Token   string // However the server type sends it
+}
+
+type Server struct {
+	*httptest.Server
+
+	// Plex library sections, by key, and the folder each is at
+	Sections map[string]string
+
+	mu        sync.Mutex
+	refreshes []Refresh
+	failures  int
+}
+
+// NewServer starts a fake media server, it should be closed by the caller
+func NewServer() *Server {
+	s := &Server{Sections: map[string]string{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /library/sections", s.handleSections)
+	mux.HandleFunc("GET /library/sections/{key}/refresh", s.handlePlexRefresh)
+	mux.HandleFunc("POST /Library/Media/Updated", s.handleMediaUpdated)
+	mux.HandleFunc("POST /emby/Library/Media/Updated", s.handleMediaUpdated)
+
+	s.Server = httptest.NewServer(s.failing(mux))
+
+	return s
+}
+
+// Fail makes the next requests fail with a server error
+func (s *Server) Fail(times int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = times
+}
+
+func (s *Server) Refreshes() []Refresh {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Refresh{}, s.refreshes...)
+}
+
+func (s *Server) failing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		fail := s.failures > 0
+		if fail {
+			s.failures--
+		}
+		s.mu.Unlock()
+
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleSections(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]string, 0, len(s.Sections))
+	for key := range s.Sections {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	directories := []map[string]any{}
+	for _, key := range keys {
+		directories = append(directories, map[string]any{
+			"key":      key,
+			"Location": []map[string]any{{"path": s.Sections[key]}},
+		})
+	}
+
+	writeJSON(w, map[string]any{"MediaContainer": map[string]any{"Directory": directories}})
+}
+
+func (s *Server) handlePlexRefresh(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := r.PathValue("key")
+	if _, ok := s.Sections[key]; !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	s.refreshes = append(s.refreshes, Refresh{
+		Section: key,
+		Path:    r.URL.Query().Get("path"),
+		Token:   r.Header.Get("X-Plex-Token"),
+	})
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) handleMediaUpdated(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Updates []struct {
+			Path string `json:"Path"`
+		} `json:"Updates"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	token := r.Header.Get("X-Emby-Token")
+	if token == "" {
+		token = r.Header.Get("Authorization")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range body.Updates {
+		s.refreshes = append(s.refreshes, Refresh{Path: u.Path, Token: token})
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, body any) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
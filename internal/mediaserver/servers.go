@@ -0,0 +1,148 @@
+package mediaserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var client = &http.Client{}
+
+// Plex only scans within a library section, so the section holding the folder
+// is looked up first
+type plexServer struct {
+	url   string
+	token string
+}
+
+type plexSections struct {
+	MediaContainer struct {
+		Directory []struct {
+			Key      string `json:"key"`
+			Location []struct {
+				Path string `json:"path"`
+			} `json:"Location"`
+		} `json:"Directory"`
+	} `json:"MediaContainer"`
+}
+
+func (s plexServer) Refresh(folder string) error {
+	section, err := s.section(folder)
+	if err != nil {
+		return err
+	}
+
+	reqUrl, err := url.Parse(s.url)
+	if err != nil {
+		return err
+	}
+	reqUrl = reqUrl.JoinPath("library/sections", section, "refresh")
+	reqUrl.RawQuery = url.Values{"path": {folder}}.Encode()
+
+	_, err = s.get(reqUrl.String())
+	return err
+}
+
+// section finds the library section with the deepest location holding the
+// folder
+func (s plexServer) section(folder string) (string, error) {
+	reqUrl, err := url.JoinPath(s.url, "library/sections")
+	if err != nil {
+		return "", err
+	}
+
+	body, err := s.get(reqUrl)
+	if err != nil {
+		return "", err
+	}
+
+	var sections plexSections
+	if err := json.Unmarshal(body, &sections); err != nil {
+		return "", err
+	}
+
+	found, longest := "", -1
+	for _, d := range sections.MediaContainer.Directory {
+		for _, l := range d.Location {
+			location := strings.TrimSuffix(l.Path, "/")
+			if folder != location && !strings.HasPrefix(folder, location+"/") {
+				continue
+			}
+			if len(location) > longest {
+				found, longest = d.Key, len(location)
+			}
+		}
+	}
+
+	if found == "" {
+		return "", errors.New(fmt.Sprintf("No Plex library section holds %s", folder))
+	}
+	return found, nil
+}
+
+func (s plexServer) get(reqUrl string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, reqUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Plex-Token", s.token)
+
+	return send(req)
+}
+
+// Emby's API is the one Jellyfin was forked from, they only differ in how
+// the token is sent. An Emby url usually ends in `/emby`.
+type jellyfinServer struct {
+	url   string
+	token string
+	emby  bool
+}
+
+func (s jellyfinServer) Refresh(folder string) error {
+	reqUrl, err := url.JoinPath(s.url, "Library/Media/Updated")
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"Updates": []map[string]string{{"Path": folder, "UpdateType": "Created"}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, reqUrl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.emby {
+		req.Header.Set("X-Emby-Token", s.token)
+	} else {
+		req.Header.Set("Authorization", fmt.Sprintf(`MediaBrowser Token="%s"`, s.token))
+	}
+
+	_, err = send(req)
+	return err
+}
+
+func send(req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		return nil, errors.New(fmt.Sprintf("Unable to make request response code: %d, message: %s", resp.StatusCode, string(body)))
+	}
+
+	return body, nil
+}
@@ -0,0 +1,165 @@
+// Package metrics keeps a small set of gauges and counters and writes them in
+// the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type kind string
+
+const (
+	gaugeKind   kind = "gauge"
+	counterKind kind = "counter"
+)
+
+type metric struct {
+	name       string
+	help       string
+	kind       kind
+	labelNames []string
+
+	mu     sync.Mutex
+	values map[string]float64 // Keyed by the label values joined with `labelSeparator`
+}
+
+const labelSeparator = "\x00"
+
+// Gauge is a value that can go up and down
+type Gauge struct{ m *metric }
+
+// Counter is a value that only goes up
+type Counter struct{ m *metric }
+
+var (
+	registryMu sync.Mutex
+	registry   = map[string]*metric{}
+)
+
+// NewGauge registers a gauge, registering the same name twice returns the
+// existing gauge
+func NewGauge(name string, help string, labelNames ...string) Gauge {
+	return Gauge{register(name, help, gaugeKind, labelNames)}
+}
+
+// NewCounter registers a counter, registering the same name twice returns the
+// existing counter
+func NewCounter(name string, help string, labelNames ...string) Counter {
+	return Counter{register(name, help, counterKind, labelNames)}
+}
+
+func register(name string, help string, k kind, labelNames []string) *metric {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if existing, ok := registry[name]; ok {
+		return existing
+	}
+
+	m := &metric{name: name, help: help, kind: k, labelNames: labelNames, values: map[string]float64{}}
+	registry[name] = m
+	return m
+}
+
+// Set replaces the value for the given label values
+func (g Gauge) Set(value float64, labelValues ...string) {
+	g.m.update(labelValues, func(float64) float64 { return value })
+}
+
+// Add changes the value for the given label values, negative values decrease it
+func (g Gauge) Add(delta float64, labelValues ...string) {
+	g.m.update(labelValues, func(current float64) float64 { return current + delta })
+}
+
+// Inc adds one to the value for the given label values
+func (c Counter) Inc(labelValues ...string) {
+	c.m.update(labelValues, func(current float64) float64 { return current + 1 })
+}
+
+// Value returns the current value for the given label values
+func (g Gauge) Value(labelValues ...string) float64 {
+	return g.m.value(labelValues)
+}
+
+// Value returns the current value for the given label values
+func (c Counter) Value(labelValues ...string) float64 {
+	return c.m.value(labelValues)
+}
+
+func (m *metric) update(labelValues []string, fn func(float64) float64) {
+	if len(labelValues) != len(m.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", m.name, len(m.labelNames), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, labelSeparator)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[key] = fn(m.values[key])
+}
+
+func (m *metric) value(labelValues []string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.values[strings.Join(labelValues, labelSeparator)]
+}
+
+// Write outputs every registered metric in the Prometheus text format
+func Write(w io.Writer) error {
+	registryMu.Lock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	registryMu.Unlock()
+	sort.Strings(names)
+
+	for _, name := range names {
+		registryMu.Lock()
+		m := registry[name]
+		registryMu.Unlock()
+
+		if _, err := io.WriteString(w, m.text()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *metric) text() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(&b, "# TYPE %s %s\n", m.name, m.kind)
+
+	// Metrics without labels always have a value so they show up before
+	// anything has happened
+	if len(m.labelNames) == 0 {
+		fmt.Fprintf(&b, "%s %v\n", m.name, m.values[""])
+		return b.String()
+	}
+
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		values := strings.Split(key, labelSeparator)
+		labels := make([]string, 0, len(values))
+		for i, v := range values {
+			labels = append(labels, fmt.Sprintf("%s=%q", m.labelNames[i], v))
+		}
+		fmt.Fprintf(&b, "%s{%s} %v\n", m.name, strings.Join(labels, ","), m.values[key])
+	}
+
+	return b.String()
+}
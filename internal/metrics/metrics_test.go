@@ -0,0 +1,43 @@
+package metrics_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/samjwillis97/sams-blackhole/internal/metrics"
+)
+
+func TestWritePrometheusText(t *testing.T) {
+	gauge := metrics.NewGauge("test_items_waiting", "Items waiting")
+	counter := metrics.NewCounter("test_items_total", "Items handled", "instance", "outcome")
+
+	gauge.Add(2)
+	gauge.Add(-1)
+	counter.Inc("sonarr", "completed")
+	counter.Inc("sonarr", "completed")
+	counter.Inc("radarr", "failed")
+
+	var b strings.Builder
+	if err := metrics.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"# HELP test_items_waiting Items waiting\n# TYPE test_items_waiting gauge\ntest_items_waiting 1\n",
+		"# TYPE test_items_total counter\n" +
+			"test_items_total{instance=\"radarr\",outcome=\"failed\"} 1\n" +
+			"test_items_total{instance=\"sonarr\",outcome=\"completed\"} 2\n",
+	}
+	for _, e := range expected {
+		if !strings.Contains(b.String(), e) {
+			t.Errorf("Expected output to contain:\n%s\ngot:\n%s", e, b.String())
+		}
+	}
+}
+
+func TestRegisteringTwiceSharesValues(t *testing.T) {
+	metrics.NewCounter("test_shared_total", "Shared").Inc()
+	if value := metrics.NewCounter("test_shared_total", "Shared").Value(); value != 1 {
+		t.Errorf("Expected the existing counter to be returned, got value %v", value)
+	}
+}
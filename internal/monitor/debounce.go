@@ -3,6 +3,8 @@ package monitor
 import (
 	"sync"
 	"time"
+
+	"github.com/samjwillis97/sams-blackhole/internal/clock"
 )
 
 type DebounceEvent int
@@ -13,16 +15,15 @@ const (
 )
 
 type debounceEntry struct {
-	timers map[DebounceEvent]*time.Timer
+	timers map[DebounceEvent]clock.Timer
 	mu     sync.Mutex
 }
 
 var debounceTimers sync.Map // A concurrent map to track timers for each file
 
-func Debounce(key string, event DebounceEvent, fn func()) {
-	const debounceDuration = 5 * time.Second
+func Debounce(key string, event DebounceEvent, debounceDuration time.Duration, fn func()) {
 	entry, _ := debounceTimers.LoadOrStore(key, &debounceEntry{
-		timers: make(map[DebounceEvent]*time.Timer),
+		timers: make(map[DebounceEvent]clock.Timer),
 	})
 
 	debounce := entry.(*debounceEntry)
@@ -31,18 +32,18 @@ func Debounce(key string, event DebounceEvent, fn func()) {
 
 	// Reset all the timers for this file
 	for _, timer := range debounce.timers {
-		// Stop and reset the timer
-		if !timer.Stop() {
-			<-timer.C // Drain channel to prevent leaks
+		// Only push back timers that haven't fired, a fired timer is already
+		// running its function and will clean itself up
+		if timer.Stop() {
+			timer.Reset(debounceDuration)
 		}
-		timer.Reset(debounceDuration)
 	}
 
 	// eventType := sonarrEventFromFileEvent(e)
 
 	// Create a new timer for this event type, if doesn't exist
 	if _, exists := debounce.timers[event]; !exists {
-		timer := time.AfterFunc(debounceDuration, func() {
+		timer := clock.AfterFunc(debounceDuration, func() {
 			// handleEvent(eventType, e.Name)
 			fn()
 
@@ -58,3 +59,10 @@ func Debounce(key string, event DebounceEvent, fn func()) {
 		debounce.timers[event] = timer
 	}
 }
+
+// Pending reports whether a debounced function for the key is waiting to run
+// or running
+func Pending(key string) bool {
+	_, ok := debounceTimers.Load(key)
+	return ok
+}
@@ -0,0 +1,42 @@
+package monitor_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/samjwillis97/sams-blackhole/internal/clock"
+	"github.com/samjwillis97/sams-blackhole/internal/monitor"
+)
+
+func TestDebounceWaitsForQuietPeriod(t *testing.T) {
+	fakeClock := clock.NewFake(time.Unix(0, 0))
+	defer clock.Set(fakeClock)()
+
+	calls := 0
+	debounced := func() {
+		monitor.Debounce("debounce-test", monitor.CreateOrWrite, 5*time.Second, func() { calls++ })
+	}
+
+	debounced()
+	fakeClock.Advance(4 * time.Second)
+
+	// A second event should push the call back another full period
+	debounced()
+	fakeClock.Advance(4 * time.Second)
+
+	if calls != 0 {
+		t.Errorf("Expected no calls before the quiet period, got %d", calls)
+	}
+
+	fakeClock.Advance(1 * time.Second)
+	if calls != 1 {
+		t.Errorf("Expected a single call after the quiet period, got %d", calls)
+	}
+
+	// Once fired a new event starts a fresh period
+	debounced()
+	fakeClock.Advance(5 * time.Second)
+	if calls != 2 {
+		t.Errorf("Expected a second call after another event, got %d", calls)
+	}
+}
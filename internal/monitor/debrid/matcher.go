@@ -0,0 +1,195 @@
+package debrid
+
+import (
+	"log/slog"
+	"path"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/samjwillis97/sams-blackhole/internal/debrid"
+)
+
+// Number of recent torrents fetched from debrid when falling back to
+// matching by ID or hash
+const debridListLimit = 100
+
+type matchSignal string
+
+const (
+	matchExact      matchSignal = "exact"
+	matchOriginal   matchSignal = "original_filename"
+	matchNormalized matchSignal = "normalized"
+	matchSingleFile matchSignal = "single_file"
+	matchDebrid     matchSignal = "debrid"
+)
+
+// mountEntry is a file or directory that has appeared at the root of the
+// debrid mount
+type mountEntry struct {
+	Name   string
+	IsFile bool
+}
+
+type localSignal struct {
+	signal  matchSignal
+	matches func(entry mountEntry, key string, meta PathMeta) bool
+}
+
+// Signals that only need the names are tried in order, from the most to the
+// least specific
+var localSignals = []localSignal{
+	{matchExact, func(entry mountEntry, key string, _ PathMeta) bool {
+		return entry.Name == key
+	}},
+	{matchOriginal, func(entry mountEntry, _ string, meta PathMeta) bool {
+		return meta.OriginalFileName != "" && entry.Name == meta.OriginalFileName
+	}},
+	{matchNormalized, func(entry mountEntry, key string, meta PathMeta) bool {
+		name := normalizeName(entry.Name)
+		return name == normalizeName(key) || (meta.OriginalFileName != "" && name == normalizeName(meta.OriginalFileName))
+	}},
+	// A torrent with a single file can be exposed as just that file rather
+	// than inside a folder named after the torrent
+	{matchSingleFile, func(entry mountEntry, key string, meta PathMeta) bool {
+		if !entry.IsFile {
+			return false
+		}
+		name := normalizeName(trimExt(entry.Name))
+		for _, candidate := range []string{key, meta.OriginalFileName} {
+			if candidate == "" {
+				continue
+			}
+			if name == normalizeName(candidate) || name == normalizeName(trimExt(candidate)) {
+				return true
+			}
+		}
+		return false
+	}},
+}
+
+// normalizeName lowercases the name and drops everything that is not a letter
+// or digit, so sanitized and differently-cased names compare equal
+func normalizeName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, name)
+}
+
+func trimExt(name string) string {
+	return strings.TrimSuffix(name, path.Ext(name))
+}
+
+// matchesLocally checks a single monitored torrent against the entry
+func matchesLocally(entry mountEntry, key string, meta PathMeta) (matchSignal, bool) {
+	for _, s := range localSignals {
+		if s.matches(entry, key, meta) {
+			return s.signal, true
+		}
+	}
+	return "", false
+}
+
+// take finds the monitored torrent for an entry in the mount and stops
+// monitoring it. The debrid API is only asked once none of the names match.
+func (s *Monitors) take(mount string, entry mountEntry, logger *slog.Logger) (string, PathMeta, matchSignal, bool) {
+	if key, meta, signal, ok := s.takeLocal(mount, entry, logger); ok {
+		return key, meta, signal, ok
+	}
+
+	return s.takeByDebrid(mount, entry, logger)
+}
+
+func (s *Monitors) takeLocal(mount string, entry mountEntry, logger *slog.Logger) (string, PathMeta, matchSignal, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, signal := range localSignals {
+		var matched []string
+		for key, meta := range s.set {
+			if inMount(meta, mount) && signal.matches(entry, key, meta) {
+				matched = append(matched, key)
+			}
+		}
+
+		if len(matched) > 1 {
+			// Rather wait than link the wrong torrent
+			logger.Warn("mount entry matches more than one torrent", "signal", signal.signal, "matched", matched)
+			continue
+		}
+
+		if len(matched) == 1 {
+			meta := s.set[matched[0]]
+			delete(s.set, matched[0])
+			return matched[0], meta, signal.signal, true
+		}
+	}
+
+	return "", PathMeta{}, "", false
+}
+
+// takeByDebrid looks the entry up in the torrents of the mount's accounts by
+// name and matches it on the torrent ID or info hash
+func (s *Monitors) takeByDebrid(mount string, entry mountEntry, logger *slog.Logger) (string, PathMeta, matchSignal, bool) {
+	for _, account := range s.accountsWithDebridIdentifiers(mount) {
+		torrents, err := debrid.For(account).ListTorrents(debridListLimit)
+		if err != nil {
+			logger.Warn("failed to list debrid torrents", "account", account, "err", err)
+			continue
+		}
+
+		if key, meta, ok := s.takeFromTorrents(entry, account, torrents); ok {
+			return key, meta, matchDebrid, true
+		}
+	}
+
+	return "", PathMeta{}, "", false
+}
+
+func (s *Monitors) takeFromTorrents(entry mountEntry, account string, torrents []debrid.GetInfoResponse) (string, PathMeta, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, torrent := range torrents {
+		if torrent.Filename != entry.Name && normalizeName(torrent.Filename) != normalizeName(entry.Name) {
+			continue
+		}
+
+		for key, meta := range s.set {
+			if meta.Account != account {
+				continue
+			}
+
+			sameID := meta.DebridID != "" && meta.DebridID == torrent.ID
+			sameHash := meta.InfoHash != "" && strings.EqualFold(meta.InfoHash, torrent.Hash)
+			if sameID || sameHash {
+				delete(s.set, key)
+				return key, meta, true
+			}
+		}
+	}
+
+	return "", PathMeta{}, false
+}
+
+// accountsWithDebridIdentifiers returns the accounts using the mount that
+// anything can be looked up in, listing torrents is only worth it for those
+func (s *Monitors) accountsWithDebridIdentifiers(mount string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	accounts := []string{}
+	for _, meta := range s.set {
+		if !inMount(meta, mount) {
+			continue
+		}
+		if (meta.DebridID != "" || meta.InfoHash != "") && !slices.Contains(accounts, meta.Account) {
+			accounts = append(accounts, meta.Account)
+		}
+	}
+	slices.Sort(accounts)
+	return accounts
+}
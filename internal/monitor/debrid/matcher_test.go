@@ -0,0 +1,230 @@
+package debrid_test
+
+import (
+	"log/slog"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/samjwillis97/sams-blackhole/internal/arr"
+	"github.com/samjwillis97/sams-blackhole/internal/clock"
+	"github.com/samjwillis97/sams-blackhole/internal/config"
+	debridapi "github.com/samjwillis97/sams-blackhole/internal/debrid"
+	"github.com/samjwillis97/sams-blackhole/internal/debrid/debridtest"
+	"github.com/samjwillis97/sams-blackhole/internal/logger"
+	"github.com/samjwillis97/sams-blackhole/internal/monitor"
+	"github.com/samjwillis97/sams-blackhole/internal/monitor/debrid"
+	"github.com/samjwillis97/sams-blackhole/internal/notify"
+	"github.com/spf13/viper"
+)
+
+type matchSetup struct {
+	MountDir       string
+	CompletedDir   string
+	ProcessingFile string
+}
+
+func setupMatch(t *testing.T, debridUrl string) matchSetup {
+	root := t.TempDir()
+	s := matchSetup{
+		MountDir:       path.Join(root, "mount"),
+		CompletedDir:   path.Join(root, "completed"),
+		ProcessingFile: path.Join(root, "processing.magnet"),
+	}
+
+	for _, dir := range []string{s.MountDir, s.CompletedDir} {
+		if err := os.Mkdir(dir, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(s.ProcessingFile, []byte{}, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	mockViper := viper.New()
+	mockViper.Set("real_debrid.url", debridUrl)
+	mockViper.Set("real_debrid.mount_timeout", 30)
+	mockViper.Set("real_debrid.watch_path", s.MountDir)
+	mockViper.Set("state_path", root)
+	config.InitializeAppConfig(mockViper)
+	t.Cleanup(notify.Wait)
+
+	return s
+}
+
+func (s matchSetup) mount(t *testing.T, name string, isFile bool) string {
+	mountPath := path.Join(s.MountDir, name)
+	filePath := path.Join(mountPath, "episode.mkv")
+	if isFile {
+		filePath = mountPath
+	}
+
+	if err := os.MkdirAll(path.Dir(filePath), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filePath, []byte("video"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return mountPath
+}
+
+func TestMountEntryMatchedByName(t *testing.T) {
+	testCases := []struct {
+		description      string
+		filename         string
+		originalFilename string
+		mountName        string
+		isFile           bool
+	}{
+		{"original filename", "Show.S01.1080p", "Show S01 1080p WEB", "Show S01 1080p WEB", false},
+		{"different case", "Show.S01.1080p", "", "show.s01.1080P", false},
+		{"sanitized punctuation", "Show: The Return (2024) S01", "", "Show The Return 2024 S01", false},
+		{"single file without folder", "Movie.2024.1080p", "", "Movie.2024.1080p.mkv", true},
+		{"single file named with extension", "Movie.2024.1080p.mkv", "", "movie 2024 1080p.mkv", true},
+	}
+
+	log := slog.New(logger.NewHandler(&slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			s := setupMatch(t, "http://localhost")
+			s.mount(t, tc.mountName, tc.isFile)
+
+			debrid.MonitorForDebridFiles(debrid.MonitorConfig{
+				Filename:         tc.filename,
+				OriginalFilename: tc.originalFilename,
+				CompletedDir:     s.CompletedDir,
+				ProcessingPath:   s.ProcessingFile,
+				Service:          arr.Sonarr,
+				Callbacks: debrid.Callbacks{
+					Success: func() error { return nil },
+					Failure: func() {},
+				},
+			}, log)
+
+			if _, err := os.Stat(path.Join(s.CompletedDir, tc.filename)); err != nil {
+				t.Errorf("Expected %s to be linked under %s: %s", tc.mountName, tc.filename, err)
+			}
+			if _, err := os.Stat(s.ProcessingFile); !os.IsNotExist(err) {
+				t.Errorf("Expected processing file to be removed")
+			}
+		})
+	}
+}
+
+func TestMountEntryNotMatchedWhenAmbiguous(t *testing.T) {
+	log := slog.New(logger.NewHandler(&slog.HandlerOptions{Level: slog.LevelDebug}))
+	s := setupMatch(t, "http://localhost")
+
+	for _, filename := range []string{"Ambiguous.Show.S01", "Ambiguous-Show-S01"} {
+		debrid.MonitorForDebridFiles(debrid.MonitorConfig{
+			Filename:       filename,
+			CompletedDir:   s.CompletedDir,
+			ProcessingPath: s.ProcessingFile,
+			Service:        arr.Sonarr,
+		}, log)
+	}
+
+	fakeClock := clock.NewFake(time.Now())
+	defer clock.Set(fakeClock)()
+
+	mountPath := s.mount(t, "ambiguous show s01", false)
+	debrid.MonitorHandler(monitor.Event{Op: monitor.Create, Path: mountPath}, s.MountDir, log)
+	fakeClock.Advance(config.DefaultDebounce)
+
+	entries, _ := os.ReadDir(s.CompletedDir)
+	if len(entries) != 0 {
+		t.Errorf("Expected nothing to be linked for an ambiguous match, got %d entries", len(entries))
+	}
+}
+
+func TestMountEntryMatchedByDebridID(t *testing.T) {
+	log := slog.New(logger.NewHandler(&slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	server := debridtest.NewServer()
+	defer server.Close()
+	server.Expect(debridtest.Torrent{ID: "RENAMED1", Filename: "Completely Different Name", Hash: "abc123"})
+
+	s := setupMatch(t, server.URL)
+	if _, err := debridapi.AddMagnet("magnet:?xt=urn:btih:abc123"); err != nil {
+		t.Fatal(err)
+	}
+
+	debrid.MonitorForDebridFiles(debrid.MonitorConfig{
+		Filename:       "Expected.Release.Name",
+		CompletedDir:   s.CompletedDir,
+		ProcessingPath: s.ProcessingFile,
+		Service:        arr.Radarr,
+		DebridID:       "RENAMED1",
+		Callbacks: debrid.Callbacks{
+			Success: func() error { return nil },
+			Failure: func() {},
+		},
+	}, log)
+
+	fakeClock := clock.NewFake(time.Now())
+	defer clock.Set(fakeClock)()
+
+	mountPath := s.mount(t, "Completely Different Name", false)
+	debrid.MonitorHandler(monitor.Event{Op: monitor.Create, Path: mountPath}, s.MountDir, log)
+	fakeClock.Advance(config.DefaultDebounce)
+
+	if _, err := os.Stat(path.Join(s.CompletedDir, "Expected.Release.Name", "episode.mkv")); err != nil {
+		t.Errorf("Expected mount entry to be linked by debrid ID: %s", err)
+	}
+}
+
+func TestMountEntryOnlyMatchesItsAccounts(t *testing.T) {
+	log := slog.New(logger.NewHandler(&slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	s := setupMatch(t, "http://localhost")
+	animeMount := path.Join(t.TempDir(), "anime")
+	if err := os.Mkdir(animeMount, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	mockViper := viper.New()
+	mockViper.Set("real_debrid.url", "http://localhost")
+	mockViper.Set("real_debrid.mount_timeout", 30)
+	mockViper.Set("real_debrid.watch_path", s.MountDir)
+	mockViper.Set("debrid_accounts", []map[string]any{{"name": "anime", "watch_path": animeMount}})
+	mockViper.Set("state_path", t.TempDir())
+	config.InitializeAppConfig(mockViper)
+
+	callbacks := debrid.Callbacks{
+		Success: func() error { return nil },
+		Failure: func() {},
+	}
+	// Named exactly as the entry, but on an account with a different mount
+	debrid.MonitorForDebridFiles(debrid.MonitorConfig{
+		Filename:       "Same Name",
+		CompletedDir:   path.Join(s.CompletedDir, "anime"),
+		ProcessingPath: s.ProcessingFile,
+		Service:        arr.Sonarr,
+		Account:        "anime",
+		Callbacks:      callbacks,
+	}, log)
+	debrid.MonitorForDebridFiles(debrid.MonitorConfig{
+		Filename:       "Same.Name",
+		CompletedDir:   s.CompletedDir,
+		ProcessingPath: s.ProcessingFile,
+		Service:        arr.Sonarr,
+		Callbacks:      callbacks,
+	}, log)
+
+	fakeClock := clock.NewFake(time.Now())
+	defer clock.Set(fakeClock)()
+
+	mountPath := s.mount(t, "Same Name", false)
+	debrid.MonitorHandler(monitor.Event{Op: monitor.Create, Path: mountPath}, s.MountDir, log)
+	fakeClock.Advance(config.DefaultDebounce)
+
+	if _, err := os.Stat(path.Join(s.CompletedDir, "Same.Name", "episode.mkv")); err != nil {
+		t.Errorf("Expected the entry to be linked for the account using the mount: %s", err)
+	}
+	if !debrid.IsWatchingFor("", "Same Name") {
+		t.Errorf("Expected the other account's torrent to still be watched for")
+	}
+}
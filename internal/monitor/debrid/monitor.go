@@ -1,19 +1,22 @@
 package debrid
 
 import (
-	"errors"
-	"io/fs"
 	"log/slog"
 	"os"
 	"path"
-	"path/filepath"
-	"strings"
 	"time"
 
-	"github.com/radovskyb/watcher"
 	"github.com/samjwillis97/sams-blackhole/internal/arr"
+	"github.com/samjwillis97/sams-blackhole/internal/audit"
+	"github.com/samjwillis97/sams-blackhole/internal/cleanup"
+	"github.com/samjwillis97/sams-blackhole/internal/clock"
 	"github.com/samjwillis97/sams-blackhole/internal/config"
+	"github.com/samjwillis97/sams-blackhole/internal/jobs"
+	"github.com/samjwillis97/sams-blackhole/internal/link"
+	"github.com/samjwillis97/sams-blackhole/internal/logger/attr"
 	"github.com/samjwillis97/sams-blackhole/internal/monitor"
+	"github.com/samjwillis97/sams-blackhole/internal/notify"
+	"github.com/samjwillis97/sams-blackhole/internal/repair"
 )
 
 type MonitorConfig struct {
@@ -22,127 +25,259 @@ type MonitorConfig struct {
 	CompletedDir     string
 	ProcessingPath   string
 	Service          arr.ArrService
+	Instance         string
+	InfoHash         string
+	DebridID         string
+	Account          string // The debrid account it was added to, `real_debrid` when empty
+	LinkStrategy     string
+	JobID            string        // The timeline the rest of the item's audit entries go on
+	MountTimeout     time.Duration // How long to wait for it in the mount, the debrid mount timeout when zero
 	Callbacks        Callbacks
 }
 
 func MonitorForDebridFiles(c MonitorConfig, logger *slog.Logger) {
-	expectedPath := path.Join(config.GetAppConfig().RealDebrid.WatchPatch, c.Filename)
+	accountMount := mountPath(c.Account)
+	expectedPath := path.Join(accountMount, c.Filename)
 
-	timeout := time.Duration(config.GetAppConfig().RealDebrid.MountTimeout) * time.Second
-	expiry := time.Now().Add(timeout)
+	timeout := c.MountTimeout
+	if timeout <= 0 {
+		timeout = config.GetAppConfig().RealDebrid.GetMountTimeout()
+	}
+	expiry := clock.Now().Add(timeout)
 
 	logger.Info("adding path to debrid watch list", "expiry", expiry)
 
 	pathSet := getPathSetInstance()
 	meta := PathMeta{
 		Expiration:       expiry,
+		Timeout:          timeout,
 		OriginalFileName: c.OriginalFilename,
 		Service:          c.Service,
+		Instance:         c.Instance,
+		InfoHash:         c.InfoHash,
+		DebridID:         c.DebridID,
+		Account:          c.Account,
 		CompletedDir:     c.CompletedDir,
 		ProcessingPath:   c.ProcessingPath,
+		LinkStrategy:     c.LinkStrategy,
+		JobID:            c.JobID,
 		Callbacks:        c.Callbacks,
 	}
 	pathSet.add(c.Filename, meta)
 
 	if _, err := os.Stat(expectedPath); err == nil {
 		logger.Info("path already exists in debrid mount, going to process")
-		newMountFileOrDir(expectedPath, c.Filename, logger)
+		newMountFileOrDir(accountMount, expectedPath, logger)
+		return
+	}
+
+	// The torrent may already be mounted under a different name
+	entries, err := os.ReadDir(accountMount)
+	if err != nil {
+		logger.Warn("failed to read debrid mount", "err", err)
 		return
 	}
+
+	for _, e := range entries {
+		entry := mountEntry{Name: e.Name(), IsFile: !e.IsDir()}
+		if signal, ok := matchesLocally(entry, c.Filename, meta); ok {
+			logger.Info("matching path already exists in debrid mount, going to process", "mountName", e.Name(), "signal", signal)
+			newMountFileOrDir(accountMount, path.Join(accountMount, e.Name()), logger)
+			return
+		}
+	}
+}
+
+// mountPath is where the account's torrents appear
+func mountPath(account string) string {
+	conf, _ := config.GetAppConfig().DebridAccount(account)
+	return conf.WatchPatch
 }
 
-func MonitorHandler(e watcher.Event, _ string, logger *slog.Logger) {
-	name := path.Base(e.Path)
+// inMount reports whether the torrent appears in the mount, accounts without a
+// watch path of their own share the default one
+func inMount(meta PathMeta, mount string) bool {
+	return path.Clean(mountPath(meta.Account)) == path.Clean(mount)
+}
 
+func MonitorHandler(e monitor.Event, dir string, logger *slog.Logger) {
 	switch e.Op {
-	case watcher.Create:
-		monitor.Debounce(e.Path, monitor.CreateOrWrite, func() {
-			newMountFileOrDir(e.Path, name, logger)
+	case monitor.Create:
+		monitor.Debounce(e.Path, monitor.CreateOrWrite, config.GetAppConfig().GetTimings().Debounce, func() {
+			newMountFileOrDir(dir, e.Path, logger)
 		})
 	}
 }
 
-func newMountFileOrDir(newPath string, name string, logger *slog.Logger) {
-	pathSet := getPathSetInstance()
-
-	// FIXME: Eventually also check the originalfilename, I guess
-	pathMeta, err := pathSet.remove(name)
+// newMountFileOrDir processes an entry that has appeared in the mount, only
+// torrents of the accounts using that mount are matched against it
+func newMountFileOrDir(mount string, newPath string, logger *slog.Logger) {
+	name := path.Base(newPath)
 
+	info, err := os.Stat(newPath)
 	if err != nil {
+		logger.Warn("failed to stat mount entry", "err", err)
+		return
+	}
+
+	pathSet := getPathSetInstance()
+	key, pathMeta, signal, ok := pathSet.take(mount, mountEntry{Name: name, IsFile: !info.IsDir()}, logger)
+	if !ok {
 		logger.Debug("not monitoring for, skipping")
 		return
 	}
 
+	logger = logger.With("mountName", name, "torrentName", key, "matchSignal", signal)
 	logger = logger.With("outputDir", pathMeta.CompletedDir)
 	logger = logger.With("processingPath", pathMeta.ProcessingPath)
+	logger = logger.With(attr.DebridID(pathMeta.DebridID), attr.InfoHash(pathMeta.InfoHash))
+	audit.Record(pathMeta.JobID, audit.Entry{Kind: audit.MountMatch, Message: string(signal), Path: newPath})
 
 	if _, err := os.Stat(pathMeta.ProcessingPath); err != nil {
 		logger.Warn("doesn't exist anymore, not processing")
 		return
 	}
 
-	logger.Info("starting symlinking")
-	completedPath := path.Join(pathMeta.CompletedDir, name)
-	err = os.Mkdir(completedPath, os.ModePerm)
+	strategy, err := link.New(pathMeta.LinkStrategy, link.Torrent{DebridID: pathMeta.DebridID, Account: pathMeta.Account}, logger)
 	if err != nil {
-		logger.Error("failed to link", "err", err)
+		logger.Error("failed to create link strategy", "err", err)
 		return
 	}
 
-	logger.Debug("recursively symlinking")
+	logger.Info("starting linking", "linkStrategy", pathMeta.LinkStrategy)
+	// Linked under the name the torrent was added with, which is what *arr
+	// will be expecting even when the mount names it differently
+	completedPath := path.Join(pathMeta.CompletedDir, key)
+	linked, err := link.Tree(newPath, completedPath, strategy)
+	audit.Record(pathMeta.JobID, audit.Entry{Kind: audit.Linked, Message: pathMeta.LinkStrategy, Path: completedPath, Count: linked, Error: audit.Err(err)})
+	if err != nil {
+		logger.Error("recursive linking failed", "err", err)
+		return
+	}
 
-	err = filepath.WalkDir(newPath, func(currentFile string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
+	logger.Info("linking complete", "linkCount", linked)
+	notify.Async(logger, notify.Event{Type: notify.Completed, Release: key, Instance: pathMeta.Instance})
 
-		if d.IsDir() {
-			return nil
-		}
+	err = repair.RecordLinked(repair.LinkedTorrent{
+		Name:         name,
+		InfoHash:     pathMeta.InfoHash,
+		DebridID:     pathMeta.DebridID,
+		Account:      pathMeta.Account,
+		Service:      pathMeta.Service,
+		Instance:     pathMeta.Instance,
+		CompletedDir: pathMeta.CompletedDir,
+		LinkedAt:     clock.Now(),
+	})
+	if err != nil {
+		logger.Warn("failed to record link for repair", "err", err)
+	}
 
-		relativePath, err := filepath.Rel(newPath, currentFile)
+	err = pathMeta.Callbacks.Success()
+	if err != nil {
+		logger.Warn("success callback failed", "err", err)
+		pathMeta.Callbacks.Failure()
+	} else {
+		err = cleanup.Track(cleanup.Item{
+			CompletedPath: completedPath,
+			MountName:     name,
+			InfoHash:      pathMeta.InfoHash,
+			DebridID:      pathMeta.DebridID,
+			Account:       pathMeta.Account,
+			Service:       pathMeta.Service,
+			Instance:      pathMeta.Instance,
+			LinkedAt:      clock.Now(),
+		})
 		if err != nil {
-			return err
+			logger.Warn("failed to track for cleanup after import", "err", err)
 		}
+	}
 
-		currentFileToMove := path.Join(completedPath, relativePath)
+	logger.Debug("removing from processing")
+	err = os.Remove(pathMeta.ProcessingPath)
+	if err != nil {
+		logger.Error("failed to delete processing file", "err", err)
+		return
+	}
+	if err := jobs.RemoveRoute(pathMeta.ProcessingPath); err != nil {
+		logger.Warn("failed to delete written route", "err", err)
+	}
 
-		if strings.Contains(relativePath, "../") {
-			return errors.New("File appears to be from outside root dir")
-		}
+}
 
-		toMoveParentDir, _ := path.Split(currentFileToMove)
-		err = os.MkdirAll(toMoveParentDir, os.ModePerm)
-		if err != nil {
-			return err
+// IsMonitoring reports whether the mount is being watched for the torrent of a
+// processing file
+func IsMonitoring(processingPath string) bool {
+	for _, meta := range getPathSetInstance().snapshot() {
+		if meta.ProcessingPath == processingPath {
+			return true
 		}
+	}
+	return false
+}
 
-		err = os.Symlink(currentFile, currentFileToMove)
-		if err != nil {
-			return err
+// IsWatchingFor reports whether the mount is being watched for the torrent,
+// by either its debrid ID or its name in the mount
+func IsWatchingFor(debridID string, name string) bool {
+	for key, meta := range getPathSetInstance().snapshot() {
+		if (debridID != "" && meta.DebridID == debridID) || key == name || meta.OriginalFileName == name {
+			return true
 		}
+	}
+	return false
+}
 
-		return nil
-	})
+// Reconcile checks everything being watched for against the mount, picking up
+// torrents whose event was missed and forgetting any whose processing file has
+// gone. It returns the names that were found and forgotten.
+func Reconcile(logger *slog.Logger) ([]string, []string) {
+	pathSet := getPathSetInstance()
+	found := []string{}
+	forgotten := []string{}
 
-	if err != nil {
-		logger.Error("recursive linking failed", "err", err)
-		return
+	watching := pathSet.snapshot()
+	for name, meta := range watching {
+		if _, err := os.Stat(meta.ProcessingPath); err != nil {
+			logger.Info("processing file is gone, no longer watching mount for it", "torrentName", name, "processingPath", meta.ProcessingPath)
+			pathSet.remove(name)
+			delete(watching, name)
+			forgotten = append(forgotten, name)
+		}
 	}
 
-	logger.Info("symlinking complete")
+	if len(watching) == 0 {
+		return found, forgotten
+	}
 
-	err = pathMeta.Callbacks.Success()
-	if err != nil {
-		logger.Warn("success callback failed", "err", err)
-		pathMeta.Callbacks.Failure()
+	// Each account has its own mount
+	byMount := map[string]PathSet{}
+	for name, meta := range watching {
+		p := mountPath(meta.Account)
+		if byMount[p] == nil {
+			byMount[p] = PathSet{}
+		}
+		byMount[p][name] = meta
 	}
 
-	logger.Debug("removing from processing")
-	err = os.Remove(pathMeta.ProcessingPath)
-	if err != nil {
-		logger.Error("failed to delete processing file", "err", err)
-		return
+	for mount, watching := range byMount {
+		entries, err := os.ReadDir(mount)
+		if err != nil {
+			logger.Warn("failed to read debrid mount", "mountPath", mount, "err", err)
+			continue
+		}
+
+		for _, e := range entries {
+			entry := mountEntry{Name: e.Name(), IsFile: !e.IsDir()}
+			for name, meta := range watching {
+				if signal, ok := matchesLocally(entry, name, meta); ok {
+					logger.Info("found missed path in debrid mount, going to process", "mountName", e.Name(), "torrentName", name, "signal", signal)
+					newMountFileOrDir(mount, path.Join(mount, e.Name()), logger)
+					delete(watching, name)
+					found = append(found, name)
+					break
+				}
+			}
+		}
 	}
 
+	return found, forgotten
 }
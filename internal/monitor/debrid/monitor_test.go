@@ -6,11 +6,15 @@ import (
 	"os"
 	"path"
 	"testing"
+	"time"
 
 	"github.com/samjwillis97/sams-blackhole/internal/arr"
+	"github.com/samjwillis97/sams-blackhole/internal/clock"
 	"github.com/samjwillis97/sams-blackhole/internal/config"
 	"github.com/samjwillis97/sams-blackhole/internal/logger"
 	"github.com/samjwillis97/sams-blackhole/internal/monitor/debrid"
+	"github.com/samjwillis97/sams-blackhole/internal/mount"
+	"github.com/samjwillis97/sams-blackhole/internal/notify"
 	"github.com/spf13/viper"
 )
 
@@ -53,12 +57,15 @@ func setup() setupOutput {
 	mockViper.Set("real_debrid.url", "http://localhost")
 	mockViper.Set("real_debrid.mount_timeout", 30)
 	mockViper.Set("real_debrid.watch_path", "/tmp")
+	mockViper.Set("state_path", completedDir)
 	config.InitializeAppConfig(mockViper)
 
 	return setupOutput{ProcessingFile: processingFile.Name(), ToLinkDir: toLinkDir, CompletedDir: completedDir, InternalFiles: files}
 }
 
 func cleanup(setup setupOutput) {
+	// Completion notifications read the config the next test replaces
+	notify.Wait()
 	os.Remove(setup.ProcessingFile)
 	os.RemoveAll(setup.ToLinkDir)
 	os.RemoveAll(setup.CompletedDir)
@@ -101,3 +108,75 @@ func TestMountMonitorDirCreated(t *testing.T) {
 		t.Errorf("Processing file still exists at %s", setupConfig.ProcessingFile)
 	}
 }
+
+func TestMountMonitorExpiresItems(t *testing.T) {
+	log := slog.New(logger.NewHandler(&slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	fakeClock := clock.NewFake(time.Now())
+	defer clock.Set(fakeClock)()
+
+	setupConfig := setup()
+	defer cleanup(setupConfig)
+
+	filename := "debrid-test-never-mounted"
+	debrid.MonitorForDebridFiles(debrid.MonitorConfig{
+		Filename:       filename,
+		CompletedDir:   setupConfig.CompletedDir,
+		ProcessingPath: setupConfig.ProcessingFile,
+		Service:        arr.Sonarr,
+	}, log)
+
+	fakeClock.Advance(29 * time.Second)
+	if debrid.GetMonitoredFile(filename).ProcessingPath == "" {
+		t.Errorf("Expected %s to still be monitored before the mount timeout", filename)
+	}
+
+	fakeClock.Advance(2 * time.Second)
+	if debrid.GetMonitoredFile(filename).ProcessingPath != "" {
+		t.Errorf("Expected %s to no longer be monitored after the mount timeout", filename)
+	}
+
+	if _, err := os.Lstat(setupConfig.ProcessingFile); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected expired processing file to be removed from %s", setupConfig.ProcessingFile)
+	}
+}
+
+func TestMountMonitorSuspendsExpiryWhileMountUnhealthy(t *testing.T) {
+	log := slog.New(logger.NewHandler(&slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	fakeClock := clock.NewFake(time.Now())
+	defer clock.Set(fakeClock)()
+	t.Cleanup(func() { mount.Update(nil) })
+
+	setupConfig := setup()
+	defer cleanup(setupConfig)
+
+	filename := "debrid-test-mount-outage"
+	debrid.MonitorForDebridFiles(debrid.MonitorConfig{
+		Filename:       filename,
+		CompletedDir:   setupConfig.CompletedDir,
+		ProcessingPath: setupConfig.ProcessingFile,
+		Service:        arr.Sonarr,
+	}, log)
+
+	fakeClock.Advance(10 * time.Second)
+	mount.Update(errors.New("transport endpoint is not connected"))
+
+	fakeClock.Advance(time.Minute)
+	if debrid.GetMonitoredFile(filename).ProcessingPath == "" {
+		t.Fatalf("Expected %s to not expire while the mount is unhealthy", filename)
+	}
+
+	mount.Update(nil)
+
+	// 10 seconds were used before the outage, so 20 remain
+	fakeClock.Advance(19 * time.Second)
+	if debrid.GetMonitoredFile(filename).ProcessingPath == "" {
+		t.Errorf("Expected the outage to not count towards expiry")
+	}
+
+	fakeClock.Advance(2 * time.Second)
+	if debrid.GetMonitoredFile(filename).ProcessingPath != "" {
+		t.Errorf("Expected %s to expire after the rest of the mount timeout", filename)
+	}
+}
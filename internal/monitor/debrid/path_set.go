@@ -3,19 +3,33 @@ package debrid
 import (
 	"errors"
 	"log"
+	"log/slog"
 	"os"
 	"sync"
 	"time"
 
 	"github.com/samjwillis97/sams-blackhole/internal/arr"
+	"github.com/samjwillis97/sams-blackhole/internal/audit"
+	"github.com/samjwillis97/sams-blackhole/internal/clock"
+	"github.com/samjwillis97/sams-blackhole/internal/config"
+	"github.com/samjwillis97/sams-blackhole/internal/jobs"
+	"github.com/samjwillis97/sams-blackhole/internal/mount"
+	"github.com/samjwillis97/sams-blackhole/internal/notify"
 )
 
 type PathMeta struct {
 	OriginalFileName string
 	Expiration       time.Time
+	Timeout          time.Duration // What the expiration was set from
 	ProcessingPath   string
 	CompletedDir     string
 	Service          arr.ArrService
+	Instance         string
+	InfoHash         string
+	DebridID         string
+	Account          string
+	LinkStrategy     string
+	JobID            string
 	Callbacks        Callbacks
 }
 
@@ -47,6 +61,9 @@ func getPathSetInstance() *Monitors {
 		instance = &Monitors{
 			set: make(PathSet),
 		}
+
+		// Time spent with the mount down doesn't count towards expiry
+		mount.OnRecover(instance.extendExpiry)
 	})
 
 	instance.cleanupExpiredItems()
@@ -98,21 +115,59 @@ func (s *Monitors) items() []string {
 	return items
 }
 
+// snapshot returns a copy of the set
+func (s *Monitors) snapshot() PathSet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	set := make(PathSet, len(s.set))
+	for k, meta := range s.set {
+		set[k] = meta
+	}
+	return set
+}
+
+// extendExpiry pushes back expirations by the time the mount was down, items
+// added during the outage are only extended by the part they waited through
+func (s *Monitors) extendExpiry(downFor time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := clock.Now()
+
+	for k, meta := range s.set {
+		timeout := meta.Timeout
+		if timeout <= 0 {
+			timeout = config.GetAppConfig().RealDebrid.GetMountTimeout()
+		}
+		added := meta.Expiration.Add(-timeout)
+		meta.Expiration = meta.Expiration.Add(min(downFor, now.Sub(added)))
+		s.set[k] = meta
+	}
+}
+
 func (s *Monitors) cleanupExpiredItems() {
+	// Nothing can appear while the mount is down so nothing should expire
+	if !mount.IsHealthy() {
+		return
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	now := time.Now()
+	now := clock.Now()
 
 	for k, meta := range s.set {
 		if now.After(meta.Expiration) {
 			log.Printf("[debrid-monitor]\tremoving %s from monitoring and processing\n", k)
 			// TODO: Notify *arr of failure
+			audit.Record(meta.JobID, audit.Entry{Kind: audit.Error, Message: "never appeared in the debrid mount", Path: k})
+			notify.Async(slog.Default(), notify.Event{Type: notify.Timeout, Release: k, Instance: meta.Instance, Error: "never appeared in the debrid mount"})
 			delete(s.set, k)
 			err := os.Remove(meta.ProcessingPath)
 			if err != nil {
 				log.Printf("[debrid-monitor]\terror occured deleting %s from processing: %s\n", k, err)
 			}
+			jobs.RemoveRoute(meta.ProcessingPath)
 		}
 	}
 }
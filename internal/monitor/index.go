@@ -0,0 +1,115 @@
+package monitor
+
+import (
+	"io/fs"
+	"path"
+	"path/filepath"
+)
+
+// pathIndex finds the setting owning a path by walking up from it, so the
+// cost depends on how deep the path is rather than how many settings there
+// are, and the closest root wins when roots are nested
+type pathIndex struct {
+	settings []MonitorSetting
+	roots    map[string]int // Root directory to its index in settings
+	excluded map[string]bool
+}
+
+func newPathIndex(settings []MonitorSetting) pathIndex {
+	index := pathIndex{
+		settings: settings,
+		roots:    map[string]int{},
+		excluded: map[string]bool{},
+	}
+
+	for i, s := range settings {
+		index.roots[path.Clean(s.Directory)] = i
+		for _, e := range s.Exclude {
+			if e != "" {
+				index.excluded[path.Clean(e)] = true
+			}
+		}
+	}
+
+	return index
+}
+
+// lookup returns the setting the path belongs to, along with how many
+// directories below the root it is, files directly in the root are depth 0
+func (i pathIndex) lookup(p string) (MonitorSetting, int, bool) {
+	p = path.Clean(p)
+	if i.excluded[p] {
+		return MonitorSetting{}, 0, false
+	}
+
+	depth := 0
+	for dir := path.Dir(p); ; dir = path.Dir(dir) {
+		if i.excluded[dir] {
+			return MonitorSetting{}, 0, false
+		}
+
+		if idx, ok := i.roots[dir]; ok {
+			return i.settings[idx], depth, true
+		}
+
+		if dir == "/" || dir == "." {
+			return MonitorSetting{}, 0, false
+		}
+		depth++
+	}
+}
+
+// match returns the setting that should handle an event for the path
+func (i pathIndex) match(p string) (MonitorSetting, bool) {
+	setting, depth, ok := i.lookup(p)
+	if !ok || !setting.allowsDepth(depth) {
+		return MonitorSetting{}, false
+	}
+	return setting, true
+}
+
+// shouldWatch reports whether a directory beneath a root needs adding to the
+// watcher, which is when the files inside it are within the setting's depth
+func (i pathIndex) shouldWatch(dir string) bool {
+	setting, depth, ok := i.lookup(dir)
+	return ok && setting.Recursive && setting.allowsDepth(depth+1)
+}
+
+func (s MonitorSetting) allowsDepth(depth int) bool {
+	if depth == 0 {
+		return true
+	}
+	return s.Recursive && (s.MaxDepth <= 0 || depth <= s.MaxDepth)
+}
+
+type adder interface {
+	Add(string) error
+}
+
+// addTree adds the directory, and every directory beneath it the index says
+// should be watched, returning the directories added
+func (i pathIndex) addTree(w adder, root string) ([]string, error) {
+	added := []string{}
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.IsDir() {
+			return nil
+		}
+
+		if p != root && !i.shouldWatch(p) {
+			return fs.SkipDir
+		}
+
+		if err := w.Add(p); err != nil {
+			return err
+		}
+		added = append(added, p)
+
+		return nil
+	})
+
+	return added, err
+}
@@ -4,13 +4,13 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"os"
 	"path"
-	"strings"
+	"sync"
 	"time"
 
-	"github.com/fsnotify/fsnotify"
 	"github.com/google/uuid"
-	"github.com/radovskyb/watcher"
+	"github.com/samjwillis97/sams-blackhole/internal/logger/attr"
 )
 
 // TODO: rename module
@@ -18,154 +18,178 @@ import (
 type Monitor struct {
 	Logger   *slog.Logger
 	Settings []MonitorSetting
+
+	// How often polling based directories are checked, defaults to a second
+	PollInterval time.Duration
+	// How often hybrid directories are listed to catch missed events,
+	// defaults to a minute
+	ReconcileInterval time.Duration
+
+	watchers    []Watcher
+	dispatchers sync.WaitGroup
+	handlers    sync.WaitGroup // Handlers dispatched that have yet to return
 }
 
 type MonitorSetting struct {
-	Name         string
-	Directory    string
-	EventHandler func(fsnotify.Event, string, *slog.Logger)
-	PollHandler  func(watcher.Event, string, *slog.Logger)
-}
+	Name      string
+	Directory string
+	Handler   Handler
 
-func (m *Monitor) StartMonitoring() (*fsnotify.Watcher, *watcher.Watcher) {
-	m.Logger.Info("initializing monitor")
+	// One of the backends, defaults to fsnotify
+	Backend string
 
-	eventBasedWatcher, err := m.createEventBasedWatcher()
-	if err != nil {
-		m.Logger.Error("failed to create event based watcher", "err", err)
-		panic(1)
-	}
+	// Recursive settings also handle files in subdirectories, down to
+	// MaxDepth levels below the directory or without limit when zero
+	Recursive bool
+	MaxDepth  int
 
-	pollBasedWatcher, err := m.createPollingBasedWatcher()
-	if err != nil {
-		m.Logger.Error("failed to create poll based watcher", "err", err)
-		panic(1)
-	}
-
-	return eventBasedWatcher, pollBasedWatcher
+	// Directories beneath Directory that are never handled, such as the
+	// processing and completed paths
+	Exclude []string
 }
 
-func (m *Monitor) createPollingBasedWatcher() (*watcher.Watcher, error) {
-	pollingBasedMonitors := []MonitorSetting{}
+// StartMonitoring creates a watcher for each backend in use and starts
+// handling events, Close stops them
+func (m *Monitor) StartMonitoring() error {
+	m.Logger.Info("initializing monitor")
+
+	byBackend := map[string][]MonitorSetting{}
+	backends := []string{}
 	for _, s := range m.Settings {
-		if s.PollHandler != nil {
-			pollingBasedMonitors = append(pollingBasedMonitors, s)
+		backend := s.Backend
+		if backend == "" {
+			backend = Fsnotify
 		}
-	}
-
-	logger := m.Logger.With("monitorType", "poll")
 
-	// Create
-	w := watcher.New()
+		if _, ok := byBackend[backend]; !ok {
+			backends = append(backends, backend)
+		}
+		byBackend[backend] = append(byBackend[backend], s)
+	}
 
-	// SetMaxEvents to 1 to allow at most 1 event's to be received
-	// on the Event channel per watching cycle.
-	//
-	// If SetMaxEvents is not set, the default is to send all events.
-	w.SetMaxEvents(1)
+	reconcileInterval := m.ReconcileInterval
+	if reconcileInterval <= 0 {
+		reconcileInterval = time.Minute
+	}
 
-	go m.pollWatchHandler(w, pollingBasedMonitors)
+	for _, backend := range backends {
+		logger := m.Logger.With("monitorType", backend)
 
-	for _, setting := range pollingBasedMonitors {
-		logger.Info("watching directory", "directory", setting.Directory)
-		err := w.Add(setting.Directory)
+		w, err := NewWatcher(backend, m.PollInterval, reconcileInterval)
 		if err != nil {
-			return nil, errors.New(fmt.Sprintf("Failed to watch %s: %s", setting.Directory, err))
+			m.Close()
+			return err
 		}
+		m.watchers = append(m.watchers, w)
+
+		index := newPathIndex(byBackend[backend])
+		m.dispatchers.Add(1)
+		go func() {
+			defer m.dispatchers.Done()
+			m.dispatch(w, index, logger)
+		}()
+
+		for _, setting := range byBackend[backend] {
+			logger.Info("watching directory", "directory", setting.Directory, "recursive", setting.Recursive)
+			_, err := index.addTree(w, setting.Directory)
+			if err != nil {
+				m.Close()
+				return errors.New(fmt.Sprintf("Failed to watch %s: %s", setting.Directory, err))
+			}
+		}
+
+		logger.Info("monitor started")
 	}
 
-	go w.Start(time.Second * 1)
+	return nil
+}
+
+// Close stops every watcher, waiting for the handlers of events already
+// received to return
+func (m *Monitor) Close() error {
+	var err error
+	for _, w := range m.watchers {
+		err = errors.Join(err, w.Close())
+	}
+	m.watchers = nil
 
-	logger.Info("monitor started")
+	m.dispatchers.Wait()
+	m.handlers.Wait()
+	return err
+}
 
-	return w, nil
+// handle runs the handler in its own goroutine so a slow handler doesn't hold
+// up other events
+func (m *Monitor) handle(setting MonitorSetting, event Event, logger *slog.Logger) {
+	m.handlers.Add(1)
+	go func() {
+		defer m.handlers.Done()
+		setting.Handler(event, setting.Directory, logger)
+	}()
 }
 
-func (m *Monitor) pollWatchHandler(w *watcher.Watcher, s []MonitorSetting) {
-	logger := m.Logger.With("monitorType", "poll")
+func (m *Monitor) dispatch(w Watcher, index pathIndex, logger *slog.Logger) {
+	errs := w.Errors()
 	for {
 		select {
-		case event := <-w.Event:
-			for _, setting := range s {
-				if strings.Contains(event.Path, setting.Directory) {
-					eventId := uuid.New()
-					logger = logger.With("monitorName", setting.Name).With("monitorEventType", event.Op.String()).With("monitorEventPath", event.Path).With("eventID", eventId)
+		case event, ok := <-w.Events():
+			if !ok {
+				return
+			}
+
+			setting, ok := index.match(event.Path)
+			if !ok {
+				continue
+			}
 
-					logger.Debug("event received")
+			eventLogger := logger.With(attr.MonitorName(setting.Name), "monitorEventType", event.Op.String(), "monitorEventPath", event.Path, attr.EventID(uuid.New().String()))
+			eventLogger.Debug("event received")
 
-					setting.PollHandler(event, setting.Directory, logger)
-				}
+			if event.Op == Create && event.IsDir && index.shouldWatch(event.Path) {
+				m.watchNewDirectory(w, index, event.Path, eventLogger)
+				continue
+			}
+
+			m.handle(setting, event, eventLogger)
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
 			}
-		case err := <-w.Error:
+
 			logger.Error("monitor encountered error", "err", err)
-			panic(1)
-		case <-w.Closed:
-			return
 		}
 	}
 }
 
-func (m *Monitor) createEventBasedWatcher() (*fsnotify.Watcher, error) {
-	eventBasedMonitors := []MonitorSetting{}
-	for _, s := range m.Settings {
-		if s.EventHandler != nil {
-			eventBasedMonitors = append(eventBasedMonitors, s)
-		}
-	}
-
-	logger := m.Logger.With("monitorType", "event")
-
-	// Create new event based watcher
-	eventWatcher, err := fsnotify.NewWatcher()
+// watchNewDirectory adds a directory created beneath a recursive setting, any
+// files written before it was added are handled as though they had just been
+// written
+func (m *Monitor) watchNewDirectory(w Watcher, index pathIndex, dir string, logger *slog.Logger) {
+	added, err := index.addTree(w, dir)
 	if err != nil {
-		return nil, errors.New(fmt.Sprintf("Failed to create event watcher: %s", err))
+		logger.Warn("failed to watch new directory", "err", err)
 	}
 
-	// Start listening for events.
-	go eventWatchHandler(eventWatcher, eventBasedMonitors, logger)
-
-	for _, setting := range eventBasedMonitors {
-		logger.Info("watching directory", "directory", setting.Directory)
-		err = eventWatcher.Add(setting.Directory)
+	for _, d := range added {
+		entries, err := os.ReadDir(d)
 		if err != nil {
-			return nil, errors.New(fmt.Sprintf("Failed to watch %s: %s", setting.Directory, err))
+			logger.Warn("failed to read new directory", "directory", d, "err", err)
+			continue
 		}
-	}
-
-	logger.Info("monitor started")
 
-	return eventWatcher, nil
-}
-
-func eventWatchHandler(w *fsnotify.Watcher, s []MonitorSetting, logger *slog.Logger) {
-	for {
-		select {
-		case event, ok := <-w.Events:
-			if !ok {
-				logger.Error("not okay event received")
-				return
+		for _, e := range entries {
+			if e.IsDir() {
+				continue
 			}
 
-			for _, setting := range s {
-				currentDir := event.Name
-				for currentDir != "/" {
-					currentDir = path.Dir(currentDir)
-					if currentDir == setting.Directory {
-						eventId := uuid.New()
-						logger = logger.With("monitorName", setting.Name).With("monitorEventType", event.Op.String()).With("monitorEventPath", event.Name).With("eventID", eventId)
-
-						logger.Debug("event received")
-						// FIXME: I dont like putting a `go` here, feels like there is something blocking the function
-						go setting.EventHandler(event, setting.Directory, logger)
-					}
-				}
-			}
-		case err, ok := <-w.Errors:
+			filePath := path.Join(d, e.Name())
+			setting, ok := index.match(filePath)
 			if !ok {
-				return
+				continue
 			}
 
-			logger.Error("monitor encountered error", "err", err)
+			m.handle(setting, Event{Path: filePath, Op: Write}, logger.With("monitorEventPath", filePath))
 		}
 	}
 }
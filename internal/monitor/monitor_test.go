@@ -4,16 +4,17 @@ import (
 	"log/slog"
 	"os"
 	"path"
+	"slices"
 	"testing"
+	"time"
 
-	"github.com/fsnotify/fsnotify"
 	"github.com/samjwillis97/sams-blackhole/internal/logger"
 	"github.com/samjwillis97/sams-blackhole/internal/monitor"
 )
 
 type result struct {
 	bool
-	fsnotify.Op
+	monitor.Op
 }
 
 // TODO: Given When Then
@@ -35,10 +36,10 @@ func TestBasicHandler(t *testing.T) {
 	settings = append(settings, monitor.MonitorSetting{
 		Name:      "test handler",
 		Directory: dir,
-		EventHandler: func(e fsnotify.Event, s string, log *slog.Logger) {
+		Handler: func(e monitor.Event, s string, log *slog.Logger) {
 			resultChannel <- result{
 				true,
-				fsnotify.Create,
+				e.Op,
 			}
 		},
 	})
@@ -49,24 +50,20 @@ func TestBasicHandler(t *testing.T) {
 	}
 
 	// Need to get a signal back for when the monitor has started
-	w, _ := monitorSetup.StartMonitoring()
-	defer w.Close()
+	if err := monitorSetup.StartMonitoring(); err != nil {
+		t.Fatalf("Failed to start monitoring: %s", err)
+	}
+	defer monitorSetup.Close()
 
 	// Then create a file or delete in the testing directory
 	os.Create(fileToCreate)
 
 	outcome := <-resultChannel
-	if !outcome.bool || outcome.Op != fsnotify.Create {
+	if !outcome.bool || outcome.Op != monitor.Create {
 		t.Errorf("Expected true create, received %t, %s", outcome.bool, outcome.Op.String())
 	}
 }
 
-// TODO: Advanced test with atleast like a subdirectory
-// dir, _ := os.MkdirTemp("", "monitor-test-*")
-//  firstDir := path.Join(dir, "first")
-// secon:= path.Join(dir, "TestFile")
-// fileToCreate := path.Join(dir, "TestFile")
-
 func TestMultipleEventHandlers(t *testing.T) {
 	log := slog.New(logger.NewHandler(&slog.HandlerOptions{Level: slog.LevelDebug}))
 	resultChannel := make(chan result)
@@ -91,7 +88,7 @@ func TestMultipleEventHandlers(t *testing.T) {
 	settings = append(settings, monitor.MonitorSetting{
 		Name:      "first test handler",
 		Directory: firstDir,
-		EventHandler: func(e fsnotify.Event, s string, log *slog.Logger) {
+		Handler: func(e monitor.Event, s string, log *slog.Logger) {
 			t.Errorf("This event handler should not have been triggered")
 		},
 	})
@@ -99,10 +96,10 @@ func TestMultipleEventHandlers(t *testing.T) {
 	settings = append(settings, monitor.MonitorSetting{
 		Name:      "second test handler",
 		Directory: secondDir,
-		EventHandler: func(e fsnotify.Event, s string, log *slog.Logger) {
+		Handler: func(e monitor.Event, s string, log *slog.Logger) {
 			resultChannel <- result{
 				true,
-				fsnotify.Create,
+				e.Op,
 			}
 		},
 	})
@@ -113,14 +110,277 @@ func TestMultipleEventHandlers(t *testing.T) {
 	}
 
 	// Need to get a signal back for when the monitor has started
-	w, _ := monitorSetup.StartMonitoring()
-	defer w.Close()
+	if err := monitorSetup.StartMonitoring(); err != nil {
+		t.Fatalf("Failed to start monitoring: %s", err)
+	}
+	defer monitorSetup.Close()
 
 	// Then create a file or delete in the testing directory
 	os.Create(fileToCreate)
 
 	outcome := <-resultChannel
-	if !outcome.bool || outcome.Op != fsnotify.Create {
+	if !outcome.bool || outcome.Op != monitor.Create {
 		t.Errorf("Expected true create, received %t, %s", outcome.bool, outcome.Op.String())
 	}
 }
+
+func TestRecursiveEventHandler(t *testing.T) {
+	log := slog.New(logger.NewHandler(&slog.HandlerOptions{Level: slog.LevelDebug}))
+	handled := make(chan string, 10)
+
+	dir := t.TempDir()
+	processingDir := path.Join(dir, "processing")
+	os.Mkdir(processingDir, os.ModePerm)
+	existingDir := path.Join(dir, "existing")
+	os.Mkdir(existingDir, os.ModePerm)
+
+	monitorSetup := monitor.Monitor{
+		Logger: log,
+		Settings: []monitor.MonitorSetting{
+			{
+				Name:      "recursive handler",
+				Directory: dir,
+				Recursive: true,
+				MaxDepth:  2,
+				Exclude:   []string{processingDir},
+				Handler: func(e monitor.Event, s string, log *slog.Logger) {
+					if e.Op == monitor.Write {
+						handled <- e.Path
+					}
+				},
+			},
+		},
+	}
+
+	if err := monitorSetup.StartMonitoring(); err != nil {
+		t.Fatalf("Failed to start monitoring: %s", err)
+	}
+	defer monitorSetup.Close()
+
+	// Files in excluded directories and beyond the max depth are never handled
+	os.WriteFile(path.Join(processingDir, "ignored.magnet"), []byte("ignored"), 0o644)
+
+	tooDeep := path.Join(dir, "one", "two", "three")
+	os.MkdirAll(tooDeep, os.ModePerm)
+	os.WriteFile(path.Join(tooDeep, "ignored.magnet"), []byte("ignored"), 0o644)
+
+	expected := []string{
+		path.Join(existingDir, "existing.magnet"),
+		path.Join(dir, "one", "two", "nested.magnet"),
+	}
+	for _, f := range expected {
+		os.WriteFile(f, []byte("magnet"), 0o644)
+	}
+
+	received := map[string]bool{}
+	timeout := time.After(5 * time.Second)
+	for len(received) < len(expected) {
+		select {
+		case name := <-handled:
+			received[name] = true
+		case <-timeout:
+			t.Fatalf("Expected events for %v, received %v", expected, received)
+		}
+	}
+
+	for name := range received {
+		if !slices.Contains(expected, name) {
+			t.Errorf("Did not expect an event for %s", name)
+		}
+	}
+}
+
+func TestNestedRootsDispatchToClosestRoot(t *testing.T) {
+	log := slog.New(logger.NewHandler(&slog.HandlerOptions{Level: slog.LevelDebug}))
+	handled := make(chan string, 10)
+
+	dir := t.TempDir()
+	nestedDir := path.Join(dir, "4k")
+	os.Mkdir(nestedDir, os.ModePerm)
+
+	monitorSetup := monitor.Monitor{
+		Logger: log,
+		Settings: []monitor.MonitorSetting{
+			{
+				Name:      "outer handler",
+				Directory: dir,
+				Recursive: true,
+				Handler: func(e monitor.Event, s string, log *slog.Logger) {
+					if e.Op == monitor.Write {
+						handled <- "outer"
+					}
+				},
+			},
+			{
+				Name:      "nested handler",
+				Directory: nestedDir,
+				Handler: func(e monitor.Event, s string, log *slog.Logger) {
+					if e.Op == monitor.Write {
+						handled <- "nested"
+					}
+				},
+			},
+		},
+	}
+
+	if err := monitorSetup.StartMonitoring(); err != nil {
+		t.Fatalf("Failed to start monitoring: %s", err)
+	}
+	defer monitorSetup.Close()
+
+	os.WriteFile(path.Join(nestedDir, "movie.magnet"), []byte("magnet"), 0o644)
+
+	select {
+	case name := <-handled:
+		if name != "nested" {
+			t.Errorf("Expected the nested handler, got the %s handler", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected an event to be handled")
+	}
+
+	select {
+	case name := <-handled:
+		t.Errorf("Expected a single handler, the %s handler was also called", name)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPollBackend(t *testing.T) {
+	log := slog.New(logger.NewHandler(&slog.HandlerOptions{Level: slog.LevelDebug}))
+	handled := make(chan monitor.Event, 10)
+
+	dir := t.TempDir()
+
+	monitorSetup := monitor.Monitor{
+		Logger:       log,
+		PollInterval: 50 * time.Millisecond,
+		Settings: []monitor.MonitorSetting{
+			{
+				Name:      "poll handler",
+				Directory: dir,
+				Backend:   monitor.Poll,
+				Handler: func(e monitor.Event, s string, log *slog.Logger) {
+					handled <- e
+				},
+			},
+		},
+	}
+
+	if err := monitorSetup.StartMonitoring(); err != nil {
+		t.Fatalf("Failed to start monitoring: %s", err)
+	}
+	defer monitorSetup.Close()
+
+	fileToCreate := path.Join(dir, "movie.magnet")
+	os.WriteFile(fileToCreate, []byte("magnet"), 0o644)
+
+	select {
+	case e := <-handled:
+		if e.Op != monitor.Create || e.Path != fileToCreate {
+			t.Errorf("Expected a create of %s, received %s of %s", fileToCreate, e.Op, e.Path)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected an event to be handled")
+	}
+}
+
+func TestPollBackendSendsEveryChangeInACycle(t *testing.T) {
+	log := slog.New(logger.NewHandler(&slog.HandlerOptions{Level: slog.LevelDebug}))
+	handled := make(chan monitor.Event, 10)
+
+	dir := t.TempDir()
+
+	monitorSetup := monitor.Monitor{
+		Logger:       log,
+		PollInterval: 500 * time.Millisecond,
+		Settings: []monitor.MonitorSetting{
+			{
+				Name:      "poll handler",
+				Directory: dir,
+				Backend:   monitor.Poll,
+				Handler: func(e monitor.Event, s string, log *slog.Logger) {
+					if e.Op == monitor.Create {
+						handled <- e
+					}
+				},
+			},
+		},
+	}
+
+	if err := monitorSetup.StartMonitoring(); err != nil {
+		t.Fatalf("Failed to start monitoring: %s", err)
+	}
+	defer monitorSetup.Close()
+
+	// A torrent appearing in the mount changes the mount itself in the same
+	// cycle, neither change may be dropped for the other
+	expected := []string{}
+	for _, name := range []string{"First.Torrent", "Second.Torrent", "Third.Torrent"} {
+		p := path.Join(dir, name)
+		if err := os.MkdirAll(path.Join(p, "episode.mkv"), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, p)
+	}
+
+	created := []string{}
+	for range expected {
+		select {
+		case e := <-handled:
+			created = append(created, e.Path)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected a create for each torrent, received %v", created)
+		}
+	}
+
+	slices.Sort(created)
+	if !slices.Equal(created, expected) {
+		t.Errorf("Expected creates of %v, received %v", expected, created)
+	}
+}
+
+func TestHybridBackendHandlesEachChangeOnce(t *testing.T) {
+	log := slog.New(logger.NewHandler(&slog.HandlerOptions{Level: slog.LevelDebug}))
+	handled := make(chan monitor.Event, 10)
+
+	dir := t.TempDir()
+
+	monitorSetup := monitor.Monitor{
+		Logger:            log,
+		ReconcileInterval: 50 * time.Millisecond,
+		Settings: []monitor.MonitorSetting{
+			{
+				Name:      "hybrid handler",
+				Directory: dir,
+				Backend:   monitor.Hybrid,
+				Handler: func(e monitor.Event, s string, log *slog.Logger) {
+					if e.Op == monitor.Create {
+						handled <- e
+					}
+				},
+			},
+		},
+	}
+
+	if err := monitorSetup.StartMonitoring(); err != nil {
+		t.Fatalf("Failed to start monitoring: %s", err)
+	}
+	defer monitorSetup.Close()
+
+	os.WriteFile(path.Join(dir, "movie.magnet"), []byte("magnet"), 0o644)
+
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected an event to be handled")
+	}
+
+	// Several reconciles happen in this time, none of which should repeat the
+	// create fsnotify already reported
+	select {
+	case e := <-handled:
+		t.Errorf("Expected a single create, received another for %s", e.Path)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/samjwillis97/sams-blackhole/internal/arr"
+	"github.com/samjwillis97/sams-blackhole/internal/clock"
 )
 
 type PathMeta struct {
@@ -91,7 +92,7 @@ func (s *Monitors) cleanupExpiredItems() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	now := time.Now()
+	now := clock.Now()
 
 	for k, meta := range s.set {
 		if now.After(meta.Expiration) {
@@ -3,19 +3,23 @@ package sonarr
 import (
 	"log/slog"
 
-	"github.com/fsnotify/fsnotify"
 	"github.com/samjwillis97/sams-blackhole/internal/arr"
 	"github.com/samjwillis97/sams-blackhole/internal/config"
 	"github.com/samjwillis97/sams-blackhole/internal/monitor"
 )
 
-func MonitorHandlerBuilder(serviceType arr.ArrService, conf config.ArrConfig) func(e fsnotify.Event, s string, l *slog.Logger) {
-	return func(e fsnotify.Event, _ string, logger *slog.Logger) {
+func MonitorHandlerBuilder(serviceType arr.ArrService, conf config.ArrConfig) monitor.Handler {
+	return func(e monitor.Event, _ string, logger *slog.Logger) {
+		if e.IsDir {
+			return
+		}
+
 		switch e.Op {
-		case fsnotify.Create:
-		case fsnotify.Write:
-			monitor.Debounce(e.Name, monitor.CreateOrWrite, func() {
-				NewTorrentFile(serviceType, conf, e.Name, logger)
+		// Polling backends only see the file once it is complete, so a create
+		// is handled the same as a write
+		case monitor.Create, monitor.Write:
+			monitor.Debounce(e.Path, monitor.CreateOrWrite, conf.GetTimings().Debounce, func() {
+				NewTorrentFile(serviceType, conf, e.Path, logger)
 			})
 		}
 	}
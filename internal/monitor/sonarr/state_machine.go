@@ -6,18 +6,40 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"path"
 	"strings"
-
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/looplab/fsm"
 	"github.com/samjwillis97/sams-blackhole/internal/arr"
+	"github.com/samjwillis97/sams-blackhole/internal/audit"
+	"github.com/samjwillis97/sams-blackhole/internal/clock"
 	"github.com/samjwillis97/sams-blackhole/internal/config"
 	"github.com/samjwillis97/sams-blackhole/internal/debrid"
+	"github.com/samjwillis97/sams-blackhole/internal/jobs"
+	"github.com/samjwillis97/sams-blackhole/internal/logger/attr"
+	"github.com/samjwillis97/sams-blackhole/internal/metrics"
 	debridMonitor "github.com/samjwillis97/sams-blackhole/internal/monitor/debrid"
+	"github.com/samjwillis97/sams-blackhole/internal/mount"
+	"github.com/samjwillis97/sams-blackhole/internal/notify"
+	"github.com/samjwillis97/sams-blackhole/internal/rclone"
+	"github.com/samjwillis97/sams-blackhole/internal/slots"
 	"github.com/samjwillis97/sams-blackhole/internal/torrents"
 )
 
+var (
+	errTimedOut = errors.New("timed out")
+	errStopped  = errors.New("stopped")
+)
+
+var (
+	awaitingMount = metrics.NewGauge("blackhole_items_awaiting_mount", "Number of items held until the debrid mount is healthy")
+	debridRetries = metrics.NewCounter("blackhole_debrid_retries_total", "Number of debrid requests retried after a transient failure")
+	deferredItems = metrics.NewCounter("blackhole_items_deferred_total", "Number of items left in processing after debrid kept failing")
+)
+
 var StateRequiredFields = map[string][]string{
 	"processing":       {"IngestedPath"},
 	"addingToDebrid":   {"ProcessingTorrent"},
@@ -30,12 +52,35 @@ type MonitorItem struct {
 	processingTorrent torrents.ToProcess
 
 	debridID    string
+	startedAt   time.Time
 	timeoutTime time.Time
+	pausedAt    time.Time
 	prettyName  string
-
+	jobID       string
+	grab        jobs.Grab
+
+	retryDeadline time.Time
+	retryEvent    string
+	retryDelay    time.Duration
+	attempts      map[debrid.ErrorClass]int
+
+	// Set once a slot has been taken from the queue, the next add uses it
+	slotTaken bool
+	// Gives up the item's place in the slot queue while it is awaiting a slot
+	leaveSlotQueue func()
+
+	// Set once the job has been cancelled or completed by hand, any
+	// transitions still to come are dropped
+	stopped    atomic.Bool
+	cancelled  bool
+	failedPath string
+	actionMu   sync.Mutex
+
+	service   arr.ArrService
 	arrClient arr.ArrClient
 	logger    *slog.Logger
 	config    config.ArrConfig
+	route     config.Route
 
 	sm *fsm.FSM
 }
@@ -43,35 +88,37 @@ type MonitorItem struct {
 func (m *MonitorItem) setProcessingTorrent(t torrents.ToProcess) {
 	m.processingTorrent = t
 	m.logger = m.logger.With("processingPath", t.FullPath)
+	jobs.SetProcessingPath(m.jobID, t.FullPath)
+	if err := jobs.WriteRoute(t.FullPath, m.route); err != nil {
+		m.logger.Warn("failed to write route, it is routed by name if resumed", "err", err)
+	}
+
+	// *arr may have told us about the release when it grabbed it
+	hash, err := t.GetHash()
+	if err != nil {
+		return
+	}
+	if grab, ok := jobs.LookupGrab(hash); ok {
+		m.grab = grab
+		m.prettyName = grab.ReleaseTitle
+		m.logger = m.logger.With("releaseTitle", grab.ReleaseTitle)
+	}
 }
 
 func (m *MonitorItem) setDebridID(id string) {
 	m.debridID = id
-	m.logger = m.logger.With("debridID", id)
+	m.logger = m.logger.With(attr.DebridID(id))
+	jobs.SetDebridID(m.jobID, id)
 }
 
 func new(serviceType arr.ArrService, conf config.ArrConfig, logger *slog.Logger) (*MonitorItem, error) {
-	var client arr.ArrClient
-	var err error
-
-	switch serviceType {
-	case arr.Sonarr:
-		client, err = arr.CreateNewSonarrClient(
-			conf.Url,
-			config.GetSecrets().GetString(fmt.Sprintf("%s_API_KEY", strings.ToUpper(conf.Name))),
-		)
-	case arr.Radarr:
-		client, err = arr.CreateNewRadarrClient(
-			conf.Url,
-			config.GetSecrets().GetString(fmt.Sprintf("%s_API_KEY", strings.ToUpper(conf.Name))),
-		)
-	}
-
+	client, err := arr.CreateNewClient(serviceType, conf.Url, conf.APIKey())
 	if err != nil {
 		return nil, err
 	}
 
 	s := &MonitorItem{
+		service:   serviceType,
 		arrClient: client,
 		config:    conf,
 		logger:    logger,
@@ -82,20 +129,29 @@ func new(serviceType arr.ArrService, conf config.ArrConfig, logger *slog.Logger)
 
 		"processing":     s.enterProcessing,
 		"addingToDebrid": s.enterAddingToDebrid,
+		"awaitingMount":  s.enterAwaitingMount,
+		"awaitingSlot":   s.enterAwaitingSlot,
 
 		"debridProcessing": s.enterDebridProcessing,
 
 		"awaitingDebridRetry": s.waitToRetryDebridProcessing,
 
+		"backingOff": s.enterBackingOff,
+		"deferred":   s.enterDeferred,
+
 		"failure":   s.enterFailure,
 		"completed": s.enterCompleted,
 	}
 
 	events := fsm.Events{
 		{Name: "torrentFound", Src: []string{"new"}, Dst: "processing"},
-		{Name: "addToDebrid", Src: []string{"new", "processing"}, Dst: "addingToDebrid"},
-		{Name: "checkDebridState", Src: []string{"addingToDebrid", "awaitingDebridRetry"}, Dst: "debridProcessing"},
+		{Name: "addToDebrid", Src: []string{"new", "processing", "awaitingMount", "awaitingSlot", "backingOff"}, Dst: "addingToDebrid"},
+		{Name: "awaitMount", Src: []string{"addingToDebrid"}, Dst: "awaitingMount"},
+		{Name: "awaitSlot", Src: []string{"addingToDebrid"}, Dst: "awaitingSlot"},
+		{Name: "checkDebridState", Src: []string{"addingToDebrid", "awaitingDebridRetry", "backingOff"}, Dst: "debridProcessing"},
 		{Name: "retryDebridProcessing", Src: []string{"debridProcessing"}, Dst: "awaitingDebridRetry"},
+		{Name: "backOff", Src: []string{"addingToDebrid", "debridProcessing"}, Dst: "backingOff"},
+		{Name: "deferRetry", Src: []string{"addingToDebrid", "awaitingMount", "awaitingSlot", "debridProcessing", "backingOff", "awaitingDebridRetry"}, Dst: "deferred"},
 		{Name: "complete", Src: []string{"failure", "debridProcessing"}, Dst: "completed"},
 	}
 
@@ -122,6 +178,8 @@ func NewTorrentFile(serviceType arr.ArrService, conf config.ArrConfig, filepath
 	}
 
 	torrentItem.ingestedPath = filepath
+	torrentItem.setRoute(conf.Route(strings.TrimPrefix(filepath, strings.TrimSuffix(conf.WatchPath, "/")+"/")))
+	torrentItem.register(path.Join(conf.ProcessingPath, path.Base(filepath)))
 
 	if err := torrentItem.sm.Event(context.Background(), "torrentFound"); err != nil {
 		return err
@@ -137,8 +195,18 @@ func ResumeProcessingFile(serviceType arr.ArrService, conf config.ArrConfig, fil
 		return err
 	}
 
+	// Which subfolder it came from is lost once in processing, files from
+	// before routes were written can only be routed by name
+	route, err := jobs.ReadRoute(filepath)
+	if err != nil {
+		route = conf.Route(path.Base(filepath))
+	}
+	torrentItem.setRoute(route)
+	torrentItem.register(filepath)
+
 	toProcess, err := torrents.NewFileToProcess(filepath, conf.ProcessingPath)
 	if err != nil {
+		jobs.Remove(torrentItem.jobID)
 		return err
 	}
 
@@ -151,6 +219,84 @@ func ResumeProcessingFile(serviceType arr.ArrService, conf config.ArrConfig, fil
 	return nil
 }
 
+// RestoreFailedJob rebuilds a failed job read back after a restart, so it can
+// be retried or dropped as though blackhole had never stopped
+func RestoreFailedJob(serviceType arr.ArrService, conf config.ArrConfig, job jobs.Job, logger *slog.Logger) error {
+	torrentItem, err := new(serviceType, conf, logger)
+	if err != nil {
+		return err
+	}
+
+	toProcess, err := torrents.ExistingFileToProcess(job.ProcessingPath)
+	if err != nil {
+		return err
+	}
+
+	torrentItem.ingestedPath = job.IngestedPath
+	if job.CompletedPath != "" {
+		torrentItem.setRoute(config.Route{Account: job.Account, CompletedPath: job.CompletedPath, LinkStrategy: job.LinkStrategy})
+	} else {
+		torrentItem.setRoute(conf.Route(path.Base(job.ProcessingPath)))
+	}
+	torrentItem.failedPath = job.FailedPath
+	torrentItem.sm.SetState("failure")
+
+	job.State = "failure"
+	jobs.Restore(job)
+	torrentItem.jobID = job.ID
+	torrentItem.logger = torrentItem.logger.With("jobID", job.ID)
+	jobs.SetHandle(job.ID, torrentItem)
+
+	// Set directly as the job's times are kept for it to expire on time
+	torrentItem.processingTorrent = toProcess
+	torrentItem.logger = torrentItem.logger.With("processingPath", toProcess.FullPath)
+
+	return nil
+}
+
+// setRoute records where the item goes
+func (s *MonitorItem) setRoute(route config.Route) {
+	s.route = route
+	if s.route.Account != "" {
+		s.logger = s.logger.With("debridAccount", s.route.Account)
+	}
+}
+
+// debridClient is the client for the account the item was routed to
+func (s *MonitorItem) debridClient() debrid.Client {
+	return debrid.For(s.route.Account)
+}
+
+// usesSlots reports whether the item is queued for its account's slots, they
+// are only tracked for Real-Debrid accounts
+func (s *MonitorItem) usesSlots() bool {
+	return slots.Tracked(s.route.Account)
+}
+
+// register tracks the item as a job, the processing path is where the file
+// will be even before it has been moved there
+func (s *MonitorItem) register(processingPath string) {
+	job := jobs.Register(jobs.Job{
+		Service:        s.service,
+		Instance:       s.config.Name,
+		IngestedPath:   s.ingestedPath,
+		ProcessingPath: processingPath,
+		Account:        s.route.Account,
+		CompletedPath:  s.route.CompletedPath,
+		LinkStrategy:   s.route.LinkStrategy,
+		State:          s.sm.Current(),
+	})
+	s.jobID = job.ID
+	s.logger = s.logger.With("jobID", job.ID)
+	jobs.SetHandle(job.ID, s)
+
+	pickedUpFrom := s.ingestedPath
+	if pickedUpFrom == "" {
+		pickedUpFrom = processingPath
+	}
+	audit.Record(job.ID, audit.Entry{Kind: audit.Registered, Message: s.config.Name, Path: pickedUpFrom})
+}
+
 func (s *MonitorItem) validateFields(requiredFields ...string) error {
 	fieldErrors := []string{}
 	for _, field := range requiredFields {
@@ -177,36 +323,325 @@ func (s *MonitorItem) validateFields(requiredFields ...string) error {
 }
 
 func (s *MonitorItem) enterState(c context.Context, e *fsm.Event) {
+	if s.stopped.Load() {
+		e.Cancel(errStopped)
+		return
+	}
+
 	if s.timeoutTime.IsZero() {
-		s.timeoutTime = time.Now().Add(30 * time.Second)
+		s.startedAt = clock.Now()
+		s.timeoutTime = s.startedAt.Add(s.config.GetTimings().ProcessingDeadline)
 	}
 
-	if time.Now().After(s.timeoutTime) {
-		s.sm.Event(c, "failed", errors.New("timed out"))
+	// Can't trigger the failure from inside a transition, so cancel it and
+	// let `transition` move to failure
+	if e.Event != "failed" && e.Event != "deferRetry" && clock.Now().After(s.timeoutTime) {
+		audit.Record(s.jobID, audit.Entry{Kind: audit.Error, Message: fmt.Sprintf("ran out of time before %s", e.Event), Error: errTimedOut.Error()})
+		e.Cancel(errTimedOut)
+		return
 	}
 
+	entry := audit.Entry{Kind: audit.Transition, Message: e.Event, From: e.Src, To: e.Dst}
+	if e.Event == "failed" && len(e.Args) > 0 {
+		entry.Error = fmt.Sprint(e.Args[0])
+	}
+	audit.Record(s.jobID, entry)
+
 	s.logger.Debug(fmt.Sprintf("entering %s", e.Dst))
-	s.logger = s.logger.With("handlerState", s.sm.Current())
+	s.logger = s.logger.With(attr.HandlerState(s.sm.Current()))
+	jobs.SetState(s.jobID, e.Dst)
+}
+
+// transition triggers the event, moving to failure instead if the item has
+// run out of time. Items that have been retrying are deferred rather than
+// failed, as debrid is what held them up.
+func (s *MonitorItem) transition(c context.Context, event string) {
+	err := s.sm.Event(c, event)
+
+	var canceled fsm.CanceledError
+	if errors.As(err, &canceled) && canceled.Err == errStopped {
+		// Anything added since being cancelled would be left behind
+		s.actionMu.Lock()
+		defer s.actionMu.Unlock()
+		if s.cancelled {
+			s.removeFromDebrid()
+		}
+		return
+	}
+
+	if errors.As(err, &canceled) && canceled.Err == errTimedOut {
+		if !s.retryDeadline.IsZero() {
+			err := s.sm.Event(c, "deferRetry", errTimedOut)
+			if err == nil {
+				return
+			}
+			// Failing is better than being left where nothing moves it on
+			s.logger.Error("unable to defer timed out item, failing it instead", "err", err)
+		}
+		if err := s.sm.Event(c, "failed", errTimedOut); err != nil {
+			s.logger.Error("unable to fail timed out item", "err", err)
+		}
+		return
+	}
+
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("event transition %s failed", event), "err", err)
+	}
 }
 
+// enterFailure cleans up after the item and fails it in *arr, the file is kept
+// so the job can be retried by hand
 func (s *MonitorItem) enterFailure(c context.Context, e *fsm.Event) {
+	s.actionMu.Lock()
+	defer s.actionMu.Unlock()
+
 	s.logger.Warn("encountered error", "err", e.Args[0])
 
-	if s.debridID != "" {
-		err := debrid.Remove(s.debridID)
-		if err != nil {
-			s.logger.Error("failed to remove from debrid", "err", err)
+	event := notify.Event{Type: notify.Failure, Release: s.releaseName(), Instance: s.config.Name, Error: fmt.Sprint(e.Args[0])}
+	if e.Args[0] == errTimedOut {
+		event.Type = notify.Timeout
+	}
+	notify.Async(s.logger, event)
+
+	s.leaveSlot()
+	s.removeFromDebrid()
+
+	// The release itself is fine when it was only sent to an account that
+	// can't download it, so it is kept without *arr blocklisting it
+	if err, _ := e.Args[0].(error); errors.Is(err, debrid.ErrNoUsenet) {
+		s.logger.Warn("no usenet account to send the nzb to, keeping it without failing it in *arr")
+	} else {
+		s.removeFromSonarr()
+		s.logger.Info("removed from sonarr")
+	}
+
+	s.keepFailedFile()
+}
+
+// removeFromDebrid removes the torrent from debrid, retrying adds it again
+func (s *MonitorItem) removeFromDebrid() {
+	if s.debridID == "" {
+		return
+	}
+
+	err := s.debridClient().Remove(s.debridID)
+	audit.Record(s.jobID, audit.Entry{Kind: audit.DebridCall, Message: "remove", Error: audit.Err(err)})
+	if err != nil {
+		s.logger.Error("failed to remove from debrid", "err", err)
+		return
+	}
+	s.logger.Info("removed from debrid")
+	s.debridID = ""
+	jobs.SetDebridID(s.jobID, "")
+}
+
+// keepFailedFile moves the file out of processing to where it can be retried
+// from, it is removed instead if it can't be kept
+func (s *MonitorItem) keepFailedFile() {
+	if s.processingTorrent.FullPath == "" {
+		return
+	}
+
+	failedPath, err := jobs.FailedPath(s.jobID, s.processingTorrent.FullPath)
+	if err == nil {
+		err = moveFile(s.processingTorrent.FullPath, failedPath)
+	}
+	if err != nil {
+		s.logger.Warn("failed to keep failed file, it can't be retried", "err", err)
+		if err := os.Remove(s.processingTorrent.FullPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			s.logger.Error("failed to remove file from processing", "err", err)
+		}
+		if err := jobs.RemoveRoute(s.processingTorrent.FullPath); err != nil {
+			s.logger.Warn("failed to remove written route", "err", err)
 		}
-		s.logger.Info("removed from debrid")
+		return
+	}
+
+	// The route is kept with the failed job instead
+	if err := jobs.RemoveRoute(s.processingTorrent.FullPath); err != nil {
+		s.logger.Warn("failed to remove written route", "err", err)
 	}
 
-	s.removeFromSonarr()
-	s.logger.Info("removed from sonarr")
+	s.failedPath = failedPath
+	if err := jobs.SetFailedPath(s.jobID, failedPath); err != nil {
+		s.logger.Warn("failed to write failed job, it can't be retried after a restart", "err", err)
+	}
+}
 
-	err := os.Remove(s.processingTorrent.FullPath)
+// moveFile moves a file that may be on another filesystem, they are only ever
+// small torrent and magnet files
+func moveFile(from string, to string) error {
+	data, err := os.ReadFile(from)
 	if err != nil {
-		s.logger.Error("failed to remove file from processing", "err", err)
+		return err
 	}
+
+	if err := os.MkdirAll(path.Dir(to), os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.WriteFile(to, data, 0o644); err != nil {
+		return err
+	}
+
+	return os.Remove(from)
+}
+
+// Retry starts a failed or deferred item again, either adding it to debrid
+// again or checking on the torrent already there
+func (s *MonitorItem) Retry(from string) error {
+	s.actionMu.Lock()
+	defer s.actionMu.Unlock()
+
+	if s.stopped.Load() {
+		return jobs.ErrNotFound
+	}
+
+	current := s.sm.Current()
+	if current != "failure" && current != "deferred" {
+		return errors.New(fmt.Sprintf("Only failed or deferred jobs can be retried, job is %s", current))
+	}
+
+	if from == "" {
+		from = "addingToDebrid"
+	}
+
+	// The item is put back in the state before the one retried from
+	var resumeFrom, event string
+	switch from {
+	case "addingToDebrid":
+		resumeFrom, event = "processing", "addToDebrid"
+	case "debridProcessing":
+		if s.debridID == "" {
+			return errors.New("Job has no torrent in debrid to check on")
+		}
+		resumeFrom, event = "awaitingDebridRetry", "checkDebridState"
+	default:
+		return errors.New(fmt.Sprintf("Can't retry from %s, only addingToDebrid or debridProcessing", from))
+	}
+
+	if (s.processingTorrent == torrents.ToProcess{}) {
+		return errors.New("Job failed before it was processed, it needs to be grabbed again")
+	}
+
+	if s.failedPath != "" {
+		if err := moveFile(s.failedPath, s.processingTorrent.FullPath); err != nil {
+			return err
+		}
+		s.failedPath = ""
+		if err := jobs.SetFailedPath(s.jobID, ""); err != nil {
+			s.logger.Warn("failed to remove written failed job", "err", err)
+		}
+		if err := jobs.WriteRoute(s.processingTorrent.FullPath, s.route); err != nil {
+			s.logger.Warn("failed to write route, it is routed by name if resumed", "err", err)
+		}
+	}
+
+	s.logger.Info("retrying", "from", from)
+	audit.Record(s.jobID, audit.Entry{Kind: audit.Manual, Message: "retry", From: current, To: from})
+
+	// Retrying gets a fresh deadline
+	s.timeoutTime = time.Time{}
+	s.retryDeadline = time.Time{}
+	s.attempts = nil
+
+	s.sm.SetState(resumeFrom)
+	jobs.SetState(s.jobID, resumeFrom)
+	go s.transition(context.Background(), event)
+
+	return nil
+}
+
+// Cancel stops the item and cleans up after it like a failure does, without
+// failing it in *arr
+func (s *MonitorItem) Cancel() error {
+	s.actionMu.Lock()
+	defer s.actionMu.Unlock()
+
+	if err := s.stop("cancel"); err != nil {
+		return err
+	}
+	s.cancelled = true
+
+	s.removeFromDebrid()
+	s.removeFiles()
+	s.logger.Info("cancelled")
+
+	return nil
+}
+
+// ForceComplete stops the item and treats it as done, the torrent is left in
+// debrid and *arr is asked to pick up the download
+func (s *MonitorItem) ForceComplete() error {
+	s.actionMu.Lock()
+	defer s.actionMu.Unlock()
+
+	if err := s.stop("complete"); err != nil {
+		return err
+	}
+
+	s.removeFiles()
+	if err := s.monitorSuccessCallback(); err != nil {
+		s.logger.Warn("failed to refresh monitored downloads", "err", err)
+	}
+	s.logger.Info("completed by hand")
+
+	return nil
+}
+
+func (s *MonitorItem) stop(action string) error {
+	if s.stopped.Swap(true) {
+		return jobs.ErrNotFound
+	}
+	s.leaveSlot()
+
+	audit.Record(s.jobID, audit.Entry{Kind: audit.Manual, Message: action, From: s.sm.Current()})
+	jobs.Remove(s.jobID)
+	jobs.ForgetGrab(s.grab.InfoHash)
+	return nil
+}
+
+// leaveSlot takes the item out of the slot queue, handing back the slot if
+// one was taken for it. The action lock must be held.
+func (s *MonitorItem) leaveSlot() {
+	if s.leaveSlotQueue == nil {
+		return
+	}
+	s.leaveSlotQueue()
+	s.leaveSlotQueue = nil
+}
+
+// removeFiles removes the file from processing, or from where it was kept
+// after failing
+func (s *MonitorItem) removeFiles() {
+	paths := []string{s.processingTorrent.FullPath}
+	if s.processingTorrent.FullPath != "" {
+		paths = append(paths, jobs.RoutePath(s.processingTorrent.FullPath))
+	}
+	if s.failedPath != "" {
+		paths = append(paths, s.failedPath, jobs.KeptJobPath(s.failedPath))
+	}
+
+	for _, p := range paths {
+		if p == "" {
+			continue
+		}
+		if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			s.logger.Error("failed to remove file", "path", p, "err", err)
+		}
+	}
+	s.failedPath = ""
+}
+
+// releaseName is the best name known for the item, for people to recognise it
+// by
+func (s *MonitorItem) releaseName() string {
+	if s.prettyName != "" {
+		return s.prettyName
+	}
+	if s.processingTorrent.FilenameNoExt != "" {
+		return s.processingTorrent.FilenameNoExt
+	}
+	return path.Base(s.ingestedPath)
 }
 
 func (s *MonitorItem) checkRequiredParams(c context.Context, e *fsm.Event) bool {
@@ -235,23 +670,39 @@ func (s *MonitorItem) enterProcessing(c context.Context, e *fsm.Event) {
 	}
 
 	s.setProcessingTorrent(toProcess)
-	if err := s.sm.Event(c, "addToDebrid"); err != nil {
-		s.logger.Error(fmt.Sprintf("event transition %s failed", "addToDebrid"), "err", err)
-		return
-	}
+	s.transition(c, "addToDebrid")
 }
 
 func (s *MonitorItem) enterAddingToDebrid(c context.Context, e *fsm.Event) {
 	if success := s.checkRequiredParams(c, e); !success {
 		return
 	}
+
+	// Nothing added now could be linked, so hold on to it in processing
+	if !mount.IsHealthy() {
+		s.transition(c, "awaitMount")
+		return
+	}
+
+	s.actionMu.Lock()
+	slotTaken := s.slotTaken
+	s.slotTaken = false
+	s.actionMu.Unlock()
+
+	// Queue locally rather than have debrid refuse it
+	if s.usesSlots() && !slotTaken && !slots.TryAcquire(s.route.Account) {
+		s.transition(c, "awaitSlot")
+		return
+	}
+
 	switch s.processingTorrent.FileType {
 	case torrents.TorrentFile:
 		s.logger.Info("adding torrent file to debrid")
 		// TODO: Finish handling here - need to find a torrent file to test with
-		torrentResponse, err := debrid.AddTorrent(s.processingTorrent.FullPath)
+		torrentResponse, err := s.debridClient().AddTorrent(s.processingTorrent.FullPath)
+		audit.Record(s.jobID, audit.Entry{Kind: audit.DebridCall, Message: "addTorrent", Error: audit.Err(err)})
 		if err != nil {
-			s.sm.Event(c, "failed", err)
+			s.addFailed(c, err)
 			return
 		}
 		s.setDebridID(torrentResponse.ID)
@@ -264,18 +715,111 @@ func (s *MonitorItem) enterAddingToDebrid(c context.Context, e *fsm.Event) {
 		}
 
 		s.logger.Info("adding magnet to debrid")
-		magnetResponse, err := debrid.AddMagnet(magnetLink)
+		magnetResponse, err := s.debridClient().AddMagnet(magnetLink)
+		audit.Record(s.jobID, audit.Entry{Kind: audit.DebridCall, Message: "addMagnet", Error: audit.Err(err)})
 		if err != nil {
-			s.sm.Event(c, "failed", err)
+			s.addFailed(c, err)
 			return
 		}
 		s.setDebridID(magnetResponse.ID)
+	case torrents.NZB:
+		nzb, err := s.processingTorrent.GetNZB()
+		if err != nil {
+			s.sm.Event(c, "failed", err)
+			return
+		}
+
+		s.logger.Info("adding nzb to debrid", "files", len(nzb.Files), "size", nzb.Size)
+		nzbResponse, err := s.debridClient().AddNZB(s.processingTorrent.FullPath)
+		audit.Record(s.jobID, audit.Entry{Kind: audit.DebridCall, Message: "addNZB", Error: audit.Err(err)})
+		if err != nil {
+			s.addFailed(c, err)
+			return
+		}
+		s.setDebridID(nzbResponse.ID)
+	}
+
+	// Recorded for every account, housekeeping only removes what blackhole added
+	if err := slots.Added(s.route.Account, s.debridID); err != nil {
+		s.logger.Warn("failed to record torrent as added by blackhole", "err", err)
 	}
 
-	if err := s.sm.Event(c, "checkDebridState"); err != nil {
-		s.logger.Error(fmt.Sprintf("event transition %s failed", "checkDebridState"), "err", err)
+	s.transition(c, "checkDebridState")
+}
+
+// enterAwaitingMount holds the item until the mount recovers, the time spent
+// waiting doesn't count towards the processing or retry deadlines
+func (s *MonitorItem) enterAwaitingMount(_ context.Context, _ *fsm.Event) {
+	s.logger.Info("debrid mount is unhealthy, holding until it recovers")
+	s.pausedAt = clock.Now()
+	awaitingMount.Add(1)
+
+	// Waiting here would hold up whatever triggered the event, such as
+	// resuming files at startup
+	go func() {
+		<-mount.Recovered()
+		awaitingMount.Add(-1)
+
+		// Retrying or cancelling by hand could otherwise race the resume
+		s.actionMu.Lock()
+		heldFor := clock.Since(s.pausedAt)
+		s.extendDeadlines(heldFor)
+		s.actionMu.Unlock()
+
+		s.logger.Info("debrid mount recovered, resuming", "heldFor", heldFor)
+		s.transition(context.Background(), "addToDebrid")
+	}()
+}
+
+// extendDeadlines pushes back the processing and retry deadlines by how long
+// the item was held. The action lock must be held.
+func (s *MonitorItem) extendDeadlines(heldFor time.Duration) {
+	s.timeoutTime = s.timeoutTime.Add(heldFor)
+	if !s.retryDeadline.IsZero() {
+		s.retryDeadline = s.retryDeadline.Add(heldFor)
+	}
+}
+
+// addFailed queues the item again when debrid had no slot for it, anything
+// else is retried or failed
+func (s *MonitorItem) addFailed(c context.Context, err error) {
+	if debrid.Classify(err) == debrid.SlotsFull && s.usesSlots() {
+		slots.Full(s.route.Account)
+		s.transition(c, "awaitSlot")
 		return
 	}
+	s.retryOrFail(c, "addToDebrid", err)
+}
+
+// enterAwaitingSlot queues the item until a debrid slot is free, the time
+// spent queued doesn't count towards the processing or retry deadlines
+func (s *MonitorItem) enterAwaitingSlot(_ context.Context, _ *fsm.Event) {
+	s.logger.Info("debrid slots are all in use, queueing", "priority", s.config.Priority)
+	s.pausedAt = clock.Now()
+	ready, leave := slots.Wait(s.route.Account, s.config.Priority)
+	s.actionMu.Lock()
+	s.leaveSlotQueue = leave
+	s.actionMu.Unlock()
+
+	go func() {
+		<-ready
+
+		// The item may have been stopped or failed while it was queued
+		s.actionMu.Lock()
+		if s.leaveSlotQueue == nil {
+			s.actionMu.Unlock()
+			return
+		}
+		s.leaveSlotQueue = nil
+
+		queuedFor := clock.Since(s.pausedAt)
+		s.extendDeadlines(queuedFor)
+		s.slotTaken = true
+		s.actionMu.Unlock()
+
+		s.logger.Info("debrid slot free, resuming", "queuedFor", queuedFor)
+		s.transition(context.Background(), "addToDebrid")
+	}()
 }
 
 func (s *MonitorItem) enterDebridProcessing(c context.Context, e *fsm.Event) {
@@ -283,9 +827,10 @@ func (s *MonitorItem) enterDebridProcessing(c context.Context, e *fsm.Event) {
 		return
 	}
 
-	torrentInfo, err := debrid.GetInfo(s.debridID)
+	torrentInfo, err := s.debridClient().GetInfo(s.debridID)
+	audit.Record(s.jobID, audit.Entry{Kind: audit.DebridCall, Message: "getInfo", Status: string(torrentInfo.Status), Error: audit.Err(err)})
 	if err != nil {
-		s.sm.Event(c, "failed", err)
+		s.retryOrFail(c, "checkDebridState", err)
 		return
 	}
 
@@ -296,33 +841,31 @@ func (s *MonitorItem) enterDebridProcessing(c context.Context, e *fsm.Event) {
 	case debrid.WaitingFileSelection:
 		err := s.selectDebridFiles()
 		if err != nil {
-			s.sm.Event(c, "failed", err)
+			s.retryOrFail(c, "checkDebridState", err)
 			return
 		}
 
-		if err := s.sm.Event(c, "retryDebridProcessing"); err != nil {
-			s.logger.Error(fmt.Sprintf("event transition %s failed", "retryDebridProcessing"), "err", err)
-			return
-		}
+		s.transition(c, "retryDebridProcessing")
 		return
 	case debrid.Queued:
-		if err := s.sm.Event(c, "retryDebridProcessing"); err != nil {
-			s.logger.Error(fmt.Sprintf("event transition %s failed", "retryDebridProcessing"), "err", err)
-			return
-		}
+		s.transition(c, "retryDebridProcessing")
 		return
 	case debrid.Downloading:
-		// TODO: Flag this as only if instant_availabiltiy is desired
-		// If it is downloading I will need something to periodically check debrid waiting for completion,
-		// then can be moved to the other monitor
+		// Waiting is bounded by the processing deadline like any other status,
+		// Usenet has nothing cached so NZBs are always waited for
+		if s.config.GetUncached() == "wait" || s.processingTorrent.FileType == torrents.NZB {
+			s.transition(c, "retryDebridProcessing")
+			return
+		}
 		s.sm.Event(c, "failed", errors.New("not instantly available"))
 		return
 	case debrid.Downloaded:
-		s.addToDebridMonitor(torrentInfo)
-		if err := s.sm.Event(c, "complete"); err != nil {
-			s.logger.Error(fmt.Sprintf("event transition %s failed", "complete"), "err", err)
+		if s.stopped.Load() {
 			return
 		}
+		s.refreshMount()
+		s.addToDebridMonitor(torrentInfo)
+		s.transition(c, "complete")
 		return
 	default:
 		s.sm.Event(c, "failed", errors.New(fmt.Sprintf("Unexpected debrid status - %s", torrentInfo.Status)))
@@ -332,11 +875,86 @@ func (s *MonitorItem) enterDebridProcessing(c context.Context, e *fsm.Event) {
 
 func (s *MonitorItem) enterCompleted(c context.Context, _ *fsm.Event) {
 	s.logger.Info("finished handling")
+	// The debrid monitor keeps track of it from here
+	jobs.Remove(s.jobID)
+	jobs.ForgetGrab(s.grab.InfoHash)
+}
+
+// retryOrFail retries a failed debrid request by the policy for its kind of
+// failure, only permanent failures fail the item. Once the attempts or the
+// retry deadline run out the item is deferred instead.
+func (s *MonitorItem) retryOrFail(c context.Context, retryEvent string, err error) {
+	class := debrid.Classify(err)
+	if class == debrid.Permanent {
+		s.sm.Event(c, "failed", err)
+		return
+	}
+
+	retry := config.GetAppConfig().RealDebrid.GetRetry()
+	if s.retryDeadline.IsZero() {
+		s.retryDeadline = s.startedAt.Add(retry.Deadline)
+		// The retry deadline takes over from the processing deadline
+		if s.retryDeadline.After(s.timeoutTime) {
+			s.timeoutTime = s.retryDeadline
+		}
+	}
+
+	if s.attempts == nil {
+		s.attempts = map[debrid.ErrorClass]int{}
+	}
+	s.attempts[class]++
+
+	policy := retryPolicy(retry, class)
+	attempt := s.attempts[class]
+	delay := policy.Delay(attempt)
+	s.logger = s.logger.With("errorClass", class, "attempt", attempt)
+
+	if attempt >= policy.MaxAttempts || clock.Now().Add(delay).After(s.retryDeadline) {
+		s.sm.Event(c, "deferRetry", err)
+		return
+	}
+
+	s.retryEvent = retryEvent
+	s.retryDelay = delay
+	s.sm.Event(c, "backOff", err)
+}
+
+func retryPolicy(retry config.RetryConfig, class debrid.ErrorClass) config.RetryPolicy {
+	switch class {
+	case debrid.RateLimited:
+		return retry.RateLimited
+	case debrid.ServerError:
+		return retry.Server
+	}
+	return retry.Network
+}
+
+// enterBackingOff waits before trying the failed request again
+func (s *MonitorItem) enterBackingOff(c context.Context, e *fsm.Event) {
+	s.logger.Warn("debrid request failed, retrying", "err", e.Args[0], "retryIn", s.retryDelay)
+	debridRetries.Inc()
+
+	clock.Sleep(s.retryDelay)
+	s.transition(c, s.retryEvent)
+}
+
+// enterDeferred gives up for now without failing the release in *arr. The
+// file stays in processing and the job is kept, so the reconciler or a
+// restart tries it again from the start.
+func (s *MonitorItem) enterDeferred(_ context.Context, e *fsm.Event) {
+	s.actionMu.Lock()
+	defer s.actionMu.Unlock()
+
+	s.logger.Warn("debrid is still failing, leaving in processing to retry later", "err", e.Args[0])
+	deferredItems.Inc()
+
+	s.removeFromDebrid()
 }
 
 func (s *MonitorItem) selectDebridFiles() error {
 	s.logger.Debug("selecting all files")
-	err := debrid.SelectFiles(s.debridID, []string{})
+	err := s.debridClient().SelectFiles(s.debridID, []string{})
+	audit.Record(s.jobID, audit.Entry{Kind: audit.DebridCall, Message: "selectFiles", Error: audit.Err(err)})
 	if err != nil {
 		return err
 	}
@@ -345,16 +963,29 @@ func (s *MonitorItem) selectDebridFiles() error {
 }
 
 func (s *MonitorItem) waitToRetryDebridProcessing(c context.Context, e *fsm.Event) {
-	time.Sleep(1 * time.Second)
+	clock.Sleep(s.config.GetTimings().DebridRetryInterval)
+
+	s.transition(c, "checkDebridState")
+}
+
+// refreshMount has rclone re-read the torrents directory so the torrent is in
+// the mount before it starts being watched for
+func (s *MonitorItem) refreshMount() {
+	if !rclone.Enabled() {
+		return
+	}
 
-	if err := s.sm.Event(c, "checkDebridState"); err != nil {
-		s.logger.Error(fmt.Sprintf("event transition %s failed", "checkDebridState"), "err", err)
+	err := rclone.Refresh()
+	if err != nil {
+		s.logger.Warn("failed to refresh rclone mount", "err", err)
 		return
 	}
+	s.logger.Debug("refreshed rclone mount")
 }
 
 func (s *MonitorItem) monitorSuccessCallback() error {
 	_, err := s.arrClient.RefreshMonitoredDownloads()
+	audit.Record(s.jobID, audit.Entry{Kind: audit.ArrCallback, Message: "refreshMonitoredDownloads", Error: audit.Err(err)})
 	// TODO: Confirm refresh happened
 	return err
 }
@@ -364,16 +995,28 @@ func (s *MonitorItem) monitorFailureCallback() {
 
 func (s *MonitorItem) addToDebridMonitor(torrentInfo debrid.GetInfoResponse) {
 	s.logger = s.logger.With("torrentFilename", torrentInfo.Filename)
-	s.logger = s.logger.With("sonarrCompletedDir", s.config.CompletedPath)
+	s.logger = s.logger.With("sonarrCompletedDir", s.route.CompletedPath)
 	s.logger = s.logger.With("sonarrProcessingPath", s.processingTorrent.FullPath)
 
 	s.logger.Info("adding to monitor")
+	hash, err := s.processingTorrent.GetHash()
+	if err != nil && !errors.Is(err, torrents.ErrNoHash) {
+		s.logger.Warn("failed to get hash", "err", err)
+	}
+
 	debridMonitor.MonitorForDebridFiles(debridMonitor.MonitorConfig{
 		Filename:         torrentInfo.Filename,
 		OriginalFilename: torrentInfo.OriginalFilename,
-		CompletedDir:     s.config.CompletedPath,
-		Service:          arr.Sonarr,
+		CompletedDir:     s.route.CompletedPath,
+		Service:          s.service,
+		Instance:         s.config.Name,
+		InfoHash:         hash,
+		DebridID:         s.debridID,
+		Account:          s.route.Account,
+		LinkStrategy:     s.route.LinkStrategy,
 		ProcessingPath:   s.processingTorrent.FullPath,
+		JobID:            s.jobID,
+		MountTimeout:     s.config.GetMountTimeout(),
 		Callbacks: debridMonitor.Callbacks{
 			Success: func() error { return s.monitorSuccessCallback() },
 			Failure: func() { s.monitorFailureCallback() },
@@ -381,29 +1024,60 @@ func (s *MonitorItem) addToDebridMonitor(torrentInfo debrid.GetInfoResponse) {
 	}, s.logger)
 }
 
+// researchGrabbedSeason searches for the season again from what *arr sent when
+// it grabbed a season pack, for when the grab has fallen out of the history
+func (s *MonitorItem) researchGrabbedSeason() {
+	client, ok := s.arrClient.(*arr.SonarrClient)
+	if !ok || s.grab.ReleaseType != arr.SeasonPack || s.grab.SeriesID == 0 || s.config.GetSeasonPacks() != "research" {
+		return
+	}
+
+	s.logger.Info("triggering retry of season from grab")
+	_, err := client.SearchSeason(s.grab.SeriesID, s.grab.SeasonNumber)
+	audit.Record(s.jobID, audit.Entry{Kind: audit.ArrCallback, Message: "searchSeason", Error: audit.Err(err)})
+	if err != nil {
+		s.logger.Error("failed to retry season")
+	}
+}
+
+// grabbedAs reports whether the history item is the grab of this release.
+// Torrents are matched on their hash, *arr only has the title of an NZB,
+// which it named the file after.
+func (s *MonitorItem) grabbedAs(item arr.HistoryItem, hash string) bool {
+	if s.processingTorrent.FileType == torrents.NZB {
+		return strings.EqualFold(item.SourceTitle, s.processingTorrent.FilenameNoExt)
+	}
+	return strings.EqualFold(item.Data.TorrentInfoHash, hash)
+}
+
 func (s *MonitorItem) removeFromSonarr() {
 	hash, err := s.processingTorrent.GetHash()
-	if err != nil {
+	if err != nil && !errors.Is(err, torrents.ErrNoHash) {
 		s.logger.Error("failed to get hash", "err", err)
 		return
 	}
-	s.logger = s.logger.With("infoHash", hash)
+	if hash != "" {
+		s.logger = s.logger.With(attr.InfoHash(hash))
+	}
 
-	history, err := s.arrClient.GetHistory(100)
+	history, err := s.arrClient.GetHistory(s.config.GetHistoryPageSize())
 	if err != nil {
+		audit.Record(s.jobID, audit.Entry{Kind: audit.ArrCallback, Message: "getHistory", Error: audit.Err(err)})
 		s.logger.Error("failed to get history")
 		return
 	}
 
 	var toRemove []int
 	for i, item := range history.Records {
-		if item.EventType == arr.Grabbed && strings.ToUpper(item.Data.TorrentInfoHash) == strings.ToUpper(hash) {
+		if item.EventType == arr.Grabbed && s.grabbedAs(item, hash) {
 			toRemove = append(toRemove, i)
 		}
 	}
 
 	if len(toRemove) == 0 {
-		s.logger.Error("could not find hash in history")
+		audit.Record(s.jobID, audit.Entry{Kind: audit.ArrCallback, Message: "getHistory", Error: "release not found in history"})
+		s.logger.Error("could not find release in history")
+		s.researchGrabbedSeason()
 		return
 	}
 
@@ -415,12 +1089,12 @@ func (s *MonitorItem) removeFromSonarr() {
 
 			s.logger.Info("failing history item")
 			err = s.arrClient.FailHistoryItem(arrId)
+			audit.Record(s.jobID, audit.Entry{Kind: audit.ArrCallback, Message: fmt.Sprintf("failHistoryItem %d", arrId), Error: audit.Err(err)})
 			if err != nil {
 				s.logger.Error("failed to fail history item")
 			}
 		}
 	case *arr.SonarrClient:
-		// TODO: Maybe put this behind a config option
 		isSeasonPack := history.Records[toRemove[0]].Data.ReleaseType == arr.SeasonPack
 		if isSeasonPack {
 			s.logger.Info("season pack found")
@@ -433,15 +1107,17 @@ func (s *MonitorItem) removeFromSonarr() {
 
 			s.logger.Info("failing history item")
 			err = s.arrClient.FailHistoryItem(arrId)
+			audit.Record(s.jobID, audit.Entry{Kind: audit.ArrCallback, Message: fmt.Sprintf("failHistoryItem %d", arrId), Error: audit.Err(err)})
 			if err != nil {
 				s.logger.Error("failed to fail history item")
 			}
 		}
 
-		if isSeasonPack {
+		if isSeasonPack && s.config.GetSeasonPacks() == "research" {
 			historyRecord := history.Records[toRemove[0]]
 			s.logger.Info("triggering retry of season")
 			_, err := client.SearchSeason(historyRecord.Episode.SeriesID, historyRecord.Episode.SeasonNumber)
+			audit.Record(s.jobID, audit.Entry{Kind: audit.ArrCallback, Message: "searchSeason", Error: audit.Err(err)})
 			if err != nil {
 				s.logger.Error("failed to retry season")
 			}
@@ -11,9 +11,10 @@ import (
 	"testing"
 	"time"
 
+	"github.com/samjwillis97/sams-blackhole/internal/arr"
 	"github.com/samjwillis97/sams-blackhole/internal/config"
 	"github.com/samjwillis97/sams-blackhole/internal/logger"
-	"github.com/samjwillis97/sams-blackhole/internal/monitor"
+	debridMonitor "github.com/samjwillis97/sams-blackhole/internal/monitor/debrid"
 	"github.com/samjwillis97/sams-blackhole/internal/monitor/sonarr"
 	"github.com/samjwillis97/sams-blackhole/internal/torrents"
 	"github.com/spf13/viper"
@@ -117,7 +118,17 @@ func TestNewMagnetFileCreated2(t *testing.T) {
 	mockSecretViper.Set("DEBRID_API_KEY", debridapikey)
 	config.InitializeSecrets(mockSecretViper)
 
-	err := sonarr.NewTorrentFile(path.Join(rootDir, createdFile))
+	sonarrConfig := config.ArrConfig{
+		Name:           "sonarr",
+		Url:            server.URL,
+		ProcessingPath: sonarrProcessingPath,
+		CompletedPath:  sonarrCompletedPath,
+	}
+
+	err := sonarr.NewTorrentFile(arr.Sonarr, sonarrConfig, path.Join(rootDir, createdFile), log)
+	if err != nil {
+		t.Errorf("Expected no error, got %s", err)
+	}
 
 	processingFile := path.Join(sonarrProcessingPath, createdFile)
 	_, err = os.Stat(processingFile)
@@ -129,7 +140,7 @@ func TestNewMagnetFileCreated2(t *testing.T) {
 		t.Errorf("Expected a request to be made, but was not")
 	}
 
-	monitoredMeta := monitor.GetMonitoredFile(createdFile)
+	monitoredMeta := debridMonitor.GetMonitoredFile(createdFile)
 	if monitoredMeta.CompletedDir != sonarrCompletedPath {
 		t.Errorf("Expected debrid mount monitor to have completed path %s, got %s", sonarrCompletedPath, monitoredMeta.CompletedDir)
 	}
@@ -0,0 +1,77 @@
+package monitor
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/samjwillis97/sams-blackhole/internal/config"
+)
+
+// Backends a directory can be watched with
+const (
+	Fsnotify = "fsnotify" // Kernel notifications, doesn't fire for changes made on other machines such as over NFS
+	Poll     = "poll"     // Periodically lists the directory and compares it to the last listing
+	Hybrid   = "hybrid"   // Kernel notifications, plus a periodic listing to catch anything they missed
+)
+
+func init() {
+	config.RegisterNames(config.Watchers, Fsnotify, Poll, Hybrid)
+}
+
+type Op uint32
+
+const (
+	Create Op = iota // The path appeared, including being moved in
+	Write            // The contents of the path changed
+	Remove           // The path disappeared, including being moved away
+)
+
+func (o Op) String() string {
+	switch o {
+	case Create:
+		return "CREATE"
+	case Write:
+		return "WRITE"
+	case Remove:
+		return "REMOVE"
+	}
+	return "UNKNOWN"
+}
+
+// Event is a change to a path, the same regardless of the backend it came
+// from
+type Event struct {
+	Path  string
+	Op    Op
+	IsDir bool
+}
+
+// Handler is called with every event for a setting's directory
+type Handler func(e Event, directory string, logger *slog.Logger)
+
+// Watcher reports changes to the direct children of the directories added to
+// it
+type Watcher interface {
+	Add(dir string) error
+	Events() <-chan Event
+	Errors() <-chan error
+	Close() error
+}
+
+// NewWatcher creates a watcher for the backend, the poll interval is how often
+// a polling backend lists the directories and the reconcile interval how often
+// a hybrid backend does
+func NewWatcher(backend string, pollInterval time.Duration, reconcileInterval time.Duration) (Watcher, error) {
+	switch backend {
+	case "", Fsnotify:
+		return newFsnotifyWatcher()
+	case Poll:
+		return newPollWatcher(pollInterval)
+	case Hybrid:
+		return newHybridWatcher(reconcileInterval)
+	}
+
+	return nil, errors.New(fmt.Sprintf("Unknown watcher backend: %s", backend))
+}
@@ -0,0 +1,76 @@
+package monitor
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+type fsnotifyWatcher struct {
+	w      *fsnotify.Watcher
+	events chan Event
+}
+
+func newFsnotifyWatcher() (*fsnotifyWatcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to create event watcher: %s", err))
+	}
+
+	f := &fsnotifyWatcher{w: w, events: make(chan Event)}
+	go f.translate()
+
+	return f, nil
+}
+
+func (f *fsnotifyWatcher) translate() {
+	defer close(f.events)
+
+	for event := range f.w.Events {
+		e, ok := fromFsnotify(event)
+		if ok {
+			f.events <- e
+		}
+	}
+}
+
+func fromFsnotify(event fsnotify.Event) (Event, bool) {
+	e := Event{Path: event.Name}
+
+	switch {
+	case event.Has(fsnotify.Create):
+		e.Op = Create
+	case event.Has(fsnotify.Write):
+		e.Op = Write
+	// fsnotify reports the old name on a rename, the new name gets a create
+	case event.Has(fsnotify.Remove), event.Has(fsnotify.Rename):
+		e.Op = Remove
+		return e, true
+	default:
+		return Event{}, false
+	}
+
+	if info, err := os.Stat(event.Name); err == nil {
+		e.IsDir = info.IsDir()
+	}
+
+	return e, true
+}
+
+func (f *fsnotifyWatcher) Add(dir string) error {
+	return f.w.Add(dir)
+}
+
+func (f *fsnotifyWatcher) Events() <-chan Event {
+	return f.events
+}
+
+func (f *fsnotifyWatcher) Errors() <-chan error {
+	return f.w.Errors
+}
+
+func (f *fsnotifyWatcher) Close() error {
+	return f.w.Close()
+}
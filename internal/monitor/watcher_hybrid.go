@@ -0,0 +1,139 @@
+package monitor
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// seen is what the hybrid watcher last knew about a path
+type seen struct {
+	modTime time.Time
+	removed bool
+}
+
+// hybridWatcher passes on fsnotify events as they happen, and a slow poll of
+// the same directories reconciles anything fsnotify didn't report. Poll events
+// that fsnotify already covered are dropped.
+type hybridWatcher struct {
+	notify *fsnotifyWatcher
+	poll   *pollWatcher
+
+	events chan Event
+	errors chan error
+
+	mu   sync.Mutex
+	seen map[string]seen
+	wg   sync.WaitGroup
+}
+
+func newHybridWatcher(reconcileInterval time.Duration) (*hybridWatcher, error) {
+	notify, err := newFsnotifyWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	poll, err := newPollWatcher(reconcileInterval)
+	if err != nil {
+		notify.Close()
+		return nil, err
+	}
+
+	h := &hybridWatcher{
+		notify: notify,
+		poll:   poll,
+		events: make(chan Event),
+		errors: make(chan error),
+		seen:   map[string]seen{},
+	}
+
+	h.wg.Add(2)
+	go h.forward(notify.Events(), notify.Errors(), h.fromNotify)
+	go h.forward(poll.Events(), poll.Errors(), h.fromPoll)
+	go func() {
+		h.wg.Wait()
+		close(h.events)
+	}()
+
+	return h, nil
+}
+
+func (h *hybridWatcher) forward(events <-chan Event, errs <-chan error, keep func(Event) bool) {
+	defer h.wg.Done()
+
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if keep(e) {
+				h.events <- e
+			}
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			h.errors <- err
+		}
+	}
+}
+
+// fromNotify records every fsnotify event so the poll can skip it
+func (h *hybridWatcher) fromNotify(e Event) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if e.Op == Remove {
+		h.seen[e.Path] = seen{removed: true}
+		return true
+	}
+
+	if info, err := os.Stat(e.Path); err == nil {
+		h.seen[e.Path] = seen{modTime: info.ModTime()}
+	}
+	return true
+}
+
+// fromPoll only keeps events for changes fsnotify missed
+func (h *hybridWatcher) fromPoll(e Event) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	last, known := h.seen[e.Path]
+
+	if e.Op == Remove {
+		delete(h.seen, e.Path)
+		return !(known && last.removed)
+	}
+
+	info, err := os.Stat(e.Path)
+	if err != nil {
+		return false
+	}
+
+	if known && !last.removed && last.modTime.Equal(info.ModTime()) {
+		return false
+	}
+
+	h.seen[e.Path] = seen{modTime: info.ModTime()}
+	return true
+}
+
+func (h *hybridWatcher) Add(dir string) error {
+	return errors.Join(h.notify.Add(dir), h.poll.Add(dir))
+}
+
+func (h *hybridWatcher) Events() <-chan Event {
+	return h.events
+}
+
+func (h *hybridWatcher) Errors() <-chan error {
+	return h.errors
+}
+
+func (h *hybridWatcher) Close() error {
+	return errors.Join(h.notify.Close(), h.poll.Close())
+}
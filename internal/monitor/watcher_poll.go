@@ -0,0 +1,83 @@
+package monitor
+
+import (
+	"time"
+
+	"github.com/radovskyb/watcher"
+)
+
+type pollWatcher struct {
+	w      *watcher.Watcher
+	events chan Event
+}
+
+func newPollWatcher(interval time.Duration) (*pollWatcher, error) {
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	// Every event in a cycle is sent, limiting them drops the creation of a
+	// torrent whenever the mount directory itself changes in the same cycle
+	w := watcher.New()
+
+	p := &pollWatcher{w: w, events: make(chan Event)}
+	go p.translate()
+	go w.Start(interval)
+
+	w.Wait()
+
+	return p, nil
+}
+
+func (p *pollWatcher) translate() {
+	defer close(p.events)
+
+	for {
+		select {
+		case event := <-p.w.Event:
+			for _, e := range fromPoll(event) {
+				p.events <- e
+			}
+		case <-p.w.Closed:
+			return
+		}
+	}
+}
+
+func fromPoll(event watcher.Event) []Event {
+	isDir := event.FileInfo != nil && event.IsDir()
+
+	switch event.Op {
+	case watcher.Create:
+		return []Event{{Path: event.Path, Op: Create, IsDir: isDir}}
+	case watcher.Write:
+		return []Event{{Path: event.Path, Op: Write, IsDir: isDir}}
+	case watcher.Remove:
+		return []Event{{Path: event.Path, Op: Remove, IsDir: isDir}}
+	// The old path is gone and the new one has appeared
+	case watcher.Rename, watcher.Move:
+		return []Event{
+			{Path: event.OldPath, Op: Remove, IsDir: isDir},
+			{Path: event.Path, Op: Create, IsDir: isDir},
+		}
+	}
+
+	return nil
+}
+
+func (p *pollWatcher) Add(dir string) error {
+	return p.w.Add(dir)
+}
+
+func (p *pollWatcher) Events() <-chan Event {
+	return p.events
+}
+
+func (p *pollWatcher) Errors() <-chan error {
+	return p.w.Error
+}
+
+func (p *pollWatcher) Close() error {
+	p.w.Close()
+	return nil
+}
@@ -0,0 +1,225 @@
+// Package mount tracks whether the debrid mount is usable. A dead rclone
+// mount shows up as stale FUSE handles, IO errors or an empty listing, and
+// while it is down new items are held and nothing waiting on the mount is
+// allowed to expire.
+package mount
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/samjwillis97/sams-blackhole/internal/clock"
+	"github.com/samjwillis97/sams-blackhole/internal/config"
+	"github.com/samjwillis97/sams-blackhole/internal/logger/attr"
+	"github.com/samjwillis97/sams-blackhole/internal/metrics"
+	"github.com/samjwillis97/sams-blackhole/internal/notify"
+)
+
+type State string
+
+const (
+	Unknown   State = "unknown"
+	Healthy   State = "healthy"
+	Unhealthy State = "unhealthy"
+)
+
+var (
+	ErrEmpty     = errors.New("mount is empty")
+	ErrTimedOut  = errors.New("timed out checking mount")
+	ErrStale     = errors.New("stale FUSE handle")
+	ErrIOFailure = errors.New("IO error reading mount")
+)
+
+// Status is the result of the latest health check
+type Status struct {
+	State     State     `json:"state"`
+	Since     time.Time `json:"since"`
+	LastCheck time.Time `json:"lastCheck"`
+	Error     string    `json:"error,omitempty"`
+}
+
+var (
+	healthyGauge = metrics.NewGauge("blackhole_mount_healthy", "Whether the debrid mount passed its last health check")
+	outageCount  = metrics.NewCounter("blackhole_mount_outages_total", "Number of times the debrid mount has become unhealthy")
+	lastCheck    = metrics.NewGauge("blackhole_mount_last_check_timestamp_seconds", "Unix time of the last debrid mount health check")
+)
+
+var (
+	mu        sync.Mutex
+	status    = Status{State: Unknown}
+	recovered = closedChannel()
+	onRecover []func(downFor time.Duration)
+)
+
+func closedChannel() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}
+
+// checkMounts checks each mount in turn, they are only healthy when all of
+// them are
+func checkMounts(mounts []config.DebridConfig, timeout time.Duration) error {
+	for _, account := range mounts {
+		if err := Check(account.WatchPatch, account.AllowEmptyMount, timeout); err != nil {
+			return errors.New(fmt.Sprintf("%s: %s", account.WatchPatch, err))
+		}
+	}
+	return nil
+}
+
+// Check lists the mount and stats an entry in it, reads from a dead FUSE mount
+// can hang so the check gives up after the timeout
+func Check(mountPath string, allowEmpty bool, timeout time.Duration) error {
+	result := make(chan error, 1)
+	go func() {
+		result <- check(mountPath, allowEmpty)
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-clock.After(timeout):
+		return ErrTimedOut
+	}
+}
+
+func check(mountPath string, allowEmpty bool) error {
+	entries, err := os.ReadDir(mountPath)
+	if err != nil {
+		return classify(err)
+	}
+
+	if len(entries) == 0 {
+		if allowEmpty {
+			return nil
+		}
+		return ErrEmpty
+	}
+
+	_, err = os.Stat(path.Join(mountPath, entries[0].Name()))
+	if err != nil {
+		return classify(err)
+	}
+
+	return nil
+}
+
+func classify(err error) error {
+	switch {
+	case errors.Is(err, syscall.ENOTCONN):
+		return errors.Join(ErrStale, err)
+	case errors.Is(err, syscall.EIO):
+		return errors.Join(ErrIOFailure, err)
+	}
+	return err
+}
+
+// IsHealthy reports whether the mount can be used, before the first check it
+// is assumed to be
+func IsHealthy() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return status.State != Unhealthy
+}
+
+// GetStatus returns the result of the latest health check
+func GetStatus() Status {
+	mu.Lock()
+	defer mu.Unlock()
+	return status
+}
+
+// Recovered returns a channel that is closed once the mount is healthy, it is
+// already closed when the mount is healthy now
+func Recovered() <-chan struct{} {
+	mu.Lock()
+	defer mu.Unlock()
+	return recovered
+}
+
+// OnRecover registers a function called with how long the mount was unhealthy
+// for each time it recovers
+func OnRecover(fn func(downFor time.Duration)) {
+	mu.Lock()
+	defer mu.Unlock()
+	onRecover = append(onRecover, fn)
+}
+
+// Update records the result of a health check, returning whether the state
+// changed
+func Update(checkErr error) bool {
+	now := clock.Now()
+	lastCheck.Set(float64(now.Unix()))
+
+	mu.Lock()
+	previous := status
+	status.LastCheck = now
+	status.Error = ""
+	if checkErr != nil {
+		status.Error = checkErr.Error()
+	}
+
+	state := Healthy
+	if checkErr != nil {
+		state = Unhealthy
+	}
+
+	if state == previous.State {
+		mu.Unlock()
+		return false
+	}
+
+	status.State = state
+	status.Since = now
+
+	var callbacks []func(time.Duration)
+	if state == Unhealthy {
+		healthyGauge.Set(0)
+		outageCount.Inc()
+		recovered = make(chan struct{})
+	} else {
+		healthyGauge.Set(1)
+		if previous.State == Unhealthy {
+			close(recovered)
+			callbacks = append(callbacks, onRecover...)
+		}
+	}
+	mu.Unlock()
+
+	for _, fn := range callbacks {
+		fn(now.Sub(previous.Since))
+	}
+
+	return true
+}
+
+// Monitor checks every debrid account's mount on the configured interval,
+// logging each time their health changes
+func Monitor(logger *slog.Logger) {
+	appConfig := config.GetAppConfig()
+	interval := appConfig.GetTimings().MountHealthInterval
+
+	logger = logger.With(attr.MonitorName("mount-health"))
+	for {
+		err := checkMounts(appConfig.DebridMounts(), interval)
+		if Update(err) {
+			if err != nil {
+				logger.Error("debrid mount is unhealthy, pausing new items", "err", err)
+				notify.Async(logger, notify.Event{Type: notify.MountUnhealthy, Error: err.Error()})
+			} else {
+				logger.Info("debrid mount is healthy")
+			}
+		} else if err != nil {
+			logger.Debug("debrid mount is still unhealthy", "err", err)
+		}
+
+		clock.Sleep(interval)
+	}
+}
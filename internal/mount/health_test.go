@@ -0,0 +1,91 @@
+package mount_test
+
+import (
+	"errors"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/samjwillis97/sams-blackhole/internal/clock"
+	"github.com/samjwillis97/sams-blackhole/internal/mount"
+)
+
+func TestCheck(t *testing.T) {
+	emptyDir := t.TempDir()
+
+	populatedDir := t.TempDir()
+	if err := os.Mkdir(path.Join(populatedDir, "Show.S01"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		description string
+		path        string
+		allowEmpty  bool
+		expected    error
+	}{
+		{"populated mount", populatedDir, false, nil},
+		{"empty mount", emptyDir, false, mount.ErrEmpty},
+		{"empty mount when allowed", emptyDir, true, nil},
+		{"missing mount", path.Join(emptyDir, "missing"), false, os.ErrNotExist},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			err := mount.Check(tc.path, tc.allowEmpty, time.Second)
+			if tc.expected == nil && err != nil {
+				t.Errorf("Expected no error, got %s", err)
+			}
+			if tc.expected != nil && !errors.Is(err, tc.expected) {
+				t.Errorf("Expected %s, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestUpdateTracksOutages(t *testing.T) {
+	fakeClock := clock.NewFake(time.Now())
+	defer clock.Set(fakeClock)()
+	t.Cleanup(func() { mount.Update(nil) })
+
+	mount.Update(nil)
+
+	var downFor []time.Duration
+	mount.OnRecover(func(d time.Duration) { downFor = append(downFor, d) })
+
+	if !mount.Update(errors.New("transport endpoint is not connected")) {
+		t.Errorf("Expected the state to change when the mount fails")
+	}
+	if mount.IsHealthy() {
+		t.Errorf("Expected the mount to be unhealthy")
+	}
+
+	recovered := mount.Recovered()
+	select {
+	case <-recovered:
+		t.Fatalf("Expected recovered to block while the mount is unhealthy")
+	default:
+	}
+
+	fakeClock.Advance(time.Minute)
+	if mount.Update(errors.New("still broken")) {
+		t.Errorf("Expected repeated failures not to change the state")
+	}
+	if status := mount.GetStatus(); status.Error != "still broken" {
+		t.Errorf("Expected the latest error in the status, got %q", status.Error)
+	}
+
+	fakeClock.Advance(time.Minute)
+	mount.Update(nil)
+
+	select {
+	case <-recovered:
+	default:
+		t.Errorf("Expected recovered to be closed once the mount is healthy")
+	}
+
+	if len(downFor) != 1 || downFor[0] != 2*time.Minute {
+		t.Errorf("Expected a single recovery after 2 minutes, got %v", downFor)
+	}
+}
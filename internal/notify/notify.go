@@ -0,0 +1,184 @@
+// Package notify sends notifications about what blackhole is doing to chat
+// services and webhooks, each configured notifier choosing which events it
+// is sent.
+package notify
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/samjwillis97/sams-blackhole/internal/clock"
+	"github.com/samjwillis97/sams-blackhole/internal/config"
+)
+
+type EventType string
+
+const (
+	Failure        EventType = "failure"         // An item failed, including *arr being told
+	Completed      EventType = "completed"       // An item was linked into its completed path
+	Timeout        EventType = "timeout"         // An item ran out of time in processing or waiting for the mount
+	MountUnhealthy EventType = "mount_unhealthy" // The debrid mount stopped responding
+	RateLimited    EventType = "rate_limited"    // Debrid turned requests away for being too frequent
+	Housekeeping   EventType = "housekeeping"    // Torrents were removed from the debrid account, the release lists them
+)
+
+func init() {
+	config.RegisterNames(config.NotifierTypes, "discord", "slack", "ntfy", "gotify", "apprise", "webhook")
+	for _, t := range []EventType{Failure, Completed, Timeout, MountUnhealthy, RateLimited, Housekeeping} {
+		config.RegisterNames(config.NotifyEvents, string(t))
+	}
+}
+
+// Event is what happened, it is what the title and message templates are
+// executed with
+type Event struct {
+	Type     EventType `json:"event"`
+	Release  string    `json:"release,omitempty"`
+	Instance string    `json:"instance,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// Notification is an event along with its rendered title and message
+type Notification struct {
+	Event
+	Title   string `json:"title"`
+	Message string `json:"message"`
+}
+
+// Sink delivers notifications to a single service
+type Sink interface {
+	Send(n Notification) error
+}
+
+var defaultTitles = map[EventType]string{
+	Failure:        "Failed: {{.Release}}",
+	Completed:      "Completed: {{.Release}}",
+	Timeout:        "Timed out: {{.Release}}",
+	MountUnhealthy: "Debrid mount is unhealthy",
+	RateLimited:    "Rate limited by debrid",
+	Housekeeping:   "Removed torrents from debrid",
+}
+
+const defaultMessage = `{{with .Instance}}{{.}}: {{end}}{{.Release}}{{with .Error}}
+{{.}}{{end}}`
+
+// New creates the sink for a notifier
+func New(conf config.NotifierConfig) (Sink, error) {
+	switch conf.Type {
+	case "discord":
+		return discordSink{url: conf.Url}, nil
+	case "slack":
+		return slackSink{url: conf.Url}, nil
+	case "ntfy":
+		return ntfySink{url: conf.Url, token: conf.Token()}, nil
+	case "gotify":
+		return gotifySink{url: conf.Url, token: conf.Token()}, nil
+	case "apprise":
+		return appriseSink{url: conf.Url}, nil
+	case "webhook":
+		return webhookSink{url: conf.Url, token: conf.Token()}, nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("Unknown notifier type: %s", conf.Type))
+}
+
+var pending sync.WaitGroup
+
+// Async sends the event in its own goroutine, Wait blocks until every event
+// sent this way has been delivered
+func Async(logger *slog.Logger, e Event) {
+	pending.Add(1)
+	go func() {
+		defer pending.Done()
+		Send(logger, e)
+	}()
+}
+
+// Wait blocks until every event sent with Async has been delivered
+func Wait() {
+	pending.Wait()
+}
+
+// Send delivers the event to every notifier routed it, failures are logged.
+// It waits on each notifier in turn so is best called in its own goroutine.
+func Send(logger *slog.Logger, e Event) {
+	if e.Time.IsZero() {
+		e.Time = clock.Now()
+	}
+
+	for _, conf := range config.GetAppConfig().Notifications {
+		if !wants(conf, e.Type) {
+			continue
+		}
+
+		notifierLogger := logger.With("notifier", conf.Name, "notifyEvent", e.Type)
+
+		n, err := render(conf, e)
+		if err != nil {
+			notifierLogger.Error("failed to render notification", "err", err)
+			continue
+		}
+
+		sink, err := New(conf)
+		if err != nil {
+			notifierLogger.Error("failed to create notifier", "err", err)
+			continue
+		}
+
+		if err := sink.Send(n); err != nil {
+			notifierLogger.Warn("failed to send notification", "err", err)
+			continue
+		}
+		notifierLogger.Debug("sent notification")
+	}
+}
+
+func wants(conf config.NotifierConfig, eventType EventType) bool {
+	return len(conf.Events) == 0 || slices.Contains(conf.Events, string(eventType))
+}
+
+func render(conf config.NotifierConfig, e Event) (Notification, error) {
+	titleTemplate := conf.Title
+	if titleTemplate == "" {
+		titleTemplate = defaultTitles[e.Type]
+	}
+
+	messageTemplate := conf.Message
+	if messageTemplate == "" {
+		messageTemplate = defaultMessage
+	}
+
+	title, err := execute("title", titleTemplate, e)
+	if err != nil {
+		return Notification{}, err
+	}
+
+	message, err := execute("message", messageTemplate, e)
+	if err != nil {
+		return Notification{}, err
+	}
+
+	return Notification{Event: e, Title: title, Message: message}, nil
+}
+
+func execute(name string, text string, e Event) (string, error) {
+	t, err := template.New(name).Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var out bytes.Buffer
+	if err := t.Execute(&out, e); err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(out.String()), nil
+}
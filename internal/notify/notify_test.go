@@ -0,0 +1,171 @@
+package notify_test
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/samjwillis97/sams-blackhole/internal/config"
+	"github.com/samjwillis97/sams-blackhole/internal/logger"
+	"github.com/samjwillis97/sams-blackhole/internal/notify"
+	"github.com/spf13/viper"
+)
+
+type request struct {
+	Path    string
+	Headers http.Header
+	Body    string
+}
+
+type recorder struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []request
+}
+
+func newRecorder(t *testing.T) *recorder {
+	r := &recorder{}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.mu.Lock()
+		r.requests = append(r.requests, request{Path: req.URL.Path, Headers: req.Header, Body: string(body)})
+		r.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *recorder) Requests() []request {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]request{}, r.requests...)
+}
+
+func setup(t *testing.T, notifiers []map[string]any, secrets map[string]string) *slog.Logger {
+	mockViper := viper.New()
+	mockViper.Set("state_path", t.TempDir())
+	mockViper.Set("notifications", notifiers)
+	config.InitializeAppConfig(mockViper)
+
+	mockSecretViper := viper.New()
+	for k, v := range secrets {
+		mockSecretViper.Set(k, v)
+	}
+	config.InitializeSecrets(mockSecretViper)
+
+	return slog.New(logger.NewHandler(&slog.HandlerOptions{Level: slog.LevelDebug}))
+}
+
+var testEvent = notify.Event{
+	Type:     notify.Failure,
+	Release:  "Show.S01E01.1080p",
+	Instance: "sonarr",
+	Error:    "dead torrent",
+	Time:     time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+}
+
+func TestEachSinkIsSent(t *testing.T) {
+	server := newRecorder(t)
+	log := setup(t, []map[string]any{
+		{"name": "discord", "type": "discord", "url": server.URL + "/discord"},
+		{"name": "slack", "type": "slack", "url": server.URL + "/slack"},
+		{"name": "ntfy", "type": "ntfy", "url": server.URL + "/ntfy"},
+		{"name": "gotify", "type": "gotify", "url": server.URL + "/gotify"},
+		{"name": "apprise", "type": "apprise", "url": server.URL + "/apprise"},
+		{"name": "hook", "type": "webhook", "url": server.URL + "/hook"},
+	}, map[string]string{"GOTIFY_TOKEN": "gotify-token", "NTFY_TOKEN": "ntfy-token"})
+
+	notify.Send(log, testEvent)
+
+	requests := map[string]request{}
+	for _, r := range server.Requests() {
+		requests[r.Path] = r
+	}
+	if len(requests) != 6 {
+		t.Fatalf("Expected every notifier to be sent to, got %v", server.Requests())
+	}
+
+	if body := requests["/discord"].Body; !strings.Contains(body, `"title":"Failed: Show.S01E01.1080p"`) {
+		t.Errorf("Expected a discord embed with the title, got %s", body)
+	}
+	if body := requests["/slack"].Body; !strings.Contains(body, `Failed: Show.S01E01.1080p`) {
+		t.Errorf("Expected slack text with the title, got %s", body)
+	}
+
+	ntfy := requests["/ntfy"]
+	if ntfy.Headers.Get("Title") != "Failed: Show.S01E01.1080p" || ntfy.Headers.Get("Authorization") != "Bearer ntfy-token" {
+		t.Errorf("Expected ntfy to get the title and token as headers, got %v", ntfy.Headers)
+	}
+	if ntfy.Body != "sonarr: Show.S01E01.1080p\ndead torrent" {
+		t.Errorf("Expected the default message, got %q", ntfy.Body)
+	}
+
+	if _, ok := requests["/gotify/message"]; !ok {
+		t.Errorf("Expected gotify to be sent to its message endpoint")
+	} else if key := requests["/gotify/message"].Headers.Get("X-Gotify-Key"); key != "gotify-token" {
+		t.Errorf("Expected the gotify token, got %q", key)
+	}
+
+	if body := requests["/apprise"].Body; !strings.Contains(body, `"type":"failure"`) {
+		t.Errorf("Expected an apprise failure, got %s", body)
+	}
+
+	var hook notify.Notification
+	if err := json.Unmarshal([]byte(requests["/hook"].Body), &hook); err != nil {
+		t.Fatal(err)
+	}
+	if hook.Type != notify.Failure || hook.Release != testEvent.Release || hook.Title == "" {
+		t.Errorf("Expected the whole notification in the webhook, got %+v", hook)
+	}
+}
+
+func TestRoutesByEvent(t *testing.T) {
+	server := newRecorder(t)
+	log := setup(t, []map[string]any{
+		{"name": "failures", "type": "webhook", "url": server.URL + "/failures", "events": []string{"failure", "timeout"}},
+		{"name": "completed", "type": "webhook", "url": server.URL + "/completed", "events": []string{"completed"}},
+		{"name": "everything", "type": "webhook", "url": server.URL + "/everything"},
+	}, nil)
+
+	notify.Send(log, testEvent)
+
+	paths := []string{}
+	for _, r := range server.Requests() {
+		paths = append(paths, r.Path)
+	}
+	if strings.Join(paths, ",") != "/failures,/everything" {
+		t.Errorf("Expected only the routed notifiers, got %v", paths)
+	}
+}
+
+func TestCustomTemplates(t *testing.T) {
+	server := newRecorder(t)
+	log := setup(t, []map[string]any{{
+		"name":    "ntfy",
+		"type":    "ntfy",
+		"url":     server.URL,
+		"title":   "{{.Type}} in {{.Instance}}",
+		"message": "{{.Release}} failed because {{.Error}}",
+	}}, nil)
+
+	notify.Send(log, testEvent)
+
+	requests := server.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("Expected one notification, got %d", len(requests))
+	}
+	if title := requests[0].Headers.Get("Title"); title != "failure in sonarr" {
+		t.Errorf("Expected the custom title, got %q", title)
+	}
+	if requests[0].Body != "Show.S01E01.1080p failed because dead torrent" {
+		t.Errorf("Expected the custom message, got %q", requests[0].Body)
+	}
+}
@@ -0,0 +1,164 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var client = &http.Client{}
+
+// Red for anything needing attention, green otherwise
+func discordColor(t EventType) int {
+	if t == Completed {
+		return 0x2ecc71
+	}
+	return 0xe74c3c
+}
+
+type discordSink struct {
+	url string
+}
+
+func (s discordSink) Send(n Notification) error {
+	return postJSON(s.url, nil, map[string]any{
+		"username": "blackhole",
+		"embeds": []map[string]any{{
+			"title":       n.Title,
+			"description": n.Message,
+			"color":       discordColor(n.Type),
+			"timestamp":   n.Time,
+		}},
+	})
+}
+
+type slackSink struct {
+	url string
+}
+
+func (s slackSink) Send(n Notification) error {
+	return postJSON(s.url, nil, map[string]any{
+		"text": fmt.Sprintf("*%s*\n%s", n.Title, n.Message),
+	})
+}
+
+// The url includes the topic, such as `https://ntfy.sh/blackhole`
+type ntfySink struct {
+	url   string
+	token string
+}
+
+func (s ntfySink) Send(n Notification) error {
+	req, err := http.NewRequest(http.MethodPost, s.url, strings.NewReader(n.Message))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Title", n.Title)
+	req.Header.Set("Tags", string(n.Type))
+	if n.Type != Completed {
+		req.Header.Set("Priority", "high")
+	}
+	if s.token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", s.token))
+	}
+
+	return do(req)
+}
+
+type gotifySink struct {
+	url   string
+	token string
+}
+
+func (s gotifySink) Send(n Notification) error {
+	reqUrl, err := url.Parse(s.url)
+	if err != nil {
+		return err
+	}
+
+	priority := 8
+	if n.Type == Completed {
+		priority = 2
+	}
+
+	return postJSON(reqUrl.JoinPath("message").String(), http.Header{"X-Gotify-Key": {s.token}}, map[string]any{
+		"title":    n.Title,
+		"message":  n.Message,
+		"priority": priority,
+	})
+}
+
+// The url is the notify endpoint, such as `http://apprise:8000/notify/blackhole`
+type appriseSink struct {
+	url string
+}
+
+func (s appriseSink) Send(n Notification) error {
+	notifyType := "failure"
+	switch n.Type {
+	case Completed:
+		notifyType = "success"
+	case RateLimited:
+		notifyType = "warning"
+	}
+
+	return postJSON(s.url, nil, map[string]any{
+		"title": n.Title,
+		"body":  n.Message,
+		"type":  notifyType,
+	})
+}
+
+// Sends the whole notification as JSON, for anything without its own sink
+type webhookSink struct {
+	url   string
+	token string
+}
+
+func (s webhookSink) Send(n Notification) error {
+	header := http.Header{}
+	if s.token != "" {
+		header.Set("Authorization", fmt.Sprintf("Bearer %s", s.token))
+	}
+	return postJSON(s.url, header, n)
+}
+
+func postJSON(reqUrl string, header http.Header, body any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, reqUrl, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return do(req)
+}
+
+func do(req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(resp.Body)
+		return errors.New(fmt.Sprintf("Notification failed with status code: %d, message: %s", resp.StatusCode, string(body)))
+	}
+
+	return nil
+}
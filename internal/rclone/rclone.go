@@ -0,0 +1,186 @@
+// Package rclone talks to the remote control API of the rclone instance
+// serving the debrid mount, so the mount's directory cache can be refreshed
+// as soon as debrid has a torrent rather than waiting for it to expire.
+package rclone
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+
+	"github.com/samjwillis97/sams-blackhole/internal/clock"
+	"github.com/samjwillis97/sams-blackhole/internal/config"
+	"github.com/samjwillis97/sams-blackhole/internal/logger/attr"
+)
+
+// Stats is the subset of `core/stats` used to judge the health of the mount
+type Stats struct {
+	Bytes       int64   `json:"bytes"`
+	Checks      int64   `json:"checks"`
+	Errors      int64   `json:"errors"`
+	FatalError  bool    `json:"fatalError"`
+	LastError   string  `json:"lastError"`
+	Speed       float64 `json:"speed"`
+	Transfers   int64   `json:"transfers"`
+	ElapsedTime float64 `json:"elapsedTime"`
+}
+
+type errorResponse struct {
+	Error  string `json:"error"`
+	Status int    `json:"status"`
+}
+
+// Enabled reports whether an rclone remote control URL is configured
+func Enabled() bool {
+	return config.GetAppConfig().Rclone.Url != ""
+}
+
+// Refresh re-reads the torrents directory of the mount, and the given
+// directories beneath it, so new torrents show up straight away
+func Refresh(dirs ...string) error {
+	params := dirParams(dirs)
+
+	var result struct {
+		Result map[string]string `json:"result"`
+	}
+	err := call("vfs/refresh", params, &result)
+	if err != nil {
+		return err
+	}
+
+	// Each directory is reported as either `OK` or the reason it failed
+	for dir, status := range result.Result {
+		if status != "OK" {
+			return errors.New(fmt.Sprintf("Failed to refresh %s: %s", dir, status))
+		}
+	}
+
+	return nil
+}
+
+// Forget drops the given directories beneath the torrents directory from the
+// mount's cache, used once a torrent has been deleted from debrid
+func Forget(dirs ...string) error {
+	if len(dirs) == 0 {
+		return nil
+	}
+
+	params := dirParams(dirs)
+
+	return call("vfs/forget", params, nil)
+}
+
+// GetStats returns the transfer stats of the rclone instance
+func GetStats() (Stats, error) {
+	var stats Stats
+	err := call("core/stats", map[string]string{}, &stats)
+	return stats, err
+}
+
+// ReportHealth checks `core/stats` on the configured interval, warning when
+// rclone reports new errors or can't be reached. It returns straight away if
+// rclone or the interval is not configured.
+func ReportHealth(logger *slog.Logger) {
+	interval := config.GetAppConfig().Rclone.HealthInterval
+	if !Enabled() || interval <= 0 {
+		return
+	}
+
+	logger = logger.With(attr.MonitorName("rclone"))
+	var lastErrors int64
+	for {
+		stats, err := GetStats()
+		if err != nil {
+			logger.Warn("rclone is unreachable", "err", err)
+		} else if stats.Errors > lastErrors {
+			logger.Warn("rclone reported errors", "errors", stats.Errors, "lastError", stats.LastError, "fatal", stats.FatalError)
+			lastErrors = stats.Errors
+		} else {
+			logger.Debug("rclone is healthy", "transfers", stats.Transfers, "speed", stats.Speed)
+		}
+
+		clock.Sleep(interval)
+	}
+}
+
+// dirParams builds the `dir`, `dir2`, ... parameters for the vfs commands.
+// Directories are relative to the torrents directory and no directories means
+// the torrents directory itself, which is left out when it is the root.
+func dirParams(dirs []string) map[string]string {
+	rcloneConfig := config.GetAppConfig().Rclone
+
+	params := map[string]string{}
+	if rcloneConfig.Fs != "" {
+		params["fs"] = rcloneConfig.Fs
+	}
+
+	if len(dirs) == 0 {
+		if rcloneConfig.Dir != "" {
+			params["dir"] = rcloneConfig.Dir
+		}
+		return params
+	}
+
+	for i, dir := range dirs {
+		key := "dir"
+		if i > 0 {
+			key = fmt.Sprintf("dir%d", i+1)
+		}
+		params[key] = path.Join(rcloneConfig.Dir, dir)
+	}
+	return params
+}
+
+func call(command string, params map[string]string, response any) error {
+	rcloneConfig := config.GetAppConfig().Rclone
+
+	reqUrl, err := url.Parse(rcloneConfig.Url)
+	if err != nil {
+		return err
+	}
+	reqUrl = reqUrl.JoinPath(command)
+
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, reqUrl.String(), bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if rcloneConfig.User != "" {
+		req.SetBasicAuth(rcloneConfig.User, config.GetSecrets().GetString("RCLONE_PASSWORD"))
+	}
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	bodyBytes, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode >= 300 {
+		var apiError errorResponse
+		if json.Unmarshal(bodyBytes, &apiError) == nil && apiError.Error != "" {
+			return errors.New(fmt.Sprintf("rclone %s failed with status code: %d, error: %s", command, resp.StatusCode, apiError.Error))
+		}
+		return errors.New(fmt.Sprintf("rclone %s failed with status code: %d", command, resp.StatusCode))
+	}
+
+	if response == nil {
+		return nil
+	}
+
+	return json.Unmarshal(bodyBytes, response)
+}
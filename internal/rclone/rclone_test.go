@@ -0,0 +1,95 @@
+package rclone_test
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/samjwillis97/sams-blackhole/internal/config"
+	"github.com/samjwillis97/sams-blackhole/internal/rclone"
+	"github.com/samjwillis97/sams-blackhole/internal/rclone/rclonetest"
+	"github.com/spf13/viper"
+)
+
+func setup(t *testing.T, dir string) *rclonetest.Server {
+	server := rclonetest.NewServer()
+	server.User = "blackhole"
+	server.Password = "secret"
+	t.Cleanup(server.Close)
+
+	mockViper := viper.New()
+	mockViper.Set("rclone.url", server.URL)
+	mockViper.Set("rclone.user", "blackhole")
+	mockViper.Set("rclone.fs", "realdebrid:")
+	mockViper.Set("rclone.dir", dir)
+	config.InitializeAppConfig(mockViper)
+
+	mockSecretViper := viper.New()
+	mockSecretViper.Set("RCLONE_PASSWORD", "secret")
+	config.InitializeSecrets(mockSecretViper)
+
+	return server
+}
+
+func TestRefreshTorrentsDirectory(t *testing.T) {
+	server := setup(t, "torrents")
+
+	var refreshed []string
+	server.OnRefresh = func(dirs []string) { refreshed = dirs }
+
+	if err := rclone.Refresh(); err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	if !slices.Equal(refreshed, []string{"torrents"}) {
+		t.Errorf("Expected the torrents directory to be refreshed, got %v", refreshed)
+	}
+
+	calls := server.Calls()
+	if len(calls) != 1 || calls[0].Params["fs"] != "realdebrid:" {
+		t.Errorf("Expected a single call with the configured fs, got %v", calls)
+	}
+}
+
+func TestForgetTorrents(t *testing.T) {
+	server := setup(t, "torrents")
+
+	if err := rclone.Forget("Show.S01", "Movie.2024"); err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	calls := server.Calls()
+	if len(calls) != 1 || calls[0].Command != "vfs/forget" {
+		t.Fatalf("Expected a single forget, got %v", calls)
+	}
+	if calls[0].Params["dir"] != "torrents/Show.S01" || calls[0].Params["dir2"] != "torrents/Movie.2024" {
+		t.Errorf("Expected both torrents to be forgotten, got %v", calls[0].Params)
+	}
+}
+
+func TestGetStats(t *testing.T) {
+	server := setup(t, "")
+	server.SetStats(rclone.Stats{Errors: 3, LastError: "couldn't list directory"})
+
+	stats, err := rclone.GetStats()
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	if stats.Errors != 3 || stats.LastError != "couldn't list directory" {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestBadCredentialsReturnRcloneError(t *testing.T) {
+	setup(t, "")
+
+	mockSecretViper := viper.New()
+	mockSecretViper.Set("RCLONE_PASSWORD", "wrong")
+	config.InitializeSecrets(mockSecretViper)
+
+	err := rclone.Refresh()
+	if err == nil || !strings.Contains(err.Error(), "authentication required") {
+		t.Errorf("Expected an authentication error, got %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+// Package rclonetest provides an in-process fake of the rclone remote control
+// API for use in tests.
+package rclonetest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/samjwillis97/sams-blackhole/internal/rclone"
+)
+
+// Call is a single command received by the fake server
+type Call struct {
+	Command string
+	Params  map[string]string
+}
+
+type Server struct {
+	*httptest.Server
+
+	// When set, requests without matching basic auth are rejected
+	User     string
+	Password string
+
+	// OnRefresh is called with the directories of each `vfs/refresh`, letting
+	// a test make torrents appear in the mount as rclone would
+	OnRefresh func(dirs []string)
+
+	mu    sync.Mutex
+	calls []Call
+	stats rclone.Stats
+}
+
+// NewServer starts a fake rclone server, it should be closed by the caller
+func NewServer() *Server {
+	s := &Server{}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /vfs/refresh", s.handleRefresh)
+	mux.HandleFunc("POST /vfs/forget", s.handleForget)
+	mux.HandleFunc("POST /core/stats", s.handleStats)
+
+	s.Server = httptest.NewServer(s.record(mux))
+
+	return s
+}
+
+// SetStats replaces the stats served by `core/stats`
+func (s *Server) SetStats(stats rclone.Stats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats = stats
+}
+
+// Calls returns every command received so far, in order
+func (s *Server) Calls() []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Call{}, s.calls...)
+}
+
+// Commands returns the names of every command received so far, in order
+func (s *Server) Commands() []string {
+	commands := []string{}
+	for _, c := range s.Calls() {
+		commands = append(commands, c.Command)
+	}
+	return commands
+}
+
+func (s *Server) record(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.User != "" {
+			user, password, ok := r.BasicAuth()
+			if !ok || user != s.User || password != s.Password {
+				writeError(w, r, http.StatusUnauthorized, "authentication required")
+				return
+			}
+		}
+
+		params := map[string]string{}
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			writeError(w, r, http.StatusBadRequest, "failed to read input JSON")
+			return
+		}
+
+		s.mu.Lock()
+		s.calls = append(s.calls, Call{Command: strings.TrimPrefix(r.URL.Path, "/"), Params: params})
+		s.mu.Unlock()
+
+		data, _ := json.Marshal(params)
+		r.Body = io.NopCloser(bytes.NewReader(data))
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func paramsFrom(r *http.Request) map[string]string {
+	params := map[string]string{}
+	json.NewDecoder(r.Body).Decode(&params)
+	return params
+}
+
+func (s *Server) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	dirs := dirsFrom(paramsFrom(r))
+
+	if s.OnRefresh != nil {
+		s.OnRefresh(dirs)
+	}
+
+	result := map[string]string{}
+	for _, dir := range dirs {
+		result[dir] = "OK"
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"result": result})
+}
+
+func (s *Server) handleForget(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"forgotten": dirsFrom(paramsFrom(r))})
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	stats := s.stats
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// dirsFrom collects the `dir`, `dir2`, ... parameters, a refresh without any
+// refreshes the root
+func dirsFrom(params map[string]string) []string {
+	dirs := []string{}
+	for k, v := range params {
+		if strings.HasPrefix(k, "dir") {
+			dirs = append(dirs, v)
+		}
+	}
+	sort.Strings(dirs)
+
+	if len(dirs) == 0 {
+		dirs = append(dirs, "")
+	}
+	return dirs
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	writeJSON(w, status, map[string]any{
+		"error":  message,
+		"status": status,
+		"path":   strings.TrimPrefix(r.URL.Path, "/"),
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
@@ -0,0 +1,398 @@
+// Package reconcile periodically compares what is on disk against the jobs
+// blackhole knows about, picking up anything an event was missed for and
+// cleaning up whatever has been left behind.
+package reconcile
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samjwillis97/sams-blackhole/internal/arr"
+	"github.com/samjwillis97/sams-blackhole/internal/cleanup"
+	"github.com/samjwillis97/sams-blackhole/internal/clock"
+	"github.com/samjwillis97/sams-blackhole/internal/config"
+	"github.com/samjwillis97/sams-blackhole/internal/jobs"
+	"github.com/samjwillis97/sams-blackhole/internal/logger/attr"
+	"github.com/samjwillis97/sams-blackhole/internal/monitor"
+	"github.com/samjwillis97/sams-blackhole/internal/monitor/debrid"
+	"github.com/samjwillis97/sams-blackhole/internal/monitor/sonarr"
+	"github.com/samjwillis97/sams-blackhole/internal/mount"
+)
+
+// Report is everything a run found, in dry runs nothing was acted on
+type Report struct {
+	Adopted          []string // Files in a watch path no job had picked up
+	Resumed          []string // Processing files whose job had stopped progressing
+	Removed          []string // Processing files without a job, and routes without a processing file
+	Found            []string // Torrents found in the mount after their event was missed
+	Forgotten        []string // Torrents no longer watched for as their processing file is gone
+	CompletedTracked []string // Completed folders handed to the cleanup to remove once imported
+	Expired          []string // Failed jobs no longer kept to be retried
+	Restored         []string // Failed jobs rebuilt from what was written beside their kept file
+}
+
+var running sync.Mutex
+
+// Run reconciles every *arr instance and the debrid mount
+func Run(logger *slog.Logger, dryRun bool) (Report, error) {
+	if !running.TryLock() {
+		return Report{}, errors.New("Reconcile is already running")
+	}
+	defer running.Unlock()
+
+	report := Report{}
+	appConfig := config.GetAppConfig()
+
+	for _, conf := range appConfig.Sonarr {
+		reconcileInstance(arr.Sonarr, conf, dryRun, &report, logger.With("instance", conf.Name))
+	}
+	for _, conf := range appConfig.Radarr {
+		reconcileInstance(arr.Radarr, conf, dryRun, &report, logger.With("instance", conf.Name))
+	}
+
+	reconcileFailed(appConfig.Reconcile.KeepFailed, dryRun, &report, logger)
+
+	// Nothing can be found in a dead mount
+	if !mount.IsHealthy() {
+		logger.Info("debrid mount is unhealthy, skipping reconciling it")
+	} else if !dryRun {
+		report.Found, report.Forgotten = debrid.Reconcile(logger)
+	}
+
+	logger.Info("finished reconciling",
+		"adopted", len(report.Adopted),
+		"resumed", len(report.Resumed),
+		"removed", len(report.Removed),
+		"found", len(report.Found),
+		"forgotten", len(report.Forgotten),
+		"completedTracked", len(report.CompletedTracked),
+		"expired", len(report.Expired),
+		"restored", len(report.Restored),
+		"dryRun", dryRun,
+	)
+
+	return report, nil
+}
+
+// reconcileRoute removes a written route whose processing file has gone
+func reconcileRoute(file string, dryRun bool, report *Report, logger *slog.Logger) {
+	if _, err := os.Stat(jobs.RouteProcessingPath(file)); !errors.Is(err, os.ErrNotExist) {
+		return
+	}
+
+	if !dryRun {
+		err := os.Remove(file)
+		if errors.Is(err, os.ErrNotExist) {
+			// Removed along with its file earlier in this run
+			return
+		}
+		if err != nil {
+			logger.Warn("failed to remove written route", "file", file, "err", err)
+			return
+		}
+	}
+
+	logger.Info("removed written route without a processing file", "file", file)
+	report.Removed = append(report.Removed, file)
+}
+
+// Schedule runs the reconcile on the configured interval, it returns straight
+// away if no interval is set
+func Schedule(logger *slog.Logger) {
+	interval := config.GetAppConfig().Reconcile.Interval
+	if interval <= 0 {
+		return
+	}
+
+	logger = logger.With(attr.MonitorName("reconcile"))
+	for {
+		clock.Sleep(interval)
+
+		_, err := Run(logger, config.GetAppConfig().Reconcile.DryRun)
+		if err != nil {
+			logger.Error("reconcile failed", "err", err)
+		}
+	}
+}
+
+func reconcileInstance(service arr.ArrService, conf config.ArrConfig, dryRun bool, report *Report, logger *slog.Logger) {
+	timings := conf.GetTimings()
+
+	for _, file := range watchFiles(conf, logger) {
+		if _, ok := jobs.FindByPath(file); ok || monitor.Pending(file) {
+			continue
+		}
+
+		// Anything written to recently may still have its event on the way
+		info, err := os.Stat(file)
+		if err != nil || clock.Since(info.ModTime()) < timings.Debounce {
+			continue
+		}
+
+		logger.Info("adopting file missed in watch path", "file", file)
+		report.Adopted = append(report.Adopted, file)
+		if dryRun {
+			continue
+		}
+
+		if err := sonarr.NewTorrentFile(service, conf, file, logger); err != nil {
+			logger.Warn("failed to adopt file", "file", file, "err", err)
+		}
+	}
+
+	entries, err := os.ReadDir(conf.ProcessingPath)
+	if err != nil {
+		logger.Warn("failed to read processing path", "err", err)
+	}
+
+	for _, e := range entries {
+		file := path.Join(conf.ProcessingPath, e.Name())
+		if e.IsDir() {
+			continue
+		}
+
+		// Written routes are removed along with their file, only those left
+		// behind once it has gone are removed here
+		if jobs.IsRoute(file) {
+			reconcileRoute(file, dryRun, report, logger)
+			continue
+		}
+
+		if debrid.IsMonitoring(file) {
+			continue
+		}
+
+		job, ok := jobs.FindByPath(file)
+		if !ok {
+			logger.Info("removing processing file without a job", "file", file)
+			report.Removed = append(report.Removed, file)
+			if dryRun {
+				continue
+			}
+
+			if err := os.Remove(file); err != nil {
+				logger.Warn("failed to remove processing file", "file", file, "err", err)
+			}
+			if err := jobs.RemoveRoute(file); err != nil {
+				logger.Warn("failed to remove written route", "file", file, "err", err)
+			}
+			continue
+		}
+
+		if !isStuck(job, timings.ProcessingDeadline, config.GetAppConfig().RealDebrid.GetRetry().Deadline) {
+			continue
+		}
+
+		logger.Info("resuming stuck processing file", "file", file, "jobID", job.ID, "state", job.State, "updated", job.Updated)
+		report.Resumed = append(report.Resumed, file)
+		if dryRun {
+			continue
+		}
+
+		// The stuck job's item can't be stopped, but it no longer counts
+		jobs.Remove(job.ID)
+		if err := sonarr.ResumeProcessingFile(service, conf, file, logger); err != nil {
+			logger.Warn("failed to resume processing file", "file", file, "err", err)
+		}
+	}
+
+	for _, completedPath := range conf.CompletedPaths() {
+		report.CompletedTracked = append(report.CompletedTracked, trackCompleted(service, conf, completedPath, dryRun, logger)...)
+	}
+}
+
+// reconcileFailed rebuilds failed jobs kept from before a restart, removes
+// kept files without a job and drops failed jobs that have been kept for long
+// enough
+func reconcileFailed(keep time.Duration, dryRun bool, report *Report, logger *slog.Logger) {
+	restoreFailed(dryRun, report, logger)
+
+	if keep > 0 {
+		for _, job := range jobs.List() {
+			if job.State != "failure" || clock.Since(job.Updated) <= keep {
+				continue
+			}
+
+			logger.Info("no longer keeping failed job", "jobID", job.ID, "updated", job.Updated)
+			report.Expired = append(report.Expired, job.ID)
+			if dryRun {
+				continue
+			}
+
+			// Cancelling a failed job only removes what was kept
+			if err := jobs.Cancel(job.ID); err != nil {
+				logger.Warn("failed to drop failed job", "jobID", job.ID, "err", err)
+			}
+		}
+	}
+}
+
+// restoreFailed rebuilds the jobs of kept files from what was written beside
+// them, files without one are removed
+func restoreFailed(dryRun bool, report *Report, logger *slog.Logger) {
+	dir, err := jobs.FailedDir()
+	if err != nil {
+		return
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		file := path.Join(dir, e.Name())
+		// Written jobs are read along with their kept file
+		if e.IsDir() || jobs.IsKeptJob(file) {
+			continue
+		}
+		if _, ok := jobs.FindByPath(file); ok {
+			continue
+		}
+
+		job, err := jobs.ReadKept(file)
+		if err == nil {
+			logger.Info("restoring failed job", "jobID", job.ID, "file", file)
+			report.Restored = append(report.Restored, job.ID)
+			if dryRun {
+				continue
+			}
+
+			conf, ok := findInstance(job.Service, job.Instance)
+			if !ok {
+				logger.Warn("instance of failed job is no longer configured, leaving it", "jobID", job.ID, "instance", job.Instance)
+				continue
+			}
+			if err := sonarr.RestoreFailedJob(job.Service, conf, job, logger.With("instance", conf.Name)); err != nil {
+				logger.Warn("failed to restore failed job", "jobID", job.ID, "err", err)
+			}
+			continue
+		}
+
+		logger.Info("removing failed file without a job", "file", file)
+		report.Removed = append(report.Removed, file)
+		if dryRun {
+			continue
+		}
+
+		if err := os.Remove(file); err != nil {
+			logger.Warn("failed to remove failed file", "file", file, "err", err)
+		}
+	}
+}
+
+func findInstance(service arr.ArrService, name string) (config.ArrConfig, bool) {
+	instances := config.GetAppConfig().Sonarr
+	if service == arr.Radarr {
+		instances = config.GetAppConfig().Radarr
+	}
+
+	for _, conf := range instances {
+		if conf.Name == name {
+			return conf, true
+		}
+	}
+	return config.ArrConfig{}, false
+}
+
+// isStuck reports whether a job has gone without changing state for longer
+// than it had to finish in, items held for the mount or queued for a debrid
+// slot are expected to wait.
+// Items deferred after debrid kept failing are given the retry deadline again
+// before they are tried.
+func isStuck(job jobs.Job, deadline time.Duration, retryDeadline time.Duration) bool {
+	switch job.State {
+	case "awaitingMount", "awaitingSlot":
+		return false
+	case "deferred":
+		return clock.Since(job.Updated) > retryDeadline
+	}
+	return clock.Since(job.Updated) > deadline
+}
+
+// watchFiles lists the files in the watch path that the instance's monitor
+// would handle
+func watchFiles(conf config.ArrConfig, logger *slog.Logger) []string {
+	root := path.Clean(conf.WatchPath)
+	excluded := map[string]bool{
+		path.Clean(conf.ProcessingPath): true,
+	}
+	for _, completedPath := range conf.CompletedPaths() {
+		excluded[path.Clean(completedPath)] = true
+	}
+
+	files := []string{}
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.IsDir() {
+			files = append(files, p)
+			return nil
+		}
+
+		if p == root {
+			return nil
+		}
+
+		// Depth of the files inside this directory
+		depth := strings.Count(strings.TrimPrefix(p, root), "/")
+		if excluded[p] || !conf.Recursive || (conf.MaxDepth > 0 && depth > conf.MaxDepth) {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Warn("failed to read watch path", "err", err)
+	}
+
+	return files
+}
+
+// trackCompleted hands any completed folder that isn't being followed, such as
+// those linked before blackhole started following them, to the cleanup
+func trackCompleted(service arr.ArrService, conf config.ArrConfig, completedPath string, dryRun bool, logger *slog.Logger) []string {
+	entries, err := os.ReadDir(completedPath)
+	if err != nil {
+		logger.Warn("failed to read completed path", "err", err)
+		return nil
+	}
+
+	tracked := []string{}
+	for _, e := range entries {
+		completed := path.Join(completedPath, e.Name())
+		if cleanup.IsTracked(completed) {
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+
+		logger.Info("following completed folder for cleanup", "completedPath", completed)
+		tracked = append(tracked, completed)
+		if dryRun {
+			continue
+		}
+
+		err = cleanup.Track(cleanup.Item{
+			CompletedPath: completed,
+			Service:       service,
+			Instance:      conf.Name,
+			LinkedAt:      info.ModTime(),
+		})
+		if err != nil {
+			logger.Warn("failed to track completed folder", "completedPath", completed, "err", err)
+		}
+	}
+
+	return tracked
+}
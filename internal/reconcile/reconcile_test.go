@@ -0,0 +1,293 @@
+package reconcile_test
+
+import (
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/samjwillis97/sams-blackhole/internal/arr"
+	"github.com/samjwillis97/sams-blackhole/internal/arr/arrtest"
+	"github.com/samjwillis97/sams-blackhole/internal/cleanup"
+	"github.com/samjwillis97/sams-blackhole/internal/config"
+	"github.com/samjwillis97/sams-blackhole/internal/debrid/debridtest"
+	"github.com/samjwillis97/sams-blackhole/internal/jobs"
+	"github.com/samjwillis97/sams-blackhole/internal/logger"
+	"github.com/samjwillis97/sams-blackhole/internal/reconcile"
+	"github.com/spf13/viper"
+)
+
+type setupOutput struct {
+	WatchDir      string
+	ProcessingDir string
+	CompletedDir  string
+	Arr           *arrtest.Server
+}
+
+func setup(t *testing.T) setupOutput {
+	root := t.TempDir()
+	out := setupOutput{
+		WatchDir:      path.Join(root, "watch"),
+		ProcessingDir: path.Join(root, "watch", "processing"),
+		CompletedDir:  path.Join(root, "completed"),
+		Arr:           arrtest.NewServer(),
+	}
+	t.Cleanup(out.Arr.Close)
+
+	debridServer := debridtest.NewServer()
+	t.Cleanup(debridServer.Close)
+
+	mountDir := path.Join(root, "mount")
+	for _, dir := range []string{out.WatchDir, out.ProcessingDir, out.CompletedDir, mountDir} {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mockViper := viper.New()
+	mockViper.Set("real_debrid.url", debridServer.URL)
+	mockViper.Set("real_debrid.watch_path", mountDir)
+	mockViper.Set("real_debrid.mount_timeout", 60)
+	mockViper.Set("state_path", root)
+	mockViper.Set("sonarr", []map[string]any{{
+		"name":            "reconciletest",
+		"url":             out.Arr.URL,
+		"watch_path":      out.WatchDir,
+		"processing_path": out.ProcessingDir,
+		"completed_path":  out.CompletedDir,
+	}})
+	config.InitializeAppConfig(mockViper)
+
+	mockSecretViper := viper.New()
+	mockSecretViper.Set("DEBRID_API_KEY", "debrid")
+	mockSecretViper.Set("RECONCILETEST_API_KEY", "arr")
+	config.InitializeSecrets(mockSecretViper)
+
+	return out
+}
+
+func createFile(t *testing.T, p string, age time.Duration) {
+	if err := os.MkdirAll(path.Dir(p), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte("magnet:?xt=urn:btih:abc"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	modTime := time.Now().Add(-age)
+	if err := os.Chtimes(p, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func exists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
+
+func TestDryRunReportsWithoutActing(t *testing.T) {
+	out := setup(t)
+	log := slog.New(logger.NewHandler(&slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	missed := path.Join(out.WatchDir, "missed.magnet")
+	createFile(t, missed, time.Hour)
+	// Could still be being written, its event is yet to arrive
+	recent := path.Join(out.WatchDir, "recent.magnet")
+	createFile(t, recent, 0)
+
+	orphaned := path.Join(out.ProcessingDir, "orphaned.magnet")
+	createFile(t, orphaned, time.Hour)
+
+	report, err := reconcile.Run(log, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(report.Adopted, []string{missed}) {
+		t.Errorf("Expected %s to be adopted, got %v", missed, report.Adopted)
+	}
+	if !slices.Equal(report.Removed, []string{orphaned}) {
+		t.Errorf("Expected %s to be removed, got %v", orphaned, report.Removed)
+	}
+
+	for _, p := range []string{missed, recent, orphaned} {
+		if !exists(p) {
+			t.Errorf("Expected %s to be left alone in a dry run", p)
+		}
+	}
+}
+
+func TestRemovesOrphanedProcessingFilesOnly(t *testing.T) {
+	out := setup(t)
+	log := slog.New(logger.NewHandler(&slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	orphaned := path.Join(out.ProcessingDir, "orphaned.magnet")
+	createFile(t, orphaned, time.Hour)
+
+	inProgress := path.Join(out.ProcessingDir, "in-progress.magnet")
+	createFile(t, inProgress, time.Hour)
+	job := jobs.Register(jobs.Job{Instance: "reconciletest", ProcessingPath: inProgress, State: "awaitingMount"})
+	t.Cleanup(func() { jobs.Remove(job.ID) })
+
+	report, err := reconcile.Run(log, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exists(orphaned) {
+		t.Errorf("Expected %s to be removed", orphaned)
+	}
+	if !exists(inProgress) {
+		t.Errorf("Expected %s to be kept for its job", inProgress)
+	}
+	if len(report.Resumed) != 0 {
+		t.Errorf("Expected items held for the mount not to be resumed, got %v", report.Resumed)
+	}
+}
+
+func TestRemovesRoutesWithoutAProcessingFile(t *testing.T) {
+	out := setup(t)
+	log := slog.New(logger.NewHandler(&slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	inProgress := path.Join(out.ProcessingDir, "in-progress.magnet")
+	createFile(t, inProgress, time.Hour)
+	job := jobs.Register(jobs.Job{Instance: "reconciletest", ProcessingPath: inProgress, State: "awaitingMount"})
+	t.Cleanup(func() { jobs.Remove(job.ID) })
+	if err := jobs.WriteRoute(inProgress, config.Route{CompletedPath: out.CompletedDir}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Left behind by a crash, one part way through being written
+	leftover := jobs.RoutePath(path.Join(out.ProcessingDir, "gone.magnet"))
+	partial := jobs.RoutePath(path.Join(out.ProcessingDir, "partial.magnet")) + ".tmp"
+	createFile(t, leftover, time.Hour)
+	createFile(t, partial, time.Hour)
+
+	report, err := reconcile.Run(log, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exists(leftover) || exists(partial) {
+		t.Errorf("Expected routes without a processing file to be removed")
+	}
+	if !exists(jobs.RoutePath(inProgress)) || !exists(inProgress) {
+		t.Errorf("Expected the route of a file still being processed to be kept")
+	}
+	if !slices.Equal(report.Removed, []string{leftover, partial}) {
+		t.Errorf("Expected only the leftover routes to be removed, got %v", report.Removed)
+	}
+}
+
+func TestRemovesFailedFilesWithoutAJob(t *testing.T) {
+	setup(t)
+	log := slog.New(logger.NewHandler(&slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	failedDir, err := jobs.FailedDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orphaned := path.Join(failedDir, "orphaned.magnet")
+	createFile(t, orphaned, time.Hour)
+
+	kept := path.Join(failedDir, "kept.magnet")
+	createFile(t, kept, time.Hour)
+	job := jobs.Register(jobs.Job{Instance: "reconciletest", State: "failure"})
+	jobs.SetFailedPath(job.ID, kept)
+	t.Cleanup(func() { jobs.Remove(job.ID) })
+
+	report, err := reconcile.Run(log, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exists(orphaned) || !slices.Contains(report.Removed, orphaned) {
+		t.Errorf("Expected %s to be removed", orphaned)
+	}
+	if !exists(kept) {
+		t.Errorf("Expected %s to be kept for its job to be retried", kept)
+	}
+}
+
+func TestRestoresFailedJobsAfterRestart(t *testing.T) {
+	out := setup(t)
+	log := slog.New(logger.NewHandler(&slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	failedDir, err := jobs.FailedDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kept := path.Join(failedDir, "kept.magnet")
+	createFile(t, kept, time.Hour)
+	job := jobs.Register(jobs.Job{
+		Service:        arr.Sonarr,
+		Instance:       "reconciletest",
+		ProcessingPath: path.Join(out.ProcessingDir, "Show.S01E01.1080p.magnet"),
+		CompletedPath:  path.Join(out.CompletedDir, "routed"),
+		State:          "failure",
+	})
+	if err := jobs.SetFailedPath(job.ID, kept); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { jobs.Remove(job.ID) })
+
+	// Jobs only live in memory, so are all gone after a restart
+	jobs.Remove(job.ID)
+
+	report, err := reconcile.Run(log, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(report.Restored, []string{job.ID}) {
+		t.Errorf("Expected the job to be restored, got %v", report.Restored)
+	}
+	if !exists(kept) {
+		t.Fatalf("Expected %s to be kept for its job to be retried", kept)
+	}
+	restored, ok := jobs.Get(job.ID)
+	if !ok || restored.State != "failure" || restored.FailedPath != kept || restored.CompletedPath != job.CompletedPath {
+		t.Fatalf("Expected the failed job to be tracked again, got %v", restored)
+	}
+
+	// It can be acted on as though there had been no restart
+	if err := jobs.Cancel(job.ID); err != nil {
+		t.Fatal(err)
+	}
+	if exists(kept) || exists(jobs.KeptJobPath(kept)) {
+		t.Errorf("Expected cancelling the restored job to remove what was kept")
+	}
+}
+
+func TestTracksCompletedFoldersForCleanup(t *testing.T) {
+	out := setup(t)
+	log := slog.New(logger.NewHandler(&slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	completed := path.Join(out.CompletedDir, "Show.S01E01.1080p")
+	createFile(t, path.Join(completed, "Show.S01E01.1080p.mkv"), time.Hour)
+
+	report, err := reconcile.Run(log, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(report.CompletedTracked, []string{completed}) {
+		t.Errorf("Expected %s to be tracked, got %v", completed, report.CompletedTracked)
+	}
+	if !cleanup.IsTracked(completed) {
+		t.Errorf("Expected %s to be followed by the cleanup", completed)
+	}
+
+	// Already followed folders are left alone
+	report, err = reconcile.Run(log, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.CompletedTracked) != 0 {
+		t.Errorf("Expected nothing new to be tracked, got %v", report.CompletedTracked)
+	}
+}
@@ -0,0 +1,128 @@
+package repair
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/samjwillis97/sams-blackhole/internal/arr"
+	"github.com/samjwillis97/sams-blackhole/internal/config"
+)
+
+const indexFilename = "links.json"
+
+// LinkedTorrent is what is remembered about a torrent once it has been linked
+// out of the mount, enough to get it back if it disappears from debrid
+type LinkedTorrent struct {
+	Name         string         `json:"name"`
+	InfoHash     string         `json:"infoHash"`
+	DebridID     string         `json:"debridId"`
+	Account      string         `json:"account,omitempty"` // The debrid account, `real_debrid` when empty
+	Service      arr.ArrService `json:"service"`
+	Instance     string         `json:"instance"`
+	CompletedDir string         `json:"completedDir"`
+	LinkedAt     time.Time      `json:"linkedAt"`
+}
+
+var indexMu sync.Mutex
+
+// RecordLinked remembers a torrent that has been linked, keyed by its account
+// and its name in the mount
+func RecordLinked(t LinkedTorrent) error {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+
+	if config.GetAppConfig().StatePath == "" {
+		return errors.New("No state path configured")
+	}
+
+	index, err := readIndex()
+	if err != nil {
+		return err
+	}
+
+	index[indexKey(t.Account, t.Name)] = t
+
+	return writeIndex(index)
+}
+
+// LookupLinked finds a torrent by its account and its name in the mount
+func LookupLinked(account string, name string) (LinkedTorrent, bool) {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+
+	index, err := readIndex()
+	if err != nil {
+		return LinkedTorrent{}, false
+	}
+
+	t, ok := index[indexKey(account, name)]
+	return t, ok
+}
+
+// ForgetLinked removes a torrent of the account from the index
+func ForgetLinked(account string, name string) error {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+
+	index, err := readIndex()
+	if err != nil {
+		return err
+	}
+
+	delete(index, indexKey(account, name))
+
+	return writeIndex(index)
+}
+
+// indexKey is where a torrent is kept in the index. Torrents on `real_debrid`
+// are kept under their name alone, as they were before there were other
+// accounts.
+func indexKey(account string, name string) string {
+	if account == "" {
+		return name
+	}
+	return account + "/" + name
+}
+
+func indexPath() string {
+	return path.Join(config.GetAppConfig().StatePath, indexFilename)
+}
+
+func readIndex() (map[string]LinkedTorrent, error) {
+	index := map[string]LinkedTorrent{}
+
+	data, err := os.ReadFile(indexPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &index)
+	if err != nil {
+		return nil, err
+	}
+
+	return index, nil
+}
+
+func writeIndex(index map[string]LinkedTorrent) error {
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Written to the side then renamed so a crash can't leave a partial index
+	tmpPath := indexPath() + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0o644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, indexPath())
+}
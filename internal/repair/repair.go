@@ -0,0 +1,479 @@
+// Package repair finds symlinks into the debrid mount that have broken,
+// normally because debrid has dropped the torrent, and either re-adds the
+// torrent or has *arr search for a replacement.
+package repair
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samjwillis97/sams-blackhole/internal/arr"
+	"github.com/samjwillis97/sams-blackhole/internal/clock"
+	"github.com/samjwillis97/sams-blackhole/internal/config"
+	"github.com/samjwillis97/sams-blackhole/internal/debrid"
+	"github.com/samjwillis97/sams-blackhole/internal/logger/attr"
+	"github.com/samjwillis97/sams-blackhole/internal/mount"
+	"github.com/samjwillis97/sams-blackhole/internal/rclone"
+)
+
+const (
+	ActionReadd    = "readd"
+	ActionResearch = "research"
+)
+
+// Result is the outcome of repairing the links for a single torrent
+type Result struct {
+	Torrent string
+	Account string
+	Links   int
+	Action  string
+	Err     error
+}
+
+var running sync.Mutex
+
+// Run scans every completed path and *arr library root for broken links and
+// repairs them with the configured action
+func Run(logger *slog.Logger, dryRun bool) ([]Result, error) {
+	if !running.TryLock() {
+		return nil, errors.New("Repair is already running")
+	}
+	defer running.Unlock()
+
+	// Every link looks broken while the mount is down
+	if !mount.IsHealthy() {
+		return nil, errors.New("Debrid mount is unhealthy")
+	}
+
+	appConfig := config.GetAppConfig()
+	// Only what is found is repaired, so missing an instance's library is safe
+	roots, err := ScanRoots(appConfig)
+	if err != nil {
+		logger.Warn("unable to find every root, scanning the rest", "err", err)
+	}
+
+	logger.Info("scanning for broken links", "roots", roots)
+	broken := []BrokenLink{}
+	for _, mount := range mounts(appConfig) {
+		found, err := Scan(roots, mount.path, appConfig.Repair.CheckReadable)
+		if err != nil {
+			return nil, err
+		}
+		for _, link := range found {
+			link.Account = owner(mount.accounts, link.Torrent)
+			broken = append(broken, link)
+		}
+	}
+
+	byTorrent := map[torrentKey][]BrokenLink{}
+	for _, link := range broken {
+		key := torrentKey{account: link.Account, name: link.Torrent}
+		byTorrent[key] = append(byTorrent[key], link)
+	}
+
+	keys := make([]torrentKey, 0, len(byTorrent))
+	for key := range byTorrent {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].account != keys[j].account {
+			return keys[i].account < keys[j].account
+		}
+		return keys[i].name < keys[j].name
+	})
+
+	results := []Result{}
+	for _, key := range keys {
+		torrentLogger := logger.With("torrent", key.name)
+		if key.account != "" {
+			torrentLogger = torrentLogger.With("debridAccount", key.account)
+		}
+		result := repairTorrent(key.account, key.name, byTorrent[key], appConfig.Repair.Action, dryRun, torrentLogger)
+		if result.Err != nil {
+			torrentLogger.Warn("failed to repair", "action", result.Action, "err", result.Err)
+		} else {
+			torrentLogger.Info("repaired", "action", result.Action, "links", result.Links)
+		}
+		results = append(results, result)
+	}
+
+	logger.Info("finished scanning for broken links", "broken", len(broken), "torrents", len(results))
+
+	return results, nil
+}
+
+// torrentKey is a torrent on one of the debrid accounts, the same name can be
+// on more than one
+type torrentKey struct {
+	account string
+	name    string
+}
+
+// debridMount is a mount and the accounts whose torrents appear in it
+type debridMount struct {
+	path     string
+	accounts []string
+}
+
+// mounts returns every distinct debrid mount, accounts without a watch path of
+// their own share the default one
+func mounts(appConfig config.AppConfig) []debridMount {
+	found := []debridMount{}
+	for _, name := range appConfig.DebridAccountNames() {
+		account, _ := appConfig.DebridAccount(name)
+		i := slices.IndexFunc(found, func(m debridMount) bool { return m.path == account.WatchPatch })
+		if i < 0 {
+			found = append(found, debridMount{path: account.WatchPatch})
+			i = len(found) - 1
+		}
+		found[i].accounts = append(found[i].accounts, name)
+	}
+	return found
+}
+
+// owner is the account of a shared mount a torrent was linked from, the first
+// account when none of them linked it
+func owner(accounts []string, torrent string) string {
+	for _, account := range accounts {
+		if _, ok := LookupLinked(account, torrent); ok {
+			return account
+		}
+	}
+	return accounts[0]
+}
+
+// Schedule runs the repair on the configured interval, it returns straight
+// away if no interval is set
+func Schedule(logger *slog.Logger) {
+	interval := config.GetAppConfig().Repair.Interval
+	if interval <= 0 {
+		return
+	}
+
+	logger = logger.With(attr.MonitorName("repair"))
+	for {
+		clock.Sleep(interval)
+
+		_, err := Run(logger, config.GetAppConfig().Repair.DryRun)
+		if err != nil {
+			logger.Error("repair failed", "err", err)
+		}
+	}
+}
+
+// ScanRoots are where links into the mount may be, every completed path and
+// the library folders of each instance. The roots that could be found are
+// returned along with an error for every instance whose library folders
+// couldn't be.
+func ScanRoots(appConfig config.AppConfig) ([]string, error) {
+	roots := []string{}
+	var errs error
+
+	addInstance := func(service arr.ArrService, conf config.ArrConfig) {
+		roots = append(roots, conf.CompletedPaths()...)
+
+		if len(conf.LibraryPaths) > 0 {
+			roots = append(roots, conf.LibraryPaths...)
+			return
+		}
+
+		client, err := arr.CreateNewClient(service, conf.Url, conf.APIKey())
+		if err != nil {
+			errs = errors.Join(errs, errors.New(fmt.Sprintf("Unable to create client for %s: %s", conf.Name, err)))
+			return
+		}
+
+		folders, err := client.GetRootFolders()
+		if err != nil {
+			errs = errors.Join(errs, errors.New(fmt.Sprintf("Unable to get root folders of %s: %s", conf.Name, err)))
+			return
+		}
+
+		for _, folder := range folders {
+			roots = append(roots, folder.Path)
+		}
+	}
+
+	for _, conf := range appConfig.Sonarr {
+		addInstance(arr.Sonarr, conf)
+	}
+	for _, conf := range appConfig.Radarr {
+		addInstance(arr.Radarr, conf)
+	}
+
+	return roots, errs
+}
+
+func repairTorrent(account string, name string, links []BrokenLink, action string, dryRun bool, logger *slog.Logger) Result {
+	result := Result{Torrent: name, Account: account, Links: len(links), Action: action}
+
+	linked, known := LookupLinked(account, name)
+	if !known {
+		result.Err = errors.New("Torrent was not linked by blackhole, unable to repair")
+		return result
+	}
+	logger = logger.With(attr.InfoHash(linked.InfoHash), "instance", linked.Instance)
+
+	if dryRun {
+		logger.Info("dry run, not repairing", "action", action, "links", len(links))
+		return result
+	}
+
+	if action == ActionReadd {
+		err := readd(linked, links, logger)
+		if err == nil {
+			return result
+		}
+
+		logger.Warn("unable to re-add, falling back to research", "err", err)
+		result.Action = ActionResearch
+	}
+
+	result.Err = research(linked, links, logger)
+	return result
+}
+
+func readd(linked LinkedTorrent, links []BrokenLink, logger *slog.Logger) error {
+	if linked.InfoHash == "" {
+		return errors.New("No hash recorded for torrent")
+	}
+
+	client := debrid.For(linked.Account)
+	logger.Info("re-adding to debrid")
+	added, err := client.AddMagnet(fmt.Sprintf("magnet:?xt=urn:btih:%s", linked.InfoHash))
+	if err != nil {
+		return err
+	}
+	logger = logger.With(attr.DebridID(added.ID))
+
+	info, err := waitForDownloaded(client, added.ID)
+	if err != nil {
+		if removeErr := client.Remove(added.ID); removeErr != nil {
+			logger.Warn("failed to remove from debrid", "err", removeErr)
+		}
+		return err
+	}
+
+	if rclone.Enabled() {
+		if err := rclone.Refresh(); err != nil {
+			logger.Warn("failed to refresh rclone mount", "err", err)
+		}
+	}
+
+	timeout := config.GetAppConfig().RealDebrid.GetMountTimeout()
+	if conf, ok := findInstance(linked.Service, linked.Instance); ok {
+		timeout = conf.GetMountTimeout()
+	}
+
+	account, _ := config.GetAppConfig().DebridAccount(linked.Account)
+	mountPath := account.WatchPatch
+	newRoot := path.Join(mountPath, info.Filename)
+	err = waitForPath(newRoot, timeout)
+	if err != nil {
+		return err
+	}
+
+	oldRoot := path.Join(mountPath, linked.Name)
+	for _, link := range links {
+		relative, err := filepath.Rel(oldRoot, link.Target)
+		if err != nil {
+			return err
+		}
+
+		newTarget := path.Join(newRoot, relative)
+		if _, err := os.Stat(newTarget); err != nil {
+			return errors.New(fmt.Sprintf("Re-added torrent is missing %s", relative))
+		}
+
+		err = relink(link.Path, newTarget)
+		if err != nil {
+			return err
+		}
+	}
+
+	if linked.DebridID != "" && linked.DebridID != added.ID {
+		if err := client.Remove(linked.DebridID); err != nil {
+			logger.Debug("old torrent could not be removed from debrid", "err", err)
+		}
+	}
+
+	if info.Filename != linked.Name {
+		if err := ForgetLinked(linked.Account, linked.Name); err != nil {
+			logger.Warn("failed to forget old link", "err", err)
+		}
+
+		if rclone.Enabled() {
+			if err := rclone.Forget(linked.Name); err != nil {
+				logger.Warn("failed to forget old torrent in rclone mount", "err", err)
+			}
+		}
+	}
+
+	linked.Name = info.Filename
+	linked.DebridID = added.ID
+	linked.LinkedAt = clock.Now()
+
+	return RecordLinked(linked)
+}
+
+func waitForDownloaded(client debrid.Client, id string) (debrid.GetInfoResponse, error) {
+	timings := config.GetAppConfig().GetTimings()
+	deadline := clock.Now().Add(timings.ProcessingDeadline)
+
+	for {
+		info, err := client.GetInfo(id)
+		if err != nil {
+			return debrid.GetInfoResponse{}, err
+		}
+
+		switch info.Status {
+		case debrid.Downloaded:
+			return info, nil
+		case debrid.WaitingFileSelection:
+			err := client.SelectFiles(id, []string{})
+			if err != nil {
+				return debrid.GetInfoResponse{}, err
+			}
+		case debrid.MagnetConversion, debrid.Queued:
+		default:
+			return debrid.GetInfoResponse{}, errors.New(fmt.Sprintf("Torrent is not available - %s", info.Status))
+		}
+
+		if clock.Now().After(deadline) {
+			return debrid.GetInfoResponse{}, errors.New("Timed out waiting for debrid")
+		}
+
+		clock.Sleep(timings.DebridRetryInterval)
+	}
+}
+
+func waitForPath(p string, timeout time.Duration) error {
+	deadline := clock.Now().Add(timeout)
+
+	for {
+		if _, err := os.Stat(p); err == nil {
+			return nil
+		}
+
+		if clock.Now().After(deadline) {
+			return errors.New(fmt.Sprintf("Timed out waiting for %s to appear in mount", p))
+		}
+
+		clock.Sleep(config.GetAppConfig().GetTimings().PollInterval)
+	}
+}
+
+// relink points an existing symlink at a new target, keeping it relative if it
+// was before
+func relink(linkPath string, target string) error {
+	existing, err := os.Readlink(linkPath)
+	if err != nil {
+		return err
+	}
+
+	if !filepath.IsAbs(existing) {
+		target, err = filepath.Rel(filepath.Dir(linkPath), target)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.Remove(linkPath)
+	if err != nil {
+		return err
+	}
+
+	return os.Symlink(target, linkPath)
+}
+
+func research(linked LinkedTorrent, links []BrokenLink, logger *slog.Logger) error {
+	// NZBs have no hash to find them in the history with
+	if linked.InfoHash == "" {
+		return errors.New("No hash recorded for torrent")
+	}
+
+	conf, ok := findInstance(linked.Service, linked.Instance)
+	if !ok {
+		return errors.New(fmt.Sprintf("Unknown instance: %s", linked.Instance))
+	}
+
+	client, err := arr.CreateNewClient(linked.Service, conf.Url, conf.APIKey())
+	if err != nil {
+		return err
+	}
+
+	history, err := client.GetHistory(conf.GetHistoryPageSize())
+	if err != nil {
+		return err
+	}
+
+	ids := []int{}
+	seen := map[int]bool{}
+	for _, item := range history.Records {
+		if !strings.EqualFold(item.Data.TorrentInfoHash, linked.InfoHash) {
+			continue
+		}
+
+		id := item.MovieID
+		if linked.Service == arr.Sonarr {
+			id = item.EpisodeID
+			if id == 0 {
+				id = item.Episode.ID
+			}
+		}
+
+		if id != 0 && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	if len(ids) == 0 {
+		return errors.New("Could not find torrent in history")
+	}
+
+	// Broken links are removed so *arr sees the files as missing
+	for _, link := range links {
+		if err := os.Remove(link.Path); err != nil {
+			logger.Warn("failed to remove broken link", "link", link.Path, "err", err)
+		}
+	}
+
+	switch client := client.(type) {
+	case *arr.SonarrClient:
+		logger.Info("searching for episodes", "episodeIds", ids)
+		_, err = client.SearchEpisodes(ids)
+	case *arr.RadarrClient:
+		logger.Info("searching for movies", "movieIds", ids)
+		_, err = client.SearchMovies(ids)
+	}
+	if err != nil {
+		return err
+	}
+
+	return ForgetLinked(linked.Account, linked.Name)
+}
+
+func findInstance(service arr.ArrService, name string) (config.ArrConfig, bool) {
+	instances := config.GetAppConfig().Sonarr
+	if service == arr.Radarr {
+		instances = config.GetAppConfig().Radarr
+	}
+
+	for _, conf := range instances {
+		if conf.Name == name {
+			return conf, true
+		}
+	}
+
+	return config.ArrConfig{}, false
+}
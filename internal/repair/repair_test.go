@@ -0,0 +1,278 @@
+package repair_test
+
+import (
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/samjwillis97/sams-blackhole/internal/arr"
+	"github.com/samjwillis97/sams-blackhole/internal/arr/arrtest"
+	"github.com/samjwillis97/sams-blackhole/internal/config"
+	"github.com/samjwillis97/sams-blackhole/internal/debrid"
+	"github.com/samjwillis97/sams-blackhole/internal/debrid/debridtest"
+	"github.com/samjwillis97/sams-blackhole/internal/logger"
+	"github.com/samjwillis97/sams-blackhole/internal/repair"
+	"github.com/spf13/viper"
+)
+
+const testHash = "150947B245DA89629349290C2812ECDB6D0308C7"
+
+type setupOutput struct {
+	MountDir     string
+	CompletedDir string
+	LibraryDir   string
+	Arr          *arrtest.Server
+	Debrid       *debridtest.Server
+}
+
+func setup(t *testing.T, action string, configure ...func(*viper.Viper)) setupOutput {
+	root := t.TempDir()
+	out := setupOutput{
+		MountDir:     path.Join(root, "mount"),
+		CompletedDir: path.Join(root, "completed"),
+		LibraryDir:   path.Join(root, "library"),
+		Arr:          arrtest.NewServer(),
+		Debrid:       debridtest.NewServer(),
+	}
+	t.Cleanup(out.Arr.Close)
+	t.Cleanup(out.Debrid.Close)
+
+	for _, dir := range []string{out.MountDir, out.CompletedDir, out.LibraryDir} {
+		if err := os.Mkdir(dir, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out.Arr.SetRootFolders(arr.RootFolder{ID: 1, Path: out.LibraryDir, Accessible: true})
+
+	mockViper := viper.New()
+	mockViper.Set("real_debrid.url", out.Debrid.URL)
+	mockViper.Set("real_debrid.watch_path", out.MountDir)
+	mockViper.Set("real_debrid.mount_timeout", 1)
+	mockViper.Set("state_path", root)
+	mockViper.Set("timings.debrid_retry_interval", time.Millisecond)
+	mockViper.Set("timings.poll_interval", time.Millisecond)
+	mockViper.Set("repair.action", action)
+	mockViper.Set("repair.check_readable", true)
+	mockViper.Set("sonarr", []map[string]any{{
+		"name":           "repairtest",
+		"url":            out.Arr.URL,
+		"completed_path": out.CompletedDir,
+	}})
+	for _, fn := range configure {
+		fn(mockViper)
+	}
+	config.InitializeAppConfig(mockViper)
+
+	mockSecretViper := viper.New()
+	mockSecretViper.Set("DEBRID_API_KEY", "debrid")
+	mockSecretViper.Set("REPAIRTEST_API_KEY", "arr")
+	config.InitializeSecrets(mockSecretViper)
+
+	return out
+}
+
+func symlink(t *testing.T, target string, link string) {
+	if err := os.MkdirAll(path.Dir(link), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func createFile(t *testing.T, p string) {
+	if err := os.MkdirAll(path.Dir(p), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScanFindsOnlyBrokenMountLinks(t *testing.T) {
+	root := t.TempDir()
+	mount := path.Join(root, "mount")
+	completed := path.Join(root, "completed")
+
+	createFile(t, path.Join(mount, "Alive", "file.mkv"))
+	createFile(t, path.Join(root, "elsewhere", "file.mkv"))
+
+	symlink(t, path.Join(mount, "Alive", "file.mkv"), path.Join(completed, "Alive", "file.mkv"))
+	symlink(t, path.Join(mount, "Dead", "file.mkv"), path.Join(completed, "Dead", "file.mkv"))
+	symlink(t, "../../mount/Dead/other.mkv", path.Join(completed, "Dead", "other.mkv"))
+	symlink(t, path.Join(root, "elsewhere", "missing.mkv"), path.Join(completed, "Other", "file.mkv"))
+
+	broken, err := repair.Scan([]string{completed, path.Join(root, "does-not-exist")}, mount, true)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	if len(broken) != 2 {
+		t.Fatalf("Expected 2 broken links, got %d: %v", len(broken), broken)
+	}
+
+	for _, b := range broken {
+		if b.Torrent != "Dead" {
+			t.Errorf("Expected broken link to belong to Dead, got %s", b.Torrent)
+		}
+	}
+}
+
+func TestRepairReaddsAndRepointsLinks(t *testing.T) {
+	log := slog.New(logger.NewHandler(&slog.HandlerOptions{Level: slog.LevelDebug}))
+	s := setup(t, repair.ActionReadd)
+
+	completedLink := path.Join(s.CompletedDir, "Old.Name", "episode.mkv")
+	libraryLink := path.Join(s.LibraryDir, "Show", "Season 1", "episode.mkv")
+	symlink(t, path.Join(s.MountDir, "Old.Name", "episode.mkv"), completedLink)
+	symlink(t, path.Join(s.MountDir, "Old.Name", "episode.mkv"), libraryLink)
+
+	err := repair.RecordLinked(repair.LinkedTorrent{
+		Name:     "Old.Name",
+		InfoHash: testHash,
+		DebridID: "OLD",
+		Service:  arr.Sonarr,
+		Instance: "repairtest",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Debrid.Expect(debridtest.Torrent{
+		ID:       "NEW",
+		Filename: "New.Name",
+		Statuses: []debrid.DebridStatus{debrid.WaitingFileSelection, debrid.Downloaded},
+	})
+	createFile(t, path.Join(s.MountDir, "New.Name", "episode.mkv"))
+
+	results, err := repair.Run(log, false)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	if len(results) != 1 || results[0].Err != nil || results[0].Action != repair.ActionReadd {
+		t.Fatalf("Expected a single successful re-add, got %v", results)
+	}
+
+	expectedTarget := path.Join(s.MountDir, "New.Name", "episode.mkv")
+	for _, link := range []string{completedLink, libraryLink} {
+		target, err := os.Readlink(link)
+		if err != nil || target != expectedTarget {
+			t.Errorf("Expected %s to point at %s, got %s (%v)", link, expectedTarget, target, err)
+		}
+	}
+
+	if _, ok := repair.LookupLinked("", "New.Name"); !ok {
+		t.Errorf("Expected the new name to be recorded")
+	}
+	if _, ok := repair.LookupLinked("", "Old.Name"); ok {
+		t.Errorf("Expected the old name to be forgotten")
+	}
+}
+
+func TestRepairFallsBackToResearch(t *testing.T) {
+	log := slog.New(logger.NewHandler(&slog.HandlerOptions{Level: slog.LevelDebug}))
+	s := setup(t, repair.ActionReadd)
+
+	libraryLink := path.Join(s.LibraryDir, "Show", "Season 1", "episode.mkv")
+	symlink(t, path.Join(s.MountDir, "Gone", "episode.mkv"), libraryLink)
+
+	err := repair.RecordLinked(repair.LinkedTorrent{
+		Name:     "Gone",
+		InfoHash: testHash,
+		Service:  arr.Sonarr,
+		Instance: "repairtest",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Not cached on debrid any more
+	s.Debrid.Expect(debridtest.Torrent{
+		ID:       "UNCACHED",
+		Filename: "Gone",
+		Statuses: []debrid.DebridStatus{debrid.Downloading},
+	})
+
+	s.Arr.SetHistory(
+		arr.HistoryItem{ID: 1, EventType: arr.Grabbed, EpisodeID: 5, Data: arr.HistoryItemData{TorrentInfoHash: testHash}},
+		arr.HistoryItem{ID: 2, EventType: arr.Grabbed, EpisodeID: 6, Data: arr.HistoryItemData{TorrentInfoHash: testHash}},
+		arr.HistoryItem{ID: 3, EventType: arr.Grabbed, EpisodeID: 7, Data: arr.HistoryItemData{TorrentInfoHash: "OTHER"}},
+	)
+
+	results, err := repair.Run(log, false)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	if len(results) != 1 || results[0].Err != nil || results[0].Action != repair.ActionResearch {
+		t.Fatalf("Expected a single successful research, got %v", results)
+	}
+
+	commands := s.Arr.Commands()
+	if len(commands) != 1 || commands[0].Name != "EpisodeSearch" || !slices.Equal(commands[0].EpisodeIDs, []int{5, 6}) {
+		t.Errorf("Expected an episode search for 5 and 6, got %v", commands)
+	}
+
+	if !slices.Contains(s.Debrid.Removed(), "UNCACHED") {
+		t.Errorf("Expected the uncached torrent to be removed from debrid")
+	}
+
+	if _, err := os.Lstat(libraryLink); !os.IsNotExist(err) {
+		t.Errorf("Expected broken link to be removed")
+	}
+}
+
+func TestRepairKeepsAccountsApart(t *testing.T) {
+	log := slog.New(logger.NewHandler(&slog.HandlerOptions{Level: slog.LevelDebug}))
+	animeMount := path.Join(t.TempDir(), "anime")
+	s := setup(t, repair.ActionReadd, func(v *viper.Viper) {
+		v.Set("debrid_accounts", []map[string]any{
+			{"name": "anime", "watch_path": animeMount},
+			{"name": "shared"},
+		})
+	})
+
+	// The same name on two accounts, and one only on an account sharing the
+	// default mount
+	symlink(t, path.Join(s.MountDir, "Same.Name", "episode.mkv"), path.Join(s.LibraryDir, "Default", "episode.mkv"))
+	symlink(t, path.Join(animeMount, "Same.Name", "episode.mkv"), path.Join(s.LibraryDir, "Anime", "episode.mkv"))
+	symlink(t, path.Join(s.MountDir, "Shared.Only", "episode.mkv"), path.Join(s.LibraryDir, "Shared", "episode.mkv"))
+
+	for _, linked := range []repair.LinkedTorrent{
+		{Name: "Same.Name", InfoHash: testHash},
+		{Name: "Same.Name", InfoHash: testHash, Account: "anime"},
+		{Name: "Shared.Only", InfoHash: testHash, Account: "shared"},
+	} {
+		if err := repair.RecordLinked(linked); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	results, err := repair.Run(log, true)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	found := []string{}
+	for _, r := range results {
+		if r.Err != nil || r.Links != 1 {
+			t.Errorf("Expected %s on %q to be known with a single link, got %+v", r.Torrent, r.Account, r)
+		}
+		found = append(found, r.Account+"/"+r.Torrent)
+	}
+	if !slices.Equal(found, []string{"/Same.Name", "anime/Same.Name", "shared/Shared.Only"}) {
+		t.Errorf("Expected each torrent to be repaired on its own account, got %v", found)
+	}
+
+	if err := repair.ForgetLinked("anime", "Same.Name"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := repair.LookupLinked("", "Same.Name"); !ok {
+		t.Errorf("Expected forgetting one account's torrent to leave the other's")
+	}
+}
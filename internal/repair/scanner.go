@@ -0,0 +1,136 @@
+package repair
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BrokenLink is a symlink into the debrid mount whose target has gone
+type BrokenLink struct {
+	Path    string // Location of the symlink itself
+	Target  string // Absolute path the symlink points at
+	Torrent string // Name of the torrent directory in the mount the target was in
+	Account string // The debrid account the mount belongs to, `real_debrid` when empty
+	Err     error
+}
+
+// Scan walks each root looking for symlinks into the mount that no longer
+// resolve. With checkReadable every target is also read from, as the mount
+// can keep listing files that debrid will no longer serve.
+func Scan(roots []string, mountPath string, checkReadable bool) ([]BrokenLink, error) {
+	mountPath = filepath.Clean(mountPath)
+	broken := []BrokenLink{}
+
+	err := walkLinks(roots, func(linkPath string, target string) {
+		torrent, ok := torrentName(target, mountPath)
+		if !ok {
+			return
+		}
+
+		if err := checkTarget(target, checkReadable); err != nil {
+			broken = append(broken, BrokenLink{
+				Path:    linkPath,
+				Target:  target,
+				Torrent: torrent,
+				Err:     err,
+			})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return broken, nil
+}
+
+// LinkedTorrents walks each root for symlinks into the mount, returning the
+// names of the torrents they point into whether or not the targets resolve
+func LinkedTorrents(roots []string, mountPath string) (map[string]bool, error) {
+	mountPath = filepath.Clean(mountPath)
+	linked := map[string]bool{}
+
+	err := walkLinks(roots, func(_ string, target string) {
+		if torrent, ok := torrentName(target, mountPath); ok {
+			linked[torrent] = true
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return linked, nil
+}
+
+// walkLinks walks each root calling fn with every symlink found and the
+// absolute path it points at, roots that don't exist are skipped
+func walkLinks(roots []string, fn func(linkPath string, target string)) error {
+	for _, root := range roots {
+		err := filepath.WalkDir(root, func(currentPath string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if currentPath == root && errors.Is(err, fs.ErrNotExist) {
+					return filepath.SkipDir
+				}
+				return err
+			}
+
+			if d.Type()&fs.ModeSymlink == 0 {
+				return nil
+			}
+
+			target, err := os.Readlink(currentPath)
+			if err != nil {
+				return err
+			}
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(filepath.Dir(currentPath), target)
+			}
+
+			fn(currentPath, filepath.Clean(target))
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// torrentName returns the first path element of target beneath the mount
+func torrentName(target string, mountPath string) (string, bool) {
+	relative, err := filepath.Rel(mountPath, target)
+	if err != nil || relative == "." || strings.HasPrefix(relative, "..") {
+		return "", false
+	}
+
+	return strings.Split(relative, string(filepath.Separator))[0], true
+}
+
+func checkTarget(target string, checkReadable bool) error {
+	info, err := os.Stat(target)
+	if err != nil {
+		return err
+	}
+
+	if !checkReadable || info.IsDir() {
+		return nil
+	}
+
+	f, err := os.Open(target)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Read(make([]byte, 1))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/samjwillis97/sams-blackhole/internal/config"
+)
+
+// Authorized reports whether the request carries the API key, either as the
+// basic auth password or the `apikey` query parameter. Nothing is authorized
+// without a key.
+func Authorized(r *http.Request, apiKey string) bool {
+	if apiKey == "" {
+		return false
+	}
+
+	provided := r.URL.Query().Get("apikey")
+	if _, password, ok := r.BasicAuth(); ok {
+		provided = password
+	}
+
+	return subtle.ConstantTimeCompare([]byte(provided), []byte(apiKey)) == 1
+}
+
+// RequireAPIKey only serves requests that carry the server's API key
+func RequireAPIKey(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !Authorized(r, config.GetAppConfig().Server.APIKey()) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
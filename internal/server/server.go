@@ -0,0 +1,101 @@
+// Package server exposes blackhole's status and metrics over HTTP, along with
+// any routes other packages register.
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"github.com/samjwillis97/sams-blackhole/internal/config"
+	"github.com/samjwillis97/sams-blackhole/internal/metrics"
+)
+
+var (
+	statusMu sync.Mutex
+	statuses = map[string]func() any{}
+	routes   = map[string]http.Handler{}
+)
+
+// RegisterStatus adds a section to the `/status` response, the function is
+// called on every request
+func RegisterStatus(name string, fn func() any) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	statuses[name] = fn
+}
+
+// Handle adds a route served alongside the status and metrics, the pattern is
+// the same as for `http.ServeMux`
+func Handle(pattern string, handler http.Handler) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	routes[pattern] = handler
+}
+
+// Handler serves every route
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", handleStatus)
+	mux.HandleFunc("GET /metrics", handleMetrics)
+
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	for pattern, handler := range routes {
+		mux.Handle(pattern, handler)
+	}
+
+	return mux
+}
+
+// Serve listens on the configured address, it returns straight away if no
+// address is set
+func Serve(logger *slog.Logger) {
+	address := config.GetAppConfig().Server.Address
+	if address == "" {
+		return
+	}
+
+	logger = logger.With("address", address)
+	logger.Info("starting http server")
+
+	err := http.ListenAndServe(address, Handler())
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("http server failed", "err", err)
+	}
+}
+
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	statusMu.Lock()
+	fns := make(map[string]func() any, len(statuses))
+	for name, fn := range statuses {
+		fns[name] = fn
+	}
+	statusMu.Unlock()
+
+	response := map[string]any{}
+	for name, fn := range fns {
+		response[name] = fn()
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.Write(w)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
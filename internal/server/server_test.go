@@ -0,0 +1,42 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/samjwillis97/sams-blackhole/internal/metrics"
+	"github.com/samjwillis97/sams-blackhole/internal/server"
+)
+
+func TestStatus(t *testing.T) {
+	server.RegisterStatus("example", func() any { return map[string]string{"state": "healthy"} })
+
+	w := httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/status", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+
+	var response map[string]map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response["example"]["state"] != "healthy" {
+		t.Errorf("Expected the registered status, got %s", w.Body.String())
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	metrics.NewGauge("server_test_gauge", "A gauge").Set(3)
+
+	w := httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if !strings.Contains(w.Body.String(), "server_test_gauge 3\n") {
+		t.Errorf("Expected the gauge in the metrics, got %s", w.Body.String())
+	}
+}
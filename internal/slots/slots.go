@@ -0,0 +1,404 @@
+// Package slots keeps track of each Real-Debrid account's active torrent
+// slots. While every slot is in use items wait in the account's queue, highest
+// priority first, rather than being refused by debrid, and torrents blackhole
+// added that have stalled or errored are removed to free up their slots.
+package slots
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/samjwillis97/sams-blackhole/internal/clock"
+	"github.com/samjwillis97/sams-blackhole/internal/config"
+	"github.com/samjwillis97/sams-blackhole/internal/debrid"
+	"github.com/samjwillis97/sams-blackhole/internal/jobs"
+	"github.com/samjwillis97/sams-blackhole/internal/logger/attr"
+	"github.com/samjwillis97/sams-blackhole/internal/metrics"
+)
+
+const (
+	stateFilename = "slots.json" // Other accounts are written to `slots-<account>.json`
+	// Torrents blackhole added are looked for in this many of the newest
+	listLimit = 1000
+)
+
+var (
+	queued    = metrics.NewGauge("blackhole_items_awaiting_slot", "Number of items queued for a free debrid slot")
+	collected = metrics.NewCounter("blackhole_debrid_torrents_collected_total", "Number of stale or errored torrents blackhole added that were removed from debrid")
+)
+
+type waiter struct {
+	priority int
+	ready    chan struct{}
+	taken    bool // A slot was taken for it
+	left     bool
+}
+
+// pool is the slots of a single account
+type pool struct {
+	active int
+	limit  int  // Zero until the active count has been checked
+	full   bool // Debrid refused a torrent since the last check
+	queue  []*waiter
+}
+
+var (
+	mu    sync.Mutex
+	pools = map[string]*pool{}
+
+	stateMu sync.Mutex
+)
+
+// Tracked reports whether slots are tracked for the account, only Real-Debrid
+// has a limit on active torrents
+func Tracked(account string) bool {
+	conf, ok := config.GetAppConfig().DebridAccount(account)
+	return ok && conf.GetProvider() == config.ProviderRealDebrid
+}
+
+// poolFor returns the account's pool, creating it if needed. The lock must be
+// held.
+func poolFor(account string) *pool {
+	p, ok := pools[account]
+	if !ok {
+		p = &pool{}
+		pools[account] = p
+	}
+	return p
+}
+
+type Status struct {
+	Active int  `json:"active"`
+	Limit  int  `json:"limit"`
+	Full   bool `json:"full"`
+	Queued int  `json:"queued"`
+}
+
+// GetStatus returns the slots of the account, `real_debrid` when empty
+func GetStatus(account string) Status {
+	mu.Lock()
+	defer mu.Unlock()
+
+	p := poolFor(account)
+	return Status{Active: p.active, Limit: p.limit, Full: !p.free(), Queued: len(p.queue)}
+}
+
+// GetStatuses returns the slots of every account they are tracked for, by
+// name with `real_debrid` as the empty name
+func GetStatuses() map[string]Status {
+	statuses := map[string]Status{}
+	for _, account := range config.GetAppConfig().DebridAccountNames() {
+		if Tracked(account) {
+			statuses[account] = GetStatus(account)
+		}
+	}
+	return statuses
+}
+
+// TryAcquire takes one of the account's slots if one is free and nothing is
+// queued ahead
+func TryAcquire(account string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	p := poolFor(account)
+	if len(p.queue) > 0 || !p.free() {
+		return false
+	}
+	p.take()
+	return true
+}
+
+// Wait queues for one of the account's slots behind anything of the same or
+// a higher priority, the channel is closed once a slot has been taken for the
+// caller. Calling leave gives up the place in the queue, closing the channel,
+// or hands back the slot if one had already been taken and the caller won't
+// use it.
+func Wait(account string, priority int) (<-chan struct{}, func()) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	p := poolFor(account)
+	w := &waiter{priority: priority, ready: make(chan struct{})}
+	i := slices.IndexFunc(p.queue, func(q *waiter) bool { return q.priority < priority })
+	if i < 0 {
+		i = len(p.queue)
+	}
+	p.queue = slices.Insert(p.queue, i, w)
+	queued.Add(1)
+
+	p.drain()
+	return w.ready, func() { p.leave(w) }
+}
+
+func (p *pool) leave(w *waiter) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if w.left {
+		return
+	}
+	w.left = true
+
+	if !w.taken {
+		p.queue = slices.DeleteFunc(p.queue, func(q *waiter) bool { return q == w })
+		queued.Add(-1)
+		close(w.ready)
+		return
+	}
+
+	// Counted as used until the next check otherwise
+	if p.limit > 0 && p.active > 0 {
+		p.active--
+	}
+	p.drain()
+}
+
+// Full records debrid refusing a torrent for the account having no slots
+// left, nothing more is handed out until a check finds one free
+func Full(account string) {
+	mu.Lock()
+	defer mu.Unlock()
+	poolFor(account).full = true
+}
+
+// Check refreshes the active count of every account slots are tracked for,
+// handing any free slots to their queues
+func Check() error {
+	var errs error
+	for _, account := range config.GetAppConfig().DebridAccountNames() {
+		if !Tracked(account) {
+			continue
+		}
+
+		count, err := debrid.For(account).ActiveCount()
+		if err != nil {
+			errs = errors.Join(errs, err)
+			continue
+		}
+
+		mu.Lock()
+		p := poolFor(account)
+		p.active = count.Active
+		p.limit = count.Limit
+		p.full = false
+		p.drain()
+		mu.Unlock()
+	}
+
+	return errs
+}
+
+// free reports whether a slot is believed to be free, an unchecked limit is
+// treated as there being room. The lock must be held.
+func (p *pool) free() bool {
+	return !p.full && (p.limit == 0 || p.active < p.limit)
+}
+
+// take counts a slot as used until the next check. The lock must be held.
+func (p *pool) take() {
+	if p.limit > 0 {
+		p.active++
+	}
+}
+
+// drain hands free slots to the front of the queue. The lock must be held.
+func (p *pool) drain() {
+	for len(p.queue) > 0 && p.free() {
+		w := p.queue[0]
+		p.queue = p.queue[1:]
+		queued.Add(-1)
+
+		p.take()
+		w.taken = true
+		close(w.ready)
+	}
+}
+
+// Added records a torrent blackhole added to the account, only these are
+// ever collected or removed by housekeeping
+func Added(account string, id string) error {
+	return modifyState(account, func(owned map[string]time.Time) {
+		owned[id] = clock.Now()
+	})
+}
+
+// Owned returns the IDs of the torrents blackhole added to the account that
+// are still on debrid as of the last collection, with when they were added
+func Owned(account string) (map[string]time.Time, error) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	return readState(account)
+}
+
+// Collect removes torrents blackhole added to any account that errored, or
+// that haven't finished downloading within the stale period, returning the
+// IDs removed
+func Collect(staleAfter time.Duration, logger *slog.Logger) ([]string, error) {
+	removed := []string{}
+	var errs error
+	for _, account := range config.GetAppConfig().DebridAccountNames() {
+		accountLogger := logger
+		if account != "" {
+			accountLogger = logger.With("debridAccount", account)
+		}
+
+		ids, err := collect(account, staleAfter, accountLogger)
+		if err != nil {
+			errs = errors.Join(errs, err)
+		}
+		removed = append(removed, ids...)
+	}
+	return removed, errs
+}
+
+// collect removes the account's stale torrents. Torrents still being worked
+// on by a job are left to the job.
+func collect(account string, staleAfter time.Duration, logger *slog.Logger) ([]string, error) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	owned, err := readState(account)
+	if err != nil || len(owned) == 0 {
+		return nil, err
+	}
+
+	client := debrid.For(account)
+	torrents, err := client.ListTorrents(listLimit)
+	if err != nil {
+		return nil, err
+	}
+	listed := map[string]debrid.GetInfoResponse{}
+	for _, t := range torrents {
+		listed[t.ID] = t
+	}
+
+	inFlight := map[string]bool{}
+	for _, job := range jobs.List() {
+		inFlight[job.DebridID] = true
+	}
+
+	removed := []string{}
+	for id, addedAt := range owned {
+		t, ok := listed[id]
+		switch {
+		case !ok:
+			// Removed by something else
+			delete(owned, id)
+		case t.Status == debrid.Downloaded:
+			// It's part of the library now, but still kept as blackhole's
+		case inFlight[id]:
+		case isErrored(t.Status) || clock.Since(addedAt) > staleAfter:
+			err := client.Remove(id)
+			if err != nil {
+				logger.Warn("failed to remove stale torrent", attr.DebridID(id), "status", t.Status, "err", err)
+				continue
+			}
+
+			logger.Info("removed stale torrent", attr.DebridID(id), "status", t.Status, "addedAt", addedAt)
+			collected.Inc()
+			removed = append(removed, id)
+			delete(owned, id)
+		}
+	}
+
+	return removed, writeState(account, owned)
+}
+
+func isErrored(status debrid.DebridStatus) bool {
+	switch status {
+	case debrid.MagnetError, debrid.Error, debrid.Virus, debrid.Dead:
+		return true
+	}
+	return false
+}
+
+// Schedule checks the active count and collects stale torrents on the
+// configured interval
+func Schedule(logger *slog.Logger) {
+	logger = logger.With(attr.MonitorName("slots"))
+	for {
+		conf := config.GetAppConfig().RealDebrid.GetSlots()
+
+		removed, err := Collect(conf.StaleAfter, logger)
+		if err != nil {
+			logger.Error("failed to collect stale torrents", "err", err)
+		} else if len(removed) > 0 {
+			logger.Info("collected stale torrents", "count", len(removed))
+		}
+
+		if err := Check(); err != nil {
+			logger.Error("failed to check active torrents", "err", err)
+		}
+
+		clock.Sleep(conf.CheckInterval)
+	}
+}
+
+func modifyState(account string, fn func(owned map[string]time.Time)) error {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	if config.GetAppConfig().StatePath == "" {
+		return errors.New("No state path configured")
+	}
+
+	owned, err := readState(account)
+	if err != nil {
+		return err
+	}
+
+	fn(owned)
+
+	return writeState(account, owned)
+}
+
+func statePath(account string) string {
+	filename := stateFilename
+	if account != "" {
+		filename = fmt.Sprintf("slots-%s.json", account)
+	}
+	return path.Join(config.GetAppConfig().StatePath, filename)
+}
+
+func readState(account string) (map[string]time.Time, error) {
+	owned := map[string]time.Time{}
+
+	data, err := os.ReadFile(statePath(account))
+	if errors.Is(err, os.ErrNotExist) {
+		return owned, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &owned)
+	if err != nil {
+		return nil, err
+	}
+
+	return owned, nil
+}
+
+func writeState(account string, owned map[string]time.Time) error {
+	data, err := json.MarshalIndent(owned, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Written to the side then renamed so a crash can't leave partial state
+	tmpPath := statePath(account) + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0o644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, statePath(account))
+}
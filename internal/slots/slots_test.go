@@ -0,0 +1,183 @@
+package slots_test
+
+import (
+	"log/slog"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/samjwillis97/sams-blackhole/internal/config"
+	"github.com/samjwillis97/sams-blackhole/internal/debrid"
+	"github.com/samjwillis97/sams-blackhole/internal/debrid/debridtest"
+	"github.com/samjwillis97/sams-blackhole/internal/logger"
+	"github.com/samjwillis97/sams-blackhole/internal/slots"
+	"github.com/spf13/viper"
+)
+
+func setup(t *testing.T) *debridtest.Server {
+	server := debridtest.NewServer()
+	t.Cleanup(server.Close)
+
+	mockViper := viper.New()
+	mockViper.Set("real_debrid.url", server.URL)
+	mockViper.Set("state_path", t.TempDir())
+	config.InitializeAppConfig(mockViper)
+
+	return server
+}
+
+func isReady(ready <-chan struct{}) bool {
+	select {
+	case <-ready:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestQueueDrainsByPriority(t *testing.T) {
+	server := setup(t)
+	server.SlotLimit = 1
+	server.Seed(debridtest.Torrent{ID: "BUSY", Statuses: []debrid.DebridStatus{debrid.Downloading}})
+
+	if err := slots.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if slots.TryAcquire("") {
+		t.Fatalf("Expected no slot to be free")
+	}
+
+	regular, _ := slots.Wait("", 0)
+	later, _ := slots.Wait("", 0)
+	urgent, _ := slots.Wait("", 10)
+	if status := slots.GetStatus(""); status.Queued != 3 || !status.Full {
+		t.Errorf("Expected three items queued on a full account, got %+v", status)
+	}
+
+	server.SetStatuses("BUSY", debrid.Downloaded)
+	if err := slots.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if !isReady(urgent) || isReady(regular) || isReady(later) {
+		t.Errorf("Expected the highest priority to take the free slot")
+	}
+
+	server.SlotLimit = 3
+	if err := slots.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if !isReady(regular) || !isReady(later) {
+		t.Errorf("Expected the rest of the queue to drain once there is room")
+	}
+	if slots.GetStatus("").Queued != 0 {
+		t.Errorf("Expected the queue to be empty")
+	}
+}
+
+func TestLeavingGivesUpPlaceOrSlot(t *testing.T) {
+	server := setup(t)
+	server.SlotLimit = 1
+	server.Seed(debridtest.Torrent{ID: "BUSY", Statuses: []debrid.DebridStatus{debrid.Downloading}})
+
+	if err := slots.Check(); err != nil {
+		t.Fatal(err)
+	}
+
+	gone, leaveGone := slots.Wait("", 10)
+	handedBack, leaveHandedBack := slots.Wait("", 5)
+	waiting, _ := slots.Wait("", 0)
+
+	leaveGone()
+	if !isReady(gone) || slots.GetStatus("").Queued != 2 {
+		t.Errorf("Expected leaving to close the channel and give up the place, got %+v", slots.GetStatus(""))
+	}
+
+	server.SetStatuses("BUSY", debrid.Downloaded)
+	if err := slots.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if !isReady(handedBack) || isReady(waiting) {
+		t.Fatalf("Expected the next in the queue to take the free slot")
+	}
+
+	leaveHandedBack()
+	if !isReady(waiting) || slots.GetStatus("").Queued != 0 {
+		t.Errorf("Expected a slot handed back to go to the rest of the queue, got %+v", slots.GetStatus(""))
+	}
+}
+
+func TestCollectRemovesOnlyStaleTorrentsBlackholeAdded(t *testing.T) {
+	server := setup(t)
+	log := slog.New(logger.NewHandler(&slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	for _, torrent := range []debridtest.Torrent{
+		{ID: "ERRORED", Statuses: []debrid.DebridStatus{debrid.MagnetError}},
+		{ID: "QUEUED", Statuses: []debrid.DebridStatus{debrid.Queued}},
+		{ID: "DONE", Statuses: []debrid.DebridStatus{debrid.Downloaded}},
+		{ID: "NOT_OURS", Statuses: []debrid.DebridStatus{debrid.Dead}},
+	} {
+		server.Seed(torrent)
+	}
+	for _, id := range []string{"ERRORED", "QUEUED", "DONE"} {
+		if err := slots.Added("", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := slots.Collect(time.Hour, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(removed, []string{"ERRORED"}) {
+		t.Errorf("Expected only the errored torrent to be removed, got %v", removed)
+	}
+
+	removed, err = slots.Collect(0, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(removed, []string{"QUEUED"}) {
+		t.Errorf("Expected the stale torrent to be removed, got %v", removed)
+	}
+
+	if !slices.Equal(server.Removed(), []string{"ERRORED", "QUEUED"}) {
+		t.Errorf("Expected torrents blackhole didn't add to be left alone, removed %v", server.Removed())
+	}
+
+	owned, err := slots.Owned("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := owned["DONE"]; !ok || len(owned) != 1 {
+		t.Errorf("Expected only the downloaded torrent to still be owned, got %v", owned)
+	}
+}
+
+func TestAccountsHaveTheirOwnSlots(t *testing.T) {
+	server := setup(t)
+	other := debridtest.NewServer()
+	t.Cleanup(other.Close)
+
+	mockViper := viper.New()
+	mockViper.Set("real_debrid.url", server.URL)
+	mockViper.Set("state_path", t.TempDir())
+	mockViper.Set("debrid_accounts", []map[string]any{{"name": "other", "url": other.URL}})
+	config.InitializeAppConfig(mockViper)
+
+	other.SlotLimit = 1
+	other.Seed(debridtest.Torrent{ID: "BUSY", Statuses: []debrid.DebridStatus{debrid.Downloading}})
+	server.SlotLimit = 1
+
+	if err := slots.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if slots.TryAcquire("other") {
+		t.Errorf("Expected the full account to have no slot free")
+	}
+	if !slots.TryAcquire("") {
+		t.Errorf("Expected the other account being full not to use up the default account's slots")
+	}
+	if status := slots.GetStatus("other"); status.Active != 1 || status.Limit != 1 {
+		t.Errorf("Expected the account's own count, got %+v", status)
+	}
+}
@@ -0,0 +1,91 @@
+package torrents
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+)
+
+// NZBInfo is what an NZB will download
+type NZBInfo struct {
+	Name  string // From the `name` meta tag, when there is one
+	Files []NZBFile
+	Size  int64 // Bytes across every file
+}
+
+type NZBFile struct {
+	Name string
+	Size int64
+}
+
+// See: https://sabnzbd.org/wiki/extra/nzb-spec
+type nzbDocument struct {
+	Meta  []nzbMeta `xml:"head>meta"`
+	Files []nzbFile `xml:"file"`
+}
+
+type nzbMeta struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type nzbFile struct {
+	Subject  string       `xml:"subject,attr"`
+	Segments []nzbSegment `xml:"segments>segment"`
+}
+
+type nzbSegment struct {
+	Bytes int64 `xml:"bytes,attr"`
+}
+
+func parseNZB(content []byte) (NZBInfo, error) {
+	var doc nzbDocument
+	decoder := xml.NewDecoder(bytes.NewReader(content))
+	// Indexers aren't consistent about declaring the encoding
+	decoder.CharsetReader = func(_ string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	if err := decoder.Decode(&doc); err != nil {
+		return NZBInfo{}, err
+	}
+
+	info := NZBInfo{}
+	for _, m := range doc.Meta {
+		if m.Type == "name" {
+			info.Name = strings.TrimSpace(m.Value)
+		}
+	}
+
+	for _, f := range doc.Files {
+		file := NZBFile{Name: nzbFilename(f.Subject)}
+		for _, s := range f.Segments {
+			file.Size += s.Bytes
+		}
+		info.Files = append(info.Files, file)
+		info.Size += file.Size
+	}
+
+	if len(info.Files) == 0 {
+		return NZBInfo{}, errors.New("NZB contains no files")
+	}
+
+	return info, nil
+}
+
+// nzbFilename takes the file's name from its subject, which by convention
+// has it in quotes such as `Release [01/10] - "file.mkv" yEnc (1/100)`
+func nzbFilename(subject string) string {
+	start := strings.Index(subject, `"`)
+	if start < 0 {
+		return subject
+	}
+
+	end := strings.Index(subject[start+1:], `"`)
+	if end < 0 {
+		return subject
+	}
+
+	return subject[start+1 : start+1+end]
+}
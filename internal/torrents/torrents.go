@@ -18,8 +18,12 @@ type TorrentType int
 const (
 	Magnet TorrentType = iota
 	TorrentFile
+	NZB
 )
 
+// ErrNoHash is returned for NZBs, which aren't identified by an info hash
+var ErrNoHash = errors.New("NZBs have no info hash")
+
 type ToProcess struct {
 	FullPath      string
 	Filename      string
@@ -83,6 +87,24 @@ func NewFileToProcess(filePath string, processingLocation string) (ToProcess, er
 	return toProcess, nil
 }
 
+// ExistingFileToProcess describes a file by where it is processed from,
+// without moving it there, for a file kept elsewhere until it is retried
+func ExistingFileToProcess(processingPath string) (ToProcess, error) {
+	filename := path.Base(processingPath)
+
+	torrentType, err := getTorrentType(filename)
+	if err != nil {
+		return ToProcess{}, err
+	}
+
+	return ToProcess{
+		FullPath:      processingPath,
+		Filename:      filename,
+		FilenameNoExt: strings.TrimSuffix(filename, path.Ext(filename)),
+		FileType:      torrentType,
+	}, nil
+}
+
 func (t *ToProcess) GetMagnetLink() (string, error) {
 	if t.FileType != Magnet {
 		return "", errors.New("Unable to get magnet for torrent file")
@@ -95,6 +117,19 @@ func (t *ToProcess) GetMagnetLink() (string, error) {
 	return string(fileContent), nil
 }
 
+// GetNZB parses the NZB for the files it will download
+func (t *ToProcess) GetNZB() (NZBInfo, error) {
+	if t.FileType != NZB {
+		return NZBInfo{}, errors.New("Unable to get NZB for torrent")
+	}
+
+	fileContent, err := os.ReadFile(t.FullPath)
+	if err != nil {
+		return NZBInfo{}, err
+	}
+	return parseNZB(fileContent)
+}
+
 func (t *ToProcess) GetHash() (string, error) {
 	fileContent, err := os.ReadFile(t.FullPath)
 	if err != nil {
@@ -106,6 +141,8 @@ func (t *ToProcess) GetHash() (string, error) {
 		return getTorrentFileInfoHash(fileContent)
 	case Magnet:
 		return getMagnetLinkInfoHash(string(fileContent))
+	case NZB:
+		return "", ErrNoHash
 	}
 
 	return "", errors.New("Unknown file type")
@@ -139,6 +176,10 @@ func getTorrentType(filename string) (TorrentType, error) {
 		return Magnet, nil
 	}
 
+	if path.Ext(filename) == ".nzb" {
+		return NZB, nil
+	}
+
 	return 0, errors.New("Not a valid torrent file")
 }
 
@@ -1,6 +1,8 @@
 package torrents_test
 
 import (
+	"errors"
+	"slices"
 	"strings"
 	"testing"
 
@@ -44,3 +46,41 @@ func TestGettingMagnetInfoHash(t *testing.T) {
 		t.Errorf("Expected hash to be %s, received %s", expected, strings.ToUpper(hash))
 	}
 }
+
+func TestParsingNZB(t *testing.T) {
+	filePath := "./testfiles/test.nzb"
+
+	torrent, err := torrents.NewFileToProcess(filePath, "./testfiles")
+	if err != nil {
+		t.Fatalf("Error occurred: %s", err)
+	}
+
+	if torrent.FileType != torrents.NZB {
+		t.Errorf("Expected an NZB, received %d", torrent.FileType)
+	}
+
+	if _, err := torrent.GetHash(); !errors.Is(err, torrents.ErrNoHash) {
+		t.Errorf("Expected no hash for an NZB, received %v", err)
+	}
+
+	nzb, err := torrent.GetNZB()
+	if err != nil {
+		t.Fatalf("Error occurred: %s", err)
+	}
+
+	if nzb.Name != "Mythic.Quest.S01E01.1080p.WEB.H264-GROUP" {
+		t.Errorf("Unexpected name %s", nzb.Name)
+	}
+
+	expected := []torrents.NZBFile{
+		{Name: "mythic.quest.s01e01.mkv", Size: 1280000},
+		{Name: "mythic.quest.s01e01.nfo", Size: 2048},
+	}
+	if !slices.Equal(nzb.Files, expected) {
+		t.Errorf("Expected files %v, received %v", expected, nzb.Files)
+	}
+
+	if nzb.Size != 1282048 {
+		t.Errorf("Expected size to be 1282048, received %d", nzb.Size)
+	}
+}
@@ -0,0 +1,182 @@
+// Package webhook receives the "Connect → Webhook" notifications sonarr and
+// radarr send, so blackhole hears about grabs, imports and failures as they
+// happen rather than only when it next reads the history.
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/samjwillis97/sams-blackhole/internal/arr"
+	"github.com/samjwillis97/sams-blackhole/internal/cleanup"
+	"github.com/samjwillis97/sams-blackhole/internal/config"
+	"github.com/samjwillis97/sams-blackhole/internal/debrid"
+	"github.com/samjwillis97/sams-blackhole/internal/jobs"
+	"github.com/samjwillis97/sams-blackhole/internal/logger/attr"
+	"github.com/samjwillis97/sams-blackhole/internal/mediaserver"
+	"github.com/samjwillis97/sams-blackhole/internal/server"
+)
+
+// Pattern is the route the handler is served on, the instance is the name
+// given to it in the config
+const Pattern = "POST /webhook/{instance}"
+
+const torrentListLimit = 100
+
+// Handler serves webhooks for every configured instance. Requests must carry
+// the instance's API key, either as the basic auth password or the `apikey`
+// query parameter.
+func Handler(logger *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("instance")
+		service, conf, ok := findInstance(name)
+		if !ok {
+			http.Error(w, "unknown instance", http.StatusNotFound)
+			return
+		}
+
+		if !server.Authorized(r, conf.APIKey()) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var payload arr.WebhookPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "invalid payload", http.StatusBadRequest)
+			return
+		}
+
+		eventLogger := logger.With(attr.MonitorName("webhook"), "instance", name, "webhookEventType", payload.EventType, attr.InfoHash(payload.DownloadID))
+		eventLogger.Debug("webhook received")
+
+		if err := handle(service, conf, payload, eventLogger); err != nil {
+			eventLogger.Error("failed to handle webhook", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func handle(service arr.ArrService, conf config.ArrConfig, payload arr.WebhookPayload, logger *slog.Logger) error {
+	switch payload.EventType {
+	case arr.WebhookTest:
+		logger.Info("webhook test received")
+	case arr.WebhookGrab:
+		return handleGrab(service, conf, payload, logger)
+	case arr.WebhookDownload:
+		return handleImport(conf, payload, logger)
+	case arr.WebhookDownloadFailed:
+		return handleFailed(payload, logger)
+	case arr.WebhookManualInteractionRequired:
+		logger.Warn("*arr needs manual interaction to import", "releaseTitle", payload.Release.ReleaseTitle, "downloadStatus", payload.DownloadStatus)
+	default:
+		logger.Debug("ignoring webhook event")
+	}
+
+	return nil
+}
+
+// handleGrab remembers the release so the torrent has its context when it
+// lands in the watch path
+func handleGrab(service arr.ArrService, conf config.ArrConfig, payload arr.WebhookPayload, logger *slog.Logger) error {
+	if payload.DownloadID == "" {
+		return errors.New("Grab has no download ID")
+	}
+
+	episodeIDs := []int{}
+	for _, e := range payload.Episodes {
+		episodeIDs = append(episodeIDs, e.ID)
+	}
+
+	jobs.ExpectGrab(jobs.Grab{
+		InfoHash:     payload.DownloadID,
+		Service:      service,
+		Instance:     conf.Name,
+		ReleaseTitle: payload.Release.ReleaseTitle,
+		ReleaseType:  payload.Release.ReleaseType,
+		SeriesID:     payload.Series.ID,
+		SeasonNumber: payload.SeasonNumber(),
+		EpisodeIDs:   episodeIDs,
+		MovieID:      payload.Movie.ID,
+	})
+	logger.Info("expecting grabbed release", "releaseTitle", payload.Release.ReleaseTitle)
+
+	return nil
+}
+
+// handleImport has the media servers scan where the file went, and marks the
+// item as imported once every file in it has been. The completed folder is
+// left to the scheduled cleanup and the instance's retention period.
+func handleImport(conf config.ArrConfig, payload arr.WebhookPayload, logger *slog.Logger) error {
+	matched, marked, err := cleanup.MarkImported(conf, payload.DownloadID, payload.ImportedFrom())
+	if err != nil {
+		return err
+	}
+
+	if !matched {
+		logger.Debug("import isn't for anything being followed", "importedFrom", payload.ImportedFrom())
+		return nil
+	}
+
+	go mediaserver.Refresh(logger, conf.Name, []string{payload.ImportedTo()})
+
+	if !marked {
+		logger.Info("file has been imported, waiting on the rest of the download", "importedFrom", payload.ImportedFrom(), "importedTo", payload.ImportedTo())
+		return nil
+	}
+
+	logger.Info("item has been imported", "importedFrom", payload.ImportedFrom(), "importedTo", payload.ImportedTo())
+
+	return nil
+}
+
+// handleFailed removes the torrent from whichever debrid account has it,
+// failures blackhole caused itself have already been removed so aren't found
+func handleFailed(payload arr.WebhookPayload, logger *slog.Logger) error {
+	if payload.DownloadID == "" {
+		return errors.New("Failure has no download ID")
+	}
+
+	for _, account := range config.GetAppConfig().DebridAccountNames() {
+		client := debrid.For(account)
+		torrents, err := client.ListTorrents(torrentListLimit)
+		if err != nil {
+			return err
+		}
+
+		for _, t := range torrents {
+			if !strings.EqualFold(t.Hash, payload.DownloadID) {
+				continue
+			}
+
+			if err := client.Remove(t.ID); err != nil {
+				return errors.New(fmt.Sprintf("Failed to remove %s from debrid: %s", t.ID, err))
+			}
+			logger.Info("removed failed download from debrid", attr.DebridID(t.ID), "account", account, "message", payload.Message)
+			return nil
+		}
+	}
+
+	logger.Debug("failed download isn't in debrid")
+	return nil
+}
+
+func findInstance(name string) (arr.ArrService, config.ArrConfig, bool) {
+	for _, conf := range config.GetAppConfig().Sonarr {
+		if conf.Name == name {
+			return arr.Sonarr, conf, true
+		}
+	}
+	for _, conf := range config.GetAppConfig().Radarr {
+		if conf.Name == name {
+			return arr.Radarr, conf, true
+		}
+	}
+	return arr.Sonarr, config.ArrConfig{}, false
+}
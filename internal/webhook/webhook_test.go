@@ -0,0 +1,245 @@
+package webhook_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/samjwillis97/sams-blackhole/internal/arr"
+	"github.com/samjwillis97/sams-blackhole/internal/arr/arrtest"
+	"github.com/samjwillis97/sams-blackhole/internal/cleanup"
+	"github.com/samjwillis97/sams-blackhole/internal/config"
+	"github.com/samjwillis97/sams-blackhole/internal/debrid/debridtest"
+	"github.com/samjwillis97/sams-blackhole/internal/jobs"
+	"github.com/samjwillis97/sams-blackhole/internal/logger"
+	"github.com/samjwillis97/sams-blackhole/internal/mediaserver/mediaservertest"
+	"github.com/samjwillis97/sams-blackhole/internal/webhook"
+	"github.com/spf13/viper"
+)
+
+const (
+	testHash   = "150947B245DA89629349290C2812ECDB6D0308C7"
+	testAPIKey = "arr"
+)
+
+type setupOutput struct {
+	CompletedDir string
+	Arr          *arrtest.Server
+	Debrid       *debridtest.Server
+	Handler      http.Handler
+}
+
+func setup(t *testing.T) setupOutput {
+	return setupWithMediaServers(t, nil)
+}
+
+func setupWithMediaServers(t *testing.T, mediaServers []map[string]any) setupOutput {
+	root := t.TempDir()
+	out := setupOutput{
+		CompletedDir: path.Join(root, "completed"),
+		Arr:          arrtest.NewServer(),
+		Debrid:       debridtest.NewServer(),
+	}
+	t.Cleanup(out.Arr.Close)
+	t.Cleanup(out.Debrid.Close)
+
+	mountDir := path.Join(root, "mount")
+	for _, dir := range []string{out.CompletedDir, mountDir} {
+		if err := os.Mkdir(dir, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mockViper := viper.New()
+	mockViper.Set("real_debrid.url", out.Debrid.URL)
+	mockViper.Set("real_debrid.watch_path", mountDir)
+	mockViper.Set("state_path", root)
+	mockViper.Set("sonarr", []map[string]any{{
+		"name":           "webhooktest",
+		"url":            out.Arr.URL,
+		"completed_path": out.CompletedDir,
+	}})
+	mockViper.Set("media_servers", mediaServers)
+	config.InitializeAppConfig(mockViper)
+
+	mockSecretViper := viper.New()
+	mockSecretViper.Set("DEBRID_API_KEY", "debrid")
+	mockSecretViper.Set("WEBHOOKTEST_API_KEY", testAPIKey)
+	mockSecretViper.Set("JELLYFIN_TOKEN", "jellyfin")
+	config.InitializeSecrets(mockSecretViper)
+
+	log := slog.New(logger.NewHandler(&slog.HandlerOptions{Level: slog.LevelDebug}))
+	out.Handler = webhook.Handler(log)
+
+	return out
+}
+
+func (s setupOutput) send(t *testing.T, instance string, apiKey string, payload arr.WebhookPayload) int {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(webhook.Pattern, s.Handler)
+
+	r := httptest.NewRequest(http.MethodPost, "/webhook/"+instance, bytes.NewReader(body))
+	r.SetBasicAuth("sonarr", apiKey)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+
+	return w.Code
+}
+
+func TestRejectsUnknownInstancesAndKeys(t *testing.T) {
+	out := setup(t)
+	payload := arr.WebhookPayload{EventType: arr.WebhookTest}
+
+	if code := out.send(t, "missing", testAPIKey, payload); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown instance, got %d", code)
+	}
+	if code := out.send(t, "webhooktest", "wrong", payload); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for the wrong key, got %d", code)
+	}
+	if code := out.send(t, "webhooktest", testAPIKey, payload); code != http.StatusNoContent {
+		t.Errorf("Expected 204 for a test, got %d", code)
+	}
+}
+
+func TestGrabIsExpected(t *testing.T) {
+	out := setup(t)
+	t.Cleanup(func() { jobs.ForgetGrab(testHash) })
+
+	code := out.send(t, "webhooktest", testAPIKey, arr.WebhookPayload{
+		EventType:  arr.WebhookGrab,
+		DownloadID: testHash,
+		Series:     arr.WebhookSeries{ID: 7, Title: "Show"},
+		Episodes: []arr.WebhookEpisode{
+			{ID: 70, SeasonNumber: 2, EpisodeNumber: 1},
+			{ID: 71, SeasonNumber: 2, EpisodeNumber: 2},
+		},
+		Release: arr.WebhookRelease{ReleaseTitle: "Show.S02.1080p", ReleaseType: arr.SeasonPack},
+	})
+	if code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", code)
+	}
+
+	grab, ok := jobs.LookupGrab(testHash)
+	if !ok {
+		t.Fatalf("Expected the grab to be remembered")
+	}
+	if grab.ReleaseTitle != "Show.S02.1080p" || grab.SeriesID != 7 || grab.SeasonNumber != 2 || !slices.Equal(grab.EpisodeIDs, []int{70, 71}) {
+		t.Errorf("Expected the grab's context to be kept, got %+v", grab)
+	}
+}
+
+func TestImportIsMarkedOnceDownloadLeavesQueue(t *testing.T) {
+	out := setup(t)
+
+	completed := path.Join(out.CompletedDir, "Show.S01.1080p")
+	if err := os.Mkdir(completed, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	err := cleanup.Track(cleanup.Item{CompletedPath: completed, InfoHash: testHash, Service: arr.Sonarr, Instance: "webhooktest"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	importEpisode := func(episode string) {
+		code := out.send(t, "webhooktest", testAPIKey, arr.WebhookPayload{
+			EventType:   arr.WebhookDownload,
+			DownloadID:  testHash,
+			EpisodeFile: arr.WebhookFile{SourcePath: "/downloads/completed/Show.S01.1080p/" + episode},
+		})
+		if code != http.StatusNoContent {
+			t.Fatalf("Expected 204, got %d", code)
+		}
+	}
+
+	// Sonarr sends one webhook per file, the rest of the season is still to come
+	out.Arr.SetQueue(arr.QueueItem{ID: 1, DownloadID: testHash, TrackedDownloadState: "importing"})
+	importEpisode("Show.S01E01.mkv")
+
+	items, err := cleanup.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Imported() {
+		t.Fatalf("Expected the item not to be imported while in the queue, got %v", items)
+	}
+
+	out.Arr.SetQueue()
+	importEpisode("Show.S01E02.mkv")
+
+	items, err = cleanup.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || !items[0].Imported() {
+		t.Fatalf("Expected the item to be imported once it left the queue, got %v", items)
+	}
+
+	// Removing it is left to the scheduled cleanup
+	if _, err := os.Stat(completed); err != nil {
+		t.Errorf("Expected %s to be kept for its retention", completed)
+	}
+}
+
+func TestImportRefreshesMediaServers(t *testing.T) {
+	jellyfin := mediaservertest.NewServer()
+	t.Cleanup(jellyfin.Close)
+	out := setupWithMediaServers(t, []map[string]any{{"name": "jellyfin", "type": "jellyfin", "url": jellyfin.URL}})
+
+	completed := path.Join(out.CompletedDir, "Show.S01E01.1080p")
+	err := cleanup.Track(cleanup.Item{CompletedPath: completed, InfoHash: testHash, Service: arr.Sonarr, Instance: "webhooktest"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code := out.send(t, "webhooktest", testAPIKey, arr.WebhookPayload{
+		EventType:   arr.WebhookDownload,
+		DownloadID:  testHash,
+		EpisodeFile: arr.WebhookFile{Path: "/tv/Show/Season 01/Show.S01E01.mkv"},
+	})
+	if code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", code)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(jellyfin.Refreshes()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected Jellyfin to be refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if refreshed := jellyfin.Refreshes()[0].Path; refreshed != "/tv/Show/Season 01" {
+		t.Errorf("Expected the season folder to be refreshed, got %s", refreshed)
+	}
+}
+
+func TestFailureRemovesFromDebrid(t *testing.T) {
+	out := setup(t)
+	out.Debrid.Seed(debridtest.Torrent{ID: "FAILED", Filename: "Show.S01E01.1080p", Hash: testHash})
+	out.Debrid.Seed(debridtest.Torrent{ID: "OTHER", Filename: "Show.S01E02.1080p", Hash: "0000000000000000000000000000000000000000"})
+
+	code := out.send(t, "webhooktest", testAPIKey, arr.WebhookPayload{
+		EventType:  arr.WebhookDownloadFailed,
+		DownloadID: testHash,
+		Message:    "Import failed",
+	})
+	if code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", code)
+	}
+
+	if !slices.Equal(out.Debrid.Removed(), []string{"FAILED"}) {
+		t.Errorf("Expected only the failed torrent to be removed, got %v", out.Debrid.Removed())
+	}
+}
@@ -2,38 +2,88 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"log/slog"
 	"os"
 	"path"
 
-	"github.com/radovskyb/watcher"
 	"github.com/samjwillis97/sams-blackhole/internal/arr"
+	"github.com/samjwillis97/sams-blackhole/internal/audit"
+	"github.com/samjwillis97/sams-blackhole/internal/cleanup"
 	"github.com/samjwillis97/sams-blackhole/internal/config"
+	"github.com/samjwillis97/sams-blackhole/internal/housekeeping"
+	"github.com/samjwillis97/sams-blackhole/internal/jobs"
 	"github.com/samjwillis97/sams-blackhole/internal/logger"
 	"github.com/samjwillis97/sams-blackhole/internal/monitor"
 	"github.com/samjwillis97/sams-blackhole/internal/monitor/debrid"
 	"github.com/samjwillis97/sams-blackhole/internal/monitor/sonarr"
+	"github.com/samjwillis97/sams-blackhole/internal/mount"
+	"github.com/samjwillis97/sams-blackhole/internal/rclone"
+	"github.com/samjwillis97/sams-blackhole/internal/reconcile"
+	"github.com/samjwillis97/sams-blackhole/internal/repair"
+	"github.com/samjwillis97/sams-blackhole/internal/server"
+	"github.com/samjwillis97/sams-blackhole/internal/slots"
+	"github.com/samjwillis97/sams-blackhole/internal/webhook"
 )
 
 func main() {
-	// logger.Main()
-	log := slog.New(logger.NewHandler(&slog.HandlerOptions{Level: slog.LevelDebug}))
+	log, logFile, err := logger.FromConfig(config.GetAppConfig().Log, os.Stdout)
+	if err != nil {
+		panic(err)
+	}
+	defer logFile.Close()
+	slog.SetDefault(log)
+
+	if len(os.Args) > 1 {
+		runCommand(log, os.Args[1], os.Args[2:])
+		return
+	}
+
+	serve(log)
+}
+
+func serve(log *slog.Logger) {
 	log.Info("starting")
 
 	monitorSetttings := []monitor.MonitorSetting{}
 
 	monitorSetttings = append(monitorSetttings, setupSonarrMonitor(log)...)
 	monitorSetttings = append(monitorSetttings, setupRadarrMonitor(log)...)
-	monitorSetttings = append(monitorSetttings, setupDebridMonitor(log))
+	monitorSetttings = append(monitorSetttings, setupDebridMonitors(log)...)
 
 	monitorSetup := monitor.Monitor{
-		Logger:   log,
-		Settings: monitorSetttings,
+		Logger:            log,
+		Settings:          monitorSetttings,
+		PollInterval:      config.GetAppConfig().GetTimings().PollInterval,
+		ReconcileInterval: config.GetAppConfig().GetTimings().ReconcileInterval,
 	}
 
-	eventWatcher, pollWatcher := monitorSetup.StartMonitoring()
-	defer eventWatcher.Close()
-	defer pollWatcher.Close()
+	if err := monitorSetup.StartMonitoring(); err != nil {
+		panic(err)
+	}
+	defer monitorSetup.Close()
+
+	server.RegisterStatus("mount", func() any { return mount.GetStatus() })
+	server.RegisterStatus("jobs", func() any { return jobs.List() })
+	server.RegisterStatus("slots", func() any { return slots.GetStatuses() })
+	server.RegisterStatus("housekeeping", func() any { return housekeeping.LastReport() })
+	server.Handle(webhook.Pattern, webhook.Handler(log))
+	server.Handle(audit.ListPattern, audit.ListHandler())
+	server.Handle(audit.TimelinePattern, audit.TimelineHandler())
+	server.Handle(jobs.ListPattern, jobs.ListHandler())
+	server.Handle(jobs.RetryPattern, jobs.RetryHandler())
+	server.Handle(jobs.CancelPattern, jobs.CancelHandler())
+	server.Handle(jobs.CompletePattern, jobs.CompleteHandler())
+
+	go mount.Monitor(log)
+	go repair.Schedule(log)
+	go reconcile.Schedule(log)
+	go cleanup.Schedule(log)
+	go audit.Schedule(log)
+	go slots.Schedule(log)
+	go housekeeping.Schedule(log)
+	go rclone.ReportHealth(log)
+	go server.Serve(log)
 
 	<-make(chan struct{})
 }
@@ -50,11 +100,11 @@ func setupRadarrMonitor(log *slog.Logger) []monitor.MonitorSetting {
 
 		log.Info("resuming processing of existing radarr files")
 		for _, f := range radarrFilesToResume {
-			if f.IsDir() {
+			pathToProcess := path.Join(config.ProcessingPath, f.Name())
+			if f.IsDir() || jobs.IsRoute(pathToProcess) {
 				continue
 			}
 
-			pathToProcess := path.Join(config.ProcessingPath, f.Name())
 			log.Info("resuming file", "file", pathToProcess)
 			err := sonarr.ResumeProcessingFile(arr.Radarr, config, pathToProcess, log)
 			if err != nil {
@@ -84,9 +134,13 @@ func setupRadarrMonitor(log *slog.Logger) []monitor.MonitorSetting {
 		log.Info("finished processing existing radarr files")
 
 		monitors = append(monitors, monitor.MonitorSetting{
-			Name:         config.Name,
-			Directory:    config.WatchPath,
-			EventHandler: sonarr.MonitorHandlerBuilder(arr.Radarr, config),
+			Name:      config.Name,
+			Directory: config.WatchPath,
+			Handler:   sonarr.MonitorHandlerBuilder(arr.Radarr, config),
+			Backend:   config.Watcher,
+			Recursive: config.Recursive,
+			MaxDepth:  config.MaxDepth,
+			Exclude:   append([]string{config.ProcessingPath}, config.CompletedPaths()...),
 		},
 		)
 	}
@@ -106,11 +160,11 @@ func setupSonarrMonitor(log *slog.Logger) []monitor.MonitorSetting {
 
 		log.Info("resuming processing of existing sonarr files")
 		for _, f := range sonarrFilesToResume {
-			if f.IsDir() {
+			pathToProcess := path.Join(config.ProcessingPath, f.Name())
+			if f.IsDir() || jobs.IsRoute(pathToProcess) {
 				continue
 			}
 
-			pathToProcess := path.Join(config.ProcessingPath, f.Name())
 			log.Info("resuming file", "file", pathToProcess)
 			err := sonarr.ResumeProcessingFile(arr.Sonarr, config, pathToProcess, log)
 			if err != nil {
@@ -140,9 +194,13 @@ func setupSonarrMonitor(log *slog.Logger) []monitor.MonitorSetting {
 		log.Info("finished processing existing sonarr files")
 
 		monitors = append(monitors, monitor.MonitorSetting{
-			Name:         config.Name,
-			Directory:    config.WatchPath,
-			EventHandler: sonarr.MonitorHandlerBuilder(arr.Sonarr, config),
+			Name:      config.Name,
+			Directory: config.WatchPath,
+			Handler:   sonarr.MonitorHandlerBuilder(arr.Sonarr, config),
+			Backend:   config.Watcher,
+			Recursive: config.Recursive,
+			MaxDepth:  config.MaxDepth,
+			Exclude:   append([]string{config.ProcessingPath}, config.CompletedPaths()...),
 		},
 		)
 	}
@@ -150,8 +208,24 @@ func setupSonarrMonitor(log *slog.Logger) []monitor.MonitorSetting {
 	return monitors
 }
 
-func setupDebridMonitor(log *slog.Logger) monitor.MonitorSetting {
-	debridMonitorPath := config.GetAppConfig().RealDebrid.WatchPatch
+// setupDebridMonitors watches the mount of each debrid account, accounts that
+// share a mount share the monitor
+func setupDebridMonitors(log *slog.Logger) []monitor.MonitorSetting {
+	monitors := []monitor.MonitorSetting{}
+
+	for _, account := range config.GetAppConfig().DebridMounts() {
+		setting := setupDebridMonitor(account, log)
+		if account.Account != "" {
+			setting.Name = fmt.Sprintf("Debrid Monitor (%s)", account.Account)
+		}
+		monitors = append(monitors, setting)
+	}
+
+	return monitors
+}
+
+func setupDebridMonitor(account config.DebridConfig, log *slog.Logger) monitor.MonitorSetting {
+	debridMonitorPath := account.WatchPatch
 	currentDebridFiles, err := os.ReadDir(debridMonitorPath)
 	if err != nil {
 		panic(errors.New("Failed to read debrid watch directory"))
@@ -159,16 +233,25 @@ func setupDebridMonitor(log *slog.Logger) monitor.MonitorSetting {
 
 	log.Info("starting processing existing debrid files")
 	for _, f := range currentDebridFiles {
-		debrid.MonitorHandler(watcher.Event{
-			Path: path.Join(debridMonitorPath, f.Name()),
-			Op:   watcher.Create,
+		debrid.MonitorHandler(monitor.Event{
+			Path:  path.Join(debridMonitorPath, f.Name()),
+			Op:    monitor.Create,
+			IsDir: f.IsDir(),
 		}, debridMonitorPath, log)
 	}
 	log.Info("finished processing existing debrid files")
 
+	// FUSE mounts don't send inotify events, so unlike the *arr directories the
+	// mount is polled unless configured otherwise
+	backend := account.Watcher
+	if backend == "" {
+		backend = monitor.Poll
+	}
+
 	return monitor.MonitorSetting{
-		Name:        "Debrid Monitor",
-		Directory:   debridMonitorPath,
-		PollHandler: debrid.MonitorHandler,
+		Name:      "Debrid Monitor",
+		Directory: debridMonitorPath,
+		Handler:   debrid.MonitorHandler,
+		Backend:   backend,
 	}
 }